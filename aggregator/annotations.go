@@ -0,0 +1,24 @@
+package aggregator
+
+import (
+	"github.com/ddosify/alaz/datastore"
+	"github.com/ddosify/alaz/k8s"
+)
+
+// max bytes of request payload sent for pods that opted in with alaz.io/capture-payload
+const maxCapturedPayloadSize = 1024
+
+// SetPodPolicies makes the aggregator honour alaz.io pod and namespace annotations
+func (a *Aggregator) SetPodPolicies(p *k8s.PolicyStore) {
+	a.policies = p
+}
+
+// applyPodPolicies returns false if the source or destination pod opted out of tracing the request
+func (a *Aggregator) applyPodPolicies(req *datastore.Request) bool {
+	return a.policies.RequestTraced(req.FromUID, req.ToUID, req.ToType == POD, req.Protocol)
+}
+
+// capturePayload returns true if either side of the request opted in for payload capture
+func (a *Aggregator) capturePayload(req *datastore.Request) bool {
+	return a.policies.RequestPayloadCaptured(req.FromUID, req.ToUID, req.ToType == POD)
+}
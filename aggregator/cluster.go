@@ -6,6 +6,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/ddosify/alaz/aggregator/probe"
 	"github.com/ddosify/alaz/log"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -15,6 +16,22 @@ type ClusterInfo struct {
 	PodIPToPodUid         map[string]types.UID `json:"podIPToPodUid"`
 	ServiceIPToServiceUid map[string]types.UID `json:"serviceIPToServiceUid"`
 
+	// pod ip -> probe targets of the pod
+	PodIPToProbes map[string]*probe.Pod
+
+	// pod or service uid -> namespace and workload, used by filter rules
+	UidToWorkload map[string]workload
+
+	// pod uid -> node name, node name -> zone, edges are told apart as same node, same zone or cross zone
+	PodUidToNode map[string]string
+	NodeToZone   map[string]string
+
+	// namespace/name of a service -> uids of its endpoint pods, locality of edges to services is told from them
+	ServiceEndpointPods map[string][]string
+
+	// uids of pods out of scope, they are only resolved as destinations
+	OutOfScopePods map[string]struct{}
+
 	// Pid -> SocketMap
 	// pid -> fd -> {saddr, sport, daddr, dport}
 	SocketMaps   []*SocketMap // index symbolizes pid
@@ -32,6 +49,12 @@ func newClusterInfo(liveProcCount int) *ClusterInfo {
 	ci := &ClusterInfo{
 		PodIPToPodUid:         map[string]types.UID{},
 		ServiceIPToServiceUid: map[string]types.UID{},
+		PodIPToProbes:         map[string]*probe.Pod{},
+		UidToWorkload:         map[string]workload{},
+		PodUidToNode:          map[string]string{},
+		NodeToZone:            map[string]string{},
+		ServiceEndpointPods:   map[string][]string{},
+		OutOfScopePods:        map[string]struct{}{},
 	}
 	ci.signalChan = make(chan uint32)
 	sockMaps := make([]*SocketMap, maxPid+1) // index=pid
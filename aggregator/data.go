@@ -15,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/time/rate"
@@ -22,6 +23,11 @@ import (
 	"time"
 
 	"github.com/ddosify/alaz/aggregator/kafka"
+	"github.com/ddosify/alaz/aggregator/payload"
+	"github.com/ddosify/alaz/aggregator/red"
+	"github.com/ddosify/alaz/aggregator/sampling"
+	"github.com/ddosify/alaz/aggregator/traffic"
+	"github.com/ddosify/alaz/config"
 	"github.com/ddosify/alaz/cri"
 	"github.com/ddosify/alaz/datastore"
 	"github.com/ddosify/alaz/ebpf"
@@ -29,6 +35,7 @@ import (
 	"github.com/ddosify/alaz/ebpf/proc"
 	"github.com/ddosify/alaz/ebpf/tcp_state"
 	"github.com/ddosify/alaz/log"
+	"github.com/ddosify/alaz/metrics"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 
@@ -86,8 +93,32 @@ type Aggregator struct {
 	liveProcesses   map[uint32]struct{} // pid -> struct{}
 
 	// Used to rate limit and drop trace events based on pid
-	rateLimiters map[uint32]*rate.Limiter // pid -> rateLimiter
-	rateLimitMu  sync.RWMutex
+	rateLimiters   map[uint32]*rate.Limiter // pid -> rateLimiter
+	rateLimitMu    sync.RWMutex
+	rateLimit      rate.Limit
+	rateLimitBurst int
+
+	// probe handling, filter rules, tail sampling and rate limits, replaced on config reload
+	policy atomic.Pointer[Policy]
+
+	// egress trace events held until tail sampling decides on their request
+	traceGate *sampling.TraceGate[*l7_req.TraceEvent]
+
+	// per edge rate, error and duration histograms, nil if disabled
+	red *red.Recorder
+
+	// per edge and zone pair request and byte counters, nil if disabled
+	traffic *traffic.Recorder
+
+	// alaz.io pod and namespace annotations, nil if k8s collector is disabled
+	policies *k8s.PolicyStore
+
+	// ebpf events taken from channels and not processed yet
+	inflight atomic.Int64
+
+	// events taken from any channel, Healthy tells a stalled event loop from an idle one by it
+	taken      atomic.Uint64
+	progressAt atomic.Int64 // unix nanos taken last changed at
 }
 
 type http2Parser struct {
@@ -111,6 +142,9 @@ var (
 
 	defaultExpiration = 5 * time.Minute
 	purgeTime         = 10 * time.Minute
+
+	drainCheckInterval = 50 * time.Millisecond
+	drainIdleChecks    = 3
 )
 
 var reverseDnsCache *cache.Cache
@@ -156,6 +190,7 @@ func NewAggregator(parentCtx context.Context, ct *cri.CRITool, k8sChan chan inte
 		h2Frames:            make(map[string]*FrameArrival),
 		liveProcesses:       make(map[uint32]struct{}),
 		rateLimiters:        make(map[uint32]*rate.Limiter),
+		traceGate:           sampling.NewTraceGate[*l7_req.TraceEvent](),
 		pgStmts:             make(map[string]string),
 		mySqlStmts:          make(map[string]string),
 	}
@@ -171,8 +206,18 @@ func NewAggregator(parentCtx context.Context, ct *cri.CRITool, k8sChan chan inte
 	a.liveProcessesMu.RUnlock()
 
 	a.clusterInfo = newClusterInfo(liveProcCount)
+	// replaced by the configured policy before Run
+	defaultPolicy, _ := NewPolicy(config.Default().Policy)
+	a.setPolicy(defaultPolicy)
 
 	go a.clearSocketLines(ctx)
+	go a.clearTailSamplerEdges(ctx)
+	go a.releaseHeldTraces(ctx)
+	go metrics.SampleChannelDepths(ctx, map[string]func() int{
+		"ebpfEvents":    func() int { return len(a.ebpfChan) },
+		"ebpfTcpEvents": func() int { return len(a.ebpfTcpChan) },
+		"h2Ch":          func() int { return len(a.h2Ch) },
+	})
 
 	go func() {
 		t := time.NewTicker(2 * time.Minute)
@@ -218,6 +263,8 @@ func (a *Aggregator) Run() {
 		}
 	}()
 	go a.processk8s()
+	a.progressAt.Store(time.Now().UnixNano())
+	go a.trackProgress(a.ctx)
 
 	cpuCount := runtime.NumCPU()
 	numWorker := cpuCount
@@ -238,6 +285,7 @@ func (a *Aggregator) Run() {
 
 func (a *Aggregator) processk8s() {
 	for data := range a.k8sChan {
+		a.taken.Add(1)
 		d := data.(k8s.K8sResourceMessage)
 		switch d.ResourceType {
 		case k8s.POD:
@@ -256,6 +304,8 @@ func (a *Aggregator) processk8s() {
 			a.processDaemonSet(d)
 		case k8s.STATEFULSET:
 			a.processStatefulSet(d)
+		case k8s.NODE:
+			a.processNode(d)
 		default:
 			log.Logger.Warn().Msgf("unknown resource type %s", d.ResourceType)
 		}
@@ -264,75 +314,127 @@ func (a *Aggregator) processk8s() {
 
 func (a *Aggregator) processEbpfProc(ctx context.Context) {
 	for data := range a.ebpfProcChan {
+		a.inflight.Add(1)
+		a.taken.Add(1)
 		select {
 		case <-ctx.Done():
+			a.inflight.Add(-1)
 			return
 		default:
-			bpfEvent, ok := data.(ebpf.BpfEvent)
-			if !ok {
-				log.Logger.Error().Interface("ebpfData", data).Msg("error casting ebpf event")
-				continue
-			}
-			switch bpfEvent.Type() {
-			case proc.PROC_EVENT:
-				d := data.(*proc.ProcEvent) // copy data's value
-				if d.Type_ == proc.EVENT_PROC_EXEC {
-					a.processExec(d)
-				} else if d.Type_ == proc.EVENT_PROC_EXIT {
-					a.processExit(d.Pid)
-				}
-			}
+			a.processEbpfProcEvent(data)
+		}
+		a.inflight.Add(-1)
+	}
+}
+
+func (a *Aggregator) processEbpfProcEvent(data interface{}) {
+	bpfEvent, ok := data.(ebpf.BpfEvent)
+	if !ok {
+		log.Logger.Error().Interface("ebpfData", data).Msg("error casting ebpf event")
+		return
+	}
+	switch bpfEvent.Type() {
+	case proc.PROC_EVENT:
+		d := data.(*proc.ProcEvent) // copy data's value
+		if d.Type_ == proc.EVENT_PROC_EXEC {
+			a.processExec(d)
+		} else if d.Type_ == proc.EVENT_PROC_EXIT {
+			a.processExit(d.Pid)
 		}
 	}
 }
 
 func (a *Aggregator) processEbpfTcp(ctx context.Context) {
 	for data := range a.ebpfTcpChan {
+		a.inflight.Add(1)
+		a.taken.Add(1)
 		select {
 		case <-ctx.Done():
+			a.inflight.Add(-1)
 			return
 		default:
-			bpfEvent, ok := data.(ebpf.BpfEvent)
-			if !ok {
-				log.Logger.Error().Interface("ebpfData", data).Msg("error casting ebpf event")
-				continue
-			}
-			switch bpfEvent.Type() {
-			case tcp_state.TCP_CONNECT_EVENT:
-				d := data.(*tcp_state.TcpConnectEvent) // copy data's value
-				ctxPid := context.WithValue(a.ctx, log.LOG_CONTEXT, fmt.Sprint(d.Pid))
-				a.processTcpConnect(ctxPid, d)
-			}
+			a.processEbpfTcpEvent(data)
 		}
+		a.inflight.Add(-1)
+	}
+}
+
+func (a *Aggregator) processEbpfTcpEvent(data interface{}) {
+	bpfEvent, ok := data.(ebpf.BpfEvent)
+	if !ok {
+		log.Logger.Error().Interface("ebpfData", data).Msg("error casting ebpf event")
+		return
+	}
+	switch bpfEvent.Type() {
+	case tcp_state.TCP_CONNECT_EVENT:
+		d := data.(*tcp_state.TcpConnectEvent) // copy data's value
+		ctxPid := context.WithValue(a.ctx, log.LOG_CONTEXT, fmt.Sprint(d.Pid))
+		a.processTcpConnect(ctxPid, d)
 	}
 }
 
 func (a *Aggregator) processEbpf(ctx context.Context) {
 	for data := range a.ebpfChan {
+		a.inflight.Add(1)
+		a.taken.Add(1)
 		select {
 		case <-ctx.Done():
+			a.inflight.Add(-1)
 			return
 		default:
-			bpfEvent, ok := data.(ebpf.BpfEvent)
-			if !ok {
-				log.Logger.Error().Interface("ebpfData", data).Msg("error casting ebpf event")
-				continue
-			}
-			switch bpfEvent.Type() {
-			case l7_req.L7_EVENT:
-				d := data.(*l7_req.L7Event) // copy data's value
-				ctxPid := context.WithValue(a.ctx, log.LOG_CONTEXT, fmt.Sprint(d.Pid))
-				go a.signalTlsAttachment(d.Pid)
-				a.processL7(ctxPid, d)
-			case l7_req.TRACE_EVENT:
-				d := data.(*l7_req.TraceEvent)
-				rateLimiter := a.getRateLimiterForPid(d.Pid)
-				if rateLimiter.Allow() {
-					a.ds.PersistTraceEvent(d)
-				}
-			}
+			a.processEbpfEvent(data)
+		}
+		a.inflight.Add(-1)
+	}
+}
+
+func (a *Aggregator) processEbpfEvent(data interface{}) {
+	bpfEvent, ok := data.(ebpf.BpfEvent)
+	if !ok {
+		log.Logger.Error().Interface("ebpfData", data).Msg("error casting ebpf event")
+		return
+	}
+	switch bpfEvent.Type() {
+	case l7_req.L7_EVENT:
+		d := data.(*l7_req.L7Event) // copy data's value
+		ctxPid := context.WithValue(a.ctx, log.LOG_CONTEXT, fmt.Sprint(d.Pid))
+		go a.signalTlsAttachment(d.Pid)
+		a.processL7(ctxPid, d)
+	case l7_req.TRACE_EVENT:
+		d := data.(*l7_req.TraceEvent)
+		if a.gateTraceEvent(d) {
+			return
+		}
+		a.persistTraceEvent(d)
+	}
+}
+
+// Drain waits until events already read from ebpf are processed and handed to the datastore.
+// Probes must be detached before, otherwise channels may never stay empty.
+func (a *Aggregator) Drain(ctx context.Context) error {
+	t := time.NewTicker(drainCheckInterval)
+	defer t.Stop()
+
+	// a worker may have taken an event but not counted it yet, so idle must hold for a few checks
+	idleChecks := 0
+	for idleChecks < drainIdleChecks {
+		if len(a.ebpfChan) == 0 && len(a.ebpfTcpChan) == 0 && len(a.ebpfProcChan) == 0 &&
+			len(a.h2Ch) == 0 && a.inflight.Load() == 0 {
+			idleChecks++
+		} else {
+			idleChecks = 0
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("aggregator not drained, %d ebpf events left: %w", len(a.ebpfChan)+len(a.ebpfTcpChan)+len(a.ebpfProcChan), ctx.Err())
+		case <-t.C:
 		}
 	}
+	// requests of held trace events are processed by now
+	for _, trace := range a.traceGate.Release() {
+		a.persistTraceEvent(trace)
+	}
+	return nil
 }
 
 func (a *Aggregator) getRateLimiterForPid(pid uint32) *rate.Limiter {
@@ -344,7 +446,7 @@ func (a *Aggregator) getRateLimiterForPid(pid uint32) *rate.Limiter {
 		a.rateLimitMu.Lock()
 		// r means number of token added to bucket per second, maximum number of token in bucket is b, if bucket is full, token will be dropped
 		// b means the initial and max number of token in bucket
-		limiter = rate.NewLimiter(100, 1000)
+		limiter = rate.NewLimiter(a.rateLimit, a.rateLimitBurst)
 		a.rateLimiters[pid] = limiter
 		a.rateLimitMu.Unlock()
 	}
@@ -571,6 +673,7 @@ func (a *Aggregator) processHttp2Frames() {
 
 	persistReq := func(d *l7_req.L7Event, req *datastore.Request, statusCode uint32, grpcStatus uint32) {
 		if req.Method == "" || req.Path == "" {
+			metrics.ParseFailures.WithLabelValues(d.Protocol).Inc()
 			// if we couldn't parse the request, discard
 			// this is possible because of hpack dynamic table, we can't parse the request until a new connection is established
 
@@ -612,7 +715,7 @@ func (a *Aggregator) processHttp2Frames() {
 			return
 		}
 
-		a.ds.PersistRequest(req)
+		a.persistRequest(req)
 	}
 
 	parseFrameHeader := func(buf []byte) http2.FrameHeader {
@@ -627,6 +730,7 @@ func (a *Aggregator) processHttp2Frames() {
 	}
 
 	for d := range a.h2Ch {
+		a.taken.Add(1)
 		// Normally we tried to use http2.Framer to parse frames but
 		// http2.Framer spends too much memory and cpu reading frames
 		// golang.org/x/net/http2.(*Framer).ReadFrame /go/pkg/mod/golang.org/x/net@v0.12.0/http2/frame.go:505
@@ -815,6 +919,20 @@ func (a *Aggregator) getPodWithIP(addr string) (types.UID, bool) {
 	return podUid, ok
 }
 
+// getSourcePodWithIP is getPodWithIP for the source of traffic, pods out of scope are not found
+func (a *Aggregator) getSourcePodWithIP(addr string) (types.UID, bool) {
+	a.clusterInfo.k8smu.RLock()
+	defer a.clusterInfo.k8smu.RUnlock()
+	podUid, ok := a.clusterInfo.PodIPToPodUid[addr]
+	if !ok {
+		return "", false
+	}
+	if _, out := a.clusterInfo.OutOfScopePods[string(podUid)]; out {
+		return "", false
+	}
+	return podUid, true
+}
+
 func (a *Aggregator) getSvcWithIP(addr string) (types.UID, bool) {
 	a.clusterInfo.k8smu.RLock() // lock for reading
 	svcUid, ok := a.clusterInfo.ServiceIPToServiceUid[addr]
@@ -825,8 +943,9 @@ func (a *Aggregator) getSvcWithIP(addr string) (types.UID, bool) {
 
 func (a *Aggregator) setFromToV2(addrPair *AddressPair, d *l7_req.L7Event, event datastore.DirectionalEvent, hostHeader string) error {
 	// find pod info
-	podUid, ok := a.getPodWithIP(addrPair.Saddr)
+	podUid, ok := a.getSourcePodWithIP(addrPair.Saddr)
 	if !ok {
+		metrics.UnresolvedEvents.WithLabelValues(d.Protocol).Inc()
 		return fmt.Errorf("error finding pod with sockets saddr")
 	}
 
@@ -870,7 +989,7 @@ func (a *Aggregator) setFromToV2(addrPair *AddressPair, d *l7_req.L7Event, event
 
 func (a *Aggregator) setFromTo(skInfo *SockInfo, d *l7_req.L7Event, event datastore.DirectionalEvent, hostHeader string) error {
 	// find pod info
-	podUid, ok := a.getPodWithIP(skInfo.Saddr)
+	podUid, ok := a.getSourcePodWithIP(skInfo.Saddr)
 	if !ok {
 		return fmt.Errorf("error finding pod with sockets saddr")
 	}
@@ -1026,7 +1145,11 @@ func (a *Aggregator) processHttp2Event(d *l7_req.L7Event) {
 
 func (a *Aggregator) processKafkaEvent(ctx context.Context, d *l7_req.L7Event) {
 	kafkaMessages, err := a.decodeKafkaPayload(d)
-	if err != nil || len(kafkaMessages) == 0 {
+	if err != nil {
+		metrics.ParseFailures.WithLabelValues(d.Protocol).Inc()
+		return
+	}
+	if len(kafkaMessages) == 0 {
 		return
 	}
 
@@ -1073,19 +1196,21 @@ func (a *Aggregator) processAmqpEvent(ctx context.Context, d *l7_req.L7Event) {
 	addrPair := extractAddressPair(d)
 
 	reqDto := &datastore.Request{
-		StartTime:  int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
-		Latency:    d.Duration,
-		FromIP:     addrPair.Saddr,
-		ToIP:       addrPair.Daddr,
-		Protocol:   d.Protocol,
-		Tls:        d.Tls,
-		Completed:  true,
-		StatusCode: d.Status,
-		FailReason: "",
-		Method:     d.Method,
-		Path:       "",
-		Tid:        d.Tid,
-		Seq:        d.Seq,
+		StartTime:    int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
+		Latency:      d.Duration,
+		FromIP:       addrPair.Saddr,
+		ToIP:         addrPair.Daddr,
+		Protocol:     d.Protocol,
+		Tls:          d.Tls,
+		Completed:    true,
+		StatusCode:   d.Status,
+		FailReason:   "",
+		Method:       d.Method,
+		Path:         "",
+		Tid:          d.Tid,
+		Seq:          d.Seq,
+		RequestSize:  d.RequestSize,
+		ResponseSize: d.ResponseSize,
 	}
 
 	err := a.setFromToV2(addrPair, d, reqDto, "")
@@ -1101,7 +1226,7 @@ func (a *Aggregator) processAmqpEvent(ctx context.Context, d *l7_req.L7Event) {
 		reqDto.ReverseDirection()
 	}
 
-	err = a.ds.PersistRequest(reqDto)
+	err = a.persistRequest(reqDto)
 	if err != nil {
 		log.Logger.Error().Err(err).Msg("error persisting request")
 	}
@@ -1113,19 +1238,21 @@ func (a *Aggregator) processRedisEvent(ctx context.Context, d *l7_req.L7Event) {
 	addrPair := extractAddressPair(d)
 
 	reqDto := &datastore.Request{
-		StartTime:  int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
-		Latency:    d.Duration,
-		FromIP:     addrPair.Saddr,
-		ToIP:       addrPair.Daddr,
-		Protocol:   d.Protocol,
-		Tls:        d.Tls,
-		Completed:  true,
-		StatusCode: d.Status,
-		FailReason: "",
-		Method:     d.Method,
-		Path:       query,
-		Tid:        d.Tid,
-		Seq:        d.Seq,
+		StartTime:    int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
+		Latency:      d.Duration,
+		FromIP:       addrPair.Saddr,
+		ToIP:         addrPair.Daddr,
+		Protocol:     d.Protocol,
+		Tls:          d.Tls,
+		Completed:    true,
+		StatusCode:   d.Status,
+		FailReason:   "",
+		Method:       d.Method,
+		Path:         query,
+		Tid:          d.Tid,
+		Seq:          d.Seq,
+		RequestSize:  d.RequestSize,
+		ResponseSize: d.ResponseSize,
 	}
 
 	err := a.setFromToV2(addrPair, d, reqDto, "")
@@ -1141,7 +1268,7 @@ func (a *Aggregator) processRedisEvent(ctx context.Context, d *l7_req.L7Event) {
 		reqDto.ReverseDirection()
 	}
 
-	err = a.ds.PersistRequest(reqDto)
+	err = a.persistRequest(reqDto)
 	if err != nil {
 		log.Logger.Error().Ctx(ctx).
 			Err(err).Msg("error persisting request")
@@ -1205,19 +1332,21 @@ func (a *Aggregator) processHttpEvent(ctx context.Context, d *l7_req.L7Event) {
 	addrPair := extractAddressPair(d)
 
 	reqDto := &datastore.Request{
-		StartTime:  int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
-		Latency:    d.Duration,
-		FromIP:     addrPair.Saddr,
-		ToIP:       addrPair.Daddr,
-		Protocol:   d.Protocol,
-		Tls:        d.Tls,
-		Completed:  true,
-		StatusCode: d.Status,
-		FailReason: "",
-		Method:     d.Method,
-		Path:       path,
-		Tid:        d.Tid,
-		Seq:        d.Seq,
+		StartTime:    int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
+		Latency:      d.Duration,
+		FromIP:       addrPair.Saddr,
+		ToIP:         addrPair.Daddr,
+		Protocol:     d.Protocol,
+		Tls:          d.Tls,
+		Completed:    true,
+		StatusCode:   d.Status,
+		FailReason:   "",
+		Method:       d.Method,
+		Path:         path,
+		Tid:          d.Tid,
+		Seq:          d.Seq,
+		RequestSize:  d.RequestSize,
+		ResponseSize: d.ResponseSize,
 	}
 
 	err := a.setFromToV2(addrPair, d, reqDto, reqHostHeader)
@@ -1229,7 +1358,15 @@ func (a *Aggregator) processHttpEvent(ctx context.Context, d *l7_req.L7Event) {
 		reqDto.Protocol = "HTTPS"
 	}
 
-	err = a.ds.PersistRequest(reqDto)
+	if a.capturePayload(reqDto) {
+		size := d.PayloadSize
+		if size > maxCapturedPayloadSize {
+			size = maxCapturedPayloadSize
+		}
+		reqDto.Payload = payload.SanitizeHTTP(string(d.Payload[0:size]))
+	}
+
+	err = a.persistRequest(reqDto)
 	if err != nil {
 		log.Logger.Error().Err(err).Msg("error persisting request")
 	}
@@ -1239,25 +1376,28 @@ func (a *Aggregator) processHttpEvent(ctx context.Context, d *l7_req.L7Event) {
 func (a *Aggregator) processMySQLEvent(ctx context.Context, d *l7_req.L7Event) {
 	query, err := a.parseMySQLCommand(d)
 	if err != nil {
+		metrics.ParseFailures.WithLabelValues(d.Protocol).Inc()
 		log.Logger.Error().AnErr("err", err)
 		return
 	}
 	addrPair := extractAddressPair(d)
 
 	reqDto := &datastore.Request{
-		StartTime:  int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
-		Latency:    d.Duration,
-		FromIP:     addrPair.Saddr,
-		ToIP:       addrPair.Daddr,
-		Protocol:   d.Protocol,
-		Tls:        d.Tls,
-		Completed:  true,
-		StatusCode: d.Status,
-		FailReason: "",
-		Method:     d.Method,
-		Path:       query,
-		Tid:        d.Tid,
-		Seq:        d.Seq,
+		StartTime:    int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
+		Latency:      d.Duration,
+		FromIP:       addrPair.Saddr,
+		ToIP:         addrPair.Daddr,
+		Protocol:     d.Protocol,
+		Tls:          d.Tls,
+		Completed:    true,
+		StatusCode:   d.Status,
+		FailReason:   "",
+		Method:       d.Method,
+		Path:         query,
+		Tid:          d.Tid,
+		Seq:          d.Seq,
+		RequestSize:  d.RequestSize,
+		ResponseSize: d.ResponseSize,
 	}
 
 	err = a.setFromToV2(addrPair, d, reqDto, "")
@@ -1266,7 +1406,7 @@ func (a *Aggregator) processMySQLEvent(ctx context.Context, d *l7_req.L7Event) {
 	}
 
 	log.Logger.Debug().Any("event", reqDto).Msg("persisting mysql-event")
-	err = a.ds.PersistRequest(reqDto)
+	err = a.persistRequest(reqDto)
 	if err != nil {
 		log.Logger.Error().Err(err).Msg("error persisting request")
 	}
@@ -1279,6 +1419,7 @@ func (a *Aggregator) processPostgresEvent(ctx context.Context, d *l7_req.L7Event
 
 	query, err := a.parsePostgresCommand(d)
 	if err != nil {
+		metrics.ParseFailures.WithLabelValues(d.Protocol).Inc()
 		log.Logger.Error().AnErr("err", err)
 		return
 	}
@@ -1286,19 +1427,21 @@ func (a *Aggregator) processPostgresEvent(ctx context.Context, d *l7_req.L7Event
 	addrPair := extractAddressPair(d)
 
 	reqDto := &datastore.Request{
-		StartTime:  int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
-		Latency:    d.Duration,
-		FromIP:     addrPair.Saddr,
-		ToIP:       addrPair.Daddr,
-		Protocol:   d.Protocol,
-		Tls:        d.Tls,
-		Completed:  true,
-		StatusCode: d.Status,
-		FailReason: "",
-		Method:     d.Method,
-		Path:       query,
-		Tid:        d.Tid,
-		Seq:        d.Seq,
+		StartTime:    int64(convertKernelTimeToUserspaceTime(d.WriteTimeNs) / 1e6),
+		Latency:      d.Duration,
+		FromIP:       addrPair.Saddr,
+		ToIP:         addrPair.Daddr,
+		Protocol:     d.Protocol,
+		Tls:          d.Tls,
+		Completed:    true,
+		StatusCode:   d.Status,
+		FailReason:   "",
+		Method:       d.Method,
+		Path:         query,
+		Tid:          d.Tid,
+		Seq:          d.Seq,
+		RequestSize:  d.RequestSize,
+		ResponseSize: d.ResponseSize,
 	}
 
 	err = a.setFromToV2(addrPair, d, reqDto, "")
@@ -1306,13 +1449,21 @@ func (a *Aggregator) processPostgresEvent(ctx context.Context, d *l7_req.L7Event
 		return
 	}
 
-	err = a.ds.PersistRequest(reqDto)
+	err = a.persistRequest(reqDto)
 	if err != nil {
 		log.Logger.Error().Err(err).Msg("error persisting request")
 	}
 }
 
 func (a *Aggregator) processL7(ctx context.Context, d *l7_req.L7Event) {
+	a.countSocketBytes(d)
+
+	// checked before parsing, kafka events do not go through persistRequest.
+	// Protocols told apart later, like HTTPS and gRPC, are checked there.
+	if !a.protocolEnabled(d.Protocol) {
+		return
+	}
+
 	switch d.Protocol {
 	case l7_req.L7_PROTOCOL_HTTP2:
 		a.processHttp2Event(d)
@@ -1331,6 +1482,20 @@ func (a *Aggregator) processL7(ctx context.Context, d *l7_req.L7Event) {
 	}
 }
 
+// countSocketBytes adds bytes of the event to its connection, they are sent with it
+func (a *Aggregator) countSocketBytes(d *l7_req.L7Event) {
+	sockMap := a.clusterInfo.SocketMaps[d.Pid]
+	if sockMap == nil {
+		return
+	}
+	sockMap.mu.RLock()
+	skLine, ok := sockMap.M[d.Fd]
+	sockMap.mu.RUnlock()
+	if ok {
+		skLine.AddBytes(d.RequestSize, d.ResponseSize)
+	}
+}
+
 // reverse dns lookup
 func getHostnameFromIP(ipAddr string) (string, error) {
 	// return from cache, if exists
@@ -1528,7 +1693,7 @@ func (a *Aggregator) sendOpenConnection(sl *SocketLine) {
 
 	t := sl.Values[len(sl.Values)-1]
 	if t.SockInfo != nil {
-		podUid, ok := a.getPodWithIP(t.SockInfo.Saddr)
+		podUid, ok := a.getSourcePodWithIP(t.SockInfo.Saddr)
 		if !ok {
 			// ignore if source pod not found, or it is not a pod
 			return
@@ -1561,6 +1726,8 @@ func (a *Aggregator) sendOpenConnection(sl *SocketLine) {
 				ac.ToUID = t.SockInfo.Daddr
 			}
 		}
+		ac.Locality, _, _ = a.edgeLocality(ac.FromUID, ac.ToType, ac.ToUID)
+		ac.SentBytes, ac.ReceivedBytes = sl.TakeBytes()
 
 		a.ds.PersistAliveConnection(ac)
 	}
@@ -1651,3 +1818,27 @@ func extractAddressPair(d *l7_req.L7Event) *AddressPair {
 		Dport: d.Dport,
 	}
 }
+
+// persistRequest is the single point that all l7 requests pass through before the datastore
+func (a *Aggregator) persistRequest(req *datastore.Request) error {
+	req.Weight = 1
+	if !a.protocolEnabled(req.Protocol) {
+		return nil
+	}
+	if !a.applyPodPolicies(req) {
+		return nil
+	}
+	if !a.classifyProbe(req) {
+		return nil
+	}
+	if !a.filterRequest(req) {
+		return nil
+	}
+	fromZone, toZone := a.setLocality(req)
+	a.recordRED(req)
+	a.recordTraffic(req, fromZone, toZone)
+	if !a.tailSample(req) {
+		return nil
+	}
+	return a.ds.PersistRequest(req)
+}
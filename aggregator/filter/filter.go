@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ddosify/alaz/config"
+)
+
+// Rules are evaluated in order before a request is persisted, first matching rule decides.
+// Requests that match no rule are kept. They are set in filterRules of the policy section.
+type Rule = config.FilterRule
+
+type Action = string
+
+const (
+	ActionKeep   Action = "keep"
+	ActionDrop   Action = "drop"
+	ActionSample Action = "sample" // keep samplePercent% of matching requests
+	ActionRedact Action = "redact" // keep, but strip query string and redact matches of redactPattern in path, payload is not stored
+)
+
+const redactedValue = "<redacted>"
+
+// Attrs are the fields of a request that rules are evaluated against
+type Attrs struct {
+	Protocol  string
+	Method    string
+	Path      string
+	Status    uint32
+	LatencyNs uint64
+
+	FromNamespace string
+	FromWorkload  string
+	ToNamespace   string
+	ToWorkload    string
+
+	Weight   float64 // multiplied by 100/samplePercent if kept by a sample rule
+	Redacted bool    // set if the matching rule redacts, payload of the request must not be stored
+}
+
+type rule struct {
+	Rule
+	namespaceRx *regexp.Regexp
+	workloadRx  *regexp.Regexp
+	pathRx      *regexp.Regexp
+	redactRx    *regexp.Regexp
+	statusMin   uint32
+	statusMax   uint32
+}
+
+// Engine is not changed once built, a policy reload builds a new one
+type Engine struct {
+	rules []*rule
+}
+
+func NewEngine(rules []Rule) (*Engine, error) {
+	e := &Engine{rules: make([]*rule, 0, len(rules))}
+	for i, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+		}
+		e.rules = append(e.rules, c)
+	}
+	return e, nil
+}
+
+func (e *Engine) Len() int {
+	return len(e.rules)
+}
+
+// Apply returns false if the request must be dropped.
+// Path of attrs is rewritten and Redacted is set if the matching rule redacts.
+func (e *Engine) Apply(attrs *Attrs) bool {
+	for _, r := range e.rules {
+		if !r.match(attrs) {
+			continue
+		}
+
+		switch r.Action {
+		case ActionDrop:
+			return false
+		case ActionSample:
+			if rand.Float64()*100 >= r.SamplePercent {
+				return false
+			}
+			attrs.Weight *= 100 / r.SamplePercent
+			return true
+		case ActionRedact:
+			attrs.Path = r.redact(attrs.Path)
+			attrs.Redacted = true
+			return true
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+func compile(r Rule) (*rule, error) {
+	c := &rule{Rule: r}
+	c.Action = strings.ToLower(r.Action)
+
+	switch c.Action {
+	case ActionKeep, ActionDrop, ActionRedact:
+	case ActionSample:
+		if r.SamplePercent < 0 || r.SamplePercent > 100 {
+			return nil, fmt.Errorf("samplePercent must be between 0 and 100, got %v", r.SamplePercent)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	var err error
+	if c.namespaceRx, err = compileRx(r.Namespace); err != nil {
+		return nil, err
+	}
+	if c.workloadRx, err = compileRx(r.Workload); err != nil {
+		return nil, err
+	}
+	if c.pathRx, err = compileRx(r.Path); err != nil {
+		return nil, err
+	}
+	if c.redactRx, err = compileRx(r.RedactPattern); err != nil {
+		return nil, err
+	}
+	if c.statusMin, c.statusMax, err = parseStatus(r.Status); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func compileRx(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// parseStatus accepts 404, 5xx and 400-499 forms
+func parseStatus(s string) (uint32, uint32, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, 0, nil
+	}
+
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		d, err := strconv.ParseUint(s[:1], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid status %q", s)
+		}
+		return uint32(d) * 100, uint32(d)*100 + 99, nil
+	}
+
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		min, err1 := strconv.ParseUint(from, 10, 32)
+		max, err2 := strconv.ParseUint(to, 10, 32)
+		if err1 != nil || err2 != nil || min > max {
+			return 0, 0, fmt.Errorf("invalid status range %q", s)
+		}
+		return uint32(min), uint32(max), nil
+	}
+
+	code, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status %q", s)
+	}
+	return uint32(code), uint32(code), nil
+}
+
+func (r *rule) match(a *Attrs) bool {
+	if r.Protocol != "" && !strings.EqualFold(r.Protocol, a.Protocol) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, a.Method) {
+		return false
+	}
+	if r.namespaceRx != nil && !matchEither(r.namespaceRx, a.FromNamespace, a.ToNamespace) {
+		return false
+	}
+	if r.workloadRx != nil && !matchEither(r.workloadRx, a.FromWorkload, a.ToWorkload) {
+		return false
+	}
+	if r.pathRx != nil && !r.pathRx.MatchString(a.Path) {
+		return false
+	}
+	if r.statusMax != 0 && (a.Status < r.statusMin || a.Status > r.statusMax) {
+		return false
+	}
+
+	latencyMs := float64(a.LatencyNs) / 1e6
+	if r.MinLatencyMs > 0 && latencyMs < r.MinLatencyMs {
+		return false
+	}
+	if r.MaxLatencyMs > 0 && latencyMs > r.MaxLatencyMs {
+		return false
+	}
+	return true
+}
+
+func matchEither(rx *regexp.Regexp, from, to string) bool {
+	return (from != "" && rx.MatchString(from)) || (to != "" && rx.MatchString(to))
+}
+
+func (r *rule) redact(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if r.redactRx != nil {
+		path = r.redactRx.ReplaceAllString(path, redactedValue)
+	}
+	return path
+}
@@ -0,0 +1,76 @@
+package filter
+
+import "testing"
+
+func TestApplyFirstMatchWins(t *testing.T) {
+	e, err := NewEngine([]Rule{
+		{Name: "keep-payments", Namespace: "^payments$", Action: ActionKeep},
+		{Name: "drop-metrics", Protocol: "HTTP", Path: "^/metrics", Action: ActionDrop},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Apply(&Attrs{Protocol: "HTTP", Path: "/metrics", ToNamespace: "default"}) {
+		t.Fatalf("expected /metrics scrape to be dropped")
+	}
+	if !e.Apply(&Attrs{Protocol: "HTTP", Path: "/metrics", ToNamespace: "payments"}) {
+		t.Fatalf("expected payments request to be kept by first rule")
+	}
+	if !e.Apply(&Attrs{Protocol: "HTTP", Path: "/api/orders"}) {
+		t.Fatalf("expected unmatched request to be kept")
+	}
+}
+
+func TestApplyStatusAndLatency(t *testing.T) {
+	e, err := NewEngine([]Rule{
+		{Name: "drop-fast-2xx", Status: "2xx", MaxLatencyMs: 10, Action: ActionDrop},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Apply(&Attrs{Status: 200, LatencyNs: 5e6}) {
+		t.Fatalf("expected fast 200 to be dropped")
+	}
+	if !e.Apply(&Attrs{Status: 200, LatencyNs: 50e6}) {
+		t.Fatalf("expected slow 200 to be kept")
+	}
+	if !e.Apply(&Attrs{Status: 500, LatencyNs: 5e6}) {
+		t.Fatalf("expected 500 to be kept")
+	}
+}
+
+func TestApplyRedact(t *testing.T) {
+	e, err := NewEngine([]Rule{
+		{Name: "redact-users", Path: "^/users/", RedactPattern: "[0-9]+", Action: ActionRedact},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := &Attrs{Path: "/users/42/orders?token=secret"}
+	if !e.Apply(attrs) {
+		t.Fatalf("expected redacted request to be kept")
+	}
+	if attrs.Path != "/users/<redacted>/orders" {
+		t.Fatalf("unexpected redacted path %s", attrs.Path)
+	}
+	if !attrs.Redacted {
+		t.Fatalf("expected request to be marked redacted")
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: "forward"},
+		{Action: ActionSample, SamplePercent: 120},
+		{Action: ActionDrop, Path: "("},
+		{Action: ActionDrop, Status: "5x"},
+		{Action: ActionDrop, Status: "500-400"},
+	} {
+		if _, err := NewEngine([]Rule{r}); err == nil {
+			t.Fatalf("expected error for rule %+v", r)
+		}
+	}
+}
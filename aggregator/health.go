@@ -0,0 +1,45 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	progressCheckInterval = 5 * time.Second
+	// events may be queued this long without any taken before the aggregator is reported stalled
+	stalledAfter = 30 * time.Second
+)
+
+// trackProgress notes when events were last taken from the channels, progressAt is set before it runs
+func (a *Aggregator) trackProgress(ctx context.Context) {
+	t := time.NewTicker(progressCheckInterval)
+	defer t.Stop()
+
+	last := a.taken.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if taken := a.taken.Load(); taken != last {
+				last = taken
+				a.progressAt.Store(now.UnixNano())
+			}
+		}
+	}
+}
+
+// Healthy reports an error if events are queued but none was taken for a while.
+// An aggregator without events to process is healthy.
+func (a *Aggregator) Healthy() error {
+	queued := len(a.k8sChan) + len(a.ebpfChan) + len(a.ebpfTcpChan) + len(a.ebpfProcChan) + len(a.h2Ch)
+	if queued == 0 {
+		return nil
+	}
+	if since := time.Since(time.Unix(0, a.progressAt.Load())); since > stalledAfter {
+		return fmt.Errorf("%d events queued, none processed for %s", queued, since.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package payload
+
+import (
+	"strings"
+)
+
+// Captured http payloads are stored by the backend, credentials in them must not leave the node.
+// Query strings often carry tokens, they are stripped from the request line like from request paths.
+var sensitiveHeaders = map[string]struct{}{
+	"authorization":       {},
+	"proxy-authorization": {},
+	"cookie":              {},
+	"set-cookie":          {},
+	"x-api-key":           {},
+	"x-auth-token":        {},
+	"x-csrf-token":        {},
+}
+
+// SanitizeHTTP strips the query string from the request line and drops sensitive headers of an http/1.x request.
+// Payload may be truncated, a partial header line is dropped if its name is sensitive or cut before the colon.
+func SanitizeHTTP(p string) string {
+	head, body, complete := strings.Cut(p, "\r\n\r\n")
+
+	lines := strings.Split(head, "\r\n")
+	lines[0] = stripQuery(lines[0])
+
+	kept := lines[:1]
+	for i, l := range lines[1:] {
+		name, _, ok := strings.Cut(l, ":")
+		if !ok {
+			if !complete && i == len(lines)-2 {
+				// cut before the colon, name may be the prefix of a sensitive header
+				continue
+			}
+			kept = append(kept, l)
+			continue
+		}
+		if _, ok := sensitiveHeaders[strings.ToLower(strings.TrimSpace(name))]; ok {
+			continue
+		}
+		kept = append(kept, l)
+	}
+
+	s := strings.Join(kept, "\r\n")
+	if complete {
+		s += "\r\n\r\n" + body
+	}
+	return s
+}
+
+// stripQuery removes the query string from request line "METHOD target HTTP/1.1"
+func stripQuery(line string) string {
+	method, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return line
+	}
+	target, version, hasVersion := strings.Cut(rest, " ")
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		target = target[:i]
+	}
+	if !hasVersion {
+		return method + " " + target
+	}
+	return method + " " + target + " " + version
+}
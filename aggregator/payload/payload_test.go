@@ -0,0 +1,47 @@
+package payload
+
+import (
+	"testing"
+)
+
+func TestSanitizeHTTP(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "query and credentials",
+			in:   "POST /login?token=secret HTTP/1.1\r\nHost: api\r\nAuthorization: Bearer abc\r\nCookie: sid=1\r\nContent-Type: application/json\r\n\r\n{\"user\":\"a\"}",
+			want: "POST /login HTTP/1.1\r\nHost: api\r\nContent-Type: application/json\r\n\r\n{\"user\":\"a\"}",
+		},
+		{
+			name: "header names are case insensitive",
+			in:   "GET / HTTP/1.1\r\nx-api-key: k\r\nPROXY-AUTHORIZATION: Basic x\r\nAccept: */*\r\n\r\n",
+			want: "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name: "truncated in a sensitive header",
+			in:   "GET /a?b=c HTTP/1.1\r\nHost: api\r\nAuthorization: Bea",
+			want: "GET /a HTTP/1.1\r\nHost: api",
+		},
+		{
+			name: "truncated before the colon",
+			in:   "GET /a HTTP/1.1\r\nHost: api\r\nAuthoriz",
+			want: "GET /a HTTP/1.1\r\nHost: api",
+		},
+		{
+			name: "truncated in the request line",
+			in:   "GET /a?token=sec",
+			want: "GET /a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeHTTP(tt.in); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
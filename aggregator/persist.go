@@ -1,6 +1,7 @@
 package aggregator
 
 import (
+	"github.com/ddosify/alaz/aggregator/probe"
 	"github.com/ddosify/alaz/datastore"
 	"github.com/ddosify/alaz/k8s"
 	"github.com/ddosify/alaz/log"
@@ -56,21 +57,70 @@ func (a *Aggregator) processPod(d k8s.K8sResourceMessage) {
 	case k8s.ADD:
 		a.clusterInfo.k8smu.Lock()
 		a.clusterInfo.PodIPToPodUid[pod.Status.PodIP] = pod.UID
+		a.clusterInfo.UidToWorkload[dtoPod.UID] = podWorkload(dtoPod)
+		a.clusterInfo.PodUidToNode[dtoPod.UID] = pod.Spec.NodeName
+		a.setPodProbes(pod)
+		a.setPodScope(dtoPod.UID, d.OutOfScope)
 		a.clusterInfo.k8smu.Unlock()
-		go a.persistPod(dtoPod, ADD)
+		if !d.OutOfScope {
+			go a.persistPod(dtoPod, ADD)
+		}
 	case k8s.UPDATE:
 		a.clusterInfo.k8smu.Lock()
 		a.clusterInfo.PodIPToPodUid[pod.Status.PodIP] = pod.UID
+		a.clusterInfo.UidToWorkload[dtoPod.UID] = podWorkload(dtoPod)
+		a.clusterInfo.PodUidToNode[dtoPod.UID] = pod.Spec.NodeName
+		a.setPodProbes(pod)
+		a.setPodScope(dtoPod.UID, d.OutOfScope)
 		a.clusterInfo.k8smu.Unlock()
-		go a.persistPod(dtoPod, UPDATE)
+		if !d.OutOfScope {
+			go a.persistPod(dtoPod, UPDATE)
+		}
 	case k8s.DELETE:
 		a.clusterInfo.k8smu.Lock()
 		delete(a.clusterInfo.PodIPToPodUid, pod.Status.PodIP)
+		delete(a.clusterInfo.PodIPToProbes, pod.Status.PodIP)
+		delete(a.clusterInfo.UidToWorkload, dtoPod.UID)
+		delete(a.clusterInfo.PodUidToNode, dtoPod.UID)
+		delete(a.clusterInfo.OutOfScopePods, dtoPod.UID)
 		a.clusterInfo.k8smu.Unlock()
 		go a.persistPod(dtoPod, DELETE)
 	}
 }
 
+// must be called with k8smu held
+func (a *Aggregator) setPodProbes(pod *corev1.Pod) {
+	pp := probe.ForPod(pod)
+	if pp == nil {
+		delete(a.clusterInfo.PodIPToProbes, pod.Status.PodIP)
+		return
+	}
+	a.clusterInfo.PodIPToProbes[pod.Status.PodIP] = pp
+}
+
+// must be called with k8smu held
+func (a *Aggregator) setPodScope(uid string, outOfScope bool) {
+	if outOfScope {
+		a.clusterInfo.OutOfScopePods[uid] = struct{}{}
+	} else {
+		delete(a.clusterInfo.OutOfScopePods, uid)
+	}
+}
+
+// nodes are not persisted, only their zones are kept
+func (a *Aggregator) processNode(d k8s.K8sResourceMessage) {
+	node := d.Object.(*corev1.Node)
+
+	a.clusterInfo.k8smu.Lock()
+	defer a.clusterInfo.k8smu.Unlock()
+	switch d.EventType {
+	case k8s.ADD, k8s.UPDATE:
+		a.clusterInfo.NodeToZone[node.Name] = node.Labels[k8s.ZoneLabel]
+	case k8s.DELETE:
+		delete(a.clusterInfo.NodeToZone, node.Name)
+	}
+}
+
 func (a *Aggregator) persistSvc(dto datastore.Service, eventType string) {
 	err := a.ds.PersistService(dto, eventType)
 	if err != nil {
@@ -115,16 +165,23 @@ func (a *Aggregator) processSvc(d k8s.K8sResourceMessage) {
 	case k8s.ADD:
 		a.clusterInfo.k8smu.Lock()
 		a.clusterInfo.ServiceIPToServiceUid[service.Spec.ClusterIP] = service.UID
+		a.clusterInfo.UidToWorkload[dtoSvc.UID] = workload{Namespace: service.Namespace, Name: service.Name}
 		a.clusterInfo.k8smu.Unlock()
-		go a.persistSvc(dtoSvc, ADD)
+		if !d.OutOfScope {
+			go a.persistSvc(dtoSvc, ADD)
+		}
 	case k8s.UPDATE:
 		a.clusterInfo.k8smu.Lock()
 		a.clusterInfo.ServiceIPToServiceUid[service.Spec.ClusterIP] = service.UID
+		a.clusterInfo.UidToWorkload[dtoSvc.UID] = workload{Namespace: service.Namespace, Name: service.Name}
 		a.clusterInfo.k8smu.Unlock()
-		go a.persistSvc(dtoSvc, UPDATE)
+		if !d.OutOfScope {
+			go a.persistSvc(dtoSvc, UPDATE)
+		}
 	case k8s.DELETE:
 		a.clusterInfo.k8smu.Lock()
 		delete(a.clusterInfo.ServiceIPToServiceUid, service.Spec.ClusterIP)
+		delete(a.clusterInfo.UidToWorkload, dtoSvc.UID)
 		a.clusterInfo.k8smu.Unlock()
 		go a.persistSvc(dtoSvc, DELETE)
 	}
@@ -288,6 +345,28 @@ func (a *Aggregator) processEndpoints(ep k8s.K8sResourceMessage) {
 		Addresses: adrs,
 	}
 
+	// endpoints are named after their service
+	svcKey := endpoints.Namespace + "/" + endpoints.Name
+	a.clusterInfo.k8smu.Lock()
+	if ep.EventType == k8s.DELETE {
+		delete(a.clusterInfo.ServiceEndpointPods, svcKey)
+	} else {
+		var pods []string
+		for _, adr := range adrs {
+			for _, ip := range adr.IPs {
+				if ip.Type == "Pod" {
+					pods = append(pods, ip.ID)
+				}
+			}
+		}
+		a.clusterInfo.ServiceEndpointPods[svcKey] = pods
+	}
+	a.clusterInfo.k8smu.Unlock()
+
+	// resolves localities only
+	if ep.OutOfScope {
+		return
+	}
 	switch ep.EventType {
 	case k8s.ADD:
 		go func() {
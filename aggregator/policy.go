@@ -0,0 +1,79 @@
+package aggregator
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/ddosify/alaz/aggregator/filter"
+	"github.com/ddosify/alaz/aggregator/sampling"
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/log"
+	"golang.org/x/time/rate"
+)
+
+// Policy is the part of the aggregator's settings that can be reloaded,
+// it is swapped as a whole so requests never see half of an update
+type Policy struct {
+	conf config.PolicyConfig
+
+	// declarative drop/keep/sample/redact rules, nil if not configured
+	filter *filter.Engine
+
+	// keeps failed and slow requests, samples the rest per edge, nil if disabled
+	tailSampler *sampling.TailSampler
+
+	disabledProtocols map[string]struct{} // lowercase
+}
+
+// NewPolicy compiles filter rules of the policy, nothing is applied yet
+func NewPolicy(conf config.PolicyConfig) (*Policy, error) {
+	p := &Policy{conf: conf, disabledProtocols: map[string]struct{}{}}
+	for _, proto := range conf.DisabledProtocols {
+		p.disabledProtocols[strings.ToLower(proto)] = struct{}{}
+	}
+
+	if len(conf.FilterRules) > 0 {
+		var err error
+		if p.filter, err = filter.NewEngine(conf.FilterRules); err != nil {
+			return nil, fmt.Errorf("invalid policy.filterRules: %w", err)
+		}
+		log.Logger.Info().Msgf("loaded %d filter rules", p.filter.Len())
+	}
+
+	if ts := conf.TailSampling; ts.Enabled {
+		p.tailSampler = sampling.NewTailSampler(ts.Percentile, ts.EdgeBudget, rand.Float64)
+	}
+	return p, nil
+}
+
+// SetPolicy applies a new policy to requests processed from now on
+func (a *Aggregator) SetPolicy(p *Policy) {
+	a.setPolicy(p)
+
+	ts := p.conf.TailSampling
+	log.Logger.Info().Msgf("policy applied, probes: %s, rate limit: %v/s, tail sampling: %v (percentile: %v, budget per edge: %v req/s)",
+		p.conf.ProbeTrafficPolicy, p.conf.RateLimit, ts.Enabled, ts.Percentile, ts.EdgeBudget)
+}
+
+func (a *Aggregator) setPolicy(p *Policy) {
+	// per edge latency stats are kept if tail sampling settings did not change
+	if old := a.policy.Load(); old != nil && old.tailSampler != nil && old.conf.TailSampling == p.conf.TailSampling {
+		p.tailSampler = old.tailSampler
+	}
+
+	a.rateLimitMu.Lock()
+	a.rateLimit, a.rateLimitBurst = rate.Limit(p.conf.RateLimit), p.conf.RateLimitBurst
+	for _, limiter := range a.rateLimiters {
+		limiter.SetLimit(a.rateLimit)
+		limiter.SetBurst(a.rateLimitBurst)
+	}
+	a.rateLimitMu.Unlock()
+
+	a.policy.Store(p)
+}
+
+func (a *Aggregator) protocolEnabled(protocol string) bool {
+	_, disabled := a.policy.Load().disabledProtocols[strings.ToLower(protocol)]
+	return !disabled
+}
@@ -0,0 +1,34 @@
+package aggregator
+
+import (
+	"math/rand"
+
+	"github.com/ddosify/alaz/aggregator/probe"
+	"github.com/ddosify/alaz/datastore"
+)
+
+func (a *Aggregator) isProbeRequest(req *datastore.Request) bool {
+	a.clusterInfo.k8smu.RLock()
+	pp, ok := a.clusterInfo.PodIPToProbes[req.ToIP]
+	a.clusterInfo.k8smu.RUnlock()
+	if !ok {
+		return false
+	}
+	return pp.Matches(req.FromIP, req.ToPort, req.Path)
+}
+
+// classifyProbe tags the request if it is probe traffic,
+// returns false if the request must be dropped according to probe policy
+func (a *Aggregator) classifyProbe(req *datastore.Request) bool {
+	if !probe.Supported(req.Protocol) || !a.isProbeRequest(req) {
+		return true
+	}
+
+	req.Probe = true
+	p := a.policy.Load().conf
+	keep, weight := probe.Apply(probe.Policy(p.ProbeTrafficPolicy), p.ProbeSampleRate, rand.Float64)
+	if keep {
+		req.Weight *= weight
+	}
+	return keep
+}
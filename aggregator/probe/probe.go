@@ -0,0 +1,144 @@
+package probe
+
+import (
+	"strings"
+
+	"github.com/ddosify/alaz/ebpf/l7_req"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Kubelet liveness/readiness/startup probes and load balancer health checks
+// are sent from the node the pod is running on, to the path and port declared in the pod's probe spec.
+// They make up a big share of the observed http traffic and skew latency stats.
+type Policy string
+
+const (
+	PolicyKeep   Policy = "keep"   // persist and tag as probe
+	PolicyDrop   Policy = "drop"   // do not persist
+	PolicySample Policy = "sample" // persist a fraction of probes, tagged
+)
+
+type Target struct {
+	Port int32
+	Path string // empty for grpc probes
+	GRPC bool   // matches the methods of grpc health service only
+}
+
+// kubelet grpc probes call Check, load balancers may Watch
+var grpcHealthPaths = map[string]struct{}{
+	"/grpc.health.v1.Health/Check": {},
+	"/grpc.health.v1.Health/Watch": {},
+}
+
+// Pod keeps the probe targets of a pod
+type Pod struct {
+	HostIP  string // node ip, source of kubelet probes
+	Targets []Target
+}
+
+// ForPod extracts probe targets from all containers of the pod, nil if it has none
+func ForPod(pod *corev1.Pod) *Pod {
+	pp := &Pod{
+		HostIP: pod.Status.HostIP,
+	}
+
+	for _, c := range pod.Spec.Containers {
+		for _, probe := range []*corev1.Probe{c.LivenessProbe, c.ReadinessProbe, c.StartupProbe} {
+			if probe == nil {
+				continue
+			}
+
+			switch {
+			case probe.HTTPGet != nil:
+				port := resolveContainerPort(c, probe.HTTPGet.Port.IntValue(), probe.HTTPGet.Port.String())
+				if port == 0 {
+					continue
+				}
+				path := probe.HTTPGet.Path
+				if path == "" {
+					path = "/"
+				}
+				pp.Targets = append(pp.Targets, Target{Port: port, Path: path})
+			case probe.GRPC != nil:
+				pp.Targets = append(pp.Targets, Target{Port: probe.GRPC.Port, GRPC: true})
+			}
+			// tcpSocket probes only open a connection, any request on the port is real traffic
+		}
+	}
+
+	if len(pp.Targets) == 0 {
+		return nil
+	}
+	return pp
+}
+
+// probe ports can be given by name, resolve them through container ports
+func resolveContainerPort(c corev1.Container, port int, portName string) int32 {
+	if port != 0 {
+		return int32(port)
+	}
+	for _, p := range c.Ports {
+		if p.Name == portName {
+			return p.ContainerPort
+		}
+	}
+	return 0
+}
+
+// Matches checks if a request from fromIP to the pod is one of its probes
+func (pp *Pod) Matches(fromIP string, toPort uint16, path string) bool {
+	if pp == nil || pp.HostIP == "" || fromIP != pp.HostIP {
+		return false
+	}
+
+	// ignore query params
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	for _, t := range pp.Targets {
+		if t.Port != int32(toPort) {
+			continue
+		}
+		if t.GRPC {
+			if _, ok := grpcHealthPaths[path]; ok {
+				return true
+			}
+			continue
+		}
+		if t.Path == path {
+			return true
+		}
+		if i := strings.IndexByte(t.Path, '?'); i >= 0 && t.Path[:i] == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Supported returns false for protocols probes are not sent with
+func Supported(protocol string) bool {
+	switch protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2, "gRPC":
+		return true
+	default:
+		return false
+	}
+}
+
+// Apply decides on a probe request according to policy,
+// a kept request stands for weight probes. rand must return values in [0, 1).
+func Apply(policy Policy, sampleRate float64, rand func() float64) (keep bool, weight float64) {
+	switch policy {
+	case PolicyDrop:
+		return false, 0
+	case PolicySample:
+		if rand() >= sampleRate {
+			return false, 0
+		}
+		return true, 1 / sampleRate
+	default:
+		return true, 1
+	}
+}
@@ -0,0 +1,199 @@
+package probe
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestResolveContainerPort(t *testing.T) {
+	c := corev1.Container{Ports: []corev1.ContainerPort{
+		{Name: "http", ContainerPort: 8080},
+		{Name: "metrics", ContainerPort: 9090},
+	}}
+
+	tests := []struct {
+		name string
+		port intstr.IntOrString
+		want int32
+	}{
+		{name: "number", port: intstr.FromInt(3000), want: 3000},
+		{name: "named", port: intstr.FromString("metrics"), want: 9090},
+		{name: "unknown name", port: intstr.FromString("admin"), want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveContainerPort(c, tt.port.IntValue(), tt.port.String()); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForPod(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{
+				Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+				LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+					HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromString("http"), Path: "/healthz"},
+				}},
+				ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+					HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromInt(8081)},
+				}},
+				StartupProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("unknown")},
+				}},
+			},
+			{
+				LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+					Exec: &corev1.ExecAction{Command: []string{"cat", "/tmp/healthy"}},
+				}},
+				ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+					GRPC: &corev1.GRPCAction{Port: 9000},
+				}},
+				StartupProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(5432)},
+				}},
+			},
+		}},
+		Status: corev1.PodStatus{HostIP: "10.0.0.1"},
+	}
+
+	pp := ForPod(pod)
+	if pp == nil {
+		t.Fatal("no probes found")
+	}
+	want := []Target{
+		{Port: 8080, Path: "/healthz"},
+		{Port: 8081, Path: "/"},
+		{Port: 9000, GRPC: true},
+	}
+	if pp.HostIP != "10.0.0.1" || len(pp.Targets) != len(want) {
+		t.Fatalf("got %+v, want targets %+v", pp, want)
+	}
+	for i := range want {
+		if pp.Targets[i] != want[i] {
+			t.Errorf("target %d: got %+v, want %+v", i, pp.Targets[i], want[i])
+		}
+	}
+
+	// exec probes are not network traffic
+	execOnly := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+			Exec: &corev1.ExecAction{Command: []string{"true"}},
+		}},
+	}}}}
+	if pp := ForPod(execOnly); pp != nil {
+		t.Errorf("got %+v for exec probes, want nil", pp)
+	}
+
+	// tcp probes send no request
+	tcpOnly := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+		LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8080)},
+		}},
+	}}}}
+	if pp := ForPod(tcpOnly); pp != nil {
+		t.Errorf("got %+v for tcp probes, want nil", pp)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	pp := &Pod{HostIP: "10.0.0.1", Targets: []Target{
+		{Port: 8080, Path: "/healthz"},
+		{Port: 8081, Path: "/ready?full=1"},
+		{Port: 9000, GRPC: true},
+	}}
+
+	tests := []struct {
+		name   string
+		fromIP string
+		port   uint16
+		path   string
+		want   bool
+	}{
+		{name: "http path", fromIP: "10.0.0.1", port: 8080, path: "/healthz", want: true},
+		{name: "query params ignored", fromIP: "10.0.0.1", port: 8080, path: "/healthz?verbose", want: true},
+		{name: "query params in probe path", fromIP: "10.0.0.1", port: 8081, path: "/ready", want: true},
+		{name: "grpc health check", fromIP: "10.0.0.1", port: 9000, path: "/grpc.health.v1.Health/Check", want: true},
+		{name: "grpc health watch", fromIP: "10.0.0.1", port: 9000, path: "/grpc.health.v1.Health/Watch", want: true},
+		{name: "other grpc method", fromIP: "10.0.0.1", port: 9000, path: "/orders.v1.Orders/Get", want: false},
+		{name: "other path", fromIP: "10.0.0.1", port: 8080, path: "/api", want: false},
+		{name: "other port", fromIP: "10.0.0.1", port: 8082, path: "/healthz", want: false},
+		{name: "not from node", fromIP: "10.0.0.2", port: 8080, path: "/healthz", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pp.Matches(tt.fromIP, tt.port, tt.path); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var none *Pod
+	if none.Matches("10.0.0.1", 8080, "/healthz") {
+		t.Error("nil probes should not match")
+	}
+	if (&Pod{Targets: pp.Targets}).Matches("", 8080, "/healthz") {
+		t.Error("probes without a host ip should not match")
+	}
+}
+
+// node local traffic, e.g. from hostNetwork pods or NodePort hops, reaches the pod from the host ip too
+func TestMatchesHostTrafficOnTCPProbePort(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			LivenessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("http")},
+			}},
+			ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromString("http"), Path: "/ready"},
+			}},
+		}}},
+		Status: corev1.PodStatus{HostIP: "10.0.0.1"},
+	}
+
+	pp := ForPod(pod)
+	if pp.Matches("10.0.0.1", 8080, "/api/orders") {
+		t.Error("real traffic from host ip on a tcp probe port should not match")
+	}
+	if !pp.Matches("10.0.0.1", 8080, "/ready") {
+		t.Error("http probe on the same port should match")
+	}
+}
+
+func TestSupported(t *testing.T) {
+	for protocol, want := range map[string]bool{"HTTP": true, "HTTPS": true, "HTTP2": true, "gRPC": true, "POSTGRES": false, "REDIS": false} {
+		if got := Supported(protocol); got != want {
+			t.Errorf("Supported(%q) = %v, want %v", protocol, got, want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		rate   float64
+		rand   float64
+		keep   bool
+		weight float64
+	}{
+		{name: "keep", policy: PolicyKeep, keep: true, weight: 1},
+		{name: "unset keeps", policy: "", keep: true, weight: 1},
+		{name: "drop", policy: PolicyDrop, keep: false},
+		{name: "sampled in", policy: PolicySample, rate: 0.25, rand: 0.1, keep: true, weight: 4},
+		{name: "sampled out", policy: PolicySample, rate: 0.25, rand: 0.25, keep: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep, weight := Apply(tt.policy, tt.rate, func() float64 { return tt.rand })
+			if keep != tt.keep || weight != tt.weight {
+				t.Errorf("got (%v, %v), want (%v, %v)", keep, weight, tt.keep, tt.weight)
+			}
+		})
+	}
+}
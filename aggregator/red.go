@@ -0,0 +1,90 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/red"
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/datastore"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/log"
+)
+
+// SetREDMetrics enables per edge RED metrics, it is called before Run
+func (a *Aggregator) SetREDMetrics(conf config.SeriesMetricsConfig) {
+	if !conf.Enabled {
+		return
+	}
+	log.Logger.Info().Msgf("RED metrics enabled, max series: %d", conf.MaxSeries)
+	a.red = red.NewRecorder(conf.MaxSeries)
+	go a.clearREDSeries(a.ctx)
+}
+
+// recordRED observes requests before tail sampling, so rates are not thinned out by it.
+// Requests kept by filter sample rules are observed with their weight.
+// Kubelet probes are left out, they are not traffic between workloads.
+func (a *Aggregator) recordRED(req *datastore.Request) {
+	if a.red == nil || req.Probe {
+		return
+	}
+
+	from, to := a.edgeWorkloads(req)
+
+	// paths of other protocols are queries or commands, too many to be labels
+	var path string
+	switch req.Protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2, "gRPC":
+		path = datastore.TemplatePath(req.Path)
+	}
+
+	key := red.Key{from.Namespace, from.Name, to.Namespace, to.Name, req.Protocol, req.Method, path, statusClass(req)}
+	a.red.Observe(key, time.Duration(req.Latency), req.Weight, req.Tid, req.Seq, time.Now())
+}
+
+// edgeWorkloads returns workloads of both sides, outbound hosts and unknown uids are named as they are
+func (a *Aggregator) edgeWorkloads(req *datastore.Request) (from workload, to workload) {
+	a.clusterInfo.k8smu.RLock()
+	defer a.clusterInfo.k8smu.RUnlock()
+	from, ok := a.clusterInfo.UidToWorkload[req.FromUID]
+	if !ok {
+		from = workload{Name: req.FromUID}
+	}
+	to, ok = a.clusterInfo.UidToWorkload[req.ToUID]
+	if !ok {
+		to = workload{Name: req.ToUID}
+	}
+	return from, to
+}
+
+func (a *Aggregator) clearREDSeries(ctx context.Context) {
+	if a.red == nil {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.red.Cleanup(time.Now())
+		}
+	}
+}
+
+func statusClass(req *datastore.Request) string {
+	switch req.Protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2:
+		if req.StatusCode < 100 || req.StatusCode >= 600 {
+			return "unknown"
+		}
+		return fmt.Sprintf("%dxx", req.StatusCode/100)
+	}
+	if req.Failed() {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,90 @@
+package red
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/series"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var Labels = []string{"from_namespace", "from_workload", "to_namespace", "to_workload",
+	"protocol", "method", "path", "status_class"}
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "alaz",
+		Subsystem: "red",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of requests between workloads, its count gives request and error rates by status class.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, Labels)
+	droppedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "red",
+		Name:      "dropped_requests_total",
+		Help:      "Requests not observed because the max number of series was reached.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, droppedRequests)
+}
+
+// Key holds label values of an edge in the order of Labels
+type Key [8]string
+
+// Recorder keeps rate, error and duration histograms per edge, bounded in number of series
+type Recorder struct {
+	hist   *prometheus.HistogramVec
+	series *series.Set[Key]
+	rand   func() float64
+}
+
+// NewRecorder observes into alaz_red_request_duration_seconds
+func NewRecorder(maxSeries int) *Recorder {
+	return newRecorder(requestDuration, maxSeries)
+}
+
+func newRecorder(hist *prometheus.HistogramVec, maxSeries int) *Recorder {
+	return &Recorder{
+		hist:   hist,
+		series: series.NewSet(maxSeries, droppedRequests, func(k Key) []string { return k[:] }, hist),
+		rand:   rand.Float64,
+	}
+}
+
+// Observe returns false if the edge is new and there is no room for another series.
+// A sampled request stands for weight requests, it is observed weight times,
+// the fraction of weight adds one more observation with its probability.
+func (r *Recorder) Observe(key Key, latency time.Duration, weight float64, tid uint32, seq uint32, now time.Time) bool {
+	if !r.series.Touch(key, now) {
+		return false
+	}
+
+	n := int(weight)
+	if r.rand() < weight-float64(n) {
+		n++
+	}
+	if n == 0 {
+		return true
+	}
+
+	// exemplars lead from a latency bucket to the request itself
+	obs := r.hist.WithLabelValues(key[:]...)
+	obs.(prometheus.ExemplarObserver).ObserveWithExemplar(latency.Seconds(), prometheus.Labels{
+		"tid": strconv.FormatUint(uint64(tid), 10),
+		"seq": strconv.FormatUint(uint64(seq), 10),
+	})
+	for i := 1; i < n; i++ {
+		obs.Observe(latency.Seconds())
+	}
+	return true
+}
+
+// Cleanup removes series of edges idle for a while
+func (r *Recorder) Cleanup(now time.Time) {
+	r.series.Cleanup(now)
+}
@@ -0,0 +1,96 @@
+package red
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/series"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestHistogram() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "test_request_duration_seconds",
+		Buckets: []float64{.1, 1},
+	}, Labels)
+}
+
+func TestRecorderObservesWithExemplar(t *testing.T) {
+	hist := newTestHistogram()
+	r := newRecorder(hist, 10)
+	key := Key{"default", "frontend", "default", "backend", "HTTP", "GET", "/users/{id}", "2xx"}
+
+	now := time.Now()
+	r.Observe(key, 50*time.Millisecond, 1, 7, 1001, now)
+	r.Observe(key, 2*time.Second, 1, 7, 1002, now)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(hist)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := families[0].Metric[0].Histogram
+	if h.GetSampleCount() != 2 {
+		t.Fatalf("expected 2 observations, got %d", h.GetSampleCount())
+	}
+	exemplar := h.Bucket[0].Exemplar
+	if exemplar == nil {
+		t.Fatal("expected an exemplar on the first bucket")
+	}
+	labels := map[string]string{}
+	for _, l := range exemplar.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["tid"] != "7" || labels["seq"] != "1001" {
+		t.Errorf("unexpected exemplar labels %v", labels)
+	}
+}
+
+func TestRecorderObservesWeight(t *testing.T) {
+	hist := newTestHistogram()
+	r := newRecorder(hist, 10)
+	key := Key{"default", "frontend", "default", "backend", "HTTP", "GET", "/", "2xx"}
+	now := time.Now()
+
+	// kept by a 10% sample rule
+	r.Observe(key, 50*time.Millisecond, 10, 1, 1, now)
+	// 2.5 is observed 2 or 3 times
+	r.rand = func() float64 { return 0.4 }
+	r.Observe(key, 50*time.Millisecond, 2.5, 1, 2, now)
+	r.rand = func() float64 { return 0.6 }
+	r.Observe(key, 50*time.Millisecond, 2.5, 1, 3, now)
+
+	if n := testutil.CollectAndCount(hist); n != 1 {
+		t.Fatalf("expected 1 series, got %d", n)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(hist)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := families[0].Metric[0].Histogram.GetSampleCount(); c != 15 {
+		t.Fatalf("expected 15 observations, got %d", c)
+	}
+}
+
+func TestRecorderRemovesIdleSeries(t *testing.T) {
+	hist := newTestHistogram()
+	r := newRecorder(hist, 1)
+	now := time.Now()
+
+	if !r.Observe(Key{"ns", "a", "ns", "b", "HTTP", "GET", "/", "2xx"}, time.Millisecond, 1, 1, 1, now) {
+		t.Fatal("expected first series to be observed")
+	}
+	if r.Observe(Key{"ns", "a", "ns", "c", "HTTP", "GET", "/", "2xx"}, time.Millisecond, 1, 1, 2, now) {
+		t.Fatal("expected second series to be dropped")
+	}
+
+	r.Cleanup(now.Add(series.IdleExpiration + time.Second))
+	if n := testutil.CollectAndCount(hist); n != 0 {
+		t.Fatalf("expected idle series to be removed, %d left", n)
+	}
+}
@@ -0,0 +1,63 @@
+package aggregator
+
+import (
+	"strings"
+
+	"github.com/ddosify/alaz/aggregator/filter"
+	"github.com/ddosify/alaz/datastore"
+)
+
+type workload struct {
+	Namespace string
+	Name      string
+}
+
+// pods owned by a ReplicaSet are named after the Deployment, pod-template-hash suffix is trimmed
+func podWorkload(pod datastore.Pod) workload {
+	name := pod.OwnerName
+	switch pod.OwnerType {
+	case "":
+		name = pod.Name
+	case "ReplicaSet":
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			name = name[:i]
+		}
+	}
+	return workload{Namespace: pod.Namespace, Name: name}
+}
+
+// filterRequest returns false if the request must be dropped according to filter rules
+func (a *Aggregator) filterRequest(req *datastore.Request) bool {
+	engine := a.policy.Load().filter
+	if engine == nil {
+		return true
+	}
+
+	a.clusterInfo.k8smu.RLock()
+	from := a.clusterInfo.UidToWorkload[req.FromUID]
+	to := a.clusterInfo.UidToWorkload[req.ToUID]
+	a.clusterInfo.k8smu.RUnlock()
+
+	attrs := &filter.Attrs{
+		Protocol:      req.Protocol,
+		Method:        req.Method,
+		Path:          req.Path,
+		Status:        req.StatusCode,
+		LatencyNs:     req.Latency,
+		FromNamespace: from.Namespace,
+		FromWorkload:  from.Name,
+		ToNamespace:   to.Namespace,
+		ToWorkload:    to.Name,
+		Weight:        1,
+	}
+
+	if !engine.Apply(attrs) {
+		return false
+	}
+	req.Path = attrs.Path
+	if attrs.Redacted {
+		req.Payload = ""
+	}
+	req.Weight *= attrs.Weight
+	return true
+}
@@ -0,0 +1,93 @@
+package sampling
+
+// quantile estimates a quantile of a stream in constant memory and time
+// with the P² algorithm (Jain and Chlamtac, 1985), no observation is kept
+type quantile struct {
+	p     float64
+	count int
+	q     [5]float64 // marker heights, q[2] is the estimate
+	n     [5]float64 // marker positions
+	ns    [5]float64 // desired marker positions
+	dn    [5]float64 // increments of desired positions
+}
+
+func newQuantile(p float64) *quantile {
+	return &quantile{
+		p:  p,
+		n:  [5]float64{0, 1, 2, 3, 4},
+		ns: [5]float64{0, 2 * p, 4 * p, 2 + 2*p, 4},
+		dn: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (e *quantile) observe(x float64) {
+	if e.count < 5 {
+		// insertion sort of the first observations
+		i := e.count
+		for ; i > 0 && e.q[i-1] > x; i-- {
+			e.q[i] = e.q[i-1]
+		}
+		e.q[i] = x
+		e.count++
+		return
+	}
+	e.count++
+
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+		k = 0
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3 && x >= e.q[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.n[i]++
+	}
+	for i := range e.ns {
+		e.ns[i] += e.dn[i]
+	}
+
+	for i := 1; i < 4; i++ {
+		d := e.ns[i] - e.n[i]
+		if (d >= 1 && e.n[i+1]-e.n[i] > 1) || (d <= -1 && e.n[i-1]-e.n[i] < -1) {
+			sign := 1.0
+			if d < 0 {
+				sign = -1
+			}
+			h := e.parabolic(i, sign)
+			if e.q[i-1] < h && h < e.q[i+1] {
+				e.q[i] = h
+			} else {
+				e.q[i] = e.linear(i, sign)
+			}
+			e.n[i] += sign
+		}
+	}
+}
+
+func (e *quantile) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.n[i+1]-e.n[i-1])*
+		((e.n[i]-e.n[i-1]+d)*(e.q[i+1]-e.q[i])/(e.n[i+1]-e.n[i])+
+			(e.n[i+1]-e.n[i]-d)*(e.q[i]-e.q[i-1])/(e.n[i]-e.n[i-1]))
+}
+
+func (e *quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.n[j]-e.n[i])
+}
+
+// value returns the estimate, the nearest of the first observations until there are 5
+func (e *quantile) value() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count < 5 {
+		return e.q[int(e.p*float64(e.count-1))]
+	}
+	return e.q[2]
+}
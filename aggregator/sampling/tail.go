@@ -0,0 +1,121 @@
+package sampling
+
+import (
+	"sync"
+	"time"
+)
+
+// TailSampler decides on a request after it is completed, so that
+// failed and slow requests are always kept, and the rest is sampled down to a per edge budget.
+// Kept requests carry a weight (1/probability) so that counts can be extrapolated.
+type TailSampler struct {
+	percentile float64 // latency percentile above which requests are always kept, 0.95
+	budget     float64 // max sampled requests per second per edge
+
+	mu    sync.RWMutex // guards edges, each edge has a lock of its own
+	edges map[string]*edge
+	rand  func() float64 // must be safe for concurrent use
+}
+
+const (
+	quantileWindow     = 4096 // percentile is estimated anew after this many observations, so it follows changes
+	minLatencySamples  = 64   // percentile is not used before this many observations
+	rateWindow         = time.Second
+	edgeIdleExpiration = 5 * time.Minute
+)
+
+type edge struct {
+	mu sync.Mutex
+
+	latency   *quantile
+	threshold uint64 // latency percentile, 0 until enough samples, kept while a new estimate warms up
+
+	windowStart time.Time
+	windowCount float64 // normal requests seen in current window
+	lastRate    float64 // normal requests per second seen in previous window
+
+	lastSeen time.Time
+}
+
+func NewTailSampler(percentile float64, budget float64, rand func() float64) *TailSampler {
+	return &TailSampler{
+		percentile: percentile,
+		budget:     budget,
+		edges:      make(map[string]*edge),
+		rand:       rand,
+	}
+}
+
+// Decide returns whether the request must be kept and its sampling weight
+func (s *TailSampler) Decide(edgeKey string, failed bool, latencyNs uint64, now time.Time) (bool, float64) {
+	e := s.edge(edgeKey, now)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastSeen = now
+
+	slow := e.threshold > 0 && latencyNs > e.threshold
+	e.observe(latencyNs, s.percentile)
+
+	if failed || slow {
+		return true, 1
+	}
+
+	if elapsed := now.Sub(e.windowStart); elapsed >= rateWindow {
+		e.lastRate = e.windowCount / elapsed.Seconds()
+		e.windowCount = 0
+		e.windowStart = now
+	}
+	e.windowCount++
+
+	// no history yet or under budget, keep everything
+	if e.lastRate <= s.budget {
+		return true, 1
+	}
+
+	p := s.budget / e.lastRate
+	if s.rand() < p {
+		return true, 1 / p
+	}
+	return false, 0
+}
+
+func (s *TailSampler) edge(key string, now time.Time) *edge {
+	s.mu.RLock()
+	e, ok := s.edges[key]
+	s.mu.RUnlock()
+	if ok {
+		return e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok = s.edges[key]; !ok {
+		e = &edge{latency: newQuantile(s.percentile), windowStart: now}
+		s.edges[key] = e
+	}
+	return e
+}
+
+// Cleanup removes edges that have not been seen for a while
+func (s *TailSampler) Cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.edges {
+		e.mu.Lock()
+		idle := now.Sub(e.lastSeen) > edgeIdleExpiration
+		e.mu.Unlock()
+		if idle {
+			delete(s.edges, k)
+		}
+	}
+}
+
+func (e *edge) observe(latencyNs uint64, percentile float64) {
+	if e.latency.count >= quantileWindow {
+		e.latency = newQuantile(percentile)
+	}
+	e.latency.observe(float64(latencyNs))
+	if e.latency.count >= minLatencySamples {
+		e.threshold = uint64(e.latency.value())
+	}
+}
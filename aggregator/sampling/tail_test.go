@@ -0,0 +1,131 @@
+package sampling
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTailSamplerKeepsFailedAndSlow(t *testing.T) {
+	s := NewTailSampler(0.95, 10, func() float64 { return 0.99 })
+	now := time.Now()
+
+	// warm up the edge with 1ms requests, well above budget
+	for i := 0; i < 1000; i++ {
+		s.Decide("a->b", false, 1e6, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	now = now.Add(2 * time.Second)
+
+	if keep, _ := s.Decide("a->b", false, 1e6, now); keep {
+		t.Fatalf("expected normal request to be sampled out")
+	}
+	if keep, w := s.Decide("a->b", true, 1e6, now); !keep || w != 1 {
+		t.Fatalf("expected failed request to be kept with weight 1, got %v %v", keep, w)
+	}
+	if keep, w := s.Decide("a->b", false, 100e6, now); !keep || w != 1 {
+		t.Fatalf("expected slow request to be kept with weight 1, got %v %v", keep, w)
+	}
+}
+
+func TestTailSamplerWeight(t *testing.T) {
+	s := NewTailSampler(0.95, 10, func() float64 { return 0 })
+	start := time.Now()
+
+	// 100 req/s in first window
+	for i := 0; i < 100; i++ {
+		s.Decide("a->b", false, 1e6, start.Add(time.Duration(i)*10*time.Millisecond))
+	}
+
+	keep, w := s.Decide("a->b", false, 1e6, start.Add(time.Second))
+	if !keep {
+		t.Fatalf("expected request to be kept")
+	}
+	if w < 9 || w > 11 {
+		t.Fatalf("expected weight around 10, got %v", w)
+	}
+}
+
+func TestTailSamplerUnderBudget(t *testing.T) {
+	s := NewTailSampler(0.95, 1000, func() float64 { return 0.99 })
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if keep, w := s.Decide("a->b", false, 1e6, now.Add(time.Duration(i)*time.Millisecond)); !keep || w != 1 {
+			t.Fatalf("expected all requests under budget to be kept")
+		}
+	}
+}
+
+func TestTailSamplerCleanup(t *testing.T) {
+	s := NewTailSampler(0.95, 10, func() float64 { return 0 })
+	now := time.Now()
+	s.Decide("a->b", false, 1e6, now)
+	s.Cleanup(now.Add(10 * time.Minute))
+	if len(s.edges) != 0 {
+		t.Fatalf("expected idle edge to be removed")
+	}
+}
+
+func TestQuantileEstimate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, p := range []float64{0.5, 0.95, 0.99} {
+		q := newQuantile(p)
+		values := make([]float64, 0, 10000)
+		for i := 0; i < 10000; i++ {
+			// long tailed, like latencies
+			v := r.ExpFloat64() * 1e6
+			values = append(values, v)
+			q.observe(v)
+		}
+		sort.Float64s(values)
+		exact := values[int(p*float64(len(values)-1))]
+		if got := q.value(); math.Abs(got-exact)/exact > 0.05 {
+			t.Errorf("p%v: expected about %.0f, got %.0f", p*100, exact, got)
+		}
+	}
+
+	q := newQuantile(0.95)
+	for _, v := range []float64{3, 1, 2} {
+		q.observe(v)
+	}
+	if got := q.value(); got != 2 {
+		t.Errorf("expected nearest of first observations, got %v", got)
+	}
+}
+
+func TestTailSamplerConcurrentEdges(t *testing.T) {
+	s := NewTailSampler(0.95, 10, rand.Float64)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			edge := fmt.Sprintf("a->%d", g%4)
+			for i := 0; i < 2000; i++ {
+				s.Decide(edge, false, uint64(i%100)*1e5, now.Add(time.Duration(i)*time.Millisecond))
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Cleanup(now)
+		}
+	}()
+	wg.Wait()
+
+	if len(s.edges) != 4 {
+		t.Fatalf("expected 4 edges, got %d", len(s.edges))
+	}
+	for key, e := range s.edges {
+		if e.threshold == 0 {
+			t.Errorf("expected a latency threshold for %s", key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package sampling
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// trace events of requests not decided on within this are released
+	traceHoldTimeout = 5 * time.Second
+	// max number of requests trace events are held for and decisions kept for, each
+	maxTraceEntries = 100000
+)
+
+// TraceKey is the write of a request, by its thread id and tcp sequence number
+type TraceKey struct {
+	Tid uint32
+	Seq uint32
+}
+
+type TraceVerdict int
+
+const (
+	TraceHeld     TraceVerdict = iota // its request is not decided yet
+	TraceKeep                         // its request was kept
+	TraceDrop                         // its request was sampled out
+	TraceOverflow                     // not held, too many are held already
+)
+
+// TraceGate holds trace events of requests until tail sampling decides on them,
+// so trace events of kept requests are kept and the others are dropped
+type TraceGate[T any] struct {
+	mu      sync.Mutex
+	decided map[TraceKey]traceDecision
+	held    map[TraceKey]*heldTraces[T]
+}
+
+type traceDecision struct {
+	keep bool
+	at   time.Time
+}
+
+type heldTraces[T any] struct {
+	events []T
+	since  time.Time
+}
+
+func NewTraceGate[T any]() *TraceGate[T] {
+	return &TraceGate[T]{
+		decided: make(map[TraceKey]traceDecision),
+		held:    make(map[TraceKey]*heldTraces[T]),
+	}
+}
+
+// Offer holds a trace event until its request is decided on, unless that happened already
+func (g *TraceGate[T]) Offer(key TraceKey, event T, now time.Time) TraceVerdict {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if d, ok := g.decided[key]; ok {
+		if d.keep {
+			return TraceKeep
+		}
+		return TraceDrop
+	}
+
+	h, ok := g.held[key]
+	if !ok {
+		if len(g.held) >= maxTraceEntries {
+			return TraceOverflow
+		}
+		h = &heldTraces[T]{since: now}
+		g.held[key] = h
+	}
+	h.events = append(h.events, event)
+	return TraceHeld
+}
+
+// Decide records the decision on a request, trace events held for it are returned if it is kept
+func (g *TraceGate[T]) Decide(key TraceKey, keep bool, now time.Time) []T {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.decided) < maxTraceEntries {
+		g.decided[key] = traceDecision{keep: keep, at: now}
+	}
+
+	h, ok := g.held[key]
+	if !ok {
+		return nil
+	}
+	delete(g.held, key)
+	if !keep {
+		return nil
+	}
+	return h.events
+}
+
+// Expire forgets old decisions and returns trace events held too long, e.g. of requests
+// dropped before tail sampling, so they are handled as if they were not held
+func (g *TraceGate[T]) Expire(now time.Time) []T {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, d := range g.decided {
+		if now.Sub(d.at) > traceHoldTimeout {
+			delete(g.decided, key)
+		}
+	}
+
+	var expired []T
+	for key, h := range g.held {
+		if now.Sub(h.since) > traceHoldTimeout {
+			expired = append(expired, h.events...)
+			delete(g.held, key)
+		}
+	}
+	return expired
+}
+
+// Release returns every held trace event, e.g. on shutdown
+func (g *TraceGate[T]) Release() []T {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var events []T
+	for key, h := range g.held {
+		events = append(events, h.events...)
+		delete(g.held, key)
+	}
+	return events
+}
@@ -0,0 +1,60 @@
+package sampling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTraceGate(t *testing.T) {
+	g := NewTraceGate[string]()
+	now := time.Now()
+
+	kept, dropped, undecided := TraceKey{1, 100}, TraceKey{1, 200}, TraceKey{2, 100}
+	for key, event := range map[TraceKey]string{kept: "kept", dropped: "dropped", undecided: "undecided"} {
+		if v := g.Offer(key, event, now); v != TraceHeld {
+			t.Fatalf("expected %s to be held, got %v", event, v)
+		}
+	}
+
+	if events := g.Decide(kept, true, now); len(events) != 1 || events[0] != "kept" {
+		t.Fatalf("expected held event of kept request, got %v", events)
+	}
+	if events := g.Decide(dropped, false, now); len(events) != 0 {
+		t.Fatalf("expected held events of dropped request to be dropped, got %v", events)
+	}
+
+	// events after the decision
+	if v := g.Offer(kept, "late", now); v != TraceKeep {
+		t.Fatalf("expected late event of kept request to be kept, got %v", v)
+	}
+	if v := g.Offer(dropped, "late", now); v != TraceDrop {
+		t.Fatalf("expected late event of dropped request to be dropped, got %v", v)
+	}
+
+	if events := g.Expire(now.Add(time.Second)); len(events) != 0 {
+		t.Fatalf("expected nothing to expire yet, got %v", events)
+	}
+	if events := g.Expire(now.Add(traceHoldTimeout + time.Second)); len(events) != 1 || events[0] != "undecided" {
+		t.Fatalf("expected event of undecided request to be released, got %v", events)
+	}
+	if v := g.Offer(kept, "after expiry", now.Add(traceHoldTimeout+time.Second)); v != TraceHeld {
+		t.Fatalf("expected old decisions to be forgotten, got %v", v)
+	}
+	if events := g.Release(); len(events) != 1 || events[0] != "after expiry" {
+		t.Fatalf("expected held events to be released, got %v", events)
+	}
+}
+
+func TestTraceGateOverflow(t *testing.T) {
+	g := NewTraceGate[int]()
+	now := time.Now()
+	for i := 0; i < maxTraceEntries; i++ {
+		g.Offer(TraceKey{1, uint32(i)}, i, now)
+	}
+	if v := g.Offer(TraceKey{2, 0}, 0, now); v != TraceOverflow {
+		t.Fatalf("expected overflow, got %v", v)
+	}
+	if v := g.Offer(TraceKey{1, 0}, 0, now); v != TraceHeld {
+		t.Fatalf("expected event of a held request to be held, got %v", v)
+	}
+}
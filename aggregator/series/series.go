@@ -0,0 +1,75 @@
+package series
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// series of edges not seen for this long are removed
+const IdleExpiration = 10 * time.Minute
+
+// vec is a prometheus metric vector, e.g. *prometheus.CounterVec or *prometheus.HistogramVec
+type vec interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// Set bounds the number of series of metric vectors sharing label values,
+// series not seen for IdleExpiration are removed from all of them
+type Set[K comparable] struct {
+	maxSeries int
+	dropped   prometheus.Counter
+	labels    func(K) []string
+	vecs      []vec
+
+	mu       sync.Mutex
+	lastSeen map[K]time.Time
+}
+
+// NewSet counts observations of new series beyond maxSeries in dropped,
+// labels returns label values of a key in the order of labels of vecs
+func NewSet[K comparable](maxSeries int, dropped prometheus.Counter, labels func(K) []string, vecs ...vec) *Set[K] {
+	return &Set[K]{
+		maxSeries: maxSeries,
+		dropped:   dropped,
+		labels:    labels,
+		vecs:      vecs,
+		lastSeen:  make(map[K]time.Time),
+	}
+}
+
+// Touch marks the series of key as seen, it returns false if the series is new
+// and there is no room for another one
+func (s *Set[K]) Touch(key K, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lastSeen[key]; !ok && len(s.lastSeen) >= s.maxSeries {
+		s.dropped.Inc()
+		return false
+	}
+	s.lastSeen[key] = now
+	return true
+}
+
+// Cleanup removes series idle for a while
+func (s *Set[K]) Cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, seen := range s.lastSeen {
+		if now.Sub(seen) > IdleExpiration {
+			lvs := s.labels(key)
+			for _, v := range s.vecs {
+				v.DeleteLabelValues(lvs...)
+			}
+			delete(s.lastSeen, key)
+		}
+	}
+}
+
+// Len returns the number of series
+func (s *Set[K]) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lastSeen)
+}
@@ -0,0 +1,53 @@
+package series
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testKey [2]string
+
+func TestSetLimitsAndExpiresSeries(t *testing.T) {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total"}, []string{"from", "to"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_duration_seconds"}, []string{"from", "to"})
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_dropped_total"})
+	s := NewSet(2, dropped, func(k testKey) []string { return k[:] }, requests, duration)
+	now := time.Now()
+
+	observe := func(k testKey, at time.Time) bool {
+		if !s.Touch(k, at) {
+			return false
+		}
+		requests.WithLabelValues(k[:]...).Inc()
+		duration.WithLabelValues(k[:]...).Observe(0.1)
+		return true
+	}
+
+	a, b, c := testKey{"a", "b"}, testKey{"a", "c"}, testKey{"a", "d"}
+	if !observe(a, now) || !observe(b, now) {
+		t.Fatal("expected first two series to be observed")
+	}
+	if observe(c, now) {
+		t.Fatal("expected third series to be dropped")
+	}
+	if v := testutil.ToFloat64(dropped); v != 1 {
+		t.Errorf("expected 1 dropped observation, got %v", v)
+	}
+	if !observe(a, now.Add(IdleExpiration)) {
+		t.Fatal("expected existing series to be observed")
+	}
+
+	s.Cleanup(now.Add(IdleExpiration + time.Second))
+	if s.Len() != 1 {
+		t.Fatalf("expected idle series to be forgotten, %d left", s.Len())
+	}
+	if n := testutil.CollectAndCount(requests) + testutil.CollectAndCount(duration); n != 2 {
+		t.Fatalf("expected idle series to be removed from every vector, %d left", n)
+	}
+	if !observe(c, now) {
+		t.Fatal("expected room for a new series after cleanup")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ddosify/alaz/log"
@@ -32,6 +33,10 @@ type SocketLine struct {
 	fd     uint64
 	Values []*TimestampedSocket
 
+	// bytes of requests and responses since the connection was last sent
+	sentBytes     atomic.Uint64
+	receivedBytes atomic.Uint64
+
 	ctx context.Context
 }
 
@@ -53,6 +58,16 @@ func NewSocketLine(ctx context.Context, pid uint32, fd uint64, fetch bool) *Sock
 	return skLine
 }
 
+func (nl *SocketLine) AddBytes(sent, received uint32) {
+	nl.sentBytes.Add(uint64(sent))
+	nl.receivedBytes.Add(uint64(received))
+}
+
+// TakeBytes returns bytes counted since it was last called
+func (nl *SocketLine) TakeBytes() (sent, received uint64) {
+	return nl.sentBytes.Swap(0), nl.receivedBytes.Swap(0)
+}
+
 // clears all socket history
 func (nl *SocketLine) ClearAll() {
 	clear(nl.Values)          // sets all values to zero values (nil in this case), we do this for garbage collection
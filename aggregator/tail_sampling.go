@@ -0,0 +1,92 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/sampling"
+	"github.com/ddosify/alaz/datastore"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/metrics"
+)
+
+// tailSample returns false if the request is sampled out, weight of kept requests is adjusted
+func (a *Aggregator) tailSample(req *datastore.Request) bool {
+	sampler := a.policy.Load().tailSampler
+	if sampler == nil {
+		return true
+	}
+
+	edge := req.FromUID + "->" + req.ToUID + "/" + req.Protocol
+	now := time.Now()
+	keep, weight := sampler.Decide(edge, req.Failed(), req.Latency, now)
+	for _, trace := range a.traceGate.Decide(sampling.TraceKey{Tid: req.Tid, Seq: req.Seq}, keep, now) {
+		a.ds.PersistTraceEvent(trace)
+	}
+	if !keep {
+		return false
+	}
+	req.Weight *= weight
+	req.Sampled = true
+	return true
+}
+
+// egress trace events are written by the request side, see tcp_sock.c
+const traceEgress = 1
+
+// gateTraceEvent holds an egress trace event until tail sampling decides on its request, then it is
+// sent if the request is kept, whatever the rate limit. It returns false if the event is not gated:
+// tail sampling is off, it is an ingress event whose request is decided on the other side, or too many are held.
+func (a *Aggregator) gateTraceEvent(d *l7_req.TraceEvent) bool {
+	if d.Type_ != traceEgress || a.policy.Load().tailSampler == nil {
+		return false
+	}
+	switch a.traceGate.Offer(sampling.TraceKey{Tid: d.Tid, Seq: d.Seq}, d, time.Now()) {
+	case sampling.TraceKeep:
+		a.ds.PersistTraceEvent(d)
+	case sampling.TraceOverflow:
+		return false
+	}
+	return true
+}
+
+func (a *Aggregator) persistTraceEvent(d *l7_req.TraceEvent) {
+	if a.getRateLimiterForPid(d.Pid).Allow() {
+		a.ds.PersistTraceEvent(d)
+	} else {
+		metrics.RateLimitedEvents.WithLabelValues("trace").Inc()
+	}
+}
+
+// releaseHeldTraces rate limits trace events whose request was not tail sampled in time,
+// e.g. it was dropped by a filter before
+func (a *Aggregator) releaseHeldTraces(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, trace := range a.traceGate.Expire(now) {
+				a.persistTraceEvent(trace)
+			}
+		}
+	}
+}
+
+// tail sampling may be enabled later by a policy reload, so this runs regardless
+func (a *Aggregator) clearTailSamplerEdges(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if sampler := a.policy.Load().tailSampler; sampler != nil {
+				sampler.Cleanup(time.Now())
+			}
+		}
+	}
+}
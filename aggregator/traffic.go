@@ -0,0 +1,82 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/traffic"
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/datastore"
+	"github.com/ddosify/alaz/log"
+)
+
+// SetZoneTrafficMetrics enables per edge and zone pair traffic metrics, it is called before Run
+func (a *Aggregator) SetZoneTrafficMetrics(conf config.SeriesMetricsConfig) {
+	if !conf.Enabled {
+		return
+	}
+	log.Logger.Info().Msgf("zone traffic metrics enabled, max series: %d", conf.MaxSeries)
+	a.traffic = traffic.NewRecorder(conf.MaxSeries)
+	go a.clearTrafficSeries(a.ctx)
+}
+
+// edgeLocality returns where the sides of an edge run and their zones, a zone is empty if it is not known.
+// Edges to services are resolved by their endpoint pods, outbound hosts have no locality.
+func (a *Aggregator) edgeLocality(fromUID, toType, toUID string) (locality, fromZone, toZone string) {
+	a.clusterInfo.k8smu.RLock()
+	defer a.clusterInfo.k8smu.RUnlock()
+	fromNode := a.clusterInfo.PodUidToNode[fromUID]
+	fromZone = a.clusterInfo.NodeToZone[fromNode]
+
+	if toType == SVC {
+		if fromNode == "" {
+			return "", fromZone, ""
+		}
+		svc := a.clusterInfo.UidToWorkload[toUID]
+		pods := a.clusterInfo.ServiceEndpointPods[svc.Namespace+"/"+svc.Name]
+		endpoints := make([]traffic.Place, 0, len(pods))
+		for _, uid := range pods {
+			node := a.clusterInfo.PodUidToNode[uid]
+			endpoints = append(endpoints, traffic.Place{Node: node, Zone: a.clusterInfo.NodeToZone[node]})
+		}
+		locality, toZone = traffic.ServiceLocality(traffic.Place{Node: fromNode, Zone: fromZone}, endpoints)
+		return locality, fromZone, toZone
+	}
+
+	toNode := a.clusterInfo.PodUidToNode[toUID]
+	toZone = a.clusterInfo.NodeToZone[toNode]
+	return traffic.Locality(fromNode, toNode, fromZone, toZone), fromZone, toZone
+}
+
+func (a *Aggregator) setLocality(req *datastore.Request) (fromZone, toZone string) {
+	req.Locality, fromZone, toZone = a.edgeLocality(req.FromUID, req.ToType, req.ToUID)
+	return fromZone, toZone
+}
+
+// recordTraffic counts requests before tail sampling like recordRED, weighted by filter sampling, probes are left out
+func (a *Aggregator) recordTraffic(req *datastore.Request, fromZone, toZone string) {
+	if a.traffic == nil || req.Probe {
+		return
+	}
+
+	from, to := a.edgeWorkloads(req)
+	key := traffic.Key{from.Namespace, from.Name, fromZone, to.Namespace, to.Name, toZone, req.Locality, req.Protocol}
+	a.traffic.Observe(key, req.RequestSize, req.ResponseSize, req.Weight, time.Now())
+}
+
+func (a *Aggregator) clearTrafficSeries(ctx context.Context) {
+	if a.traffic == nil {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.traffic.Cleanup(time.Now())
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package traffic
+
+import (
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/series"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// where the sides of a request or connection run
+const (
+	SameNode  = "same_node"
+	SameZone  = "same_zone"
+	CrossZone = "cross_zone"
+
+	// edge to a service with endpoints in different places, the pod a request reached is not known
+	ViaService = "via_service"
+
+	// label of edges with a side that is not a pod on a known node
+	unknownLocality = "unknown"
+)
+
+var Labels = []string{"from_namespace", "from_workload", "from_zone", "to_namespace", "to_workload", "to_zone",
+	"locality", "protocol"}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "zone_traffic",
+		Name:      "requests_total",
+		Help:      "Requests between workloads by zones of their sides.",
+	}, Labels)
+	requestBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "zone_traffic",
+		Name:      "request_bytes_total",
+		Help:      "Bytes written for requests between workloads by zones of their sides.",
+	}, Labels)
+	responseBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "zone_traffic",
+		Name:      "response_bytes_total",
+		Help:      "Bytes read for responses between workloads by zones of their sides.",
+	}, Labels)
+	droppedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "zone_traffic",
+		Name:      "dropped_requests_total",
+		Help:      "Requests not counted because the max number of series was reached.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestBytesTotal, responseBytesTotal, droppedRequests)
+}
+
+// Locality tells where the sides of an edge run, empty if it is not known.
+// Nodes must be set, zones are only compared for different nodes.
+func Locality(fromNode, toNode, fromZone, toZone string) string {
+	switch {
+	case fromNode == "" || toNode == "":
+		return ""
+	case fromNode == toNode:
+		return SameNode
+	case fromZone == "" || toZone == "":
+		return ""
+	case fromZone == toZone:
+		return SameZone
+	default:
+		return CrossZone
+	}
+}
+
+// Place is the node and zone of a pod
+type Place struct {
+	Node string
+	Zone string
+}
+
+// ServiceLocality tells where the endpoints of a service run as seen from a pod.
+// It is known only if all endpoints are in the same place relative to the pod,
+// ViaService otherwise. toZone is set if all endpoints are in one zone.
+func ServiceLocality(from Place, endpoints []Place) (locality, toZone string) {
+	if len(endpoints) == 0 {
+		return "", ""
+	}
+	locality = Locality(from.Node, endpoints[0].Node, from.Zone, endpoints[0].Zone)
+	toZone = endpoints[0].Zone
+	for _, e := range endpoints[1:] {
+		if l := Locality(from.Node, e.Node, from.Zone, e.Zone); l != locality {
+			locality = ViaService
+		}
+		if e.Zone != toZone {
+			toZone = ""
+		}
+	}
+	if locality == "" {
+		return ViaService, toZone
+	}
+	return locality, toZone
+}
+
+// Key holds label values of an edge in the order of Labels
+type Key [8]string
+
+// Recorder counts requests and bytes per edge and zone pair, bounded in number of series
+type Recorder struct {
+	requests      *prometheus.CounterVec
+	requestBytes  *prometheus.CounterVec
+	responseBytes *prometheus.CounterVec
+	series        *series.Set[Key]
+}
+
+// NewRecorder counts into alaz_zone_traffic_requests_total and alaz_zone_traffic_{request,response}_bytes_total
+func NewRecorder(maxSeries int) *Recorder {
+	return newRecorder(requestsTotal, requestBytesTotal, responseBytesTotal, maxSeries)
+}
+
+func newRecorder(requests, requestBytes, responseBytes *prometheus.CounterVec, maxSeries int) *Recorder {
+	return &Recorder{
+		requests:      requests,
+		requestBytes:  requestBytes,
+		responseBytes: responseBytes,
+		series: series.NewSet(maxSeries, droppedRequests, func(k Key) []string { return k[:] },
+			requests, requestBytes, responseBytes),
+	}
+}
+
+// Observe returns false if the edge is new and there is no room for another series.
+// A sampled request stands for weight requests, requests and bytes are counted weight times.
+func (r *Recorder) Observe(key Key, requestSize, responseSize uint32, weight float64, now time.Time) bool {
+	if key[6] == "" {
+		key[6] = unknownLocality
+	}
+
+	if !r.series.Touch(key, now) {
+		return false
+	}
+
+	r.requests.WithLabelValues(key[:]...).Add(weight)
+	r.requestBytes.WithLabelValues(key[:]...).Add(float64(requestSize) * weight)
+	r.responseBytes.WithLabelValues(key[:]...).Add(float64(responseSize) * weight)
+	return true
+}
+
+// Cleanup removes series of edges idle for a while
+func (r *Recorder) Cleanup(now time.Time) {
+	r.series.Cleanup(now)
+}
@@ -0,0 +1,121 @@
+package traffic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/aggregator/series"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestCounters() (*prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec) {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total"}, Labels),
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_request_bytes_total"}, Labels),
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_response_bytes_total"}, Labels)
+}
+
+func TestLocality(t *testing.T) {
+	tests := []struct {
+		fromNode, toNode, fromZone, toZone string
+		expected                           string
+	}{
+		{"n1", "n1", "a", "a", SameNode},
+		{"n1", "n1", "", "", SameNode},
+		{"n1", "n2", "a", "a", SameZone},
+		{"n1", "n2", "a", "b", CrossZone},
+		{"n1", "n2", "a", "", ""},
+		{"n1", "", "a", "", ""},
+	}
+	for _, tt := range tests {
+		if got := Locality(tt.fromNode, tt.toNode, tt.fromZone, tt.toZone); got != tt.expected {
+			t.Errorf("Locality(%q, %q, %q, %q) = %q, expected %q", tt.fromNode, tt.toNode, tt.fromZone, tt.toZone, got, tt.expected)
+		}
+	}
+}
+
+func TestServiceLocality(t *testing.T) {
+	from := Place{"n1", "a"}
+	tests := []struct {
+		endpoints []Place
+		locality  string
+		toZone    string
+	}{
+		{nil, "", ""},
+		{[]Place{{"n1", "a"}}, SameNode, "a"},
+		{[]Place{{"n2", "a"}, {"n3", "a"}}, SameZone, "a"},
+		{[]Place{{"n2", "b"}, {"n3", "c"}}, CrossZone, ""},
+		{[]Place{{"n1", "a"}, {"n2", "b"}}, ViaService, ""},
+		{[]Place{{"", ""}}, ViaService, ""},
+	}
+	for _, tt := range tests {
+		locality, toZone := ServiceLocality(from, tt.endpoints)
+		if locality != tt.locality || toZone != tt.toZone {
+			t.Errorf("ServiceLocality(%v) = %q, %q, expected %q, %q", tt.endpoints, locality, toZone, tt.locality, tt.toZone)
+		}
+	}
+}
+
+func TestRecorderCountsRequestsAndBytes(t *testing.T) {
+	requests, bytes, respBytes := newTestCounters()
+	r := newRecorder(requests, bytes, respBytes, 10)
+	now := time.Now()
+
+	cross := Key{"shop", "frontend", "eu-west-1a", "shop", "cart", "eu-west-1b", CrossZone, "HTTP"}
+	r.Observe(cross, 300, 4000, 1, now)
+	r.Observe(cross, 200, 1000, 1, now)
+	r.Observe(Key{"shop", "frontend", "eu-west-1a", "", "10.0.0.1", "", "", "HTTP"}, 100, 0, 1, now)
+
+	if v := testutil.ToFloat64(requests.WithLabelValues(cross[:]...)); v != 2 {
+		t.Errorf("expected 2 requests, got %v", v)
+	}
+	if v := testutil.ToFloat64(bytes.WithLabelValues(cross[:]...)); v != 500 {
+		t.Errorf("expected 500 bytes, got %v", v)
+	}
+	if v := testutil.ToFloat64(respBytes.WithLabelValues(cross[:]...)); v != 5000 {
+		t.Errorf("expected 5000 response bytes, got %v", v)
+	}
+	outbound := []string{"shop", "frontend", "eu-west-1a", "", "10.0.0.1", "", unknownLocality, "HTTP"}
+	if v := testutil.ToFloat64(bytes.WithLabelValues(outbound...)); v != 100 {
+		t.Errorf("expected edge without locality to be counted as unknown, got %v bytes", v)
+	}
+}
+
+func TestRecorderCountsWeight(t *testing.T) {
+	requests, bytes, respBytes := newTestCounters()
+	r := newRecorder(requests, bytes, respBytes, 10)
+
+	// kept by a 25% sample rule
+	key := Key{"shop", "frontend", "eu-west-1a", "shop", "cart", "eu-west-1a", SameZone, "HTTP"}
+	r.Observe(key, 100, 1000, 4, time.Now())
+
+	if v := testutil.ToFloat64(requests.WithLabelValues(key[:]...)); v != 4 {
+		t.Errorf("expected 4 requests, got %v", v)
+	}
+	if v := testutil.ToFloat64(bytes.WithLabelValues(key[:]...)); v != 400 {
+		t.Errorf("expected 400 bytes, got %v", v)
+	}
+	if v := testutil.ToFloat64(respBytes.WithLabelValues(key[:]...)); v != 4000 {
+		t.Errorf("expected 4000 response bytes, got %v", v)
+	}
+}
+
+func TestRecorderRemovesIdleSeries(t *testing.T) {
+	requests, bytes, respBytes := newTestCounters()
+	r := newRecorder(requests, bytes, respBytes, 1)
+	now := time.Now()
+
+	a := Key{"ns", "a", "z1", "ns", "b", "z1", SameZone, "HTTP"}
+	if !r.Observe(a, 10, 10, 1, now) {
+		t.Fatal("expected first series to be observed")
+	}
+	if r.Observe(Key{"ns", "a", "z1", "ns", "b", "z2", CrossZone, "HTTP"}, 10, 10, 1, now) {
+		t.Fatal("expected second series to be dropped")
+	}
+
+	r.Cleanup(now.Add(series.IdleExpiration + time.Second))
+	if n := testutil.CollectAndCount(requests) + testutil.CollectAndCount(bytes) + testutil.CollectAndCount(respBytes); n != 0 {
+		t.Fatalf("expected idle series to be removed, %d left", n)
+	}
+}
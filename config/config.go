@@ -0,0 +1,347 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Config is the configuration of an alaz agent.
+// It is read from a yaml file, env variables override the file.
+type Config struct {
+	MonitoringID string        `yaml:"monitoringId"`
+	NodeName     string        `yaml:"nodeName"`
+	Cluster      ClusterConfig `yaml:"cluster"`
+
+	K8sCollectorEnabled bool `yaml:"k8sCollectorEnabled"`
+	TracingEnabled      bool `yaml:"tracingEnabled"`
+	MetricsEnabled      bool `yaml:"metricsEnabled"`
+	LogsEnabled         bool `yaml:"logsEnabled"`
+	ShutdownTimeout     int  `yaml:"shutdownTimeout"` // in seconds
+
+	Log        LogConfig           `yaml:"log"`
+	Policy     PolicyConfig        `yaml:"policy"`
+	LogBackend LogBackendConfig    `yaml:"logBackend"`
+	RedMetrics SeriesMetricsConfig `yaml:"redMetrics"` // per edge rate, error and duration histograms on /metrics
+	// per edge and zone pair request and byte counters on /metrics, needs nodes in alaz-role
+	ZoneTrafficMetrics SeriesMetricsConfig `yaml:"zoneTrafficMetrics"`
+
+	Datastores []string                    `yaml:"datastores"` // several datastores are fanned out to
+	Sinks      map[string]FanoutSinkConfig `yaml:"sinks"`      // fanout settings by datastore type
+	Backend    BackendDSConfig             `yaml:"backend"`
+	Otlp       OtlpDSConfig                `yaml:"otlp"`
+	Postgres   PostgresConfig              `yaml:"postgres"`
+	File       FileDSConfig                `yaml:"file"`
+	Kafka      KafkaDSConfig               `yaml:"kafka"`
+}
+
+// ClusterConfig tells clusters sharing a backend apart, it is sent in every payload.
+// Settings not set are discovered from the cluster.
+type ClusterConfig struct {
+	Name   string `yaml:"name"`
+	ID     string `yaml:"id"`     // uid of the kube-system namespace by default
+	Region string `yaml:"region"` // topology.kubernetes.io/region label of the node by default
+	Zone   string `yaml:"zone"`   // topology.kubernetes.io/zone label of the node by default
+}
+
+type LogConfig struct {
+	Level      int    `yaml:"level"` // zerolog level, -1 trace ... 5 panic
+	Disabled   bool   `yaml:"disabled"`
+	ContextKey string `yaml:"contextKey"` // only logs with this log-context are written
+}
+
+// PolicyConfig decides what is traced and kept,
+// it is applied again without a restart when the config is reloaded
+type PolicyConfig struct {
+	IncludeNamespaces    []string `yaml:"includeNamespaces"` // only these namespaces are watched, empty means all
+	ExcludeNamespaceList []string `yaml:"excludeNamespaceList"`
+	ExcludeNamespaces    string   `yaml:"excludeNamespaces"` // regex
+	NamespaceSelector    string   `yaml:"namespaceSelector"` // label selector on namespaces, e.g. "team=payments"
+	PodSelector          string   `yaml:"podSelector"`       // label selector on pods
+
+	RateLimit      float64 `yaml:"rateLimit"` // trace events per second per process
+	RateLimitBurst int     `yaml:"rateLimitBurst"`
+
+	ProbeTrafficPolicy string  `yaml:"probeTrafficPolicy"` // keep, drop or sample kubelet probes
+	ProbeSampleRate    float64 `yaml:"probeSampleRate"`
+
+	TailSampling      TailSamplingConfig `yaml:"tailSampling"`
+	FilterRules       []FilterRule       `yaml:"filterRules"`       // evaluated in order before requests are persisted
+	DisabledProtocols []string           `yaml:"disabledProtocols"` // requests of these protocols are dropped, e.g. kafka
+}
+
+// Clone returns a copy that can be changed without affecting p
+func (p PolicyConfig) Clone() PolicyConfig {
+	p.IncludeNamespaces = slices.Clone(p.IncludeNamespaces)
+	p.ExcludeNamespaceList = slices.Clone(p.ExcludeNamespaceList)
+	p.DisabledProtocols = slices.Clone(p.DisabledProtocols)
+	p.FilterRules = slices.Clone(p.FilterRules)
+	return p
+}
+
+// FilterRule drops, keeps, samples or redacts matching requests, first matching rule decides.
+// Empty fields match everything.
+type FilterRule struct {
+	Name      string `yaml:"name"`
+	Protocol  string `yaml:"protocol"`  // HTTP, HTTPS, HTTP2, gRPC, POSTGRES, REDIS ...
+	Namespace string `yaml:"namespace"` // regex, matched against source or destination namespace
+	Workload  string `yaml:"workload"`  // regex, matched against source or destination workload
+	Path      string `yaml:"path"`      // regex
+	Method    string `yaml:"method"`
+	Status    string `yaml:"status"` // 404, 5xx or 400-499
+
+	MinLatencyMs float64 `yaml:"minLatencyMs"`
+	MaxLatencyMs float64 `yaml:"maxLatencyMs"`
+
+	Action        string  `yaml:"action"` // keep, drop, sample or redact
+	SamplePercent float64 `yaml:"samplePercent"`
+	RedactPattern string  `yaml:"redactPattern"` // regex
+}
+
+type TailSamplingConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	Percentile float64 `yaml:"percentile"` // requests slower than this percentile of their edge are kept
+	EdgeBudget float64 `yaml:"edgeBudget"` // requests per second per edge
+}
+
+// SeriesMetricsConfig is a prometheus metric labeled by edge,
+// series not observed for a while are removed
+type SeriesMetricsConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	MaxSeries int  `yaml:"maxSeries"` // new series are not recorded beyond this
+}
+
+type LogBackendConfig struct {
+	Host          string `yaml:"host"` // host:port
+	ServerName    string `yaml:"serverName"`
+	TLS           bool   `yaml:"tls"`
+	MaxConnection int    `yaml:"maxConnection"`
+}
+
+var datastoreTypes = []string{"backend", "otlp", "postgres", "file", "kafka"}
+
+// Default returns the configuration used for anything not set in the file or env
+func Default() *Config {
+	return &Config{
+		K8sCollectorEnabled: true,
+		ShutdownTimeout:     25, // below the default terminationGracePeriodSeconds of 30
+		Log: LogConfig{
+			Level: 1, // info
+		},
+		Policy: PolicyConfig{
+			RateLimit:          100,
+			RateLimitBurst:     1000,
+			ProbeTrafficPolicy: "keep",
+			ProbeSampleRate:    0.1,
+			TailSampling: TailSamplingConfig{
+				Percentile: 0.95,
+				EdgeBudget: 100,
+			},
+		},
+		LogBackend: LogBackendConfig{
+			Host:          "log-alaz.getanteon.com:443",
+			ServerName:    "log-alaz.getanteon.com",
+			TLS:           true,
+			MaxConnection: 30,
+		},
+		RedMetrics: SeriesMetricsConfig{
+			MaxSeries: 10000,
+		},
+		ZoneTrafficMetrics: SeriesMetricsConfig{
+			MaxSeries: 10000,
+		},
+		Datastores: []string{"backend"},
+		Sinks:      map[string]FanoutSinkConfig{},
+		Backend: BackendDSConfig{
+			MetricsExportInterval: 10,
+			BatchSize:             1000,
+			ReqBufferSize:         40000,
+			ConnBufferSize:        1000,
+			KafkaEventBufferSize:  2000,
+			SpoolMaxSize:          512 * 1024 * 1024,
+		},
+	}
+}
+
+// Load reads the yaml file at path on top of defaults, empty path skips the file.
+// Env variables are applied last, then the result is validated.
+func Load(path string) (*Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(c, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.MonitoringID != "", "monitoringId (MONITORING_ID) is not set")
+	check(c.NodeName != "", "nodeName (NODE_NAME) is not set")
+	check(c.ShutdownTimeout > 0, "shutdownTimeout must be positive")
+	check(c.Log.Level >= -1 && c.Log.Level <= 5, "log.level must be between -1 and 5, got %d", c.Log.Level)
+	errs = append(errs, c.Policy.validate()...)
+	if c.RedMetrics.Enabled {
+		check(c.RedMetrics.MaxSeries > 0, "redMetrics.maxSeries must be positive")
+	}
+	if c.ZoneTrafficMetrics.Enabled {
+		check(c.ZoneTrafficMetrics.MaxSeries > 0, "zoneTrafficMetrics.maxSeries must be positive")
+	}
+	if c.LogsEnabled {
+		check(c.LogBackend.Host != "", "logBackend.host is not set")
+		check(c.LogBackend.MaxConnection > 0, "logBackend.maxConnection must be positive")
+	}
+
+	check(len(c.Datastores) > 0, "no datastore configured")
+	seen := map[string]bool{}
+	for _, ds := range c.Datastores {
+		check(contains(datastoreTypes, ds), "unknown datastore type %q, expected one of %v", ds, datastoreTypes)
+		check(!seen[ds], "datastore %q is listed twice", ds)
+		seen[ds] = true
+	}
+	for name, s := range c.Sinks {
+		check(contains(datastoreTypes, name), "sinks: unknown datastore type %q", name)
+		check(s.BufferSize >= 0, "sinks.%s.bufferSize must not be negative", name)
+		check(contains([]string{"", "drop_newest", "drop_oldest", "block"}, s.DropPolicy),
+			"sinks.%s.dropPolicy must be drop_newest, drop_oldest or block", name)
+	}
+
+	if seen["backend"] {
+		b := c.Backend
+		check(b.Host != "", "backend.host (BACKEND_HOST) is not set")
+		check(b.BatchSize > 0, "backend.batchSize must be positive")
+		check(b.ReqBufferSize > 0 && b.ConnBufferSize > 0 && b.KafkaEventBufferSize > 0, "backend buffer sizes must be positive")
+		check(b.MetricsExportInterval > 0, "backend.metricsExportInterval must be positive")
+		check(contains([]string{"", "json", "protobuf"}, b.Encoding), "backend.encoding must be json or protobuf")
+		check(contains([]string{"", "none", "gzip", "zstd"}, b.Compression), "backend.compression must be none, gzip or zstd")
+		check((b.ClientCertFile == "") == (b.ClientKeyFile == ""), "backend.clientCertFile and backend.clientKeyFile must be set together")
+		check(b.AuthToken == "" || b.AuthTokenFile == "", "only one of backend.authToken and backend.authTokenFile can be set")
+		check(b.SpoolDir == "" || b.SpoolMaxSize > 0, "backend.spoolMaxSize must be positive, the spool would grow unbounded")
+		check(b.AggregationInterval >= 0 && b.AggregationMaxEdges >= 0, "backend aggregation settings must not be negative")
+	}
+	if seen["otlp"] {
+		check(c.Otlp.Endpoint != "", "otlp.endpoint (OTLP_ENDPOINT) is not set")
+		check(contains([]string{"", "grpc", "http"}, c.Otlp.Protocol), "otlp.protocol must be grpc or http")
+	}
+	if seen["postgres"] {
+		check(c.Postgres.Host != "", "postgres.host (POSTGRES_HOST) is not set")
+		check(c.Postgres.RetentionDays >= 0, "postgres.retentionDays must not be negative")
+	}
+	if seen["file"] {
+		check(c.File.Directory != "", "file.directory (FILE_DIRECTORY) is not set")
+		check(contains([]string{"", "jsonl"}, c.File.Format), "file.format must be jsonl")
+	}
+	if seen["kafka"] {
+		check(len(c.Kafka.Brokers) > 0, "kafka.brokers (KAFKA_BROKERS) is not set")
+		check(contains([]string{"", "none", "gzip", "snappy", "lz4", "zstd"}, c.Kafka.Compression),
+			"kafka.compression must be none, gzip, snappy, lz4 or zstd")
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *PolicyConfig) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if p.ExcludeNamespaces != "" {
+		_, err := regexp.Compile(p.ExcludeNamespaces)
+		check(err == nil, "invalid policy.excludeNamespaces regex: %v", err)
+	}
+	_, err := labels.Parse(p.NamespaceSelector)
+	check(err == nil, "invalid policy.namespaceSelector: %v", err)
+	_, err = labels.Parse(p.PodSelector)
+	check(err == nil, "invalid policy.podSelector: %v", err)
+
+	check(p.RateLimit > 0 && p.RateLimitBurst > 0, "policy.rateLimit and policy.rateLimitBurst must be positive")
+	check(contains([]string{"keep", "drop", "sample"}, p.ProbeTrafficPolicy), "policy.probeTrafficPolicy must be keep, drop or sample")
+	check(p.ProbeSampleRate > 0 && p.ProbeSampleRate <= 1, "policy.probeSampleRate must be in (0, 1]")
+	if p.TailSampling.Enabled {
+		check(p.TailSampling.Percentile > 0 && p.TailSampling.Percentile < 1, "policy.tailSampling.percentile must be in (0, 1)")
+		check(p.TailSampling.EdgeBudget > 0, "policy.tailSampling.edgeBudget must be positive")
+	}
+	return errs
+}
+
+// Sink returns fanout settings of a datastore type
+func (c *Config) Sink(dsType string) FanoutSinkConfig {
+	s := c.Sinks[dsType]
+	s.Name = dsType
+	return s
+}
+
+const redacted = "<redacted>"
+
+// Dump returns the effective configuration as yaml, secrets are redacted
+func (c *Config) Dump() ([]byte, error) {
+	d := *c
+	if d.Backend.AuthToken != "" {
+		d.Backend.AuthToken = redacted
+	}
+	if d.Postgres.Password != "" {
+		d.Postgres.Password = redacted
+	}
+	if len(d.Otlp.Headers) > 0 {
+		headers := make(map[string]string, len(d.Otlp.Headers))
+		for k := range d.Otlp.Headers {
+			headers[k] = redacted
+		}
+		d.Otlp.Headers = headers
+	}
+	return yaml.Marshal(&d)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresRestart tells whether settings other than the policy and log level changed,
+// only those two are applied when the config is reloaded
+func (c *Config) RequiresRestart(old *Config) bool {
+	a, b := *c, *old
+	a.Policy, b.Policy = PolicyConfig{}, PolicyConfig{}
+	a.Log.Level, b.Log.Level = 0, 0
+	return !reflect.DeepEqual(a, b)
+}
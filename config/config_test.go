@@ -0,0 +1,276 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envMap(m map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "alaz.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileWithEnvOverrides(t *testing.T) {
+	path := writeConfig(t, `
+monitoringId: from-file
+nodeName: node-1
+tracingEnabled: true
+datastores: [backend, otlp]
+sinks:
+  otlp:
+    bufferSize: 500
+backend:
+  host: https://backend.local
+  reqBufferSize: 100
+otlp:
+  endpoint: collector:4317
+`)
+	c, err := load(path, envMap(map[string]string{
+		"MONITORING_ID":              "from-env",
+		"BACKEND_SPOOL_MAX_SIZE_MB":  "2",
+		"OTLP_HEADERS":               "authorization=Bearer x, tenant=a",
+		"DATASTORE_OTLP_DROP_POLICY": "drop_oldest",
+		"LOG_LEVEL":                  "",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MonitoringID != "from-env" || c.NodeName != "node-1" {
+		t.Errorf("unexpected identity %q %q", c.MonitoringID, c.NodeName)
+	}
+	if !c.TracingEnabled || !c.K8sCollectorEnabled {
+		t.Errorf("expected tracing from file and k8s collector by default")
+	}
+	if c.Backend.ReqBufferSize != 100 || c.Backend.ConnBufferSize != 1000 {
+		t.Errorf("unexpected buffer sizes %d %d", c.Backend.ReqBufferSize, c.Backend.ConnBufferSize)
+	}
+	if c.Backend.SpoolMaxSize != 2*1024*1024 {
+		t.Errorf("expected spool size in bytes, got %d", c.Backend.SpoolMaxSize)
+	}
+	if c.Otlp.Headers["tenant"] != "a" || c.Otlp.Headers["authorization"] != "Bearer x" {
+		t.Errorf("unexpected headers %v", c.Otlp.Headers)
+	}
+	if s := c.Sink("otlp"); s.Name != "otlp" || s.BufferSize != 500 || s.DropPolicy != "drop_oldest" {
+		t.Errorf("unexpected sink config %+v", s)
+	}
+	if c.Log.Level != 1 {
+		t.Errorf("expected empty env to keep the default log level, got %d", c.Log.Level)
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	path := writeConfig(t, `
+datastores: [backend, kafka, file, s3]
+backend:
+  encoding: xml
+file:
+  directory: /var/lib/alaz
+  format: parquet
+`)
+	_, err := load(path, envMap(map[string]string{"SHUTDOWN_TIMEOUT": "soon"}))
+	if err == nil || !strings.Contains(err.Error(), "SHUTDOWN_TIMEOUT") {
+		t.Fatalf("expected env parse error, got %v", err)
+	}
+
+	_, err = load(path, envMap(nil))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, expected := range []string{"MONITORING_ID", "NODE_NAME", `"s3"`, "BACKEND_HOST", "backend.encoding", "KAFKA_BROKERS", "file.format"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	path := writeConfig(t, "monitoringID: typo\n")
+	if _, err := load(path, envMap(nil)); err == nil {
+		t.Fatal("expected unknown field to be rejected")
+	}
+}
+
+func TestLegacyTracingEnv(t *testing.T) {
+	c := Default()
+	if err := applyEnv(c, envMap(map[string]string{"DIST_TRACING_ENABLED": "true"})); err != nil {
+		t.Fatal(err)
+	}
+	if !c.TracingEnabled {
+		t.Error("expected DIST_TRACING_ENABLED to enable tracing")
+	}
+}
+
+func TestDumpRedactsSecrets(t *testing.T) {
+	c := Default()
+	c.Backend.AuthToken = "secret-token"
+	c.Postgres.Password = "secret-password"
+	c.Otlp.Headers = map[string]string{"authorization": "Bearer secret"}
+
+	out, err := c.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Errorf("secrets leaked in dump:\n%s", out)
+	}
+	if c.Backend.AuthToken != "secret-token" || c.Otlp.Headers["authorization"] != "Bearer secret" {
+		t.Error("dump must not modify the config")
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	c := Default()
+	c.MonitoringID, c.NodeName, c.Backend.Host = "id", "node", "https://backend.local"
+	if err := applyEnv(c, envMap(map[string]string{
+		"POD_SELECTOR":          "app in (",
+		"PROBE_TRAFFIC_POLICY":  "ignore",
+		"TAIL_SAMPLING_ENABLED": "true",
+		"RATE_LIMIT":            "0",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, expected := range []string{"podSelector", "probeTrafficPolicy", "rateLimit"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "tailSampling") {
+		t.Errorf("expected tail sampling defaults to be valid, got %v", err)
+	}
+}
+
+func TestLoadFilterRules(t *testing.T) {
+	path := writeConfig(t, `
+monitoringId: id
+nodeName: node-1
+backend:
+  host: https://backend.local
+policy:
+  filterRules:
+  - name: drop-metrics
+    protocol: HTTP
+    path: ^/metrics
+    action: drop
+  - name: sample-fast
+    status: 2xx
+    maxLatencyMs: 10
+    action: sample
+    samplePercent: 5
+`)
+	c, err := load(path, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := c.Policy.FilterRules
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %+v", rules)
+	}
+	if rules[0].Name != "drop-metrics" || rules[0].Path != "^/metrics" || rules[0].Action != "drop" {
+		t.Errorf("unexpected first rule %+v", rules[0])
+	}
+	if rules[1].Status != "2xx" || rules[1].MaxLatencyMs != 10 || rules[1].SamplePercent != 5 {
+		t.Errorf("unexpected second rule %+v", rules[1])
+	}
+
+	clone := c.Policy.Clone()
+	clone.FilterRules[0].Action = "keep"
+	if c.Policy.FilterRules[0].Action != "drop" {
+		t.Error("clone must not share filter rules")
+	}
+}
+
+func TestMetricsAndSpoolValidation(t *testing.T) {
+	c := Default()
+	c.MonitoringID, c.NodeName, c.Backend.Host = "id", "node", "https://backend.local"
+	if c.Backend.SpoolMaxSize <= 0 {
+		t.Fatalf("expected a default spool cap, got %d", c.Backend.SpoolMaxSize)
+	}
+	if err := applyEnv(c, envMap(map[string]string{
+		"RED_METRICS_ENABLED":             "true",
+		"RED_METRICS_MAX_SERIES":          "0",
+		"ZONE_TRAFFIC_METRICS_ENABLED":    "true",
+		"ZONE_TRAFFIC_METRICS_MAX_SERIES": "-1",
+		"BACKEND_SPOOL_DIR":               "/var/lib/alaz/spool",
+		"BACKEND_SPOOL_MAX_SIZE_MB":       "0",
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if !c.RedMetrics.Enabled || !c.ZoneTrafficMetrics.Enabled {
+		t.Fatal("expected env to enable red and zone traffic metrics")
+	}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, expected := range []string{"redMetrics.maxSeries", "zoneTrafficMetrics.maxSeries", "backend.spoolMaxSize"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error about %s, got %v", expected, err)
+		}
+	}
+
+	out, err := Default().Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "redMetrics:") {
+		t.Errorf("expected red metrics in dump:\n%s", out)
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	old := Default()
+	c := Default()
+	c.Log.Level = 0
+	c.Policy.ExcludeNamespaceList = []string{"kube-public"}
+	c.Policy.TailSampling.Enabled = true
+	if c.RequiresRestart(old) {
+		t.Error("policy and log level changes must not require a restart")
+	}
+
+	c.Backend.ReqBufferSize = 10
+	if !c.RequiresRestart(old) {
+		t.Error("expected buffer size change to require a restart")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeConfig(t, "logsEnabled: false\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	if err := Watch(ctx, path, func() { changed <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("logsEnabled: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(watchDebounce + 3*time.Second):
+		t.Fatal("change not noticed")
+	}
+}
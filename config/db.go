@@ -1,20 +1,87 @@
 package config
 
 type PostgresConfig struct {
-	Host     string
-	Port     string
-	Username string
-	Password string
-	DBName   string
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DBName   string `yaml:"dbName"`
+	SSLMode  string `yaml:"sslMode"` // disable, require, verify-full ... defaults to prefer
+
+	BatchSize     int `yaml:"batchSize"`
+	FlushInterval int `yaml:"flushInterval"` // in seconds
+	RetentionDays int `yaml:"retentionDays"` // daily partitions older than this are dropped, 0 keeps everything
 }
 
 type BackendDSConfig struct {
-	Host                  string
-	MetricsExport         bool
-	GpuMetricsExport      bool
-	MetricsExportInterval int // in seconds
-
-	ReqBufferSize        int
-	ConnBufferSize       int
-	KafkaEventBufferSize int
+	Host                  string `yaml:"host"`
+	MetricsExport         bool   `yaml:"-"`
+	GpuMetricsExport      bool   `yaml:"-"`
+	MetricsExportInterval int    `yaml:"metricsExportInterval"` // in seconds
+	BatchSize             uint64 `yaml:"batchSize"`
+
+	ReqBufferSize        int `yaml:"reqBufferSize"`
+	ConnBufferSize       int `yaml:"connBufferSize"`
+	KafkaEventBufferSize int `yaml:"kafkaEventBufferSize"`
+
+	Encoding    string `yaml:"encoding"`    // json (default) or protobuf
+	Compression string `yaml:"compression"` // none (default), gzip or zstd
+
+	SpoolDir     string `yaml:"spoolDir"`     // failed batches are kept here until backend is reachable, empty disables
+	SpoolMaxSize int64  `yaml:"spoolMaxSize"` // in bytes, oldest batches are dropped beyond this, 512MB by default
+	SpoolMaxAge  int    `yaml:"spoolMaxAge"`  // in seconds, older batches are dropped instead of replayed
+
+	AuthToken      string `yaml:"authToken"`      // sent as bearer token
+	AuthTokenFile  string `yaml:"authTokenFile"`  // bearer token is read from this file and re-read when it changes, e.g. a mounted secret
+	CAFile         string `yaml:"caFile"`         // pem bundle trusted in addition to system roots
+	ClientCertFile string `yaml:"clientCertFile"` // pem client certificate for mTLS
+	ClientKeyFile  string `yaml:"clientKeyFile"`
+
+	AggregationInterval  int `yaml:"aggregationInterval"`  // in seconds, requests are sent as per edge summaries of this interval, 0 disables
+	AggregationExemplars int `yaml:"aggregationExemplars"` // slowest requests per edge and interval sent as they are, 5 by default, negative disables
+	AggregationMaxEdges  int `yaml:"aggregationMaxEdges"`  // edges summarized per interval, requests of others are counted on one overflow edge, 10000 by default
+}
+
+type OtlpDSConfig struct {
+	Endpoint string            `yaml:"endpoint"` // host:port for grpc, base url for http e.g. http://otel-collector:4318
+	Protocol string            `yaml:"protocol"` // grpc or http
+	Insecure bool              `yaml:"insecure"` // plaintext grpc, no tls
+	Headers  map[string]string `yaml:"headers"`  // sent with every export, e.g. auth headers
+
+	BatchSize     int `yaml:"batchSize"`
+	FlushInterval int `yaml:"flushInterval"` // in seconds
+	BufferSize    int `yaml:"bufferSize"`
+}
+
+type FileDSConfig struct {
+	Directory string `yaml:"directory"`
+	Format    string `yaml:"format"`   // jsonl, the only one supported
+	Compress  bool   `yaml:"compress"` // gzip files
+
+	MaxFileSize    int64 `yaml:"maxFileSize"`    // in bytes, file is rotated after this many uncompressed bytes
+	RotateInterval int   `yaml:"rotateInterval"` // in seconds, file is rotated after this long even if it is small
+
+	RetentionSize int64 `yaml:"retentionSize"` // in bytes, oldest files are removed when the directory grows beyond this, 0 disables
+	RetentionAge  int   `yaml:"retentionAge"`  // in hours, files older than this are removed, 0 disables
+}
+
+type FanoutSinkConfig struct {
+	Name       string `yaml:"-"`
+	BufferSize int    `yaml:"bufferSize"` // number of buffered calls for this sink
+	DropPolicy string `yaml:"dropPolicy"` // drop_newest (default), drop_oldest or block
+}
+
+type KafkaDSConfig struct {
+	Brokers  []string `yaml:"brokers"`
+	ClientID string   `yaml:"clientId"`
+
+	RequestsTopic    string `yaml:"requestsTopic"`
+	KafkaEventsTopic string `yaml:"kafkaEventsTopic"`
+	ConnectionsTopic string `yaml:"connectionsTopic"`
+	ResourcesTopic   string `yaml:"resourcesTopic"`
+
+	Compression   string `yaml:"compression"`   // none, gzip, snappy, lz4 or zstd
+	BatchSize     int    `yaml:"batchSize"`     // messages per batch
+	FlushInterval int    `yaml:"flushInterval"` // in milliseconds
+	MaxRetries    int    `yaml:"maxRetries"`
 }
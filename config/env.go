@@ -0,0 +1,199 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// megabytes is a size in bytes set from an env variable in megabytes
+type megabytes struct{ bytes *int64 }
+
+// envVars maps env variables to the settings they override
+var envVars = map[string]func(c *Config) any{
+	"MONITORING_ID":         func(c *Config) any { return &c.MonitoringID },
+	"NODE_NAME":             func(c *Config) any { return &c.NodeName },
+	"CLUSTER_NAME":          func(c *Config) any { return &c.Cluster.Name },
+	"CLUSTER_ID":            func(c *Config) any { return &c.Cluster.ID },
+	"CLUSTER_REGION":        func(c *Config) any { return &c.Cluster.Region },
+	"CLUSTER_ZONE":          func(c *Config) any { return &c.Cluster.Zone },
+	"K8S_COLLECTOR_ENABLED": func(c *Config) any { return &c.K8sCollectorEnabled },
+	"TRACING_ENABLED":       func(c *Config) any { return &c.TracingEnabled },
+	"METRICS_ENABLED":       func(c *Config) any { return &c.MetricsEnabled },
+	"LOGS_ENABLED":          func(c *Config) any { return &c.LogsEnabled },
+	"SHUTDOWN_TIMEOUT":      func(c *Config) any { return &c.ShutdownTimeout },
+	"DATASTORE_TYPE":        func(c *Config) any { return &c.Datastores },
+
+	"INCLUDE_NAMESPACES":        func(c *Config) any { return &c.Policy.IncludeNamespaces },
+	"EXCLUDE_NAMESPACE_LIST":    func(c *Config) any { return &c.Policy.ExcludeNamespaceList },
+	"EXCLUDE_NAMESPACES":        func(c *Config) any { return &c.Policy.ExcludeNamespaces },
+	"NAMESPACE_SELECTOR":        func(c *Config) any { return &c.Policy.NamespaceSelector },
+	"POD_SELECTOR":              func(c *Config) any { return &c.Policy.PodSelector },
+	"RATE_LIMIT":                func(c *Config) any { return &c.Policy.RateLimit },
+	"RATE_LIMIT_BURST":          func(c *Config) any { return &c.Policy.RateLimitBurst },
+	"PROBE_TRAFFIC_POLICY":      func(c *Config) any { return &c.Policy.ProbeTrafficPolicy },
+	"PROBE_SAMPLE_RATE":         func(c *Config) any { return &c.Policy.ProbeSampleRate },
+	"TAIL_SAMPLING_ENABLED":     func(c *Config) any { return &c.Policy.TailSampling.Enabled },
+	"TAIL_SAMPLING_PERCENTILE":  func(c *Config) any { return &c.Policy.TailSampling.Percentile },
+	"TAIL_SAMPLING_EDGE_BUDGET": func(c *Config) any { return &c.Policy.TailSampling.EdgeBudget },
+	"DISABLED_PROTOCOLS":        func(c *Config) any { return &c.Policy.DisabledProtocols },
+
+	"LOG_LEVEL":       func(c *Config) any { return &c.Log.Level },
+	"DISABLE_LOGS":    func(c *Config) any { return &c.Log.Disabled },
+	"LOG_CONTEXT_KEY": func(c *Config) any { return &c.Log.ContextKey },
+
+	"RED_METRICS_ENABLED":             func(c *Config) any { return &c.RedMetrics.Enabled },
+	"RED_METRICS_MAX_SERIES":          func(c *Config) any { return &c.RedMetrics.MaxSeries },
+	"ZONE_TRAFFIC_METRICS_ENABLED":    func(c *Config) any { return &c.ZoneTrafficMetrics.Enabled },
+	"ZONE_TRAFFIC_METRICS_MAX_SERIES": func(c *Config) any { return &c.ZoneTrafficMetrics.MaxSeries },
+
+	"LOG_BACKEND":                func(c *Config) any { return &c.LogBackend.Host },
+	"LOG_BACKEND_SERVER_NAME":    func(c *Config) any { return &c.LogBackend.ServerName },
+	"LOG_BACKEND_TLS":            func(c *Config) any { return &c.LogBackend.TLS },
+	"LOG_BACKEND_MAX_CONNECTION": func(c *Config) any { return &c.LogBackend.MaxConnection },
+
+	"BACKEND_HOST":                  func(c *Config) any { return &c.Backend.Host },
+	"BATCH_SIZE":                    func(c *Config) any { return &c.Backend.BatchSize },
+	"BACKEND_ENCODING":              func(c *Config) any { return &c.Backend.Encoding },
+	"BACKEND_COMPRESSION":           func(c *Config) any { return &c.Backend.Compression },
+	"BACKEND_SPOOL_DIR":             func(c *Config) any { return &c.Backend.SpoolDir },
+	"BACKEND_SPOOL_MAX_SIZE_MB":     func(c *Config) any { return megabytes{&c.Backend.SpoolMaxSize} },
+	"BACKEND_SPOOL_MAX_AGE":         func(c *Config) any { return &c.Backend.SpoolMaxAge },
+	"BACKEND_AUTH_TOKEN":            func(c *Config) any { return &c.Backend.AuthToken },
+	"BACKEND_AUTH_TOKEN_FILE":       func(c *Config) any { return &c.Backend.AuthTokenFile },
+	"BACKEND_CA_FILE":               func(c *Config) any { return &c.Backend.CAFile },
+	"BACKEND_CLIENT_CERT_FILE":      func(c *Config) any { return &c.Backend.ClientCertFile },
+	"BACKEND_CLIENT_KEY_FILE":       func(c *Config) any { return &c.Backend.ClientKeyFile },
+	"BACKEND_AGGREGATION_INTERVAL":  func(c *Config) any { return &c.Backend.AggregationInterval },
+	"BACKEND_AGGREGATION_EXEMPLARS": func(c *Config) any { return &c.Backend.AggregationExemplars },
+	"BACKEND_AGGREGATION_MAX_EDGES": func(c *Config) any { return &c.Backend.AggregationMaxEdges },
+
+	"OTLP_ENDPOINT":       func(c *Config) any { return &c.Otlp.Endpoint },
+	"OTLP_PROTOCOL":       func(c *Config) any { return &c.Otlp.Protocol },
+	"OTLP_INSECURE":       func(c *Config) any { return &c.Otlp.Insecure },
+	"OTLP_HEADERS":        func(c *Config) any { return &c.Otlp.Headers },
+	"OTLP_BATCH_SIZE":     func(c *Config) any { return &c.Otlp.BatchSize },
+	"OTLP_FLUSH_INTERVAL": func(c *Config) any { return &c.Otlp.FlushInterval },
+
+	"POSTGRES_HOST":           func(c *Config) any { return &c.Postgres.Host },
+	"POSTGRES_PORT":           func(c *Config) any { return &c.Postgres.Port },
+	"POSTGRES_USER":           func(c *Config) any { return &c.Postgres.Username },
+	"POSTGRES_PASSWORD":       func(c *Config) any { return &c.Postgres.Password },
+	"POSTGRES_DB":             func(c *Config) any { return &c.Postgres.DBName },
+	"POSTGRES_SSLMODE":        func(c *Config) any { return &c.Postgres.SSLMode },
+	"POSTGRES_BATCH_SIZE":     func(c *Config) any { return &c.Postgres.BatchSize },
+	"POSTGRES_FLUSH_INTERVAL": func(c *Config) any { return &c.Postgres.FlushInterval },
+	"POSTGRES_RETENTION_DAYS": func(c *Config) any { return &c.Postgres.RetentionDays },
+
+	"FILE_DIRECTORY":         func(c *Config) any { return &c.File.Directory },
+	"FILE_FORMAT":            func(c *Config) any { return &c.File.Format },
+	"FILE_COMPRESS":          func(c *Config) any { return &c.File.Compress },
+	"FILE_MAX_SIZE_MB":       func(c *Config) any { return megabytes{&c.File.MaxFileSize} },
+	"FILE_ROTATE_INTERVAL":   func(c *Config) any { return &c.File.RotateInterval },
+	"FILE_RETENTION_SIZE_MB": func(c *Config) any { return megabytes{&c.File.RetentionSize} },
+	"FILE_RETENTION_HOURS":   func(c *Config) any { return &c.File.RetentionAge },
+
+	"KAFKA_BROKERS":            func(c *Config) any { return &c.Kafka.Brokers },
+	"KAFKA_CLIENT_ID":          func(c *Config) any { return &c.Kafka.ClientID },
+	"KAFKA_REQUESTS_TOPIC":     func(c *Config) any { return &c.Kafka.RequestsTopic },
+	"KAFKA_KAFKA_EVENTS_TOPIC": func(c *Config) any { return &c.Kafka.KafkaEventsTopic },
+	"KAFKA_CONNECTIONS_TOPIC":  func(c *Config) any { return &c.Kafka.ConnectionsTopic },
+	"KAFKA_RESOURCES_TOPIC":    func(c *Config) any { return &c.Kafka.ResourcesTopic },
+	"KAFKA_COMPRESSION":        func(c *Config) any { return &c.Kafka.Compression },
+	"KAFKA_BATCH_SIZE":         func(c *Config) any { return &c.Kafka.BatchSize },
+	"KAFKA_FLUSH_INTERVAL_MS":  func(c *Config) any { return &c.Kafka.FlushInterval },
+	"KAFKA_MAX_RETRIES":        func(c *Config) any { return &c.Kafka.MaxRetries },
+}
+
+// applyEnv overrides settings with env variables that are set and not empty
+func applyEnv(c *Config, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	for name, field := range envVars {
+		v, ok := lookupEnv(name)
+		if !ok || v == "" {
+			continue
+		}
+		if err := setField(field(c), v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", name, err))
+		}
+	}
+
+	// for backwards compatibility
+	if _, ok := lookupEnv("TRACING_ENABLED"); !ok {
+		for _, name := range []string{"SERVICE_MAP_ENABLED", "DIST_TRACING_ENABLED"} {
+			if enabled, err := strconv.ParseBool(envOrEmpty(lookupEnv, name)); err == nil && enabled {
+				c.TracingEnabled = true
+			}
+		}
+	}
+
+	// per sink settings, e.g. DATASTORE_OTLP_BUFFER_SIZE and DATASTORE_OTLP_DROP_POLICY
+	for _, dsType := range datastoreTypes {
+		prefix := "DATASTORE_" + strings.ToUpper(dsType) + "_"
+		bufferSize := envOrEmpty(lookupEnv, prefix+"BUFFER_SIZE")
+		dropPolicy := envOrEmpty(lookupEnv, prefix+"DROP_POLICY")
+		if bufferSize == "" && dropPolicy == "" {
+			continue
+		}
+		s := c.Sinks[dsType]
+		if bufferSize != "" {
+			if err := setField(&s.BufferSize, bufferSize); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %sBUFFER_SIZE: %w", prefix, err))
+			}
+		}
+		if dropPolicy != "" {
+			s.DropPolicy = dropPolicy
+		}
+		if c.Sinks == nil {
+			c.Sinks = map[string]FanoutSinkConfig{}
+		}
+		c.Sinks[dsType] = s
+	}
+
+	return errors.Join(errs...)
+}
+
+func envOrEmpty(lookupEnv func(string) (string, bool), name string) string {
+	v, _ := lookupEnv(name)
+	return v
+}
+
+func setField(field any, v string) error {
+	var err error
+	switch f := field.(type) {
+	case *string:
+		*f = v
+	case *bool:
+		*f, err = strconv.ParseBool(v)
+	case *int:
+		*f, err = strconv.Atoi(v)
+	case *float64:
+		*f, err = strconv.ParseFloat(v, 64)
+	case *uint64:
+		*f, err = strconv.ParseUint(v, 10, 64)
+	case megabytes:
+		var mb int64
+		mb, err = strconv.ParseInt(v, 10, 64)
+		*f.bytes = mb * 1024 * 1024
+	case *[]string:
+		// comma separated list
+		*f = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*f = append(*f, s)
+			}
+		}
+	case *map[string]string:
+		// key1=value1,key2=value2
+		*f = map[string]string{}
+		for _, kv := range strings.Split(v, ",") {
+			if k, val, ok := strings.Cut(kv, "="); ok {
+				(*f)[strings.TrimSpace(k)] = strings.TrimSpace(val)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// changes of a ConfigMap come as several events, they are handled once things settle
+const watchDebounce = 2 * time.Second
+
+// Watch calls onChange when the file at path changes until ctx is done.
+// The directory is watched, mounted ConfigMaps are updated by swapping a symlink in it.
+func Watch(ctx context.Context, path string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if e.Has(fsnotify.Chmod) {
+					continue
+				}
+				debounce.Reset(watchDebounce)
+			case <-w.Errors:
+			case <-debounce.C:
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
@@ -6,10 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"regexp"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/ddosify/alaz/k8s"
 	"github.com/ddosify/alaz/log"
 	"github.com/prometheus/procfs"
 
@@ -31,12 +32,20 @@ type ContainerPodInfo struct {
 	PodNs   string
 }
 
+// PodPolicies resolves per pod opt-in/opt-out settings, e.g. from pod and namespace annotations
+type PodPolicies interface {
+	TracingEnabled(podUid string, namespace string) bool
+	LogsEnabled(podUid string, namespace string) bool
+	InScope(podUid string, namespace string) bool
+}
+
 type CRITool struct {
-	rs         internalapi.RuntimeService
-	nsFilterRx *regexp.Regexp
+	rs       internalapi.RuntimeService
+	scope    atomic.Pointer[k8s.Scope]
+	policies PodPolicies
 }
 
-func NewCRITool(ctx context.Context) (*CRITool, error) {
+func NewCRITool(ctx context.Context, scope *k8s.Scope) (*CRITool, error) {
 	var runtimeEndpointPaths = defaultRuntimeEndpoints
 	var res internalapi.RuntimeService
 	var err error
@@ -61,29 +70,64 @@ func NewCRITool(ctx context.Context) (*CRITool, error) {
 		return nil, err
 	}
 
-	var nsFilterRx *regexp.Regexp
-	if os.Getenv("EXCLUDE_NAMESPACES") != "" {
-		nsFilterRx = regexp.MustCompile(os.Getenv("EXCLUDE_NAMESPACES"))
+	ct := &CRITool{
+		rs: res,
 	}
+	ct.scope.Store(scope)
+	return ct, nil
+}
 
-	return &CRITool{
-		rs:         res,
-		nsFilterRx: nsFilterRx,
-	}, nil
+// SetScope replaces namespace include/exclude lists, e.g. on config reload
+func (ct *CRITool) SetScope(scope *k8s.Scope) {
+	ct.scope.Store(scope)
 }
 
 func (ct *CRITool) FilterNamespace(ns string) bool {
 	if ns == "kube-system" {
 		return true
 	}
-	if ct.nsFilterRx == nil {
-		return false
+	if !ct.scope.Load().NamespaceNameAllowed(ns) {
+		log.Logger.Debug().Msgf("%s filtered with namespace include/exclude lists", ns)
+		return true
 	}
-	if ct.nsFilterRx.MatchString(ns) {
-		log.Logger.Debug().Msgf("%s filtered with EXCLUDE_NAMESPACES regex %s", ns, ct.nsFilterRx.String())
+
+	return false
+}
+
+func (ct *CRITool) SetPodPolicies(p PodPolicies) {
+	ct.policies = p
+}
+
+// FilterTracing returns true if the pod must not be traced
+func (ct *CRITool) FilterTracing(info *ContainerPodInfo) bool {
+	if ct.FilterNamespace(info.PodNs) || ct.filterSelectors(info) {
 		return true
 	}
+	if ct.policies != nil && !ct.policies.TracingEnabled(info.PodUid, info.PodNs) {
+		log.Logger.Debug().Msgf("%s/%s filtered with tracing annotation", info.PodNs, info.PodName)
+		return true
+	}
+	return false
+}
 
+// FilterLogs returns true if logs of the pod must not be streamed
+func (ct *CRITool) FilterLogs(info *ContainerPodInfo) bool {
+	if ct.FilterNamespace(info.PodNs) || ct.filterSelectors(info) {
+		return true
+	}
+	if ct.policies != nil && !ct.policies.LogsEnabled(info.PodUid, info.PodNs) {
+		log.Logger.Debug().Msgf("%s/%s filtered with logs annotation", info.PodNs, info.PodName)
+		return true
+	}
+	return false
+}
+
+// namespace and pod label selectors, labels are known through k8s informers
+func (ct *CRITool) filterSelectors(info *ContainerPodInfo) bool {
+	if ct.policies != nil && !ct.policies.InScope(info.PodUid, info.PodNs) {
+		log.Logger.Debug().Msgf("%s/%s filtered with namespace/pod selectors", info.PodNs, info.PodName)
+		return true
+	}
 	return false
 }
 
@@ -139,7 +183,12 @@ func (ct *CRITool) GetPidsRunningOnContainers() (map[uint32]struct{}, error) {
 	}
 
 	for _, c := range list {
-		if ct.FilterNamespaceWithContainerId(c.Id) {
+		info, err := ct.ContainerStatus(c.Id)
+		if err != nil {
+			log.Logger.Error().Err(err).Msgf("Failed to get container status for container %s", c.Id)
+			continue
+		}
+		if ct.FilterTracing(info) {
 			log.Logger.Debug().Msgf("No tracking on ebpf side for container [%s] - [%s]", c.Id, c.Metadata.Name)
 			continue
 		}
@@ -321,3 +370,9 @@ func (ct *CRITool) getPod(podUid string) ([]*pb.PodSandbox, error) {
 
 	return ct.rs.ListPodSandbox(context.Background(), filter)
 }
+
+// Ping asks the container runtime for its version, an error means it is not reachable
+func (ct *CRITool) Ping(ctx context.Context) error {
+	_, err := ct.rs.Version(ctx, "")
+	return err
+}
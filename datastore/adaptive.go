@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveMinBatchDivisor = 10 // batch size never goes below configured/10
+	adaptiveMaxBatchFactor  = 4  // or above configured*4
+	adaptiveMaxIntervalMult = 8  // flush interval never goes above configured*8
+)
+
+// adaptiveSender tunes batch size and flush interval of one backend endpoint.
+// It backs off multiplicatively when backend pushes back (429, 5xx, connection errors)
+// and recovers additively while uploads succeed. A Retry-After pauses the endpoint.
+type adaptiveSender struct {
+	mu sync.Mutex
+
+	baseBatch   uint64
+	batchSize   uint64
+	minBatch    uint64
+	maxBatch    uint64
+	baseIntv    time.Duration
+	interval    time.Duration
+	maxInterval time.Duration
+	pausedUntil time.Time
+}
+
+func newAdaptiveSender(batchSize uint64, interval time.Duration) *adaptiveSender {
+	if batchSize == 0 {
+		batchSize = 1
+	}
+	minBatch := batchSize / adaptiveMinBatchDivisor
+	if minBatch == 0 {
+		minBatch = 1
+	}
+	return &adaptiveSender{
+		baseBatch:   batchSize,
+		batchSize:   batchSize,
+		minBatch:    minBatch,
+		maxBatch:    batchSize * adaptiveMaxBatchFactor,
+		baseIntv:    interval,
+		interval:    interval,
+		maxInterval: interval * adaptiveMaxIntervalMult,
+	}
+}
+
+// next returns the batch size to collect and how long to wait before collecting it
+func (a *adaptiveSender) next(now time.Time) (uint64, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	wait := a.interval
+	if pause := a.pausedUntil.Sub(now); pause > wait {
+		wait = pause
+	}
+	return a.batchSize, wait
+}
+
+func (a *adaptiveSender) onResult(err error, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err == nil {
+		a.batchSize += a.baseBatch / adaptiveMinBatchDivisor
+		if a.batchSize > a.maxBatch {
+			a.batchSize = a.maxBatch
+		}
+		a.interval -= a.interval / 4
+		if a.interval < a.baseIntv {
+			a.interval = a.baseIntv
+		}
+		return
+	}
+
+	var statusErr *backendStatusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		a.pausedUntil = now.Add(statusErr.retryAfter)
+	}
+	if !isRetryableBackendError(err) {
+		// backend rejected the content, it is not overloaded
+		return
+	}
+
+	a.batchSize /= 2
+	if a.batchSize < a.minBatch {
+		a.batchSize = a.minBatch
+	}
+	a.interval *= 2
+	if a.interval > a.maxInterval {
+		a.interval = a.maxInterval
+	}
+}
+
+// parseRetryAfter reads Retry-After as seconds or an http date
+func parseRetryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveSender(t *testing.T) {
+	now := time.Now()
+	a := newAdaptiveSender(1000, 5*time.Second)
+
+	// pushback halves batches and doubles the interval, down to the limits
+	for i := 0; i < 10; i++ {
+		a.onResult(&backendStatusError{statusCode: http.StatusServiceUnavailable}, now)
+	}
+	size, wait := a.next(now)
+	if size != 100 || wait != 40*time.Second {
+		t.Fatalf("expected 100 and 40s after pushback, got %d %v", size, wait)
+	}
+
+	// healthy uploads grow them back
+	for i := 0; i < 100; i++ {
+		a.onResult(nil, now)
+	}
+	size, wait = a.next(now)
+	if size != 4000 || wait != 5*time.Second {
+		t.Fatalf("expected 4000 and 5s when healthy, got %d %v", size, wait)
+	}
+
+	// bad requests are not backend pressure
+	a.onResult(&backendStatusError{statusCode: http.StatusBadRequest}, now)
+	if size, _ = a.next(now); size != 4000 {
+		t.Fatalf("400 must not shrink batches, got %d", size)
+	}
+
+	// retry-after pauses the endpoint
+	a.onResult(&backendStatusError{statusCode: http.StatusTooManyRequests, retryAfter: time.Minute}, now)
+	size, wait = a.next(now)
+	if size != 2000 || wait != time.Minute {
+		t.Fatalf("expected 2000 and 1m after 429, got %d %v", size, wait)
+	}
+
+	a.onResult(errors.New("connection refused"), now)
+	if size, _ = a.next(now); size != 1000 {
+		t.Fatalf("connection errors must shrink batches, got %d", size)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for v, want := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 00:00:30 GMT": 30 * time.Second,
+		"Sun, 31 Dec 2023 00:00:00 GMT": 0,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": []string{v}}}
+		if d, ok := parseRetryAfter(resp, now); !ok || d != want {
+			t.Fatalf("%s: expected %v, got %v %v", v, want, d, ok)
+		}
+	}
+	if _, ok := parseRetryAfter(&http.Response{Header: http.Header{"Retry-After": []string{"soon"}}}, now); ok {
+		t.Fatal("invalid retry-after must be ignored")
+	}
+}
@@ -5,21 +5,25 @@ import (
 	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ddosify/alaz/config"
 	"github.com/ddosify/alaz/ebpf/l7_req"
 	"github.com/ddosify/alaz/gpu"
 	"github.com/ddosify/alaz/log"
+	"github.com/ddosify/alaz/metrics"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log/level"
@@ -36,9 +40,25 @@ import (
 	poolutil "go.ddosify.com/ddosify/core/util"
 )
 
+// set from config before any datastore is created
 var MonitoringID string
 var NodeID string
 
+// cluster identity sent in every payload, completed once the k8s collector discovers the rest
+var cluster atomic.Pointer[config.ClusterConfig]
+
+func SetCluster(c config.ClusterConfig) {
+	cluster.Store(&c)
+}
+
+// Cluster returns the identity of the cluster alaz runs in
+func Cluster() config.ClusterConfig {
+	if c := cluster.Load(); c != nil {
+		return *c
+	}
+	return config.ClusterConfig{}
+}
+
 // set from ldflags
 var tag string
 var kernelVersion string
@@ -55,16 +75,6 @@ func init() {
 		return
 	}
 
-	MonitoringID = os.Getenv("MONITORING_ID")
-	if MonitoringID == "" {
-		log.Logger.Fatal().Msg("MONITORING_ID is not set")
-	}
-
-	NodeID = os.Getenv("NODE_NAME")
-	if NodeID == "" {
-		log.Logger.Fatal().Msg("NODE_NAME is not set")
-	}
-
 	if tag == "" {
 		log.Logger.Fatal().Msg("tag is not set")
 	}
@@ -135,6 +145,9 @@ func getCloudProvider() CloudProvider {
 // BackendDS is a backend datastore
 type BackendDS struct {
 	ctx       context.Context
+	senders   sync.WaitGroup // batch senders, they flush what is buffered when ctx is done
+	uploads   sync.WaitGroup // batches being sent
+	done      chan struct{}
 	host      string
 	port      string
 	c         *http.Client
@@ -153,6 +166,12 @@ type BackendDS struct {
 
 	traceInfoPool *poolutil.Pool[*TraceInfo]
 
+	spool    *spool // failed batches wait here for backend, nil if disabled
+	encoding *uploadEncoding
+
+	// requests are sent as per edge summaries, nil if disabled
+	summarizer *requestSummarizer
+
 	metricsExport         bool
 	gpuMetricsExport      bool
 	metricsExportInterval int
@@ -181,6 +200,7 @@ const (
 	dsEndpoint         = "/daemonset/"
 	ssEndpoint         = "/statefulset/"
 	reqEndpoint        = "/requests/"
+	reqSummaryEndpoint = "/requests/summaries/"
 	connEndpoint       = "/connections/"
 	kafkaEventEndpoint = "/events/kafka/"
 
@@ -212,10 +232,18 @@ func NewBackendDS(parentCtx context.Context, conf config.BackendDSConfig) *Backe
 
 	retryClient := retryablehttp.NewClient()
 	retryClient.Logger = LeveledLogger{l: log.Logger.With().Str("component", "retryablehttp").Logger()}
-	retryClient.Backoff = retryablehttp.DefaultBackoff
 	retryClient.RetryWaitMin = 1 * time.Second
 	retryClient.RetryWaitMax = 5 * time.Second
 	retryClient.RetryMax = 2
+	// wait as long as backend asks, CheckRetry gives up on waits longer than RetryWaitMax
+	retryClient.Backoff = func(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+		if d, ok := parseRetryAfter(resp, time.Now()); ok {
+			return d
+		}
+		return retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+	}
+	// last response is returned when retries are exhausted, senders adapt to its status
+	retryClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
 
 	retryClient.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
 		var shouldRetry bool
@@ -223,67 +251,39 @@ func NewBackendDS(parentCtx context.Context, conf config.BackendDSConfig) *Backe
 			// connection refused, connection reset, connection timeout
 			shouldRetry = true
 			log.Logger.Warn().Msgf("will retry, error: %v", err)
-		} else {
+		} else if resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= http.StatusInternalServerError {
 			defer resp.Body.Close()
-			if resp.StatusCode == http.StatusBadRequest ||
-				resp.StatusCode == http.StatusTooManyRequests ||
-				resp.StatusCode >= http.StatusInternalServerError {
-				shouldRetry = true
-
-				rb, err := io.ReadAll(resp.Body)
-				if err != nil {
-					log.Logger.Warn().Msgf("error reading response body: %v", err)
-				}
-				log.Logger.Warn().Int("statusCode", resp.StatusCode).
-					Str("path", resp.Request.URL.Path).
-					Str("respBody", string(rb)).Msgf("will retry...")
-			} else if resp.StatusCode == http.StatusOK {
+			shouldRetry = true
+			// long pauses are left to the endpoint sender instead of blocking here
+			if d, ok := parseRetryAfter(resp, time.Now()); ok && d > retryClient.RetryWaitMax {
 				shouldRetry = false
-				rb, err := io.ReadAll(resp.Body)
-				if err != nil {
-					log.Logger.Debug().Msgf("error reading response body: %v", err)
-				}
+			}
 
-				// if req endpoint
-				if resp.Request.URL.Path == reqEndpoint {
-					var resp ReqBackendReponse
-					err = json.Unmarshal(rb, &resp)
-					if err != nil {
-						log.Logger.Debug().Msgf("error unmarshalling response body: %v", err)
-					}
-					if len(resp.Errors) > 0 {
-						for _, e := range resp.Errors {
-							log.Logger.Error().Str("errorMsg", e.Error).Any("event", e.Event).Msgf("backend persist error")
-						}
-					}
-				} else {
-					var resp BackendResponse
-					err = json.Unmarshal(rb, &resp)
-					if err != nil {
-						log.Logger.Debug().Msgf("error unmarshalling response body: %v", err)
-					}
-					if len(resp.Errors) > 0 {
-						for _, e := range resp.Errors {
-							log.Logger.Error().Str("errorMsg", e.Error).Any("event", e.Event).Msgf("backend persist error")
-						}
-					}
-				}
+			rb, err := io.ReadAll(resp.Body)
+			if err != nil {
+				log.Logger.Warn().Msgf("error reading response body: %v", err)
 			}
+			log.Logger.Warn().Int("statusCode", resp.StatusCode).
+				Str("path", resp.Request.URL.Path).
+				Str("respBody", string(rb)).Msgf("will retry...")
 		}
+		// other responses are read by DoRequest, rejected events of a 200 are handled by the sender
 		return shouldRetry, nil
 	}
 
-	retryClient.HTTPClient.Transport = &http.Transport{
-		DisableKeepAlives: false,
-		MaxConnsPerHost:   500, // 500 connection per host
+	transport, err := newBackendTransport(conf)
+	if err != nil {
+		log.Logger.Fatal().Err(err).Msg("error configuring backend client")
 	}
+	retryClient.HTTPClient.Transport = transport
 	retryClient.HTTPClient.Timeout = 10 * time.Second // Set a timeout for the request
 	client := retryClient.StandardClient()
 
 	var defaultBatchSize uint64 = 1000
 
-	bs, err := strconv.ParseUint(os.Getenv("BATCH_SIZE"), 10, 64)
-	if err != nil {
+	bs := conf.BatchSize
+	if bs == 0 {
 		bs = defaultBatchSize
 	}
 	resourceChanSize := 200
@@ -312,16 +312,46 @@ func NewBackendDS(parentCtx context.Context, conf config.BackendDSConfig) *Backe
 		metricsExport:         conf.MetricsExport,
 		gpuMetricsExport:      conf.GpuMetricsExport,
 		metricsExportInterval: conf.MetricsExportInterval,
+		done:                  make(chan struct{}),
+	}
+
+	ds.encoding, err = newUploadEncoding(conf.Encoding, conf.Compression)
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("falling back to uncompressed json uploads")
+		ds.encoding, _ = newUploadEncoding(BackendEncodingJson, BackendCompressionNone)
+	}
+
+	if conf.AggregationInterval > 0 {
+		ds.summarizer = newRequestSummarizer(time.Duration(conf.AggregationInterval)*time.Second, conf.AggregationExemplars, conf.AggregationMaxEdges, time.Now())
+	}
+
+	if conf.SpoolDir != "" {
+		ds.spool, err = newSpool(conf.SpoolDir, conf.SpoolMaxSize, time.Duration(conf.SpoolMaxAge)*time.Second)
+		if err != nil {
+			log.Logger.Error().Err(err).Msg("backend spool disabled")
+		}
 	}
 
 	return ds
 }
 
 func (ds *BackendDS) Start() {
+	go metrics.SampleChannelDepths(ds.ctx, map[string]func() int{
+		"reqChanBuffer": func() int { return len(ds.reqChanBuffer) },
+	})
+
+	ds.senders.Add(12)
+	if ds.summarizer != nil {
+		ds.senders.Add(1)
+		go ds.sendRequestSummaries()
+	}
 	go ds.sendReqsInBatch(ds.batchSize)
 	go ds.sendConnsInBatch(ds.batchSize / 2)
 	go ds.sendKafkaEventsInBatch(ds.batchSize / 2)
 	go ds.sendTraceEventsInBatch(10 * ds.batchSize)
+	if ds.spool != nil {
+		go ds.replaySpool(10 * time.Second)
+	}
 
 	// events are resynced every 60 seconds on k8s informers
 	// resourceBatchSize ~ burst size, if more than resourceBatchSize events are sent in a moment, blocking can occur
@@ -395,13 +425,19 @@ func (ds *BackendDS) Start() {
 
 	go func() {
 		<-ds.ctx.Done()
-		// TODO:
-		// reqInfoPool.Put() results in send to closed channel if Done() is called
-		// ds.reqInfoPool.Done()
+		ds.senders.Wait()
+		ds.uploads.Wait()
+		// pools are not closed, a late Persist call would put into a closed channel
 		log.Logger.Info().Msg("backend datastore stopped")
+		close(ds.done)
 	}()
 }
 
+// Done is closed when buffered events are sent after the context is cancelled
+func (b *BackendDS) Done() <-chan struct{} {
+	return b.done
+}
+
 func (b *BackendDS) enqueueTraceInfo(traceInfo *TraceInfo) {
 	b.traceEventMu.Lock()
 	defer b.traceEventMu.Unlock()
@@ -429,80 +465,114 @@ func (b *BackendDS) dequeueTraceEvents(batchSize uint64) []*TraceInfo {
 	return batch
 }
 
-func (b *BackendDS) DoRequest(req *http.Request) error {
-	req.Header.Set("Content-Type", "application/json")
+// DoRequest returns the events backend rejected when it accepted the batch
+func (b *BackendDS) DoRequest(req *http.Request) ([]backendEventError, error) {
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentTypeJson)
+	}
 	req.Header.Set("Accept", "application/json")
 
-	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	// not cancelled with b.ctx, batches are still flushed while shutting down
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(b.ctx), 30*time.Second)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := b.c.Do(req.WithContext(ctx))
+	metrics.BackendRequestDuration.WithLabelValues(req.URL.Path).Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("error sending http request: %v", err)
+		metrics.BackendRequestErrors.WithLabelValues(req.URL.Path, "error").Inc()
+		return nil, fmt.Errorf("error sending http request: %v", err)
 	}
 	defer func() {
 		_, _ = io.Copy(io.Discard, resp.Body) // in order to reuse the connection
 		resp.Body.Close()
 	}()
 
+	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("req failed: %d, %s", resp.StatusCode, string(body))
+		metrics.BackendRequestErrors.WithLabelValues(req.URL.Path, strconv.Itoa(resp.StatusCode)).Inc()
+		retryAfter, _ := parseRetryAfter(resp, time.Now())
+		return nil, &backendStatusError{statusCode: resp.StatusCode, body: string(body), acceptEncoding: resp.Header.Get("Accept-Encoding"), retryAfter: retryAfter}
 	}
 
-	return nil
+	return parseBackendResponse(req.URL.Path, body), nil
+}
+
+type backendStatusError struct {
+	statusCode     int
+	body           string
+	acceptEncoding string        // sent with 415, encodings backend accepts
+	retryAfter     time.Duration // sent with 429 and 503
+}
+
+func (e *backendStatusError) Error() string {
+	return fmt.Sprintf("req failed: %d, %s", e.statusCode, e.body)
+}
+
+// batches failed by connection errors, throttling or server errors are worth sending again later
+func isRetryableBackendError(err error) bool {
+	var statusErr *backendStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= http.StatusInternalServerError
+	}
+	return err != nil
+}
+
+// newBatchMetadata is created once per batch, its idempotency key is kept
+// by every retry of the batch so backend can drop duplicates
+func newBatchMetadata() Metadata {
+	c := Cluster()
+	return Metadata{
+		MonitoringID:   MonitoringID,
+		IdempotencyKey: string(uuid.NewUUID()),
+		NodeID:         NodeID,
+		AlazVersion:    tag,
+		ClusterID:      c.ID,
+		ClusterName:    c.Name,
+		Region:         c.Region,
+		Zone:           c.Zone,
+	}
 }
 
 func convertReqsToPayload(batch []*ReqInfo) RequestsPayload {
 	return RequestsPayload{
-		Metadata: Metadata{
-			MonitoringID:   MonitoringID,
-			IdempotencyKey: string(uuid.NewUUID()),
-			NodeID:         NodeID,
-			AlazVersion:    tag,
-		},
+		Metadata: newBatchMetadata(),
 		Requests: batch,
 	}
 }
 
 func convertKafkaEventsToPayload(batch []*KafkaEventInfo) KafkaEventInfoPayload {
 	return KafkaEventInfoPayload{
-		Metadata: Metadata{
-			MonitoringID:   MonitoringID,
-			IdempotencyKey: string(uuid.NewUUID()),
-			NodeID:         NodeID,
-			AlazVersion:    tag,
-		},
+		Metadata:    newBatchMetadata(),
 		KafkaEvents: batch,
 	}
 }
 
 func convertConnsToPayload(batch []*ConnInfo) ConnInfoPayload {
 	return ConnInfoPayload{
-		Metadata: Metadata{
-			MonitoringID:   MonitoringID,
-			IdempotencyKey: string(uuid.NewUUID()),
-			NodeID:         NodeID,
-			AlazVersion:    tag,
-		},
+		Metadata:    newBatchMetadata(),
 		Connections: batch,
 	}
 }
 
 func convertTraceEventsToPayload(batch []*TraceInfo) TracePayload {
 	return TracePayload{
-		Metadata: Metadata{
-			MonitoringID:   MonitoringID,
-			IdempotencyKey: string(uuid.NewUUID()),
-			NodeID:         NodeID,
-			AlazVersion:    tag,
-		},
-		Traces: batch,
+		Metadata: newBatchMetadata(),
+		Traces:   batch,
 	}
 }
 
 func (b *BackendDS) sendMetricsToBackend(r io.Reader) {
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/metrics/scrape/?instance=%s&monitoring_id=%s", b.host, NodeID, MonitoringID), r)
+	c := Cluster()
+	query := url.Values{
+		"instance":      {NodeID},
+		"monitoring_id": {MonitoringID},
+		"cluster_id":    {c.ID},
+		"cluster_name":  {c.Name},
+		"region":        {c.Region},
+		"zone":          {c.Zone},
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/metrics/scrape/?%s", b.host, query.Encode()), r)
 	if err != nil {
 		log.Logger.Error().Msgf("error creating metrics request: %v", err)
 		return
@@ -534,65 +604,158 @@ func (b *BackendDS) sendMetricsToBackend(r io.Reader) {
 	}
 }
 
-func (b *BackendDS) sendToBackend(method string, payload interface{}, endpoint string) {
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.Logger.Error().Msgf("error marshalling batch: %v", err)
-		return
-	}
+// sendToBackend returns the error of the upload, after the batch is spooled if possible
+func (b *BackendDS) sendToBackend(method string, payload interface{}, endpoint string) error {
+	return b.sendBatch(method, payload, endpoint, 0)
+}
 
-	httpReq, err := http.NewRequest(method, b.host+endpoint, bytes.NewBuffer(payloadBytes))
+// sendBatch sends a batch, attempt counts the resends of events backend rejected transiently
+func (b *BackendDS) sendBatch(method string, payload interface{}, endpoint string, attempt int) error {
+	body, contentType, err := b.encoding.encode(payload)
 	if err != nil {
-		log.Logger.Error().Msgf("error creating http request: %v", err)
-		return
+		log.Logger.Error().Msgf("error marshalling batch: %v", err)
+		return err
 	}
 
 	// if endpoint == reqEndpoint {
 	// 	log.Logger.Debug().Str("endpoint", endpoint).Any("payload", payload).Msg("sending batch to backend")
 	// }
-	err = b.DoRequest(httpReq)
+	rejected, err := b.sendBytesToBackend(method, body, contentType, endpoint)
+	var statusErr *backendStatusError
+	if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusUnsupportedMediaType && contentType == contentTypeProtobuf {
+		// backend does not take protobuf, encoding has fallen back to json
+		body, contentType, err = b.encoding.encode(payload)
+		if err == nil {
+			rejected, err = b.sendBytesToBackend(method, body, contentType, endpoint)
+		}
+	}
 	if err != nil {
 		log.Logger.Error().Msgf("backend persist error at ep %s : %v", endpoint, err)
+		if b.spool != nil && isRetryableBackendError(err) {
+			if err := b.spool.push(endpoint, contentType, body); err != nil {
+				log.Logger.Error().Err(err).Str("endpoint", endpoint).Msg("error spooling batch, dropped")
+			}
+		}
+		return err
 	}
+	if len(rejected) > 0 {
+		b.handleRejected(method, payload, endpoint, attempt, rejected)
+	}
+	return nil
 }
 
-func (b *BackendDS) sendTraceEventsInBatch(batchSize uint64) {
-	t := time.NewTicker(1 * time.Second)
+// sendBytesToBackend compresses the body, stepping down compression while backend answers 415
+func (b *BackendDS) sendBytesToBackend(method string, body []byte, contentType string, endpoint string) ([]backendEventError, error) {
+	for {
+		compressed, contentEncoding, err := b.encoding.compress(body)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing batch: %v", err)
+		}
+		httpReq, err := http.NewRequest(method, b.host+endpoint, bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("error creating http request: %v", err)
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+		if contentEncoding != "" {
+			httpReq.Header.Set("Content-Encoding", contentEncoding)
+		}
+
+		rejected, err := b.DoRequest(httpReq)
+		var statusErr *backendStatusError
+		if !errors.As(err, &statusErr) || statusErr.statusCode != http.StatusUnsupportedMediaType {
+			return rejected, err
+		}
+		// a changed encoding is handled by the caller, which still has the payload
+		if compressionChanged, _ := b.encoding.unsupported(contentType, contentEncoding, statusErr.acceptEncoding); !compressionChanged {
+			return nil, err
+		}
+		log.Logger.Warn().Str("encoding", contentEncoding).Msg("backend does not accept request compression, falling back")
+	}
+}
+
+// replaySpool sends spooled batches once backend is reachable again
+func (b *BackendDS) replaySpool(interval time.Duration) {
+	t := time.NewTicker(interval)
 	defer t.Stop()
 
-	send := func() {
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+			if b.spool.len() == 0 {
+				continue
+			}
+			replayed, err := b.spool.replay(func(endpoint, contentType string, payload []byte) error {
+				rejected, err := b.sendBytesToBackend(http.MethodPost, payload, contentType, endpoint)
+				// spooled batches are kept encoded, rejected events can not be resent alone
+				for _, e := range rejected {
+					log.Logger.Error().Str("endpoint", endpoint).Str("errorMsg", e.msg).Any("event", e.event).Msg("backend rejected spooled event, dropped")
+					rejectedEvents.WithLabelValues(endpoint, "dropped").Inc()
+				}
+				if err != nil && !isRetryableBackendError(err) {
+					// backend will never accept it, do not block the ones behind
+					log.Logger.Error().Err(err).Str("endpoint", endpoint).Msg("spooled batch rejected by backend")
+					return nil
+				}
+				return err
+			})
+			if replayed > 0 {
+				log.Logger.Info().Int("batches", replayed).Msg("replayed spooled batches to backend")
+			}
+			if err != nil {
+				log.Logger.Debug().Err(err).Msg("backend still unreachable, spool kept")
+			}
+		}
+	}
+}
+
+func (b *BackendDS) sendTraceEventsInBatch(batchSize uint64) {
+	defer b.senders.Done()
+	sender := newAdaptiveSender(batchSize, 1*time.Second)
+
+	send := func(batchSize uint64) bool {
 		batch := b.dequeueTraceEvents(batchSize)
 
 		if len(batch) == 0 {
-			return
+			return false
 		}
 
 		tracePayload := convertTraceEventsToPayload(batch)
-		go b.sendToBackend(http.MethodPost, tracePayload, traceEventEndpoint)
-
-		// return reqInfoss to the pool
-		for _, trace := range batch {
-			b.traceInfoPool.Put(trace)
-		}
+		b.uploads.Add(1)
+		go func() {
+			defer b.uploads.Done()
+			sender.onResult(b.sendToBackend(http.MethodPost, tracePayload, traceEventEndpoint), time.Now())
+
+			// rows are returned to the pool once sent, rejected ones have been copied for resending by then
+			for _, trace := range batch {
+				b.traceInfoPool.Put(trace)
+			}
+		}()
+		return true
 	}
 
 	for {
+		batchSize, wait := sender.next(time.Now())
 		select {
 		case <-b.ctx.Done():
+			// flush what is buffered before stopping
+			for send(batchSize) {
+			}
 			log.Logger.Info().Msg("stopping sending trace events to backend")
 			return
-		case <-t.C:
-			send()
+		case <-time.After(wait):
+			send(batchSize)
 		}
 	}
 
 }
 
 func (b *BackendDS) sendReqsInBatch(batchSize uint64) {
-	t := time.NewTicker(5 * time.Second)
-	defer t.Stop()
+	defer b.senders.Done()
+	sender := newAdaptiveSender(batchSize, 5*time.Second)
 
-	send := func() {
+	send := func(batchSize uint64) bool {
 		batch := make([]*ReqInfo, 0, batchSize)
 		loop := true
 
@@ -606,36 +769,88 @@ func (b *BackendDS) sendReqsInBatch(batchSize uint64) {
 		}
 
 		if len(batch) == 0 {
-			return
+			return false
 		}
 
 		reqsPayload := convertReqsToPayload(batch)
 		log.Logger.Debug().Int("len", len(batch)).Msg("reqs batch len")
-		go b.sendToBackend(http.MethodPost, reqsPayload, reqEndpoint)
+		b.uploads.Add(1)
+		go func() {
+			defer b.uploads.Done()
+			sender.onResult(b.sendToBackend(http.MethodPost, reqsPayload, reqEndpoint), time.Now())
+
+			// return reqInfoss to the pool once sent
+			for _, req := range batch {
+				b.reqInfoPool.Put(req)
+			}
+		}()
+		return true
+	}
+
+	for {
+		batchSize, wait := sender.next(time.Now())
+		select {
+		case <-b.ctx.Done():
+			// flush what is buffered before stopping
+			for send(batchSize) {
+			}
+			log.Logger.Info().Msg("stopping sending reqs to backend")
+			return
+		case <-time.After(wait):
+			send(batchSize)
+		}
+	}
 
-		// return reqInfoss to the pool
-		for _, req := range batch {
-			b.reqInfoPool.Put(req)
+}
+
+// sendRequestSummaries sends per edge summaries and their exemplars every interval
+func (b *BackendDS) sendRequestSummaries() {
+	defer b.senders.Done()
+	t := time.NewTicker(b.summarizer.interval)
+	defer t.Stop()
+
+	send := func() {
+		summaries, exemplars := b.summarizer.flush(time.Now())
+		for len(summaries) > 0 {
+			n := min(len(summaries), int(b.batchSize))
+			payload := RequestSummaryPayload{Metadata: newBatchMetadata(), Summaries: summaries[:n]}
+			summaries = summaries[n:]
+			b.uploads.Add(1)
+			go func() {
+				defer b.uploads.Done()
+				b.sendToBackend(http.MethodPost, payload, reqSummaryEndpoint)
+			}()
+		}
+		for len(exemplars) > 0 {
+			n := min(len(exemplars), int(b.batchSize))
+			payload := convertReqsToPayload(exemplars[:n])
+			exemplars = exemplars[n:]
+			b.uploads.Add(1)
+			go func() {
+				defer b.uploads.Done()
+				b.sendToBackend(http.MethodPost, payload, reqEndpoint)
+			}()
 		}
 	}
 
 	for {
 		select {
 		case <-b.ctx.Done():
-			log.Logger.Info().Msg("stopping sending reqs to backend")
+			// the interval so far is sent before stopping
+			send()
+			log.Logger.Info().Msg("stopping sending request summaries to backend")
 			return
 		case <-t.C:
 			send()
 		}
 	}
-
 }
 
 func (b *BackendDS) sendKafkaEventsInBatch(batchSize uint64) {
-	t := time.NewTicker(5 * time.Second)
-	defer t.Stop()
+	defer b.senders.Done()
+	sender := newAdaptiveSender(batchSize, 5*time.Second)
 
-	send := func() {
+	send := func(batchSize uint64) bool {
 		batch := make([]*KafkaEventInfo, 0, batchSize)
 		loop := true
 
@@ -649,35 +864,44 @@ func (b *BackendDS) sendKafkaEventsInBatch(batchSize uint64) {
 		}
 
 		if len(batch) == 0 {
-			return
+			return false
 		}
 
 		log.Logger.Debug().Any("batch", batch).Msg("sending batch of kafka events")
 		kEventsPayload := convertKafkaEventsToPayload(batch)
-		go b.sendToBackend(http.MethodPost, kEventsPayload, kafkaEventEndpoint)
+		b.uploads.Add(1)
+		go func() {
+			defer b.uploads.Done()
+			sender.onResult(b.sendToBackend(http.MethodPost, kEventsPayload, kafkaEventEndpoint), time.Now())
 
-		for _, req := range batch {
-			b.kafkaEventInfoPool.Put(req)
-		}
+			for _, req := range batch {
+				b.kafkaEventInfoPool.Put(req)
+			}
+		}()
+		return true
 	}
 
 	for {
+		batchSize, wait := sender.next(time.Now())
 		select {
 		case <-b.ctx.Done():
+			// flush what is buffered before stopping
+			for send(batchSize) {
+			}
 			log.Logger.Info().Msg("stopping sending kafka events to backend")
 			return
-		case <-t.C:
-			send()
+		case <-time.After(wait):
+			send(batchSize)
 		}
 	}
 
 }
 
 func (b *BackendDS) sendConnsInBatch(batchSize uint64) {
-	t := time.NewTicker(30 * time.Second)
-	defer t.Stop()
+	defer b.senders.Done()
+	sender := newAdaptiveSender(batchSize, 30*time.Second)
 
-	send := func() {
+	send := func(batchSize uint64) bool {
 		batch := make([]*ConnInfo, 0, batchSize)
 		loop := true
 
@@ -691,36 +915,45 @@ func (b *BackendDS) sendConnsInBatch(batchSize uint64) {
 		}
 
 		if len(batch) == 0 {
-			return
+			return false
 		}
 
 		connsPayload := convertConnsToPayload(batch)
 		log.Logger.Debug().Any("conns", connsPayload).Msgf("sending %d conns to backend", len(batch))
-		go b.sendToBackend(http.MethodPost, connsPayload, connEndpoint)
-
-		// return openConns to the pool
-		for _, conn := range batch {
-			b.aliveConnPool.Put(conn)
-		}
+		b.uploads.Add(1)
+		go func() {
+			defer b.uploads.Done()
+			sender.onResult(b.sendToBackend(http.MethodPost, connsPayload, connEndpoint), time.Now())
+
+			// return openConns to the pool once sent
+			for _, conn := range batch {
+				b.aliveConnPool.Put(conn)
+			}
+		}()
+		return true
 	}
 
 	for {
+		batchSize, wait := sender.next(time.Now())
 		select {
 		case <-b.ctx.Done():
+			// flush what is buffered before stopping
+			for send(batchSize) {
+			}
 			log.Logger.Info().Msg("stopping sending reqs to backend")
 			return
-		case <-t.C:
-			send()
+		case <-time.After(wait):
+			send(batchSize)
 		}
 	}
 
 }
 
-func (b *BackendDS) send(ch <-chan interface{}, endpoint string) {
-	batch := make([]interface{}, 0, resourceBatchSize)
+func (b *BackendDS) send(ch <-chan interface{}, endpoint string, batchSize uint64) error {
+	batch := make([]interface{}, 0, batchSize)
 	loop := true
 
-	for i := 0; (i < int(resourceBatchSize)) && loop; i++ {
+	for i := 0; (i < int(batchSize)) && loop; i++ {
 		select {
 		case ev := <-ch:
 			batch = append(batch, ev)
@@ -730,36 +963,36 @@ func (b *BackendDS) send(ch <-chan interface{}, endpoint string) {
 	}
 
 	if len(batch) == 0 {
-		return
+		return nil
 	}
 
 	payload := EventPayload{
-		Metadata: Metadata{
-			MonitoringID:   MonitoringID,
-			IdempotencyKey: string(uuid.NewUUID()),
-			NodeID:         NodeID,
-			AlazVersion:    tag,
-		},
-		Events: batch,
+		Metadata: newBatchMetadata(),
+		Events:   batch,
 	}
 
-	b.sendToBackend(http.MethodPost, payload, endpoint)
+	return b.sendToBackend(http.MethodPost, payload, endpoint)
 }
 
 func (b *BackendDS) sendEventsInBatch(ch chan interface{}, endpoint string, interval time.Duration) {
-	t := time.NewTicker(interval)
-	defer t.Stop()
+	defer b.senders.Done()
+	sender := newAdaptiveSender(uint64(resourceBatchSize), interval)
 
 	for {
+		batchSize, wait := sender.next(time.Now())
 		select {
 		case <-b.ctx.Done():
+			// flush what is buffered before stopping
+			for len(ch) > 0 {
+				b.send(ch, endpoint, batchSize)
+			}
 			log.Logger.Info().Msg("stopping sending events to backend")
 			return
-		case <-t.C:
+		case <-time.After(wait):
 			randomDuration := time.Duration(rand.Intn(50)) * time.Millisecond
 			time.Sleep(randomDuration)
 
-			b.send(ch, endpoint)
+			sender.onResult(b.send(ch, endpoint, batchSize), time.Now())
 		}
 	}
 }
@@ -810,6 +1043,9 @@ func (b *BackendDS) PersistAliveConnection(aliveConn *AliveConnection) error {
 	oc[6] = aliveConn.ToType
 	oc[7] = aliveConn.ToUID
 	oc[8] = aliveConn.ToPort
+	oc[9] = aliveConn.Locality
+	oc[10] = aliveConn.SentBytes
+	oc[11] = aliveConn.ReceivedBytes
 
 	b.connChanBuffer <- oc
 
@@ -817,10 +1053,26 @@ func (b *BackendDS) PersistAliveConnection(aliveConn *AliveConnection) error {
 }
 
 func (b *BackendDS) PersistRequest(request *Request) error {
+	if b.summarizer != nil {
+		b.summarizer.add(request)
+		if !request.Sampled {
+			return nil
+		}
+	}
+
 	// get a reqInfo from the pool
 	reqInfo := b.reqInfoPool.Get()
+	fillReqInfo(reqInfo, request)
+	if b.summarizer != nil {
+		reqInfo[19] = float64(0) // already counted in summaries, like exemplars
+	}
+	b.reqChanBuffer <- reqInfo
 
-	// overwrite the reqInfo, all fields must be set in order to avoid conflict
+	return nil
+}
+
+// fillReqInfo overwrites the reqInfo, all fields must be set in order to avoid conflict
+func fillReqInfo(reqInfo *ReqInfo, request *Request) {
 	reqInfo[0] = request.StartTime
 	reqInfo[1] = request.Latency
 	reqInfo[2] = request.FromIP
@@ -839,10 +1091,12 @@ func (b *BackendDS) PersistRequest(request *Request) error {
 	reqInfo[15] = request.Tls
 	reqInfo[16] = request.Seq
 	reqInfo[17] = request.Tid
-
-	b.reqChanBuffer <- reqInfo
-
-	return nil
+	reqInfo[18] = request.Probe
+	reqInfo[19] = request.Weight
+	reqInfo[20] = request.Payload
+	reqInfo[21] = request.Locality
+	reqInfo[22] = request.RequestSize
+	reqInfo[23] = request.ResponseSize
 }
 
 func (b *BackendDS) PersistKafkaEvent(ke *KafkaEvent) error {
@@ -951,20 +1205,18 @@ const (
 	HealthCheckActionOK   HealthCheckAction = "ok"
 )
 
-func (b *BackendDS) SendHealthCheck(tracing bool, metrics bool, logs bool, nsFilter string, k8sVersion string) chan HealthCheckAction {
+// SendHealthCheck reports to the backend periodically.
+// Commands in healthcheck responses are run by handler and acknowledged in the next healthcheck.
+func (b *BackendDS) SendHealthCheck(tracing bool, metrics bool, logs bool, nsFilter string, k8sVersion string, handler CommandHandler) chan HealthCheckAction {
 	t := time.NewTicker(10 * time.Second)
 	// defer t.Stop()
 
 	ch := make(chan HealthCheckAction)
+	commands := newCommandRunner(handler)
 
-	createHealthCheckPayload := func() HealthCheckPayload {
+	createHealthCheckPayload := func(acks []CommandAck) HealthCheckPayload {
 		return HealthCheckPayload{
-			Metadata: Metadata{
-				MonitoringID:   MonitoringID,
-				IdempotencyKey: string(uuid.NewUUID()),
-				NodeID:         NodeID,
-				AlazVersion:    tag,
-			},
+			Metadata: newBatchMetadata(),
 			Info: struct {
 				TracingEnabled  bool   `json:"tracing"`
 				MetricsEnabled  bool   `json:"metrics"`
@@ -985,11 +1237,13 @@ func (b *BackendDS) SendHealthCheck(tracing bool, metrics bool, logs bool, nsFil
 				K8sVersion:    k8sVersion,
 				CloudProvider: string(cloudProvider),
 			},
+			Acks: acks,
 		}
 	}
 
 	f := func() {
-		payloadBytes, err := json.Marshal(createHealthCheckPayload())
+		acks := commands.acks()
+		payloadBytes, err := json.Marshal(createHealthCheckPayload(acks))
 		if err != nil {
 			log.Logger.Error().Msgf("error marshalling batch: %v", err)
 			return
@@ -1013,14 +1267,24 @@ func (b *BackendDS) SendHealthCheck(tracing bool, metrics bool, logs bool, nsFil
 			return
 		}
 
+		if resp.StatusCode == http.StatusOK {
+			commands.delivered(len(acks))
+
+			var hcResp HealthCheckResponse
+			if err := json.NewDecoder(resp.Body).Decode(&hcResp); err != nil && err != io.EOF {
+				log.Logger.Warn().Err(err).Msg("error decoding healthcheck response")
+			}
+			commands.run(hcResp.Commands, time.Now())
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body) // in order to reuse the connection
+		resp.Body.Close()
+
 		if resp.StatusCode == http.StatusPaymentRequired {
 			ch <- HealthCheckActionStop
 		} else if resp.StatusCode == http.StatusOK {
 			ch <- HealthCheckActionOK
 		}
-
-		_, _ = io.Copy(io.Discard, resp.Body) // in order to reuse the connection
-		resp.Body.Close()
 	}
 
 	go func() {
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+func TestBackendFlushOnShutdown(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var p struct {
+			Requests []json.RawMessage `json:"requests"`
+			Events   []json.RawMessage `json:"events"`
+		}
+		json.Unmarshal(body, &p)
+		mu.Lock()
+		received[r.URL.Path] += len(p.Requests) + len(p.Events)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewBackendDS(ctx, config.BackendDSConfig{Host: srv.URL, ReqBufferSize: 1000, ConnBufferSize: 10})
+	b.Start()
+
+	// senders wait for their interval, so these are still buffered when ctx is cancelled
+	for i := 0; i < 500; i++ {
+		b.PersistRequest(&Request{StartTime: int64(i)})
+	}
+	b.PersistPod(Pod{UID: "pod"}, "ADD")
+	cancel()
+
+	select {
+	case <-b.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("backend datastore not done")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received[reqEndpoint] != 500 || received[podEndpoint] != 1 {
+		t.Fatalf("expected buffered events to be flushed, got %v", received)
+	}
+}
@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"strings"
+
+	"github.com/ddosify/alaz/ebpf/l7_req"
+)
+
+// redis and mysql report 2 on error, postgres reports ErrorResponse as 2
+const dbStatusFailed = 2
+
+// Failed tells whether the response status is an error for the protocol
+func (r *Request) Failed() bool {
+	switch r.Protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2:
+		return r.StatusCode >= 500
+	case "gRPC":
+		return r.StatusCode != 0
+	case l7_req.L7_PROTOCOL_POSTGRES, l7_req.L7_PROTOCOL_REDIS, l7_req.L7_PROTOCOL_MYSQL:
+		return r.StatusCode == dbStatusFailed
+	default:
+		return false
+	}
+}
+
+// TemplatePath drops the query and replaces ids in path segments,
+// /users/42/orders?page=2 becomes /users/{id}/orders
+func TemplatePath(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		switch {
+		case s == "":
+		case isNumeric(s):
+			segments[i] = "{id}"
+		case isUUID(s):
+			segments[i] = "{uuid}"
+		case len(s) >= 16 && isHex(s):
+			segments[i] = "{hash}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return false
+			}
+		} else if !isHex(string(c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestRequestFailed(t *testing.T) {
+	tests := []struct {
+		protocol string
+		status   uint32
+		want     bool
+	}{
+		{"HTTP", 200, false},
+		{"HTTPS", 404, false},
+		{"HTTP2", 503, true},
+		{"gRPC", 0, false},
+		{"gRPC", 14, true},
+		{"POSTGRES", 2, true},
+		{"REDIS", 1, false},
+		{"MYSQL", 2, true},
+		{"KAFKA", 2, false},
+	}
+	for _, tt := range tests {
+		r := &Request{Protocol: tt.protocol, StatusCode: tt.status}
+		if got := r.Failed(); got != tt.want {
+			t.Errorf("%s %d: Failed() = %v, expected %v", tt.protocol, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestTemplatePath(t *testing.T) {
+	tests := map[string]string{
+		"/users/42/orders?page=2":                     "/users/{id}/orders",
+		"/items/3f2504e0-4f89-11d3-9a0c-0305e82c3301": "/items/{uuid}",
+		"/blobs/9b74c9897bac770ffc029102a200c5de":     "/blobs/{hash}",
+		"/api/v2/health":                              "/api/v2/health",
+		"/pkg.Service/Method":                         "/pkg.Service/Method",
+		"/":                                           "/",
+	}
+	for path, expected := range tests {
+		if got := TemplatePath(path); got != expected {
+			t.Errorf("TemplatePath(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/log"
+)
+
+// Commands come in healthcheck responses, so a fleet of agents can be managed from the backend.
+// Each one is acknowledged in the next healthcheck.
+type CommandType string
+
+const (
+	CommandSetLogLevel     CommandType = "set_log_level"    // {"level": 0}
+	CommandSetPolicy       CommandType = "set_policy"       // policy fields to change, e.g. {"tailSampling": {"enabled": true}}
+	CommandToggleProtocols CommandType = "toggle_protocols" // {"kafka": false, "http": true}
+	CommandDiagnosticDump  CommandType = "diagnostic_dump"  // result is sent in the acknowledgement
+	CommandPauseLogs       CommandType = "pause_logs"
+	CommandResumeLogs      CommandType = "resume_logs"
+)
+
+type Command struct {
+	ID   string          `json:"id"`
+	Type CommandType     `json:"type"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type CommandStatus string
+
+const (
+	CommandStatusOK          CommandStatus = "ok"
+	CommandStatusError       CommandStatus = "error"
+	CommandStatusUnsupported CommandStatus = "unsupported"
+)
+
+type CommandAck struct {
+	ID     string        `json:"id"`
+	Status CommandStatus `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Result interface{}   `json:"result,omitempty"`
+}
+
+type HealthCheckResponse struct {
+	Commands []Command `json:"commands"`
+}
+
+// CommandHandler runs a command, the result is sent back in its acknowledgement.
+// ErrUnsupportedCommand is returned for commands it does not know.
+type CommandHandler func(cmd Command) (interface{}, error)
+
+var ErrUnsupportedCommand = errors.New("unsupported command")
+
+// ran commands are remembered this long, a command resent by the backend is not run twice
+const commandIDRetention = time.Hour
+
+// commandRunner runs commands and keeps their acknowledgements until a healthcheck carrying them succeeds
+type commandRunner struct {
+	handler CommandHandler
+
+	mu      sync.Mutex
+	pending []CommandAck
+	ran     map[string]time.Time // command id -> when it ran
+}
+
+func newCommandRunner(handler CommandHandler) *commandRunner {
+	return &commandRunner{
+		handler: handler,
+		ran:     make(map[string]time.Time),
+	}
+}
+
+func (r *commandRunner) run(cmds []Command, now time.Time) {
+	for _, cmd := range cmds {
+		r.mu.Lock()
+		_, ran := r.ran[cmd.ID]
+		r.ran[cmd.ID] = now
+		r.mu.Unlock()
+		if ran {
+			continue
+		}
+
+		ack := CommandAck{ID: cmd.ID, Status: CommandStatusOK}
+		var err error
+		if r.handler == nil {
+			err = ErrUnsupportedCommand
+		} else {
+			ack.Result, err = r.handler(cmd)
+		}
+		if errors.Is(err, ErrUnsupportedCommand) {
+			ack.Status = CommandStatusUnsupported
+		} else if err != nil {
+			ack.Status = CommandStatusError
+		}
+		if err != nil {
+			ack.Error = err.Error()
+			log.Logger.Warn().Err(err).Msgf("command %s (%s) failed", cmd.ID, cmd.Type)
+		} else {
+			log.Logger.Info().Msgf("command %s (%s) done", cmd.ID, cmd.Type)
+		}
+
+		r.mu.Lock()
+		r.pending = append(r.pending, ack)
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	for id, t := range r.ran {
+		if now.Sub(t) > commandIDRetention {
+			delete(r.ran, id)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// acks returns acknowledgements not delivered yet
+func (r *commandRunner) acks() []CommandAck {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CommandAck(nil), r.pending...)
+}
+
+// delivered drops the first n acknowledgements once the backend has received them
+func (r *commandRunner) delivered(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = r.pending[n:]
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCommandRunner(t *testing.T) {
+	var ran []string
+	r := newCommandRunner(func(cmd Command) (interface{}, error) {
+		ran = append(ran, cmd.ID)
+		switch cmd.Type {
+		case CommandSetLogLevel:
+			return nil, nil
+		case CommandDiagnosticDump:
+			return map[string]int{"goroutines": 10}, nil
+		case CommandSetPolicy:
+			return nil, errors.New("invalid policy")
+		}
+		return nil, ErrUnsupportedCommand
+	})
+
+	now := time.Now()
+	r.run([]Command{
+		{ID: "1", Type: CommandSetLogLevel, Args: json.RawMessage(`{"level":0}`)},
+		{ID: "2", Type: CommandDiagnosticDump},
+		{ID: "3", Type: CommandSetPolicy},
+		{ID: "4", Type: "reboot"},
+	}, now)
+
+	acks := r.acks()
+	if len(acks) != 4 {
+		t.Fatalf("expected 4 acks, got %d", len(acks))
+	}
+	for i, status := range []CommandStatus{CommandStatusOK, CommandStatusOK, CommandStatusError, CommandStatusUnsupported} {
+		if acks[i].Status != status {
+			t.Errorf("command %s: expected %s, got %s", acks[i].ID, status, acks[i].Status)
+		}
+	}
+	if acks[1].Result == nil || acks[2].Error != "invalid policy" {
+		t.Errorf("unexpected acks %+v", acks)
+	}
+
+	// not delivered yet, a resent command is acknowledged once
+	r.run([]Command{{ID: "1", Type: CommandSetLogLevel}, {ID: "5", Type: CommandSetLogLevel}}, now.Add(time.Minute))
+	if len(ran) != 5 {
+		t.Errorf("expected 5 commands to run, got %v", ran)
+	}
+	r.delivered(len(acks))
+	if acks := r.acks(); len(acks) != 1 || acks[0].ID != "5" {
+		t.Errorf("expected only the new ack to be pending, got %+v", acks)
+	}
+
+	// ids are forgotten after a while
+	r.run(nil, now.Add(commandIDRetention+2*time.Minute))
+	r.run([]Command{{ID: "1", Type: CommandSetLogLevel}}, now.Add(commandIDRetention+2*time.Minute))
+	if len(ran) != 6 {
+		t.Errorf("expected command to run again once forgotten, got %v", ran)
+	}
+}
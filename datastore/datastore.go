@@ -1,6 +1,9 @@
 package datastore
 
 import (
+	"context"
+	"time"
+
 	"github.com/ddosify/alaz/ebpf/l7_req"
 )
 
@@ -22,3 +25,18 @@ type DataStore interface {
 
 	PersistAliveConnection(trace *AliveConnection) error
 }
+
+// Flusher is implemented by datastores that buffer events.
+// Once the context given to the datastore is cancelled, they drain and
+// send what is buffered, then close the Done channel.
+type Flusher interface {
+	Done() <-chan struct{}
+}
+
+// flushTimeout bounds the final flush of a datastore after its context is cancelled
+const flushTimeout = 20 * time.Second
+
+// flushContext outlives the cancelled datastore context for the final flush
+func flushContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+}
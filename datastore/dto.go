@@ -103,6 +103,11 @@ type AliveConnection struct {
 	ToType    string
 	ToUID     string
 	ToPort    uint16
+	Locality  string // same_node, same_zone, cross_zone or via_service
+
+	// bytes of requests and responses on the connection since it was last checked
+	SentBytes     uint64
+	ReceivedBytes uint64
 }
 
 type DirectionalEvent interface {
@@ -193,6 +198,14 @@ type Request struct {
 	Path       string
 	Tid        uint32
 	Seq        uint32
+	Probe      bool    // kubelet probe or health check
+	Weight     float64 // number of requests this one stands for after sampling
+	Sampled    bool    // kept by tail sampling, sent as it is even when requests are summarized
+	Payload    string  // request payload without query and credential headers, only for pods with alaz.io/capture-payload annotation
+	Locality   string  // same_node, same_zone, cross_zone or via_service
+
+	RequestSize  uint32 // bytes written for the request
+	ResponseSize uint32 // bytes read for the response
 }
 
 func (r *Request) SetFromUID(uid string) {
@@ -231,17 +244,19 @@ func (req *Request) ReverseDirection() {
 type BackendResponse struct {
 	Msg    string `json:"msg"`
 	Errors []struct {
-		EventNum int         `json:"event_num"`
-		Event    interface{} `json:"event"`
-		Error    string      `json:"error"`
+		EventNum  int         `json:"event_num"`
+		Event     interface{} `json:"event"`
+		Error     string      `json:"error"`
+		Retryable bool        `json:"retryable"`
 	} `json:"errors"`
 }
 
 type ReqBackendReponse struct {
 	Msg    string `json:"msg"`
 	Errors []struct {
-		EventNum int         `json:"request_num"`
-		Event    interface{} `json:"request"`
-		Error    string      `json:"errors"`
+		EventNum  int         `json:"request_num"`
+		Event     interface{} `json:"request"`
+		Error     string      `json:"errors"`
+		Retryable bool        `json:"retryable"`
 	} `json:"errors"`
 }
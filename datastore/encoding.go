@@ -0,0 +1,222 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	BackendEncodingJson     = "json"
+	BackendEncodingProtobuf = "protobuf"
+
+	BackendCompressionNone = "none"
+	BackendCompressionGzip = "gzip"
+	BackendCompressionZstd = "zstd"
+
+	contentTypeJson     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// uploadEncoding decides how batches are encoded and compressed for backend.
+// It starts with the configured preference and steps down when backend answers
+// 415 Unsupported Media Type, using the Accept-Encoding it sends back (RFC 7694).
+type uploadEncoding struct {
+	mu          sync.RWMutex
+	protobuf    bool
+	compression string
+
+	zstdEncoder *zstd.Encoder
+}
+
+func newUploadEncoding(encoding, compression string) (*uploadEncoding, error) {
+	u := &uploadEncoding{}
+	switch encoding {
+	case "", BackendEncodingJson:
+	case BackendEncodingProtobuf:
+		u.protobuf = true
+	default:
+		return nil, fmt.Errorf("unknown backend encoding %s", encoding)
+	}
+	switch compression {
+	case "", BackendCompressionNone:
+		u.compression = BackendCompressionNone
+	case BackendCompressionGzip, BackendCompressionZstd:
+		u.compression = compression
+	default:
+		return nil, fmt.Errorf("unknown backend compression %s", compression)
+	}
+
+	var err error
+	u.zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// encode returns the body and its content type, payloads without a protobuf schema are always json
+func (u *uploadEncoding) encode(payload interface{}) ([]byte, string, error) {
+	u.mu.RLock()
+	protobuf := u.protobuf
+	u.mu.RUnlock()
+
+	if protobuf {
+		if b, ok := encodeProtobufPayload(payload); ok {
+			return b, contentTypeProtobuf, nil
+		}
+	}
+	b, err := json.Marshal(payload)
+	return b, contentTypeJson, err
+}
+
+// compress returns the body to send and its Content-Encoding, empty if not compressed
+func (u *uploadEncoding) compress(body []byte) ([]byte, string, error) {
+	u.mu.RLock()
+	compression := u.compression
+	u.mu.RUnlock()
+
+	switch compression {
+	case BackendCompressionGzip:
+		var buf bytes.Buffer
+		buf.Grow(len(body) / 4)
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), BackendCompressionGzip, nil
+	case BackendCompressionZstd:
+		return u.zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/4)), BackendCompressionZstd, nil
+	default:
+		return body, "", nil
+	}
+}
+
+// unsupported is called on 415, it steps down either compression or encoding
+// and tells which one, so only that step is redone.
+func (u *uploadEncoding) unsupported(contentType, contentEncoding, acceptEncoding string) (compressionChanged, encodingChanged bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	accepted := map[string]bool{}
+	for _, e := range strings.Split(acceptEncoding, ",") {
+		e, _, _ = strings.Cut(strings.TrimSpace(e), ";")
+		accepted[strings.ToLower(e)] = true
+	}
+
+	// compression is the problem unless backend says it accepts it
+	if contentEncoding != "" && u.compression == contentEncoding && !accepted[contentEncoding] {
+		switch {
+		case contentEncoding != BackendCompressionZstd && accepted[BackendCompressionZstd]:
+			u.compression = BackendCompressionZstd
+		case contentEncoding != BackendCompressionGzip && accepted[BackendCompressionGzip]:
+			u.compression = BackendCompressionGzip
+		default:
+			u.compression = BackendCompressionNone
+		}
+		return true, false
+	}
+	if contentType == contentTypeProtobuf && u.protobuf {
+		u.protobuf = false
+		return false, true
+	}
+	return false, false
+}
+
+// Protobuf encoding of upload payloads, schema is in payload.proto.
+// Rows are positional arrays, element i is encoded as field i+1 of the row message.
+
+func encodeProtobufPayload(payload interface{}) ([]byte, bool) {
+	switch p := payload.(type) {
+	case RequestsPayload:
+		return encodeRows(p.Metadata, len(p.Requests), func(i int) []interface{} { return p.Requests[i][:] }), true
+	case ConnInfoPayload:
+		return encodeRows(p.Metadata, len(p.Connections), func(i int) []interface{} { return p.Connections[i][:] }), true
+	case TracePayload:
+		return encodeRows(p.Metadata, len(p.Traces), func(i int) []interface{} { return p.Traces[i][:] }), true
+	case KafkaEventInfoPayload:
+		return encodeRows(p.Metadata, len(p.KafkaEvents), func(i int) []interface{} { return p.KafkaEvents[i][:] }), true
+	default:
+		return nil, false
+	}
+}
+
+func encodeRows(m Metadata, n int, row func(i int) []interface{}) []byte {
+	b := make([]byte, 0, 64+n*128)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, encodeMetadata(m))
+
+	var rowBuf []byte
+	for i := 0; i < n; i++ {
+		rowBuf = rowBuf[:0]
+		for j, v := range row(i) {
+			rowBuf = appendField(rowBuf, protowire.Number(j+1), v)
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, rowBuf)
+	}
+	return b
+}
+
+func encodeMetadata(m Metadata) []byte {
+	var b []byte
+	b = appendField(b, 1, m.MonitoringID)
+	b = appendField(b, 2, m.IdempotencyKey)
+	b = appendField(b, 3, m.NodeID)
+	b = appendField(b, 4, m.AlazVersion)
+	b = appendField(b, 5, m.ClusterID)
+	b = appendField(b, 6, m.ClusterName)
+	b = appendField(b, 7, m.Region)
+	b = appendField(b, 8, m.Zone)
+	return b
+}
+
+// appendField encodes proto3 scalars, zero values are omitted as proto3 does
+func appendField(b []byte, num protowire.Number, v interface{}) []byte {
+	var u uint64
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, v)
+	case float64:
+		if v == 0 {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		u = protowire.EncodeBool(v)
+	case int64:
+		u = uint64(v)
+	case int:
+		u = uint64(v)
+	case uint64:
+		u = v
+	case uint32:
+		u = uint64(v)
+	case uint16:
+		u = uint64(v)
+	case uint8:
+		u = uint64(v)
+	default:
+		return b
+	}
+	if u == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, u)
+}
@@ -0,0 +1,177 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields returns the last value of each field of a message, nested messages as []byte
+func decodeFields(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	fields := map[protowire.Number][]interface{}{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag")
+		}
+		b = b[n:]
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			var u uint64
+			u, n = protowire.ConsumeFixed64(b)
+			v = math.Float64frombits(u)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d", num)
+		}
+		b = b[n:]
+		fields[num] = append(fields[num], v)
+	}
+	return fields
+}
+
+func TestProtobufRequestsPayload(t *testing.T) {
+	req := &ReqInfo{int64(1700000000000), uint64(5000000), "10.0.0.1", "pod", "pod-a", uint16(43210),
+		"10.0.0.2", "service", "svc-b", uint16(8080), "HTTP", uint32(200), "", "GET", "/orders",
+		false, uint32(7), uint32(99), true, 2.5, ""}
+	b, ok := encodeProtobufPayload(RequestsPayload{Metadata: Metadata{MonitoringID: "m", NodeID: "n"}, Requests: []*ReqInfo{req, req}})
+	if !ok {
+		t.Fatal("requests payload must have a protobuf encoding")
+	}
+
+	top := decodeFields(t, b)
+	meta := decodeFields(t, top[1][0].([]byte))
+	if string(meta[1][0].([]byte)) != "m" || string(meta[3][0].([]byte)) != "n" {
+		t.Fatalf("unexpected metadata %v", meta)
+	}
+	if len(top[2]) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(top[2]))
+	}
+
+	r := decodeFields(t, top[2][0].([]byte))
+	if r[1][0].(uint64) != 1700000000000 || r[10][0].(uint64) != 8080 || string(r[15][0].([]byte)) != "/orders" ||
+		r[19][0].(uint64) != 1 || r[20][0].(float64) != 2.5 {
+		t.Fatalf("unexpected request fields %v", r)
+	}
+	if _, ok := r[13]; ok {
+		t.Fatal("empty fail reason must be omitted")
+	}
+	if _, ok := r[16]; ok {
+		t.Fatal("false tls must be omitted")
+	}
+
+	if _, ok := encodeProtobufPayload(EventPayload{}); ok {
+		t.Fatal("resource events have no protobuf encoding")
+	}
+}
+
+func TestMetadataCarriesCluster(t *testing.T) {
+	SetCluster(config.ClusterConfig{ID: "uid-1", Name: "prod-eu", Zone: "eu-west-1a"})
+	t.Cleanup(func() { SetCluster(config.ClusterConfig{}) })
+
+	m := newBatchMetadata()
+	if m.ClusterID != "uid-1" || m.ClusterName != "prod-eu" || m.Region != "" || m.Zone != "eu-west-1a" {
+		t.Fatalf("unexpected metadata %+v", m)
+	}
+
+	meta := decodeFields(t, encodeMetadata(m))
+	if string(meta[5][0].([]byte)) != "uid-1" || string(meta[8][0].([]byte)) != "eu-west-1a" {
+		t.Fatalf("unexpected encoded metadata %v", meta)
+	}
+	if _, ok := meta[7]; ok {
+		t.Fatal("empty region must be omitted")
+	}
+}
+
+func TestUploadEncodingNegotiation(t *testing.T) {
+	u, err := newUploadEncoding(BackendEncodingProtobuf, BackendCompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := u.unsupported(contentTypeProtobuf, BackendCompressionZstd, "gzip;q=1.0, identity"); !c || u.compression != BackendCompressionGzip {
+		t.Fatalf("expected to fall back to gzip, got %s", u.compression)
+	}
+	if c, _ := u.unsupported(contentTypeProtobuf, BackendCompressionGzip, ""); !c || u.compression != BackendCompressionNone {
+		t.Fatalf("expected to fall back to no compression, got %s", u.compression)
+	}
+	if _, e := u.unsupported(contentTypeProtobuf, "", ""); !e || u.protobuf {
+		t.Fatal("expected to fall back to json")
+	}
+	if c, e := u.unsupported(contentTypeJson, "", ""); c || e {
+		t.Fatal("nothing left to fall back to")
+	}
+}
+
+func TestBackendCompressedUploads(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// this backend only takes gzipped json
+		if r.Header.Get("Content-Encoding") != "gzip" || r.Header.Get("Content-Type") != contentTypeJson {
+			got = append(got, r.Header.Get("Content-Type")+" "+r.Header.Get("Content-Encoding"))
+			w.Header().Set("Accept-Encoding", "gzip")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(gz)
+		got = append(got, string(body))
+	}))
+	defer srv.Close()
+
+	b := NewBackendDS(context.Background(), config.BackendDSConfig{Host: srv.URL, Encoding: BackendEncodingProtobuf, Compression: BackendCompressionZstd})
+	b.sendToBackend(http.MethodPost, ConnInfoPayload{Connections: []*ConnInfo{{int64(1)}}}, connEndpoint)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		contentTypeProtobuf + " zstd",
+		contentTypeProtobuf + " gzip",
+		`{"metadata":{"monitoring_id":"","idempotency_key":"","node_id":"","alaz_version":""},"connections":[[1,null,null,null,null,null,null,null,null,null,null,null]]}`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestZstdCompression(t *testing.T) {
+	u, _ := newUploadEncoding(BackendEncodingJson, BackendCompressionZstd)
+	body := bytes.Repeat([]byte(`{"path":"/orders"}`), 100)
+	compressed, encoding, err := u.compress(body)
+	if err != nil || encoding != BackendCompressionZstd || len(compressed) >= len(body) {
+		t.Fatalf("unexpected compression result %d bytes %s %v", len(compressed), encoding, err)
+	}
+	d, _ := zstd.NewReader(nil)
+	out, err := d.DecodeAll(compressed, nil)
+	if err != nil || !bytes.Equal(out, body) {
+		t.Fatalf("zstd round trip failed: %v", err)
+	}
+}
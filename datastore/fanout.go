@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/log"
+)
+
+const (
+	FanoutDropNewest = "drop_newest" // new calls are dropped while the sink buffer is full
+	FanoutDropOldest = "drop_oldest" // oldest buffered call is dropped to make room
+	FanoutBlock      = "block"       // caller waits for the sink, backpressure on the whole pipeline
+
+	fanoutDefaultBufferSize = 10000
+	fanoutDropLogPeriod     = 30 * time.Second
+)
+
+// FanoutDS forwards every Persist call to several sinks.
+// Each sink has its own buffer and goroutine, a slow or failing sink
+// only drops its own calls and never delays the others.
+// Sinks should be created with a context that outlives the fanout's,
+// so they are still running while buffered calls are drained into them.
+type FanoutDS struct {
+	ctx   context.Context
+	sinks []*fanoutSink
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+type FanoutSink struct {
+	DS   DataStore
+	Conf config.FanoutSinkConfig
+}
+
+type fanoutSink struct {
+	name       string
+	ds         DataStore
+	dropPolicy string
+	calls      chan func(DataStore) error
+	dropped    atomic.Uint64
+}
+
+func NewFanoutDS(parentCtx context.Context, sinks []FanoutSink) (*FanoutDS, error) {
+	f := &FanoutDS{ctx: parentCtx, done: make(chan struct{})}
+	for _, s := range sinks {
+		bufferSize := s.Conf.BufferSize
+		if bufferSize <= 0 {
+			bufferSize = fanoutDefaultBufferSize
+		}
+		dropPolicy := s.Conf.DropPolicy
+		switch dropPolicy {
+		case "":
+			dropPolicy = FanoutDropNewest
+		case FanoutDropNewest, FanoutDropOldest, FanoutBlock:
+		default:
+			return nil, fmt.Errorf("unknown drop policy %s for sink %s", dropPolicy, s.Conf.Name)
+		}
+
+		f.sinks = append(f.sinks, &fanoutSink{
+			name:       s.Conf.Name,
+			ds:         s.DS,
+			dropPolicy: dropPolicy,
+			calls:      make(chan func(DataStore) error, bufferSize),
+		})
+	}
+	return f, nil
+}
+
+func (f *FanoutDS) Start() {
+	for _, s := range f.sinks {
+		f.wg.Add(1)
+		go func(s *fanoutSink) {
+			defer f.wg.Done()
+			s.run(f.ctx)
+		}(s)
+	}
+	go func() {
+		f.wg.Wait()
+		close(f.done)
+	}()
+	go f.logDrops()
+}
+
+// Done is closed when buffered calls are handed to the sinks after the context is cancelled
+func (f *FanoutDS) Done() <-chan struct{} {
+	return f.done
+}
+
+func (s *fanoutSink) run(ctx context.Context) {
+	persist := func(call func(DataStore) error) {
+		if err := call(s.ds); err != nil {
+			log.Logger.Error().Err(err).Str("sink", s.name).Msg("error persisting to sink")
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for len(s.calls) > 0 {
+				persist(<-s.calls)
+			}
+			return
+		case call := <-s.calls:
+			persist(call)
+		}
+	}
+}
+
+func (s *fanoutSink) send(ctx context.Context, call func(DataStore) error) {
+	switch s.dropPolicy {
+	case FanoutBlock:
+		select {
+		case s.calls <- call:
+		case <-ctx.Done():
+		}
+		return
+	case FanoutDropOldest:
+		for {
+			select {
+			case s.calls <- call:
+				return
+			default:
+			}
+			select {
+			case <-s.calls:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.calls <- call:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+func (f *FanoutDS) logDrops() {
+	t := time.NewTicker(fanoutDropLogPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-t.C:
+			for _, s := range f.sinks {
+				if n := s.dropped.Swap(0); n > 0 {
+					log.Logger.Warn().Str("sink", s.name).Uint64("dropped", n).Msg("sink buffer full, calls dropped")
+				}
+			}
+		}
+	}
+}
+
+func (f *FanoutDS) fanout(call func(DataStore) error) error {
+	for _, s := range f.sinks {
+		s.send(f.ctx, call)
+	}
+	return nil
+}
+
+func (f *FanoutDS) PersistPod(pod Pod, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistPod(pod, eventType) })
+}
+
+func (f *FanoutDS) PersistService(service Service, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistService(service, eventType) })
+}
+
+func (f *FanoutDS) PersistReplicaSet(rs ReplicaSet, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistReplicaSet(rs, eventType) })
+}
+
+func (f *FanoutDS) PersistDeployment(d Deployment, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistDeployment(d, eventType) })
+}
+
+func (f *FanoutDS) PersistEndpoints(e Endpoints, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistEndpoints(e, eventType) })
+}
+
+func (f *FanoutDS) PersistContainer(c Container, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistContainer(c, eventType) })
+}
+
+func (f *FanoutDS) PersistDaemonSet(d DaemonSet, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistDaemonSet(d, eventType) })
+}
+
+func (f *FanoutDS) PersistStatefulSet(ss StatefulSet, eventType string) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistStatefulSet(ss, eventType) })
+}
+
+// sinks share the same request, they must not modify it
+func (f *FanoutDS) PersistRequest(request *Request) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistRequest(request) })
+}
+
+func (f *FanoutDS) PersistKafkaEvent(ke *KafkaEvent) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistKafkaEvent(ke) })
+}
+
+func (f *FanoutDS) PersistAliveConnection(aliveConn *AliveConnection) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistAliveConnection(aliveConn) })
+}
+
+func (f *FanoutDS) PersistTraceEvent(trace *l7_req.TraceEvent) error {
+	return f.fanout(func(ds DataStore) error { return ds.PersistTraceEvent(trace) })
+}
@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+// countingDS counts requests, optionally waiting on release before each one
+type countingDS struct {
+	OtlpDS   // only for the rest of the interface, never started
+	requests atomic.Int64
+	release  chan struct{}
+}
+
+func (c *countingDS) PersistRequest(r *Request) error {
+	if c.release != nil {
+		<-c.release
+	}
+	c.requests.Add(1)
+	return nil
+}
+
+func TestFanoutSlowSinkDoesNotBlockOthers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fast := &countingDS{}
+	slow := &countingDS{release: make(chan struct{})}
+	f, err := NewFanoutDS(ctx, []FanoutSink{
+		{DS: fast, Conf: config.FanoutSinkConfig{Name: "fast", BufferSize: 100}},
+		{DS: slow, Conf: config.FanoutSinkConfig{Name: "slow", BufferSize: 2, DropPolicy: FanoutDropNewest}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Start()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			f.PersistRequest(&Request{})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("persist blocked on slow sink")
+	}
+
+	waitFor(t, func() bool { return fast.requests.Load() == 50 })
+	close(slow.release)
+	waitFor(t, func() bool { return slow.requests.Load() > 0 })
+	if dropped := f.sinks[1].dropped.Load(); dropped == 0 || slow.requests.Load()+int64(dropped) != 50 {
+		t.Fatalf("expected slow sink to drop calls, dropped %d persisted %d", dropped, slow.requests.Load())
+	}
+}
+
+func TestFanoutDrainsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sink := &countingDS{release: make(chan struct{})}
+	f, err := NewFanoutDS(ctx, []FanoutSink{{DS: sink, Conf: config.FanoutSinkConfig{Name: "sink", BufferSize: 100}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Start()
+	for i := 0; i < 20; i++ {
+		f.PersistRequest(&Request{})
+	}
+	cancel()
+	close(sink.release)
+
+	select {
+	case <-f.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("fanout not done")
+	}
+	if n := sink.requests.Load(); n != 20 {
+		t.Fatalf("expected buffered calls to reach the sink, got %d", n)
+	}
+}
+
+func TestFanoutDropOldest(t *testing.T) {
+	s := &fanoutSink{dropPolicy: FanoutDropOldest, calls: make(chan func(DataStore) error, 2)}
+	var last int
+	for i := 1; i <= 5; i++ {
+		i := i
+		s.send(context.Background(), func(DataStore) error { last = i; return nil })
+	}
+	if s.dropped.Load() != 3 || len(s.calls) != 2 {
+		t.Fatalf("expected 3 dropped and 2 buffered, got %d and %d", s.dropped.Load(), len(s.calls))
+	}
+	(<-s.calls)(nil)
+	if last != 4 {
+		t.Fatalf("expected oldest calls to be dropped, got %d first", last)
+	}
+}
+
+func TestFanoutUnknownPolicy(t *testing.T) {
+	if _, err := NewFanoutDS(context.Background(), []FanoutSink{{DS: &countingDS{}, Conf: config.FanoutSinkConfig{DropPolicy: "spill"}}}); err == nil {
+		t.Fatal("expected error for unknown drop policy")
+	}
+}
@@ -0,0 +1,390 @@
+package datastore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/log"
+)
+
+const (
+	// the only format, parquet is not supported since no parquet encoder is vendored
+	FileFormatJsonl = "jsonl"
+
+	fileDefaultMaxSize     = 100 * 1024 * 1024
+	fileDefaultRotate      = time.Hour
+	fileDefaultBufferSize  = 40000
+	fileFlushPeriod        = 5 * time.Second
+	fileRetentionPeriod    = time.Minute
+	fileNameTimeLayout     = "20060102T150405.000000000"
+	fileStreamRequests     = "requests"
+	fileStreamKafkaEvents  = "kafka_events"
+	fileStreamConnections  = "connections"
+	fileStreamTraceEvents  = "trace_events"
+	fileStreamK8sResources = "resources"
+)
+
+// FileDS writes every event to rotating local files, one directory per stream,
+// for clusters without egress. Files are JSON lines, optionally gzipped.
+type FileDS struct {
+	ctx            context.Context
+	dir            string
+	compress       bool
+	maxSize        int64
+	rotateInterval time.Duration
+	retentionSize  int64
+	retentionAge   time.Duration
+
+	recordChan chan fileRecord
+	files      map[string]*rotatingFile // stream -> open file, only used by writer goroutine
+
+	done chan struct{}
+}
+
+type fileRecord struct {
+	stream string
+	v      interface{}
+}
+
+// kubernetes resources share one stream, kind tells them apart
+type resourceEvent struct {
+	Kind  string      `json:"kind"`
+	Event string      `json:"event"`
+	Time  int64       `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// fields of cluster identity added to every record
+type fileClusterFields struct {
+	ClusterID   string `json:"cluster_id,omitempty"`
+	ClusterName string `json:"cluster_name,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+}
+
+type rotatingFile struct {
+	path    string
+	f       *os.File
+	gz      *gzip.Writer
+	w       *bufio.Writer
+	written int64
+	opened  time.Time
+}
+
+func NewFileDS(parentCtx context.Context, conf config.FileDSConfig) (*FileDS, error) {
+	switch conf.Format {
+	case "", FileFormatJsonl:
+	default:
+		return nil, fmt.Errorf("unknown file datastore format %s", conf.Format)
+	}
+
+	if conf.Directory == "" {
+		return nil, fmt.Errorf("file datastore directory is not set")
+	}
+	if err := os.MkdirAll(conf.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating file datastore directory: %w", err)
+	}
+
+	maxSize := conf.MaxFileSize
+	if maxSize <= 0 {
+		maxSize = fileDefaultMaxSize
+	}
+	rotateInterval := time.Duration(conf.RotateInterval) * time.Second
+	if rotateInterval <= 0 {
+		rotateInterval = fileDefaultRotate
+	}
+
+	return &FileDS{
+		ctx:            parentCtx,
+		dir:            conf.Directory,
+		compress:       conf.Compress,
+		maxSize:        maxSize,
+		rotateInterval: rotateInterval,
+		retentionSize:  conf.RetentionSize,
+		retentionAge:   time.Duration(conf.RetentionAge) * time.Hour,
+		recordChan:     make(chan fileRecord, fileDefaultBufferSize),
+		files:          map[string]*rotatingFile{},
+		done:           make(chan struct{}),
+	}, nil
+}
+
+func (f *FileDS) Start() {
+	go f.run()
+}
+
+// Done is closed when buffered records are written and files are closed after the context is cancelled
+func (f *FileDS) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *FileDS) run() {
+	defer close(f.done)
+	flushTicker := time.NewTicker(fileFlushPeriod)
+	defer flushTicker.Stop()
+	retentionTicker := time.NewTicker(fileRetentionPeriod)
+	defer retentionTicker.Stop()
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			for len(f.recordChan) > 0 {
+				r := <-f.recordChan
+				if err := f.write(r, time.Now()); err != nil {
+					log.Logger.Error().Err(err).Str("stream", r.stream).Msg("error writing to file datastore")
+				}
+			}
+			f.closeAll()
+			log.Logger.Info().Msg("file datastore stopped")
+			return
+		case r := <-f.recordChan:
+			if err := f.write(r, time.Now()); err != nil {
+				log.Logger.Error().Err(err).Str("stream", r.stream).Msg("error writing to file datastore")
+			}
+		case now := <-flushTicker.C:
+			f.flush(now)
+		case now := <-retentionTicker.C:
+			f.applyRetention(now)
+		}
+	}
+}
+
+func (f *FileDS) write(r fileRecord, now time.Time) error {
+	b, err := json.Marshal(r.v)
+	if err != nil {
+		return err
+	}
+	b, err = withClusterFields(b)
+	if err != nil {
+		return err
+	}
+
+	rf := f.files[r.stream]
+	if rf != nil && (rf.written >= f.maxSize || now.Sub(rf.opened) >= f.rotateInterval) {
+		f.closeFile(r.stream)
+		rf = nil
+	}
+	if rf == nil {
+		rf, err = f.openFile(r.stream, now)
+		if err != nil {
+			return err
+		}
+		f.files[r.stream] = rf
+	}
+
+	b = append(b, '\n')
+	n, err := rf.w.Write(b)
+	rf.written += int64(n)
+	return err
+}
+
+// withClusterFields adds cluster identity to the top level of a json object
+func withClusterFields(record []byte) ([]byte, error) {
+	c := Cluster()
+	fields, err := json.Marshal(fileClusterFields{ClusterID: c.ID, ClusterName: c.Name, Region: c.Region, Zone: c.Zone})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 2 || len(record) < 2 || record[0] != '{' {
+		return record, nil
+	}
+	if len(record) == 2 { // {}
+		return fields, nil
+	}
+	out := make([]byte, 0, len(fields)+len(record))
+	out = append(out, fields[:len(fields)-1]...)
+	out = append(out, ',')
+	return append(out, record[1:]...), nil
+}
+
+func (f *FileDS) openFile(stream string, now time.Time) (*rotatingFile, error) {
+	dir := filepath.Join(f.dir, stream)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", stream, now.UTC().Format(fileNameTimeLayout), FileFormatJsonl)
+	if f.compress {
+		name += ".gz"
+	}
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := &rotatingFile{path: path, f: file, opened: now}
+	var w io.Writer = file
+	if f.compress {
+		rf.gz = gzip.NewWriter(file)
+		w = rf.gz
+	}
+	rf.w = bufio.NewWriter(w)
+	return rf, nil
+}
+
+// flush makes written records visible to readers and rotates idle files that are too old
+func (f *FileDS) flush(now time.Time) {
+	for stream, rf := range f.files {
+		if now.Sub(rf.opened) >= f.rotateInterval {
+			f.closeFile(stream)
+			continue
+		}
+		if err := rf.w.Flush(); err != nil {
+			log.Logger.Error().Err(err).Str("file", rf.path).Msg("error flushing file datastore")
+			continue
+		}
+		if rf.gz != nil {
+			if err := rf.gz.Flush(); err != nil {
+				log.Logger.Error().Err(err).Str("file", rf.path).Msg("error flushing file datastore")
+			}
+		}
+	}
+}
+
+func (f *FileDS) closeFile(stream string) {
+	rf := f.files[stream]
+	if rf == nil {
+		return
+	}
+	delete(f.files, stream)
+
+	err := rf.w.Flush()
+	if rf.gz != nil {
+		if gzErr := rf.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := rf.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Logger.Error().Err(err).Str("file", rf.path).Msg("error closing file datastore file")
+	}
+}
+
+func (f *FileDS) closeAll() {
+	for stream := range f.files {
+		f.closeFile(stream)
+	}
+}
+
+// applyRetention removes closed files older than retention age,
+// then the oldest closed files until the directory fits in retention size.
+func (f *FileDS) applyRetention(now time.Time) {
+	if f.retentionAge <= 0 && f.retentionSize <= 0 {
+		return
+	}
+
+	open := map[string]bool{}
+	for _, rf := range f.files {
+		open[rf.path] = true
+	}
+
+	type fileInfo struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []fileInfo
+	var total int64
+	err := filepath.WalkDir(f.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		if !open[path] {
+			files = append(files, fileInfo{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("error listing file datastore directory")
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, fi := range files {
+		expired := f.retentionAge > 0 && now.Sub(fi.modTime) > f.retentionAge
+		oversize := f.retentionSize > 0 && total > f.retentionSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(fi.path); err != nil {
+			log.Logger.Error().Err(err).Str("file", fi.path).Msg("error removing file datastore file")
+			continue
+		}
+		total -= fi.size
+	}
+}
+
+func (f *FileDS) persistResource(kind string, v interface{}, eventType string) error {
+	f.recordChan <- fileRecord{stream: fileStreamK8sResources, v: resourceEvent{Kind: kind, Event: eventType, Time: time.Now().UnixMilli(), Data: v}}
+	return nil
+}
+
+func (f *FileDS) PersistPod(pod Pod, eventType string) error {
+	return f.persistResource("Pod", pod, eventType)
+}
+
+func (f *FileDS) PersistService(service Service, eventType string) error {
+	return f.persistResource("Service", service, eventType)
+}
+
+func (f *FileDS) PersistReplicaSet(rs ReplicaSet, eventType string) error {
+	return f.persistResource("ReplicaSet", rs, eventType)
+}
+
+func (f *FileDS) PersistDeployment(d Deployment, eventType string) error {
+	return f.persistResource("Deployment", d, eventType)
+}
+
+func (f *FileDS) PersistEndpoints(e Endpoints, eventType string) error {
+	return f.persistResource("Endpoints", e, eventType)
+}
+
+func (f *FileDS) PersistContainer(c Container, eventType string) error {
+	return f.persistResource("Container", c, eventType)
+}
+
+func (f *FileDS) PersistDaemonSet(ds DaemonSet, eventType string) error {
+	return f.persistResource("DaemonSet", ds, eventType)
+}
+
+func (f *FileDS) PersistStatefulSet(ss StatefulSet, eventType string) error {
+	return f.persistResource("StatefulSet", ss, eventType)
+}
+
+func (f *FileDS) PersistRequest(request *Request) error {
+	f.recordChan <- fileRecord{stream: fileStreamRequests, v: request}
+	return nil
+}
+
+func (f *FileDS) PersistKafkaEvent(ke *KafkaEvent) error {
+	f.recordChan <- fileRecord{stream: fileStreamKafkaEvents, v: ke}
+	return nil
+}
+
+func (f *FileDS) PersistAliveConnection(aliveConn *AliveConnection) error {
+	f.recordChan <- fileRecord{stream: fileStreamConnections, v: aliveConn}
+	return nil
+}
+
+func (f *FileDS) PersistTraceEvent(trace *l7_req.TraceEvent) error {
+	f.recordChan <- fileRecord{stream: fileStreamTraceEvents, v: trace}
+	return nil
+}
@@ -0,0 +1,151 @@
+package datastore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+func TestFileDSRotation(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFileDS(context.Background(), config.FileDSConfig{Directory: dir, Compress: true, MaxFileSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		r := &Request{StartTime: now.UnixMilli(), FromUID: "pod-a", ToUID: "svc-b", Path: "/orders", StatusCode: 200}
+		if err := f.write(fileRecord{stream: fileStreamRequests, v: r}, now.Add(time.Duration(i)*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.persistResource("Pod", Pod{UID: "pod-a"}, "ADD")
+	f.write(<-f.recordChan, now)
+	f.closeAll()
+
+	files, _ := filepath.Glob(filepath.Join(dir, fileStreamRequests, "*.jsonl.gz"))
+	if len(files) < 2 {
+		t.Fatalf("expected rotated files, got %v", files)
+	}
+
+	lines := 0
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := bufio.NewScanner(gz)
+		for s.Scan() {
+			var r Request
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil || r.Path != "/orders" {
+				t.Fatalf("unexpected line %s", s.Text())
+			}
+			lines++
+		}
+		file.Close()
+	}
+	if lines != 10 {
+		t.Fatalf("expected 10 requests, got %d", lines)
+	}
+
+	resources, _ := filepath.Glob(filepath.Join(dir, fileStreamK8sResources, "*.jsonl.gz"))
+	if len(resources) != 1 {
+		t.Fatalf("expected one resources file, got %v", resources)
+	}
+}
+
+func TestFileDSRetention(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFileDS(context.Background(), config.FileDSConfig{Directory: dir, RetentionAge: 1, RetentionSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	write := func(name string, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, make([]byte, 100), 0o644)
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+		return path
+	}
+	expired := write("expired.jsonl", 2*time.Hour)
+	older := write("older.jsonl", 30*time.Minute)
+	newer := write("newer.jsonl", time.Minute)
+
+	f.applyRetention(now)
+
+	for path, exists := range map[string]bool{expired: false, older: false, newer: true} {
+		if _, err := os.Stat(path); (err == nil) != exists {
+			t.Fatalf("%s exists=%v, expected %v", path, err == nil, exists)
+		}
+	}
+}
+
+func TestFileDSFormat(t *testing.T) {
+	for _, format := range []string{"csv", "parquet"} {
+		if _, err := NewFileDS(context.Background(), config.FileDSConfig{Directory: t.TempDir(), Format: format}); err == nil {
+			t.Fatalf("expected error for unsupported format %s", format)
+		}
+	}
+}
+
+func TestFileDSClusterFields(t *testing.T) {
+	SetCluster(config.ClusterConfig{ID: "uid-1", Name: "prod_eu", Region: "eu-west-1", Zone: "eu-west-1a"})
+	t.Cleanup(func() { SetCluster(config.ClusterConfig{}) })
+
+	dir := t.TempDir()
+	f, err := NewFileDS(context.Background(), config.FileDSConfig{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := f.write(fileRecord{stream: fileStreamRequests, v: &Request{Path: "/orders"}}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.write(fileRecord{stream: fileStreamRequests, v: struct{}{}}, now); err != nil {
+		t.Fatal(err)
+	}
+	f.closeAll()
+
+	files, _ := filepath.Glob(filepath.Join(dir, fileStreamRequests, "*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("expected one file, got %v", files)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for i := 0; s.Scan(); i++ {
+		var r struct {
+			Path        string
+			ClusterID   string `json:"cluster_id"`
+			ClusterName string `json:"cluster_name"`
+			Region      string `json:"region"`
+			Zone        string `json:"zone"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("invalid line %s: %v", s.Text(), err)
+		}
+		if r.ClusterID != "uid-1" || r.ClusterName != "prod_eu" || r.Region != "eu-west-1" || r.Zone != "eu-west-1a" {
+			t.Fatalf("missing cluster fields in %s", s.Text())
+		}
+		if i == 0 && r.Path != "/orders" {
+			t.Fatalf("record fields lost in %s", s.Text())
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/log"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	kafkaDefaultRequestsTopic    = "alaz.requests"
+	kafkaDefaultKafkaEventsTopic = "alaz.kafka_events"
+	kafkaDefaultConnectionsTopic = "alaz.connections"
+	kafkaDefaultResourcesTopic   = "alaz.resources"
+	kafkaDefaultBatchSize        = 1000
+	kafkaDefaultFlushInterval    = 500 * time.Millisecond
+	kafkaDefaultMaxRetries       = 5
+)
+
+// KafkaDS publishes events as JSON to kafka topics.
+// Messages are keyed by the source workload, so events of a workload stay in order on one partition.
+// Trace events are not published.
+type KafkaDS struct {
+	ctx      context.Context
+	producer sarama.AsyncProducer
+
+	// publishing holds the read lock, input of the producer is closed once closed is set
+	closeMu sync.RWMutex
+	closed  bool
+
+	requestsTopic    string
+	kafkaEventsTopic string
+	connectionsTopic string
+	resourcesTopic   string
+
+	workloadsMu sync.RWMutex
+	workloads   map[string]string // pod or service uid -> namespace/workload
+	rsOwners    map[string]string // replicaset uid -> deployment name
+
+	done chan struct{}
+}
+
+func NewKafkaDS(parentCtx context.Context, conf config.KafkaDSConfig) (*KafkaDS, error) {
+	if len(conf.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers are not set")
+	}
+	saramaConf, err := newSaramaConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewAsyncProducer(conf.Brokers, saramaConf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kafka producer: %w", err)
+	}
+	return newKafkaDS(parentCtx, conf, producer), nil
+}
+
+func newSaramaConfig(conf config.KafkaDSConfig) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+	if conf.ClientID != "" {
+		c.ClientID = conf.ClientID
+	}
+
+	switch conf.Compression {
+	case "", "none":
+		c.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		c.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		c.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		c.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		c.Producer.Compression = sarama.CompressionZSTD
+		c.Version = sarama.V2_1_0_0 // zstd needs produce request v7
+	default:
+		return nil, fmt.Errorf("unknown kafka compression %s", conf.Compression)
+	}
+
+	c.Producer.Flush.Messages = conf.BatchSize
+	if c.Producer.Flush.Messages <= 0 {
+		c.Producer.Flush.Messages = kafkaDefaultBatchSize
+	}
+	c.Producer.Flush.Frequency = time.Duration(conf.FlushInterval) * time.Millisecond
+	if c.Producer.Flush.Frequency <= 0 {
+		c.Producer.Flush.Frequency = kafkaDefaultFlushInterval
+	}
+	c.Producer.Retry.Max = conf.MaxRetries
+	if c.Producer.Retry.Max <= 0 {
+		c.Producer.Retry.Max = kafkaDefaultMaxRetries
+	}
+	// exponential backoff between retries, capped at 5s
+	c.Producer.Retry.BackoffFunc = func(retries, maxRetries int) time.Duration {
+		backoff := 100 * time.Millisecond << retries
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+		return backoff
+	}
+	c.Producer.RequiredAcks = sarama.WaitForLocal
+	c.Producer.Return.Successes = false
+	c.Producer.Return.Errors = true
+
+	return c, c.Validate()
+}
+
+func newKafkaDS(ctx context.Context, conf config.KafkaDSConfig, producer sarama.AsyncProducer) *KafkaDS {
+	topic := func(t, def string) string {
+		if t == "" {
+			return def
+		}
+		return t
+	}
+	return &KafkaDS{
+		ctx:              ctx,
+		producer:         producer,
+		requestsTopic:    topic(conf.RequestsTopic, kafkaDefaultRequestsTopic),
+		kafkaEventsTopic: topic(conf.KafkaEventsTopic, kafkaDefaultKafkaEventsTopic),
+		connectionsTopic: topic(conf.ConnectionsTopic, kafkaDefaultConnectionsTopic),
+		resourcesTopic:   topic(conf.ResourcesTopic, kafkaDefaultResourcesTopic),
+		workloads:        map[string]string{},
+		rsOwners:         map[string]string{},
+		done:             make(chan struct{}),
+	}
+}
+
+func (k *KafkaDS) Start() {
+	go func() {
+		for err := range k.producer.Errors() {
+			log.Logger.Error().Err(err.Err).Str("topic", err.Msg.Topic).Msg("error publishing to kafka")
+		}
+	}()
+	go func() {
+		<-k.ctx.Done()
+		// publishers blocked on input return on ctx, no one sends after this
+		k.closeMu.Lock()
+		k.closed = true
+		k.closeMu.Unlock()
+
+		// flushes buffered messages and closes the errors channel
+		if err := k.producer.Close(); err != nil {
+			log.Logger.Error().Err(err).Msg("error closing kafka producer")
+		}
+		log.Logger.Info().Msg("kafka producer stopped")
+		close(k.done)
+	}()
+}
+
+// Done is closed when buffered messages are flushed after the context is cancelled
+func (k *KafkaDS) Done() <-chan struct{} {
+	return k.done
+}
+
+func (k *KafkaDS) publish(topic, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(b), Headers: clusterHeaders()}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+
+	k.closeMu.RLock()
+	defer k.closeMu.RUnlock()
+	if k.closed || k.ctx.Err() != nil {
+		return nil
+	}
+	select {
+	case k.producer.Input() <- msg:
+	case <-k.ctx.Done():
+	}
+	return nil
+}
+
+// clusterHeaders tell apart records of clusters sharing topics
+func clusterHeaders() []sarama.RecordHeader {
+	c := Cluster()
+	var headers []sarama.RecordHeader
+	for _, kv := range [][2]string{
+		{"cluster_id", c.ID}, {"cluster_name", c.Name}, {"region", c.Region}, {"zone", c.Zone}, {"node_id", NodeID},
+	} {
+		if kv[1] != "" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(kv[0]), Value: []byte(kv[1])})
+		}
+	}
+	return headers
+}
+
+// workloadKey returns namespace/workload of a pod or service, uid if it is not known yet
+func (k *KafkaDS) workloadKey(uid string) string {
+	k.workloadsMu.RLock()
+	defer k.workloadsMu.RUnlock()
+	if w, ok := k.workloads[uid]; ok {
+		return w
+	}
+	return uid
+}
+
+func (k *KafkaDS) setWorkload(uid, namespace, name string, eventType string) {
+	k.workloadsMu.Lock()
+	defer k.workloadsMu.Unlock()
+	if eventType == "DELETE" {
+		delete(k.workloads, uid)
+		return
+	}
+	k.workloads[uid] = namespace + "/" + name
+}
+
+func (k *KafkaDS) persistResource(kind, key string, v interface{}, eventType string) error {
+	return k.publish(k.resourcesTopic, key, resourceEvent{Kind: kind, Event: eventType, Time: time.Now().UnixMilli(), Data: v})
+}
+
+func (k *KafkaDS) PersistPod(pod Pod, eventType string) error {
+	workload := pod.Name
+	if pod.OwnerName != "" {
+		workload = pod.OwnerName
+		if pod.OwnerType == "ReplicaSet" {
+			k.workloadsMu.RLock()
+			if d, ok := k.rsOwners[pod.OwnerID]; ok {
+				workload = d
+			} else if i := strings.LastIndex(pod.OwnerName, "-"); i > 0 {
+				workload = pod.OwnerName[:i]
+			}
+			k.workloadsMu.RUnlock()
+		}
+	}
+	k.setWorkload(pod.UID, pod.Namespace, workload, eventType)
+	return k.persistResource("Pod", pod.Namespace+"/"+workload, pod, eventType)
+}
+
+func (k *KafkaDS) PersistService(service Service, eventType string) error {
+	k.setWorkload(service.UID, service.Namespace, service.Name, eventType)
+	return k.persistResource("Service", service.Namespace+"/"+service.Name, service, eventType)
+}
+
+func (k *KafkaDS) PersistReplicaSet(rs ReplicaSet, eventType string) error {
+	k.workloadsMu.Lock()
+	if eventType == "DELETE" {
+		delete(k.rsOwners, rs.UID)
+	} else if rs.OwnerType == "Deployment" {
+		k.rsOwners[rs.UID] = rs.OwnerName
+	}
+	k.workloadsMu.Unlock()
+	return k.persistResource("ReplicaSet", rs.Namespace+"/"+rs.Name, rs, eventType)
+}
+
+func (k *KafkaDS) PersistDeployment(d Deployment, eventType string) error {
+	return k.persistResource("Deployment", d.Namespace+"/"+d.Name, d, eventType)
+}
+
+func (k *KafkaDS) PersistEndpoints(e Endpoints, eventType string) error {
+	return k.persistResource("Endpoints", e.Namespace+"/"+e.Name, e, eventType)
+}
+
+func (k *KafkaDS) PersistContainer(c Container, eventType string) error {
+	return k.persistResource("Container", k.workloadKey(c.PodUID), c, eventType)
+}
+
+func (k *KafkaDS) PersistDaemonSet(ds DaemonSet, eventType string) error {
+	return k.persistResource("DaemonSet", ds.Namespace+"/"+ds.Name, ds, eventType)
+}
+
+func (k *KafkaDS) PersistStatefulSet(ss StatefulSet, eventType string) error {
+	return k.persistResource("StatefulSet", ss.Namespace+"/"+ss.Name, ss, eventType)
+}
+
+func (k *KafkaDS) PersistRequest(request *Request) error {
+	return k.publish(k.requestsTopic, k.workloadKey(request.FromUID), request)
+}
+
+func (k *KafkaDS) PersistKafkaEvent(ke *KafkaEvent) error {
+	return k.publish(k.kafkaEventsTopic, k.workloadKey(ke.FromUID), ke)
+}
+
+func (k *KafkaDS) PersistAliveConnection(aliveConn *AliveConnection) error {
+	return k.publish(k.connectionsTopic, k.workloadKey(aliveConn.FromUID), aliveConn)
+}
+
+// trace events are only used by backend to build distributed traces
+func (k *KafkaDS) PersistTraceEvent(trace *l7_req.TraceEvent) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/ddosify/alaz/config"
+)
+
+func TestKafkaDSTopicsAndKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	saramaConf, err := newSaramaConfig(config.KafkaDSConfig{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := mocks.NewAsyncProducer(t, saramaConf)
+
+	type published struct{ topic, key string }
+	var got []published
+	check := func(msg *sarama.ProducerMessage) error {
+		key, _ := msg.Key.Encode()
+		got = append(got, published{msg.Topic, string(key)})
+		return nil
+	}
+	for i := 0; i < 4; i++ {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(check)
+	}
+
+	k := newKafkaDS(ctx, config.KafkaDSConfig{RequestsTopic: "reqs"}, producer)
+	k.PersistReplicaSet(ReplicaSet{UID: "rs-1", Name: "frontend-6d4b7c", Namespace: "shop", OwnerType: "Deployment", OwnerName: "frontend"}, "ADD")
+	k.PersistPod(Pod{UID: "pod-a", Name: "frontend-6d4b7c-x2x", Namespace: "shop", OwnerType: "ReplicaSet", OwnerID: "rs-1", OwnerName: "frontend-6d4b7c"}, "ADD")
+	k.PersistRequest(&Request{FromUID: "pod-a", ToUID: "svc-b", Path: "/orders"})
+	k.PersistRequest(&Request{FromUID: "unknown"})
+
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []published{
+		{kafkaDefaultResourcesTopic, "shop/frontend-6d4b7c"},
+		{kafkaDefaultResourcesTopic, "shop/frontend"},
+		{"reqs", "shop/frontend"},
+		{"reqs", "unknown"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+// publishes through a real producer to a mock broker
+func TestKafkaDSMockBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(kafkaDefaultRequestsTopic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k, err := NewKafkaDS(ctx, config.KafkaDSConfig{Brokers: []string{broker.Addr()}, Compression: "snappy", BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Start()
+
+	r := &Request{FromUID: "pod-a", Method: "GET", Path: "/orders"}
+	k.PersistRequest(r)
+	k.PersistRequest(r)
+
+	waitFor(t, func() bool {
+		for _, rr := range broker.History() {
+			if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+				return true
+			}
+		}
+		return false
+	})
+	cancel()
+}
+
+// publishing while the producer is closed must not send on its closed input
+func TestKafkaDSPublishWhileClosing(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(kafkaDefaultRequestsTopic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k, err := NewKafkaDS(ctx, config.KafkaDSConfig{Brokers: []string{broker.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				k.PersistRequest(&Request{FromUID: "pod-a"})
+			}
+		}()
+	}
+	cancel()
+	<-k.Done()
+	wg.Wait()
+}
+
+func TestKafkaDSUnknownCompression(t *testing.T) {
+	if _, err := newSaramaConfig(config.KafkaDSConfig{Compression: "brotli"}); err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+}
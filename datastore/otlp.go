@@ -0,0 +1,545 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/log"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+const (
+	otlpScopeName          = "github.com/ddosify/alaz"
+	otlpAliveConnsMetric   = "alaz.connections.alive"
+	otlpDefaultBatchSize   = 1000
+	otlpDefaultFlushPeriod = 5 * time.Second
+	otlpDefaultBufferSize  = 40000
+
+	// values of FromType/ToType set by aggregator
+	otlpTypePod     = "pod"
+	otlpTypeService = "service"
+)
+
+// OtlpDS exports requests and kafka events as spans, and alive connections as metrics
+// to an OpenTelemetry collector over OTLP gRPC or HTTP/protobuf.
+// Kubernetes resources are not exported, they are kept to fill resource attributes of spans.
+type OtlpDS struct {
+	ctx           context.Context
+	exporter      otlpExporter
+	batchSize     int
+	flushInterval time.Duration
+
+	spanChan chan *otlpSpan
+	connChan chan *AliveConnection
+
+	resourcesMu sync.RWMutex
+	resources   map[string]otlpResource // pod or service uid -> resource
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+type otlpResource struct {
+	serviceName string
+	namespace   string
+	podName     string
+	podUid      string
+}
+
+type otlpSpan struct {
+	resource otlpResource
+	span     *tracepb.Span
+}
+
+type otlpConnKey struct {
+	fromUID, fromType, toUID, toType string
+	toPort                           uint16
+}
+
+func NewOtlpDS(parentCtx context.Context, conf config.OtlpDSConfig) (*OtlpDS, error) {
+	exporter, err := newOtlpExporter(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newOtlpDS(parentCtx, conf, exporter), nil
+}
+
+func newOtlpDS(ctx context.Context, conf config.OtlpDSConfig, exporter otlpExporter) *OtlpDS {
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = otlpDefaultBatchSize
+	}
+	flushInterval := time.Duration(conf.FlushInterval) * time.Second
+	if flushInterval <= 0 {
+		flushInterval = otlpDefaultFlushPeriod
+	}
+	bufferSize := conf.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = otlpDefaultBufferSize
+	}
+
+	return &OtlpDS{
+		ctx:           ctx,
+		exporter:      exporter,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		spanChan:      make(chan *otlpSpan, bufferSize),
+		connChan:      make(chan *AliveConnection, bufferSize),
+		resources:     map[string]otlpResource{},
+		done:          make(chan struct{}),
+	}
+}
+
+func (o *OtlpDS) Start() {
+	o.wg.Add(2)
+	go o.sendSpansInBatch()
+	go o.sendConnMetrics()
+	go func() {
+		o.wg.Wait()
+		o.exporter.close()
+		log.Logger.Info().Msg("otlp exporter stopped")
+		close(o.done)
+	}()
+}
+
+// Done is closed when buffered spans and metrics are exported after the context is cancelled
+func (o *OtlpDS) Done() <-chan struct{} {
+	return o.done
+}
+
+func (o *OtlpDS) sendSpansInBatch() {
+	defer o.wg.Done()
+	t := time.NewTicker(o.flushInterval)
+	defer t.Stop()
+
+	batch := make([]*otlpSpan, 0, o.batchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := o.exporter.exportTraces(ctx, buildTraceRequest(batch)); err != nil {
+			log.Logger.Error().Err(err).Int("spans", len(batch)).Msg("error exporting spans to otlp collector")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-o.ctx.Done():
+			ctx, cancel := flushContext(o.ctx)
+			defer cancel()
+			for len(o.spanChan) > 0 {
+				batch = append(batch, <-o.spanChan)
+				if len(batch) >= o.batchSize {
+					flush(ctx)
+				}
+			}
+			flush(ctx)
+			return
+		case s := <-o.spanChan:
+			batch = append(batch, s)
+			if len(batch) >= o.batchSize {
+				flush(o.ctx)
+			}
+		case <-t.C:
+			flush(o.ctx)
+		}
+	}
+}
+
+// alive connections are counted per edge and exported as a gauge on each flush
+func (o *OtlpDS) sendConnMetrics() {
+	defer o.wg.Done()
+	t := time.NewTicker(o.flushInterval)
+	defer t.Stop()
+
+	counts := map[otlpConnKey]int64{}
+	count := func(c *AliveConnection) {
+		counts[otlpConnKey{fromUID: c.FromUID, fromType: c.FromType, toUID: c.ToUID, toType: c.ToType, toPort: c.ToPort}]++
+	}
+	export := func(ctx context.Context, now time.Time) {
+		if len(counts) == 0 {
+			return
+		}
+		if err := o.exporter.exportMetrics(ctx, o.buildConnMetricsRequest(counts, now)); err != nil {
+			log.Logger.Error().Err(err).Msg("error exporting connection metrics to otlp collector")
+		}
+		counts = map[otlpConnKey]int64{}
+	}
+
+	for {
+		select {
+		case <-o.ctx.Done():
+			for len(o.connChan) > 0 {
+				count(<-o.connChan)
+			}
+			ctx, cancel := flushContext(o.ctx)
+			defer cancel()
+			export(ctx, time.Now())
+			return
+		case c := <-o.connChan:
+			count(c)
+		case now := <-t.C:
+			export(o.ctx, now)
+		}
+	}
+}
+
+func (o *OtlpDS) PersistRequest(request *Request) error {
+	for _, s := range o.requestSpans(request) {
+		o.spanChan <- s
+	}
+	return nil
+}
+
+func (o *OtlpDS) PersistKafkaEvent(ke *KafkaEvent) error {
+	o.spanChan <- o.kafkaSpan(ke)
+	return nil
+}
+
+func (o *OtlpDS) PersistAliveConnection(aliveConn *AliveConnection) error {
+	o.connChan <- aliveConn
+	return nil
+}
+
+// trace events are used by alaz backend to stitch distributed traces, they have no otlp counterpart
+func (o *OtlpDS) PersistTraceEvent(trace *l7_req.TraceEvent) error {
+	return nil
+}
+
+func (o *OtlpDS) PersistPod(pod Pod, eventType string) error {
+	if eventType == "DELETE" {
+		o.deleteResource(pod.UID)
+		return nil
+	}
+
+	name := pod.Name
+	switch pod.OwnerType {
+	case "ReplicaSet":
+		// pod-template-hash suffix
+		if i := strings.LastIndexByte(pod.OwnerName, '-'); i > 0 {
+			name = pod.OwnerName[:i]
+		}
+	case "":
+	default:
+		name = pod.OwnerName
+	}
+
+	o.setResource(pod.UID, otlpResource{serviceName: name, namespace: pod.Namespace, podName: pod.Name, podUid: pod.UID})
+	return nil
+}
+
+func (o *OtlpDS) PersistService(service Service, eventType string) error {
+	if eventType == "DELETE" {
+		o.deleteResource(service.UID)
+		return nil
+	}
+	o.setResource(service.UID, otlpResource{serviceName: service.Name, namespace: service.Namespace})
+	return nil
+}
+
+func (o *OtlpDS) PersistReplicaSet(rs ReplicaSet, eventType string) error   { return nil }
+func (o *OtlpDS) PersistDeployment(d Deployment, eventType string) error    { return nil }
+func (o *OtlpDS) PersistEndpoints(e Endpoints, eventType string) error      { return nil }
+func (o *OtlpDS) PersistContainer(c Container, eventType string) error      { return nil }
+func (o *OtlpDS) PersistDaemonSet(ds DaemonSet, eventType string) error     { return nil }
+func (o *OtlpDS) PersistStatefulSet(ss StatefulSet, eventType string) error { return nil }
+
+func (o *OtlpDS) setResource(uid string, r otlpResource) {
+	o.resourcesMu.Lock()
+	o.resources[uid] = r
+	o.resourcesMu.Unlock()
+}
+
+func (o *OtlpDS) deleteResource(uid string) {
+	o.resourcesMu.Lock()
+	delete(o.resources, uid)
+	o.resourcesMu.Unlock()
+}
+
+func (o *OtlpDS) resourceOf(uid string) otlpResource {
+	o.resourcesMu.RLock()
+	r, ok := o.resources[uid]
+	o.resourcesMu.RUnlock()
+	if !ok {
+		// not known yet or outbound, uid is an ip or hostname in that case
+		return otlpResource{serviceName: uid}
+	}
+	return r
+}
+
+// requestSpans maps a request to a client span on the source side,
+// and a server span on the destination side if destination is inside the cluster
+func (o *OtlpDS) requestSpans(r *Request) []*otlpSpan {
+	start := uint64(r.StartTime) * uint64(time.Millisecond)
+	end := start + r.Latency
+
+	traceId := newOtlpId(16)
+	clientSpanId := newOtlpId(8)
+
+	attrs := requestAttributes(r)
+	status := requestStatus(r)
+	name := requestSpanName(r)
+
+	spans := []*otlpSpan{{
+		resource: o.resourceOf(r.FromUID),
+		span: &tracepb.Span{
+			TraceId:           traceId,
+			SpanId:            clientSpanId,
+			Name:              name,
+			Kind:              tracepb.Span_SPAN_KIND_CLIENT,
+			StartTimeUnixNano: start,
+			EndTimeUnixNano:   end,
+			Attributes:        attrs,
+			Status:            status,
+		},
+	}}
+
+	if r.ToType == otlpTypePod || r.ToType == otlpTypeService {
+		spans = append(spans, &otlpSpan{
+			resource: o.resourceOf(r.ToUID),
+			span: &tracepb.Span{
+				TraceId:           traceId,
+				SpanId:            newOtlpId(8),
+				ParentSpanId:      clientSpanId,
+				Name:              name,
+				Kind:              tracepb.Span_SPAN_KIND_SERVER,
+				StartTimeUnixNano: start,
+				EndTimeUnixNano:   end,
+				Attributes:        attrs,
+				Status:            status,
+			},
+		})
+	}
+	return spans
+}
+
+func (o *OtlpDS) kafkaSpan(ke *KafkaEvent) *otlpSpan {
+	start := uint64(ke.StartTime) * uint64(time.Millisecond)
+
+	kind := tracepb.Span_SPAN_KIND_PRODUCER
+	operation := "publish"
+	if ke.Type == "CONSUME" {
+		kind = tracepb.Span_SPAN_KIND_CONSUMER
+		operation = "receive"
+	}
+
+	return &otlpSpan{
+		resource: o.resourceOf(ke.FromUID),
+		span: &tracepb.Span{
+			TraceId:           newOtlpId(16),
+			SpanId:            newOtlpId(8),
+			Name:              ke.Topic + " " + operation,
+			Kind:              kind,
+			StartTimeUnixNano: start,
+			EndTimeUnixNano:   start + ke.Latency,
+			Attributes: []*commonpb.KeyValue{
+				otlpString("messaging.system", "kafka"),
+				otlpString("messaging.operation", operation),
+				otlpString("messaging.destination.name", ke.Topic),
+				otlpInt("messaging.kafka.destination.partition", int64(ke.Partition)),
+				otlpString("messaging.kafka.message.key", ke.Key),
+				otlpString("server.address", ke.ToIP),
+				otlpInt("server.port", int64(ke.ToPort)),
+				otlpBool("alaz.tls", ke.Tls),
+			},
+		},
+	}
+}
+
+func requestSpanName(r *Request) string {
+	switch r.Protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2:
+		if r.Path != "" {
+			return r.Method + " " + r.Path
+		}
+	case "gRPC":
+		return r.Path
+	}
+	if r.Method != "" {
+		return r.Method
+	}
+	return r.Protocol
+}
+
+func requestAttributes(r *Request) []*commonpb.KeyValue {
+	attrs := []*commonpb.KeyValue{
+		otlpString("network.protocol.name", strings.ToLower(r.Protocol)),
+		otlpString("client.address", r.FromIP),
+		otlpInt("client.port", int64(r.FromPort)),
+		otlpString("server.address", r.ToIP),
+		otlpInt("server.port", int64(r.ToPort)),
+		otlpString("alaz.from.uid", r.FromUID),
+		otlpString("alaz.from.type", r.FromType),
+		otlpString("alaz.to.uid", r.ToUID),
+		otlpString("alaz.to.type", r.ToType),
+		otlpBool("alaz.tls", r.Tls),
+	}
+
+	switch r.Protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2:
+		attrs = append(attrs,
+			otlpString("http.request.method", r.Method),
+			otlpString("url.path", r.Path),
+			otlpInt("http.response.status_code", int64(r.StatusCode)),
+		)
+	case "gRPC":
+		attrs = append(attrs,
+			otlpString("rpc.system", "grpc"),
+			otlpString("rpc.method", r.Path),
+			otlpInt("rpc.grpc.status_code", int64(r.StatusCode)),
+		)
+	case l7_req.L7_PROTOCOL_POSTGRES, l7_req.L7_PROTOCOL_MYSQL, l7_req.L7_PROTOCOL_REDIS:
+		attrs = append(attrs,
+			otlpString("db.system", strings.ToLower(r.Protocol)),
+			otlpString("db.operation", r.Method),
+			otlpString("db.statement", r.Path),
+		)
+	case l7_req.L7_PROTOCOL_AMQP:
+		attrs = append(attrs,
+			otlpString("messaging.system", "rabbitmq"),
+			otlpString("messaging.operation", r.Method),
+		)
+	}
+
+	if r.Probe {
+		attrs = append(attrs, otlpBool("alaz.probe", true))
+	}
+	if r.Locality != "" {
+		attrs = append(attrs, otlpString("alaz.locality", r.Locality))
+	}
+	if r.RequestSize > 0 || r.ResponseSize > 0 {
+		attrs = append(attrs,
+			otlpInt("alaz.request.size", int64(r.RequestSize)),
+			otlpInt("alaz.response.size", int64(r.ResponseSize)),
+		)
+	}
+	if r.Weight > 0 && r.Weight != 1 {
+		attrs = append(attrs, otlpDouble("alaz.sampling.weight", r.Weight))
+	}
+	return attrs
+}
+
+func requestStatus(r *Request) *tracepb.Status {
+	if r.Failed() {
+		return &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: fmt.Sprintf("status %d", r.StatusCode)}
+	}
+	return &tracepb.Status{Code: tracepb.Status_STATUS_CODE_UNSET}
+}
+
+// buildTraceRequest groups spans by their resource
+func buildTraceRequest(batch []*otlpSpan) *coltracepb.ExportTraceServiceRequest {
+	byResource := map[otlpResource]*tracepb.ScopeSpans{}
+	req := &coltracepb.ExportTraceServiceRequest{}
+
+	for _, s := range batch {
+		ss, ok := byResource[s.resource]
+		if !ok {
+			ss = &tracepb.ScopeSpans{Scope: &commonpb.InstrumentationScope{Name: otlpScopeName}}
+			byResource[s.resource] = ss
+			req.ResourceSpans = append(req.ResourceSpans, &tracepb.ResourceSpans{
+				Resource:   s.resource.toProto(),
+				ScopeSpans: []*tracepb.ScopeSpans{ss},
+			})
+		}
+		ss.Spans = append(ss.Spans, s.span)
+	}
+	return req
+}
+
+func (o *OtlpDS) buildConnMetricsRequest(counts map[otlpConnKey]int64, now time.Time) *colmetricspb.ExportMetricsServiceRequest {
+	byResource := map[otlpResource]*metricspb.Gauge{}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+
+	for k, count := range counts {
+		res := o.resourceOf(k.fromUID)
+		gauge, ok := byResource[res]
+		if !ok {
+			gauge = &metricspb.Gauge{}
+			byResource[res] = gauge
+			req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+				Resource: res.toProto(),
+				ScopeMetrics: []*metricspb.ScopeMetrics{{
+					Scope: &commonpb.InstrumentationScope{Name: otlpScopeName},
+					Metrics: []*metricspb.Metric{{
+						Name:        otlpAliveConnsMetric,
+						Description: "number of alive tcp connections observed between two endpoints",
+						Unit:        "{connection}",
+						Data:        &metricspb.Metric_Gauge{Gauge: gauge},
+					}},
+				}},
+			})
+		}
+
+		gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+			TimeUnixNano: uint64(now.UnixNano()),
+			Value:        &metricspb.NumberDataPoint_AsInt{AsInt: count},
+			Attributes: []*commonpb.KeyValue{
+				otlpString("alaz.from.uid", k.fromUID),
+				otlpString("alaz.from.type", k.fromType),
+				otlpString("alaz.to.uid", k.toUID),
+				otlpString("alaz.to.type", k.toType),
+				otlpString("alaz.to.service", o.resourceOf(k.toUID).serviceName),
+				otlpInt("server.port", int64(k.toPort)),
+			},
+		})
+	}
+	return req
+}
+
+func (r otlpResource) toProto() *resourcepb.Resource {
+	attrs := []*commonpb.KeyValue{otlpString("service.name", r.serviceName)}
+	if r.namespace != "" {
+		attrs = append(attrs, otlpString("k8s.namespace.name", r.namespace))
+	}
+	if r.podName != "" {
+		attrs = append(attrs, otlpString("k8s.pod.name", r.podName), otlpString("k8s.pod.uid", r.podUid))
+	}
+	c := Cluster()
+	for _, kv := range [][2]string{
+		{"k8s.cluster.uid", c.ID}, {"k8s.cluster.name", c.Name},
+		{"cloud.region", c.Region}, {"cloud.availability_zone", c.Zone},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, otlpString(kv[0], kv[1]))
+		}
+	}
+	return &resourcepb.Resource{Attributes: attrs}
+}
+
+func newOtlpId(size int) []byte {
+	id := make([]byte, size)
+	for i := 0; i < size; i += 8 {
+		binary.BigEndian.PutUint64(id[i:], rand.Uint64())
+	}
+	return id
+}
+
+func otlpString(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+func otlpInt(k string, v int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}}
+}
+
+func otlpDouble(k string, v float64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}}
+}
+
+func otlpBool(k string, v bool) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}}
+}
@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	OtlpProtocolGrpc = "grpc"
+	OtlpProtocolHttp = "http"
+
+	otlpTracesPath  = "/v1/traces"
+	otlpMetricsPath = "/v1/metrics"
+)
+
+type otlpExporter interface {
+	exportTraces(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error
+	exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	close() error
+}
+
+func newOtlpExporter(conf config.OtlpDSConfig) (otlpExporter, error) {
+	switch strings.ToLower(conf.Protocol) {
+	case OtlpProtocolGrpc, "":
+		return newOtlpGrpcExporter(conf)
+	case OtlpProtocolHttp:
+		return newOtlpHttpExporter(conf), nil
+	default:
+		return nil, fmt.Errorf("unknown otlp protocol %s", conf.Protocol)
+	}
+}
+
+type otlpGrpcExporter struct {
+	conn    *grpc.ClientConn
+	traces  coltracepb.TraceServiceClient
+	metrics colmetricspb.MetricsServiceClient
+	md      metadata.MD
+}
+
+func newOtlpGrpcExporter(conf config.OtlpDSConfig) (*otlpGrpcExporter, error) {
+	creds := insecure.NewCredentials()
+	if !conf.Insecure {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	// dial is non-blocking, connection is established on first export
+	conn, err := grpc.Dial(conf.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("could not dial otlp endpoint %s: %w", conf.Endpoint, err)
+	}
+
+	return &otlpGrpcExporter{
+		conn:    conn,
+		traces:  coltracepb.NewTraceServiceClient(conn),
+		metrics: colmetricspb.NewMetricsServiceClient(conn),
+		md:      metadata.New(conf.Headers),
+	}, nil
+}
+
+func (e *otlpGrpcExporter) exportTraces(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	resp, err := e.traces.Export(metadata.NewOutgoingContext(ctx, e.md), req)
+	if err != nil {
+		return err
+	}
+	if ps := resp.GetPartialSuccess(); ps != nil && ps.RejectedSpans > 0 {
+		return fmt.Errorf("otlp collector rejected %d spans: %s", ps.RejectedSpans, ps.ErrorMessage)
+	}
+	return nil
+}
+
+func (e *otlpGrpcExporter) exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	resp, err := e.metrics.Export(metadata.NewOutgoingContext(ctx, e.md), req)
+	if err != nil {
+		return err
+	}
+	if ps := resp.GetPartialSuccess(); ps != nil && ps.RejectedDataPoints > 0 {
+		return fmt.Errorf("otlp collector rejected %d data points: %s", ps.RejectedDataPoints, ps.ErrorMessage)
+	}
+	return nil
+}
+
+func (e *otlpGrpcExporter) close() error {
+	return e.conn.Close()
+}
+
+// otlpHttpExporter sends binary protobuf encoded payloads, as in OTLP/HTTP spec
+type otlpHttpExporter struct {
+	endpoint string
+	headers  map[string]string
+	c        *http.Client
+}
+
+func newOtlpHttpExporter(conf config.OtlpDSConfig) *otlpHttpExporter {
+	return &otlpHttpExporter{
+		endpoint: strings.TrimSuffix(conf.Endpoint, "/"),
+		headers:  conf.Headers,
+		c:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *otlpHttpExporter) exportTraces(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	return e.post(ctx, otlpTracesPath, req)
+}
+
+func (e *otlpHttpExporter) exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	return e.post(ctx, otlpMetricsPath, req)
+}
+
+func (e *otlpHttpExporter) post(ctx context.Context, path string, m proto.Message) error {
+	body, err := proto.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal otlp payload: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := e.c.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		rb, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("otlp export to %s failed with status %d: %s", path, resp.StatusCode, string(rb))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (e *otlpHttpExporter) close() error {
+	e.c.CloseIdleConnections()
+	return nil
+}
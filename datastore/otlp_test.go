@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCollector stands in for an OpenTelemetry collector
+type fakeCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	mu      sync.Mutex
+	traces  []*coltracepb.ExportTraceServiceRequest
+	metrics []*colmetricspb.ExportMetricsServiceRequest
+}
+
+func (c *fakeCollector) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.traces = append(c.traces, req)
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+type fakeMetricsService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	c *fakeCollector
+}
+
+func (m *fakeMetricsService) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	m.c.metrics = append(m.c.metrics, req)
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (c *fakeCollector) spans() []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []*tracepb.Span
+	for _, req := range c.traces {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func (c *fakeCollector) metricCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.metrics)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for condition")
+}
+
+func persistSampleData(ds *OtlpDS) {
+	ds.PersistPod(Pod{UID: "pod-a", Name: "frontend-6d4b7c-x2x", Namespace: "shop", OwnerType: "ReplicaSet", OwnerName: "frontend-6d4b7c"}, "ADD")
+	ds.PersistService(Service{UID: "svc-b", Name: "orders", Namespace: "shop"}, "ADD")
+
+	ds.PersistRequest(&Request{
+		StartTime:  time.Now().UnixMilli(),
+		Latency:    uint64(5 * time.Millisecond),
+		FromIP:     "10.0.0.1",
+		FromType:   "pod",
+		FromUID:    "pod-a",
+		ToIP:       "10.0.0.2",
+		ToType:     "service",
+		ToUID:      "svc-b",
+		ToPort:     8080,
+		Protocol:   "HTTP",
+		Method:     "GET",
+		Path:       "/orders",
+		StatusCode: 503,
+	})
+	ds.PersistKafkaEvent(&KafkaEvent{StartTime: time.Now().UnixMilli(), FromUID: "pod-a", Topic: "orders", Type: "PUBLISH"})
+	ds.PersistAliveConnection(&AliveConnection{FromUID: "pod-a", FromType: "pod", ToUID: "svc-b", ToType: "service", ToPort: 8080})
+}
+
+func checkSpans(t *testing.T, spans []*tracepb.Span) {
+	kinds := map[tracepb.Span_SpanKind]*tracepb.Span{}
+	for _, s := range spans {
+		kinds[s.Kind] = s
+	}
+
+	client, server := kinds[tracepb.Span_SPAN_KIND_CLIENT], kinds[tracepb.Span_SPAN_KIND_SERVER]
+	if client == nil || server == nil || kinds[tracepb.Span_SPAN_KIND_PRODUCER] == nil {
+		t.Fatalf("expected client, server and producer spans, got %v", kinds)
+	}
+	if string(server.ParentSpanId) != string(client.SpanId) || string(server.TraceId) != string(client.TraceId) {
+		t.Fatalf("server span must be child of client span")
+	}
+	if client.Name != "GET /orders" {
+		t.Fatalf("unexpected span name %s", client.Name)
+	}
+	if client.Status.Code != tracepb.Status_STATUS_CODE_ERROR {
+		t.Fatalf("expected 503 to be an error span")
+	}
+}
+
+func TestOtlpGrpcExport(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &fakeCollector{}
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, collector)
+	colmetricspb.RegisterMetricsServiceServer(srv, &fakeMetricsService{c: collector})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, err := NewOtlpDS(ctx, config.OtlpDSConfig{Endpoint: lis.Addr().String(), Protocol: OtlpProtocolGrpc, Insecure: true, FlushInterval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Start()
+	persistSampleData(ds)
+
+	waitFor(t, func() bool { return len(collector.spans()) == 3 && collector.metricCount() > 0 })
+	checkSpans(t, collector.spans())
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for _, rs := range collector.traces[0].ResourceSpans {
+		for _, kv := range rs.Resource.Attributes {
+			if kv.Key == "service.name" && kv.Value.GetStringValue() != "frontend" && kv.Value.GetStringValue() != "orders" {
+				t.Fatalf("unexpected service.name %s", kv.Value.GetStringValue())
+			}
+		}
+	}
+}
+
+func TestOtlpHttpExport(t *testing.T) {
+	collector := &fakeCollector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case otlpTracesPath:
+			req := &coltracepb.ExportTraceServiceRequest{}
+			if err := proto.Unmarshal(body, req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			collector.Export(r.Context(), req)
+		case otlpMetricsPath:
+			req := &colmetricspb.ExportMetricsServiceRequest{}
+			if err := proto.Unmarshal(body, req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			(&fakeMetricsService{c: collector}).Export(r.Context(), req)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, err := NewOtlpDS(ctx, config.OtlpDSConfig{
+		Endpoint:      srv.URL,
+		Protocol:      OtlpProtocolHttp,
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		FlushInterval: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Start()
+	persistSampleData(ds)
+
+	waitFor(t, func() bool { return len(collector.spans()) == 3 && collector.metricCount() > 0 })
+	checkSpans(t, collector.spans())
+}
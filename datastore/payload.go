@@ -5,6 +5,10 @@ type Metadata struct {
 	IdempotencyKey string `json:"idempotency_key"`
 	NodeID         string `json:"node_id"`
 	AlazVersion    string `json:"alaz_version"`
+	ClusterID      string `json:"cluster_id,omitempty"`
+	ClusterName    string `json:"cluster_name,omitempty"`
+	Region         string `json:"region,omitempty"`
+	Zone           string `json:"zone,omitempty"`
 }
 
 type HealthCheckPayload struct {
@@ -20,6 +24,7 @@ type HealthCheckPayload struct {
 		K8sVersion    string `json:"k8s_version"`
 		CloudProvider string `json:"cloud_provider"`
 	} `json:"telemetry"`
+	Acks []CommandAck `json:"acks,omitempty"` // of commands from previous healthcheck responses
 }
 
 type EventPayload struct {
@@ -124,13 +129,55 @@ type ContainerEvent struct {
 // 15) Encrypted (bool)
 // 16) Seq
 // 17) Tid
-type ReqInfo [18]interface{}
+// 18) Probe (bool)
+// 19) Sampling Weight
+// 20) Payload
+// 21) Locality
+// 22) Request Size (bytes)
+// 23) Response Size (bytes)
+type ReqInfo [24]interface{}
 
 type RequestsPayload struct {
 	Metadata Metadata   `json:"metadata"`
 	Requests []*ReqInfo `json:"requests"`
 }
 
+// 0) Interval Start
+// 1) Interval Length (ms)
+// 2) Source Type
+// 3) Source ID
+// 4) Destination Type
+// 5) Destination ID
+// 6) Destination Port
+// 7) Protocol
+// 8) Method
+// 9) Path
+// 10) Encrypted (bool)
+// 11) Request Count (weighted)
+// 12) Error Count (weighted)
+// 13) Latency Sketch
+// 14) Locality
+// 15) Request Bytes (weighted)
+// 16) Response Bytes (weighted)
+type RequestSummaryInfo [17]interface{}
+
+// LatencySketch is a DDSketch of latencies in ns, value of bin i is
+// 2*gamma^i/(gamma+1) where gamma = (1+RelativeAccuracy)/(1-RelativeAccuracy)
+type LatencySketch struct {
+	RelativeAccuracy float64   `json:"relative_accuracy"`
+	ZeroCount        float64   `json:"zero_count"`
+	Indexes          []int32   `json:"indexes"`
+	Counts           []float64 `json:"counts"`
+	Min              float64   `json:"min"`
+	Max              float64   `json:"max"`
+	Sum              float64   `json:"sum"`
+}
+
+type RequestSummaryPayload struct {
+	Metadata  Metadata              `json:"metadata"`
+	Summaries []*RequestSummaryInfo `json:"summaries"`
+}
+
 // 0) CheckTime // connection is alive at that time
 // 1) Source IP
 // 2) Source Type
@@ -140,7 +187,10 @@ type RequestsPayload struct {
 // 6) Destination Type
 // 7) Destination ID
 // 8) Destination Port
-type ConnInfo [9]interface{}
+// 9) Locality
+// 10) Sent Bytes, since the previous check
+// 11) Received Bytes, since the previous check
+type ConnInfo [12]interface{}
 
 type ConnInfoPayload struct {
 	Metadata    Metadata    `json:"metadata"`
@@ -0,0 +1,505 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/ebpf/l7_req"
+	"github.com/ddosify/alaz/log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	pgDefaultBatchSize   = 1000
+	pgDefaultFlushPeriod = 5 * time.Second
+	pgDefaultBufferSize  = 40000
+	pgMaintainPeriod     = time.Hour
+	pgPartitionLayout    = "20060102"
+)
+
+// PostgresDS writes kubernetes resources and ebpf events to a postgres database.
+// Resources are upserted and soft deleted, requests, kafka events and connections
+// are inserted in batches using COPY into tables partitioned daily by time.
+type PostgresDS struct {
+	ctx           context.Context
+	conf          config.PostgresConfig
+	conn          *pgx.Conn
+	batchSize     int
+	flushInterval time.Duration
+	retention     int
+
+	reqChan      chan []interface{}
+	kafkaChan    chan []interface{}
+	connChan     chan []interface{}
+	resourceChan chan pgResourceOp
+
+	done chan struct{}
+}
+
+type pgResourceOp struct {
+	sql  string
+	args []interface{}
+}
+
+func NewPostgresDS(parentCtx context.Context, conf config.PostgresConfig) (*PostgresDS, error) {
+	conn, err := pgConnect(parentCtx, conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := pgMigrate(parentCtx, conn); err != nil {
+		conn.Close(parentCtx)
+		return nil, err
+	}
+
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = pgDefaultBatchSize
+	}
+	flushInterval := time.Duration(conf.FlushInterval) * time.Second
+	if flushInterval <= 0 {
+		flushInterval = pgDefaultFlushPeriod
+	}
+
+	return &PostgresDS{
+		ctx:           parentCtx,
+		conf:          conf,
+		conn:          conn,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		retention:     conf.RetentionDays,
+		reqChan:       make(chan []interface{}, pgDefaultBufferSize),
+		kafkaChan:     make(chan []interface{}, pgDefaultBufferSize),
+		connChan:      make(chan []interface{}, pgDefaultBufferSize),
+		resourceChan:  make(chan pgResourceOp, pgDefaultBufferSize),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+func pgConnString(conf config.PostgresConfig) string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(conf.Username, conf.Password),
+		Host:   net.JoinHostPort(conf.Host, conf.Port),
+		Path:   "/" + conf.DBName,
+	}
+	if conf.SSLMode != "" {
+		u.RawQuery = url.Values{"sslmode": []string{conf.SSLMode}}.Encode()
+	}
+	return u.String()
+}
+
+func pgConnect(ctx context.Context, conf config.PostgresConfig) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, pgConnString(conf))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to postgres: %w", err)
+	}
+	return conn, nil
+}
+
+func pgMigrate(ctx context.Context, conn *pgx.Conn) error {
+	// alaz pods of a daemonset start together, one of them migrates while the others wait on the lock
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, pgMigrationLockID); err != nil {
+			return fmt.Errorf("error locking schema migrations: %w", err)
+		}
+
+		_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+		if err != nil {
+			return fmt.Errorf("error creating schema_migrations table: %w", err)
+		}
+
+		var current int
+		err = tx.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+		if err != nil {
+			return fmt.Errorf("error reading schema version: %w", err)
+		}
+
+		for i := current; i < len(pgMigrations); i++ {
+			version := i + 1
+			if _, err := tx.Exec(ctx, pgMigrations[i]); err != nil {
+				return fmt.Errorf("error applying migration %d: %w", version, err)
+			}
+			// applied by another pod that did not take the lock, e.g. an older version
+			tag, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1) ON CONFLICT (version) DO NOTHING`, version)
+			if err != nil {
+				return fmt.Errorf("error recording migration %d: %w", version, err)
+			}
+			if tag.RowsAffected() == 0 {
+				log.Logger.Info().Int("version", version).Msg("postgres migration already applied")
+				continue
+			}
+			log.Logger.Info().Int("version", version).Msg("applied postgres migration")
+		}
+		return nil
+	})
+}
+
+func (p *PostgresDS) Start() {
+	go p.write()
+}
+
+// Done is closed when buffered rows are written after the context is cancelled
+func (p *PostgresDS) Done() <-chan struct{} {
+	return p.done
+}
+
+// write is the only goroutine using the connection, pgx.Conn is not safe for concurrent use
+func (p *PostgresDS) write() {
+	defer close(p.done)
+	flushTicker := time.NewTicker(p.flushInterval)
+	defer flushTicker.Stop()
+	maintainTicker := time.NewTicker(pgMaintainPeriod)
+	defer maintainTicker.Stop()
+
+	reqs := make([][]interface{}, 0, p.batchSize)
+	kafkaEvents := make([][]interface{}, 0, p.batchSize)
+	conns := make([][]interface{}, 0, p.batchSize)
+	resources := &pgx.Batch{}
+
+	flush := func(ctx context.Context) {
+		if !p.ensureConn(ctx) {
+			return
+		}
+		if resources.Len() > 0 {
+			if err := p.conn.SendBatch(ctx, resources).Close(); err != nil {
+				log.Logger.Error().Err(err).Int("ops", resources.Len()).Msg("error upserting resources to postgres")
+			}
+			resources = &pgx.Batch{}
+		}
+		reqs = p.copy(ctx, "requests", pgRequestColumns, reqs)
+		kafkaEvents = p.copy(ctx, "kafka_events", pgKafkaEventColumns, kafkaEvents)
+		conns = p.copy(ctx, "connections", pgConnectionColumns, conns)
+	}
+
+	queueResource := func(ctx context.Context, op pgResourceOp) {
+		resources.Queue(op.sql, op.args...)
+		if resources.Len() >= p.batchSize {
+			flush(ctx)
+		}
+	}
+	appendRow := func(ctx context.Context, rows *[][]interface{}, row []interface{}) {
+		*rows = append(*rows, row)
+		if len(*rows) >= p.batchSize {
+			flush(ctx)
+		}
+	}
+
+	if p.ensureConn(p.ctx) {
+		p.maintainPartitions(time.Now())
+	}
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			// write what is left in the buffers before closing
+			ctx, cancel := flushContext(p.ctx)
+			defer cancel()
+			for len(p.resourceChan) > 0 {
+				queueResource(ctx, <-p.resourceChan)
+			}
+			for len(p.reqChan) > 0 {
+				appendRow(ctx, &reqs, <-p.reqChan)
+			}
+			for len(p.kafkaChan) > 0 {
+				appendRow(ctx, &kafkaEvents, <-p.kafkaChan)
+			}
+			for len(p.connChan) > 0 {
+				appendRow(ctx, &conns, <-p.connChan)
+			}
+			flush(ctx)
+			p.conn.Close(ctx)
+			log.Logger.Info().Msg("postgres writer stopped")
+			return
+		case op := <-p.resourceChan:
+			queueResource(p.ctx, op)
+		case r := <-p.reqChan:
+			appendRow(p.ctx, &reqs, r)
+		case k := <-p.kafkaChan:
+			appendRow(p.ctx, &kafkaEvents, k)
+		case c := <-p.connChan:
+			appendRow(p.ctx, &conns, c)
+		case <-flushTicker.C:
+			flush(p.ctx)
+		case now := <-maintainTicker.C:
+			if p.ensureConn(p.ctx) {
+				p.maintainPartitions(now)
+			}
+		}
+	}
+}
+
+// copy inserts rows with COPY, rows are dropped on error to keep memory bounded
+func (p *PostgresDS) copy(ctx context.Context, table string, columns []string, rows [][]interface{}) [][]interface{} {
+	if len(rows) == 0 {
+		return rows
+	}
+	_, err := p.conn.CopyFrom(ctx, pgx.Identifier{table}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		log.Logger.Error().Err(err).Str("table", table).Int("rows", len(rows)).Msg("error copying rows to postgres")
+	}
+	return rows[:0]
+}
+
+func (p *PostgresDS) ensureConn(ctx context.Context) bool {
+	if !p.conn.IsClosed() {
+		return true
+	}
+	conn, err := pgConnect(ctx, p.conf)
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("error reconnecting to postgres")
+		return false
+	}
+	p.conn = conn
+	return true
+}
+
+// maintainPartitions creates partitions for today and tomorrow,
+// and drops the ones older than retention days.
+func (p *PostgresDS) maintainPartitions(now time.Time) {
+	today := pgPartitionDay(now)
+	for _, table := range pgPartitionedTables {
+		for _, day := range []time.Time{today, today.AddDate(0, 0, 1)} {
+			if _, err := p.conn.Exec(p.ctx, pgCreatePartitionSQL(table, day)); err != nil {
+				log.Logger.Error().Err(err).Str("table", table).Msg("error creating postgres partition")
+			}
+		}
+
+		if p.retention <= 0 {
+			continue
+		}
+		rows, err := p.conn.Query(p.ctx, `SELECT c.relname FROM pg_inherits i
+			JOIN pg_class c ON c.oid = i.inhrelid
+			JOIN pg_class t ON t.oid = i.inhparent
+			WHERE t.relname = $1`, table)
+		if err != nil {
+			log.Logger.Error().Err(err).Str("table", table).Msg("error listing postgres partitions")
+			continue
+		}
+		partitions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			log.Logger.Error().Err(err).Str("table", table).Msg("error listing postgres partitions")
+			continue
+		}
+
+		cutoff := today.AddDate(0, 0, -p.retention)
+		for _, name := range partitions {
+			day, ok := pgParsePartitionName(table, name)
+			if !ok || !day.Before(cutoff) {
+				continue
+			}
+			if _, err := p.conn.Exec(p.ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{name}.Sanitize()); err != nil {
+				log.Logger.Error().Err(err).Str("partition", name).Msg("error dropping postgres partition")
+				continue
+			}
+			log.Logger.Info().Str("partition", name).Msg("dropped expired postgres partition")
+		}
+	}
+}
+
+func pgPartitionDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func pgPartitionName(table string, day time.Time) string {
+	return table + "_p" + day.Format(pgPartitionLayout)
+}
+
+// pgParsePartitionName returns the day of a daily partition, default partition is not matched
+func pgParsePartitionName(table, name string) (time.Time, bool) {
+	suffix, found := strings.CutPrefix(name, table+"_p")
+	if !found {
+		return time.Time{}, false
+	}
+	day, err := time.ParseInLocation(pgPartitionLayout, suffix, time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+func pgCreatePartitionSQL(table string, day time.Time) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+		pgx.Identifier{pgPartitionName(table, day)}.Sanitize(), pgx.Identifier{table}.Sanitize(),
+		day.Format(time.RFC3339), day.AddDate(0, 0, 1).Format(time.RFC3339))
+}
+
+func pgJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// pgClusterValues are values of the cluster_id, cluster_name, region and zone columns every table has
+func pgClusterValues() []interface{} {
+	c := Cluster()
+	return []interface{}{c.ID, c.Name, c.Region, c.Zone}
+}
+
+func (p *PostgresDS) queueResource(op pgResourceOp) {
+	p.resourceChan <- op
+}
+
+// deleted resources are kept with deleted_at set, so old requests can still be resolved
+func (p *PostgresDS) softDelete(table, uid string) {
+	p.queueResource(pgResourceOp{sql: "UPDATE " + table + " SET deleted_at = now() WHERE uid = $1", args: []interface{}{uid}})
+}
+
+func (p *PostgresDS) PersistPod(pod Pod, eventType string) error {
+	if eventType == "DELETE" {
+		p.softDelete("pods", pod.UID)
+		return nil
+	}
+	p.queueResource(pgResourceOp{
+		sql: `INSERT INTO pods (uid, name, namespace, image, ip, owner_type, owner_id, owner_name, cluster_id, cluster_name, region, zone)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (uid) DO UPDATE SET name = EXCLUDED.name, namespace = EXCLUDED.namespace,
+			image = EXCLUDED.image, ip = EXCLUDED.ip, owner_type = EXCLUDED.owner_type,
+			owner_id = EXCLUDED.owner_id, owner_name = EXCLUDED.owner_name, 
+			cluster_id = EXCLUDED.cluster_id, cluster_name = EXCLUDED.cluster_name, region = EXCLUDED.region, zone = EXCLUDED.zone,
+			updated_at = now(), deleted_at = NULL`,
+		args: append([]interface{}{pod.UID, pod.Name, pod.Namespace, pod.Image, pod.IP, pod.OwnerType, pod.OwnerID, pod.OwnerName}, pgClusterValues()...),
+	})
+	return nil
+}
+
+func (p *PostgresDS) PersistService(service Service, eventType string) error {
+	if eventType == "DELETE" {
+		p.softDelete("services", service.UID)
+		return nil
+	}
+	p.queueResource(pgResourceOp{
+		sql: `INSERT INTO services (uid, name, namespace, type, cluster_ip, cluster_ips, ports, cluster_id, cluster_name, region, zone)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (uid) DO UPDATE SET name = EXCLUDED.name, namespace = EXCLUDED.namespace,
+			type = EXCLUDED.type, cluster_ip = EXCLUDED.cluster_ip, cluster_ips = EXCLUDED.cluster_ips,
+			ports = EXCLUDED.ports, 
+			cluster_id = EXCLUDED.cluster_id, cluster_name = EXCLUDED.cluster_name, region = EXCLUDED.region, zone = EXCLUDED.zone,
+			updated_at = now(), deleted_at = NULL`,
+		args: append([]interface{}{service.UID, service.Name, service.Namespace, service.Type, service.ClusterIP, service.ClusterIPs, pgJSON(service.Ports)}, pgClusterValues()...),
+	})
+	return nil
+}
+
+func (p *PostgresDS) persistWorkload(kind, uid, name, namespace, ownerType, ownerID, ownerName string, replicas int32, eventType string) {
+	if eventType == "DELETE" {
+		p.softDelete("workloads", uid)
+		return
+	}
+	p.queueResource(pgResourceOp{
+		sql: `INSERT INTO workloads (uid, kind, name, namespace, owner_type, owner_id, owner_name, replicas, cluster_id, cluster_name, region, zone)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (uid) DO UPDATE SET name = EXCLUDED.name, namespace = EXCLUDED.namespace,
+			owner_type = EXCLUDED.owner_type, owner_id = EXCLUDED.owner_id, owner_name = EXCLUDED.owner_name,
+			replicas = EXCLUDED.replicas, 
+			cluster_id = EXCLUDED.cluster_id, cluster_name = EXCLUDED.cluster_name, region = EXCLUDED.region, zone = EXCLUDED.zone,
+			updated_at = now(), deleted_at = NULL`,
+		args: append([]interface{}{uid, kind, name, namespace, ownerType, ownerID, ownerName, replicas}, pgClusterValues()...),
+	})
+}
+
+func (p *PostgresDS) PersistReplicaSet(rs ReplicaSet, eventType string) error {
+	p.persistWorkload("ReplicaSet", rs.UID, rs.Name, rs.Namespace, rs.OwnerType, rs.OwnerID, rs.OwnerName, rs.Replicas, eventType)
+	return nil
+}
+
+func (p *PostgresDS) PersistDeployment(d Deployment, eventType string) error {
+	p.persistWorkload("Deployment", d.UID, d.Name, d.Namespace, "", "", "", d.Replicas, eventType)
+	return nil
+}
+
+func (p *PostgresDS) PersistDaemonSet(ds DaemonSet, eventType string) error {
+	p.persistWorkload("DaemonSet", ds.UID, ds.Name, ds.Namespace, "", "", "", 0, eventType)
+	return nil
+}
+
+func (p *PostgresDS) PersistStatefulSet(ss StatefulSet, eventType string) error {
+	p.persistWorkload("StatefulSet", ss.UID, ss.Name, ss.Namespace, "", "", "", 0, eventType)
+	return nil
+}
+
+func (p *PostgresDS) PersistEndpoints(e Endpoints, eventType string) error {
+	if eventType == "DELETE" {
+		p.softDelete("endpoints", e.UID)
+		return nil
+	}
+	p.queueResource(pgResourceOp{
+		sql: `INSERT INTO endpoints (uid, name, namespace, addresses, cluster_id, cluster_name, region, zone)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (uid) DO UPDATE SET name = EXCLUDED.name, namespace = EXCLUDED.namespace,
+			addresses = EXCLUDED.addresses, 
+			cluster_id = EXCLUDED.cluster_id, cluster_name = EXCLUDED.cluster_name, region = EXCLUDED.region, zone = EXCLUDED.zone,
+			updated_at = now(), deleted_at = NULL`,
+		args: append([]interface{}{e.UID, e.Name, e.Namespace, pgJSON(e.Addresses)}, pgClusterValues()...),
+	})
+	return nil
+}
+
+func (p *PostgresDS) PersistContainer(c Container, eventType string) error {
+	if eventType == "DELETE" {
+		p.queueResource(pgResourceOp{
+			sql:  `UPDATE containers SET deleted_at = now() WHERE pod_uid = $1 AND name = $2`,
+			args: []interface{}{c.PodUID, c.Name},
+		})
+		return nil
+	}
+	p.queueResource(pgResourceOp{
+		sql: `INSERT INTO containers (pod_uid, name, namespace, image, ports, cluster_id, cluster_name, region, zone)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (pod_uid, name) DO UPDATE SET namespace = EXCLUDED.namespace,
+			image = EXCLUDED.image, ports = EXCLUDED.ports, 
+			cluster_id = EXCLUDED.cluster_id, cluster_name = EXCLUDED.cluster_name, region = EXCLUDED.region, zone = EXCLUDED.zone,
+			updated_at = now(), deleted_at = NULL`,
+		args: append([]interface{}{c.PodUID, c.Name, c.Namespace, c.Image, pgJSON(c.Ports)}, pgClusterValues()...),
+	})
+	return nil
+}
+
+func (p *PostgresDS) PersistRequest(r *Request) error {
+	p.reqChan <- append([]interface{}{
+		time.UnixMilli(r.StartTime), int64(r.Latency),
+		r.FromIP, r.FromType, r.FromUID, int32(r.FromPort),
+		r.ToIP, r.ToType, r.ToUID, int32(r.ToPort),
+		r.Protocol, int64(r.StatusCode), r.FailReason, r.Method, r.Path,
+		r.Tls, int64(r.Seq), int64(r.Tid), r.Probe, r.Weight, r.Payload, r.Locality, int64(r.RequestSize), int64(r.ResponseSize),
+	}, pgClusterValues()...)
+	return nil
+}
+
+func (p *PostgresDS) PersistKafkaEvent(ke *KafkaEvent) error {
+	p.kafkaChan <- append([]interface{}{
+		time.UnixMilli(ke.StartTime), int64(ke.Latency),
+		ke.FromIP, ke.FromType, ke.FromUID, int32(ke.FromPort),
+		ke.ToIP, ke.ToType, ke.ToUID, int32(ke.ToPort),
+		ke.Topic, int64(ke.Partition), ke.Key, ke.Value, ke.Type,
+		ke.Tls, int64(ke.Seq), int64(ke.Tid),
+	}, pgClusterValues()...)
+	return nil
+}
+
+func (p *PostgresDS) PersistAliveConnection(c *AliveConnection) error {
+	p.connChan <- append([]interface{}{
+		time.UnixMilli(c.CheckTime),
+		c.FromIP, c.FromType, c.FromUID, int32(c.FromPort),
+		c.ToIP, c.ToType, c.ToUID, int32(c.ToPort), c.Locality,
+		int64(c.SentBytes), int64(c.ReceivedBytes),
+	}, pgClusterValues()...)
+	return nil
+}
+
+// trace events are only used by backend to build distributed traces
+func (p *PostgresDS) PersistTraceEvent(trace *l7_req.TraceEvent) error {
+	return nil
+}
@@ -0,0 +1,181 @@
+package datastore
+
+// pg_advisory_xact_lock key held while migrating, "alaz" in ascii
+const pgMigrationLockID int64 = 0x616c617a
+
+// migrations are applied in order, in one transaction holding the migration lock.
+// Never edit an applied migration, append a new one instead.
+var pgMigrations = []string{
+	// 1: kubernetes resources
+	`CREATE TABLE IF NOT EXISTS pods (
+		uid         TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		namespace   TEXT NOT NULL,
+		image       TEXT,
+		ip          TEXT,
+		owner_type  TEXT,
+		owner_id    TEXT,
+		owner_name  TEXT,
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		deleted_at  TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS pods_ip_idx ON pods (ip);
+
+	CREATE TABLE IF NOT EXISTS services (
+		uid          TEXT PRIMARY KEY,
+		name         TEXT NOT NULL,
+		namespace    TEXT NOT NULL,
+		type         TEXT,
+		cluster_ip   TEXT,
+		cluster_ips  TEXT[],
+		ports        JSONB,
+		updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		deleted_at   TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS workloads (
+		uid         TEXT PRIMARY KEY,
+		kind        TEXT NOT NULL, -- ReplicaSet, Deployment, DaemonSet, StatefulSet
+		name        TEXT NOT NULL,
+		namespace   TEXT NOT NULL,
+		owner_type  TEXT,
+		owner_id    TEXT,
+		owner_name  TEXT,
+		replicas    INTEGER,
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		deleted_at  TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS endpoints (
+		uid         TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		namespace   TEXT NOT NULL,
+		addresses   JSONB,
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		deleted_at  TIMESTAMPTZ
+	);
+
+	CREATE TABLE IF NOT EXISTS containers (
+		pod_uid     TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		namespace   TEXT NOT NULL,
+		image       TEXT,
+		ports       JSONB,
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		deleted_at  TIMESTAMPTZ,
+		PRIMARY KEY (pod_uid, name)
+	);`,
+
+	// 2: time series, partitioned daily by time, out of range rows go to default partitions
+	`CREATE TABLE IF NOT EXISTS requests (
+		start_time   TIMESTAMPTZ NOT NULL,
+		latency_ns   BIGINT NOT NULL,
+		from_ip      TEXT,
+		from_type    TEXT,
+		from_uid     TEXT,
+		from_port    INTEGER,
+		to_ip        TEXT,
+		to_type      TEXT,
+		to_uid       TEXT,
+		to_port      INTEGER,
+		protocol     TEXT,
+		status_code  BIGINT,
+		fail_reason  TEXT,
+		method       TEXT,
+		path         TEXT,
+		tls          BOOLEAN,
+		seq          BIGINT,
+		tid          BIGINT,
+		probe        BOOLEAN,
+		weight       DOUBLE PRECISION,
+		payload      TEXT
+	) PARTITION BY RANGE (start_time);
+	CREATE TABLE IF NOT EXISTS requests_default PARTITION OF requests DEFAULT;
+	CREATE INDEX IF NOT EXISTS requests_edge_idx ON requests (from_uid, to_uid, start_time);
+
+	CREATE TABLE IF NOT EXISTS kafka_events (
+		start_time   TIMESTAMPTZ NOT NULL,
+		latency_ns   BIGINT NOT NULL,
+		from_ip      TEXT,
+		from_type    TEXT,
+		from_uid     TEXT,
+		from_port    INTEGER,
+		to_ip        TEXT,
+		to_type      TEXT,
+		to_uid       TEXT,
+		to_port      INTEGER,
+		topic        TEXT,
+		partition    BIGINT,
+		key          TEXT,
+		value        TEXT,
+		type         TEXT,
+		tls          BOOLEAN,
+		seq          BIGINT,
+		tid          BIGINT
+	) PARTITION BY RANGE (start_time);
+	CREATE TABLE IF NOT EXISTS kafka_events_default PARTITION OF kafka_events DEFAULT;
+
+	CREATE TABLE IF NOT EXISTS connections (
+		check_time   TIMESTAMPTZ NOT NULL,
+		from_ip      TEXT,
+		from_type    TEXT,
+		from_uid     TEXT,
+		from_port    INTEGER,
+		to_ip        TEXT,
+		to_type      TEXT,
+		to_uid       TEXT,
+		to_port      INTEGER
+	) PARTITION BY RANGE (check_time);
+	CREATE TABLE IF NOT EXISTS connections_default PARTITION OF connections DEFAULT;`,
+
+	// 3: node and zone locality of edges, request bytes
+	`ALTER TABLE requests ADD COLUMN IF NOT EXISTS locality TEXT;
+	ALTER TABLE requests ADD COLUMN IF NOT EXISTS size BIGINT;
+	ALTER TABLE connections ADD COLUMN IF NOT EXISTS locality TEXT;`,
+
+	// 4: response bytes, bytes of connections
+	`ALTER TABLE requests ADD COLUMN IF NOT EXISTS response_size BIGINT;
+	ALTER TABLE connections ADD COLUMN IF NOT EXISTS sent_bytes BIGINT;
+	ALTER TABLE connections ADD COLUMN IF NOT EXISTS received_bytes BIGINT;`,
+
+	// 5: cluster identity, so clusters can share a database
+	`ALTER TABLE pods ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE services ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE workloads ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE containers ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE requests ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE kafka_events ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;
+	ALTER TABLE connections ADD COLUMN IF NOT EXISTS cluster_id TEXT, ADD COLUMN IF NOT EXISTS cluster_name TEXT,
+		ADD COLUMN IF NOT EXISTS region TEXT, ADD COLUMN IF NOT EXISTS zone TEXT;`,
+}
+
+// partitioned tables, maintained by PostgresDS
+var pgPartitionedTables = []string{"requests", "kafka_events", "connections"}
+
+var pgRequestColumns = []string{
+	"start_time", "latency_ns", "from_ip", "from_type", "from_uid", "from_port",
+	"to_ip", "to_type", "to_uid", "to_port", "protocol", "status_code", "fail_reason",
+	"method", "path", "tls", "seq", "tid", "probe", "weight", "payload", "locality", "size", "response_size",
+	"cluster_id", "cluster_name", "region", "zone",
+}
+
+var pgKafkaEventColumns = []string{
+	"start_time", "latency_ns", "from_ip", "from_type", "from_uid", "from_port",
+	"to_ip", "to_type", "to_uid", "to_port", "topic", "partition", "key", "value",
+	"type", "tls", "seq", "tid",
+	"cluster_id", "cluster_name", "region", "zone",
+}
+
+var pgConnectionColumns = []string{
+	"check_time", "from_ip", "from_type", "from_uid", "from_port",
+	"to_ip", "to_type", "to_uid", "to_port", "locality", "sent_bytes", "received_bytes",
+	"cluster_id", "cluster_name", "region", "zone",
+}
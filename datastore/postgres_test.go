@@ -0,0 +1,38 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+func TestPgPartitionNames(t *testing.T) {
+	day := pgPartitionDay(time.Date(2024, 3, 9, 23, 30, 0, 0, time.FixedZone("X", -2*3600)))
+	if name := pgPartitionName("requests", day); name != "requests_p20240310" {
+		t.Fatalf("unexpected partition name %s", name)
+	}
+
+	parsed, ok := pgParsePartitionName("requests", "requests_p20240310")
+	if !ok || !parsed.Equal(day) {
+		t.Fatalf("expected %v, got %v", day, parsed)
+	}
+	if _, ok := pgParsePartitionName("requests", "requests_default"); ok {
+		t.Fatalf("default partition must not be parsed")
+	}
+	if _, ok := pgParsePartitionName("connections", "requests_p20240310"); ok {
+		t.Fatalf("partition of another table must not be parsed")
+	}
+
+	want := `CREATE TABLE IF NOT EXISTS "requests_p20240310" PARTITION OF "requests" FOR VALUES FROM ('2024-03-10T00:00:00Z') TO ('2024-03-11T00:00:00Z')`
+	if sql := pgCreatePartitionSQL("requests", day); sql != want {
+		t.Fatalf("unexpected sql %s", sql)
+	}
+}
+
+func TestPgConnString(t *testing.T) {
+	s := pgConnString(config.PostgresConfig{Host: "db", Port: "5432", Username: "alaz", Password: "p@ss", DBName: "alaz", SSLMode: "require"})
+	if s != "postgres://alaz:p%40ss@db:5432/alaz?sslmode=require" {
+		t.Fatalf("unexpected conn string %s", s)
+	}
+}
@@ -0,0 +1,200 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ddosify/alaz/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	rejectedEventMaxRetries = 3
+	rejectedEventRetryDelay = 5 * time.Second // doubled on every resend
+)
+
+var rejectedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "alaz",
+	Subsystem: "backend",
+	Name:      "rejected_events_total",
+	Help:      "Events backend rejected in an accepted batch, by endpoint and result: dropped or requeued.",
+}, []string{"endpoint", "result"})
+
+func init() {
+	prometheus.MustRegister(rejectedEvents)
+}
+
+// error messages of events that may be accepted if sent again,
+// anything else is a problem with the event itself, like a validation error
+var transientEventErrors = []string{
+	"timeout",
+	"timed out",
+	"temporar",
+	"unavailable",
+	"try again",
+	"deadlock",
+	"too many",
+	"connection",
+}
+
+// backendEventError is an event of a batch that backend did not persist,
+// eventNum is its index in the batch
+type backendEventError struct {
+	eventNum  int
+	event     interface{}
+	msg       string
+	retryable bool
+}
+
+func (e backendEventError) transient() bool {
+	if e.retryable {
+		return true
+	}
+	msg := strings.ToLower(e.msg)
+	for _, t := range transientEventErrors {
+		if strings.Contains(msg, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBackendResponse returns the rejected events listed in a 200 response
+func parseBackendResponse(endpoint string, body []byte) []backendEventError {
+	if len(body) == 0 {
+		return nil
+	}
+
+	var rejected []backendEventError
+	if endpoint == reqEndpoint {
+		var resp ReqBackendReponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			log.Logger.Debug().Msgf("error unmarshalling response body: %v", err)
+			return nil
+		}
+		for _, e := range resp.Errors {
+			rejected = append(rejected, backendEventError{eventNum: e.EventNum, event: e.Event, msg: e.Error, retryable: e.Retryable})
+		}
+	} else {
+		var resp BackendResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			log.Logger.Debug().Msgf("error unmarshalling response body: %v", err)
+			return nil
+		}
+		for _, e := range resp.Errors {
+			rejected = append(rejected, backendEventError{eventNum: e.EventNum, event: e.Event, msg: e.Error, retryable: e.Retryable})
+		}
+	}
+	return rejected
+}
+
+// handleRejected drops events rejected permanently and resends the transient ones
+// on their own batch. Its idempotency key is derived from the original one,
+// so it stays the same however many times that batch is retried.
+func (b *BackendDS) handleRejected(method string, payload interface{}, endpoint string, attempt int, rejected []backendEventError) {
+	md, n := payloadMetadata(payload)
+
+	seen := make(map[int]bool, len(rejected))
+	var retry []int
+	for _, e := range rejected {
+		if seen[e.eventNum] {
+			continue
+		}
+		seen[e.eventNum] = true
+
+		if e.eventNum < 0 || e.eventNum >= n || !e.transient() || attempt >= rejectedEventMaxRetries {
+			log.Logger.Error().Str("endpoint", endpoint).Str("errorMsg", e.msg).Any("event", e.event).Msg("backend rejected event, dropped")
+			rejectedEvents.WithLabelValues(endpoint, "dropped").Inc()
+			continue
+		}
+		log.Logger.Warn().Str("endpoint", endpoint).Str("errorMsg", e.msg).Msg("backend rejected event, will resend")
+		retry = append(retry, e.eventNum)
+	}
+	if len(retry) == 0 {
+		return
+	}
+	rejectedEvents.WithLabelValues(endpoint, "requeued").Add(float64(len(retry)))
+
+	retryPayload := subsetPayload(payload, retry, fmt.Sprintf("%s.%d", md.IdempotencyKey, attempt+1))
+	// tracked as an upload, shutting down waits for it and sends it right away
+	b.uploads.Add(1)
+	go func() {
+		defer b.uploads.Done()
+		t := time.NewTimer(rejectedEventRetryDelay << attempt)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-b.ctx.Done():
+		}
+		b.sendBatch(method, retryPayload, endpoint, attempt+1)
+	}()
+}
+
+// payloadMetadata returns metadata and number of events of a batch
+func payloadMetadata(payload interface{}) (Metadata, int) {
+	switch p := payload.(type) {
+	case RequestsPayload:
+		return p.Metadata, len(p.Requests)
+	case RequestSummaryPayload:
+		return p.Metadata, len(p.Summaries)
+	case ConnInfoPayload:
+		return p.Metadata, len(p.Connections)
+	case TracePayload:
+		return p.Metadata, len(p.Traces)
+	case KafkaEventInfoPayload:
+		return p.Metadata, len(p.KafkaEvents)
+	case EventPayload:
+		return p.Metadata, len(p.Events)
+	default:
+		return Metadata{}, 0
+	}
+}
+
+// subsetPayload returns a batch of the events at idx. Rows are copied,
+// the ones of the original batch go back to their pools once it is sent.
+func subsetPayload(payload interface{}, idx []int, idempotencyKey string) interface{} {
+	switch p := payload.(type) {
+	case RequestsPayload:
+		p.Metadata.IdempotencyKey = idempotencyKey
+		p.Requests = copyRows(p.Requests, idx)
+		return p
+	case RequestSummaryPayload:
+		p.Metadata.IdempotencyKey = idempotencyKey
+		p.Summaries = copyRows(p.Summaries, idx)
+		return p
+	case ConnInfoPayload:
+		p.Metadata.IdempotencyKey = idempotencyKey
+		p.Connections = copyRows(p.Connections, idx)
+		return p
+	case TracePayload:
+		p.Metadata.IdempotencyKey = idempotencyKey
+		p.Traces = copyRows(p.Traces, idx)
+		return p
+	case KafkaEventInfoPayload:
+		p.Metadata.IdempotencyKey = idempotencyKey
+		p.KafkaEvents = copyRows(p.KafkaEvents, idx)
+		return p
+	case EventPayload:
+		events := make([]interface{}, 0, len(idx))
+		for _, i := range idx {
+			events = append(events, p.Events[i])
+		}
+		p.Metadata.IdempotencyKey = idempotencyKey
+		p.Events = events
+		return p
+	default:
+		return payload
+	}
+}
+
+func copyRows[T any](rows []*T, idx []int) []*T {
+	out := make([]*T, 0, len(idx))
+	for _, i := range idx {
+		row := *rows[i]
+		out = append(out, &row)
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ddosify/alaz/config"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseBackendResponse(t *testing.T) {
+	rejected := parseBackendResponse(reqEndpoint, []byte(`{"msg":"ok","errors":[
+		{"request_num":0,"request":"a","errors":"invalid from_ip"},
+		{"request_num":1,"request":"b","errors":"database timeout"},
+		{"request_num":2,"request":"c","errors":"quota","retryable":true}]}`))
+	if len(rejected) != 3 {
+		t.Fatalf("expected 3 rejected events, got %d", len(rejected))
+	}
+	for i, want := range []bool{false, true, true} {
+		if rejected[i].eventNum != i || rejected[i].transient() != want {
+			t.Fatalf("event %d: expected transient %v, got %+v", i, want, rejected[i])
+		}
+	}
+
+	rejected = parseBackendResponse(connEndpoint, []byte(`{"msg":"ok","errors":[{"event_num":3,"event":"x","error":"bad"}]}`))
+	if len(rejected) != 1 || rejected[0].eventNum != 3 || rejected[0].transient() {
+		t.Fatalf("unexpected rejected events %+v", rejected)
+	}
+	if rejected = parseBackendResponse(connEndpoint, []byte(`{"msg":"ok"}`)); len(rejected) != 0 {
+		t.Fatalf("expected no rejected events, got %+v", rejected)
+	}
+}
+
+func TestSubsetPayload(t *testing.T) {
+	rows := []*ConnInfo{{int64(1)}, {int64(2)}, {int64(3)}}
+	p := ConnInfoPayload{Metadata: Metadata{IdempotencyKey: "k", NodeID: "n"}, Connections: rows}
+
+	sub := subsetPayload(p, []int{0, 2}, "k.1").(ConnInfoPayload)
+	if sub.Metadata.IdempotencyKey != "k.1" || sub.Metadata.NodeID != "n" || p.Metadata.IdempotencyKey != "k" {
+		t.Fatalf("unexpected metadata %+v", sub.Metadata)
+	}
+	if len(sub.Connections) != 2 || sub.Connections[0][0] != int64(1) || sub.Connections[1][0] != int64(3) {
+		t.Fatalf("unexpected rows %v", sub.Connections)
+	}
+	// rows go back to the pool, resent ones must not change with them
+	rows[0][0] = int64(10)
+	if sub.Connections[0][0] != int64(1) {
+		t.Fatal("resent rows must be copies")
+	}
+}
+
+func TestBackendRejectedEvents(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	var rows [][]json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var p struct {
+			Metadata    Metadata            `json:"metadata"`
+			Connections [][]json.RawMessage `json:"connections"`
+		}
+		json.Unmarshal(body, &p)
+		mu.Lock()
+		keys = append(keys, p.Metadata.IdempotencyKey)
+		rows = append(rows, p.Connections...)
+		mu.Unlock()
+		w.Write([]byte(`{"msg":"ok","errors":[
+			{"event_num":0,"event":"a","error":"validation failed"},
+			{"event_num":2,"event":"c","error":"connection reset"},
+			{"event_num":7,"event":"?","error":"connection reset"}]}`))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewBackendDS(ctx, config.BackendDSConfig{Host: srv.URL})
+
+	dropped := testutil.ToFloat64(rejectedEvents.WithLabelValues(connEndpoint, "dropped"))
+	requeued := testutil.ToFloat64(rejectedEvents.WithLabelValues(connEndpoint, "requeued"))
+
+	p := ConnInfoPayload{Metadata: Metadata{IdempotencyKey: "batch"}, Connections: []*ConnInfo{{int64(1)}, {int64(2)}, {int64(3)}}}
+	if err := b.sendToBackend(http.MethodPost, p, connEndpoint); err != nil {
+		t.Fatal(err)
+	}
+	if d := testutil.ToFloat64(rejectedEvents.WithLabelValues(connEndpoint, "dropped")) - dropped; d != 2 {
+		t.Fatalf("expected validation error and unknown event to be dropped, got %v", d)
+	}
+	if r := testutil.ToFloat64(rejectedEvents.WithLabelValues(connEndpoint, "requeued")) - requeued; r != 1 {
+		t.Fatalf("expected transient error to be requeued, got %v", r)
+	}
+
+	// resends of rejected events keep a key derived from the batch
+	if err := b.sendBatch(http.MethodPost, subsetPayload(p, []int{2}, "batch.1"), connEndpoint, rejectedEventMaxRetries); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(keys) != 2 || keys[0] != "batch" || keys[1] != "batch.1" {
+		t.Fatalf("unexpected idempotency keys %q", keys)
+	}
+	mu.Unlock()
+
+	// pending resends are sent while shutting down, the row is a copy of the pooled one
+	p.Connections[2][0] = int64(99)
+	cancel()
+	b.uploads.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 3 || keys[2] != "batch.1" {
+		t.Fatalf("expected resends to be flushed on shutdown, got keys %q", keys)
+	}
+	if last := string(rows[len(rows)-1][0]); last != "3" {
+		t.Errorf("expected resent row to be a copy, got %s", last)
+	}
+}
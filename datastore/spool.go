@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const spoolFileExt = ".spool"
+
+var (
+	spoolBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "backend_spool",
+		Name:      "batches_total",
+		Help:      "Batches that failed to reach backend, by result: spooled, replayed or dropped.",
+	}, []string{"result"})
+	spoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "alaz",
+		Subsystem: "backend_spool",
+		Name:      "bytes",
+		Help:      "Bytes waiting on disk to be replayed to backend.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(spoolBatches, spoolBytes)
+}
+
+// spool keeps batches that could not be sent to backend on disk, one file per batch.
+// Files are named by an increasing sequence number and replayed in that order.
+// Oldest batches are dropped when the spool exceeds maxBytes or a batch gets older than maxAge.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu    sync.Mutex
+	seq   uint64
+	files []spoolFile // ordered by seq
+	size  int64
+}
+
+type spoolFile struct {
+	path    string
+	size    int64
+	created time.Time
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+
+	s := &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+
+	// pick up batches left from a previous run
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, spoolFileExt+".tmp") {
+			os.Remove(filepath.Join(dir, name)) // interrupted write
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, spoolFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, spoolFile{path: filepath.Join(dir, name), size: info.Size(), created: info.ModTime()})
+		s.size += info.Size()
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].path < s.files[j].path })
+	spoolBytes.Set(float64(s.size))
+
+	return s, nil
+}
+
+// push writes a batch to disk, dropping the oldest batches if it does not fit.
+// First line of a file is the endpoint and content type of the batch.
+func (s *spool) push(endpoint, contentType string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := make([]byte, 0, len(endpoint)+len(contentType)+2+len(payload))
+	data = append(data, endpoint...)
+	data = append(data, ' ')
+	data = append(data, contentType...)
+	data = append(data, '\n')
+	data = append(data, payload...)
+	size := int64(len(data))
+	if s.maxBytes > 0 && size > s.maxBytes {
+		spoolBatches.WithLabelValues("dropped").Inc()
+		return fmt.Errorf("batch of %d bytes is bigger than spool", size)
+	}
+
+	for s.maxBytes > 0 && s.size+size > s.maxBytes && len(s.files) > 0 {
+		s.dropOldest()
+	}
+
+	// files are written aside and renamed, replay never sees a partial batch
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolFileExt))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		spoolBatches.WithLabelValues("dropped").Inc()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		spoolBatches.WithLabelValues("dropped").Inc()
+		return err
+	}
+
+	s.seq++
+	s.files = append(s.files, spoolFile{path: path, size: size, created: time.Now()})
+	s.size += size
+	spoolBatches.WithLabelValues("spooled").Inc()
+	spoolBytes.Set(float64(s.size))
+	return nil
+}
+
+// must be called with mu held
+func (s *spool) dropOldest() {
+	f := s.files[0]
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		log.Logger.Error().Err(err).Str("file", f.path).Msg("error removing spooled batch")
+	}
+	s.files = s.files[1:]
+	s.size -= f.size
+	spoolBatches.WithLabelValues("dropped").Inc()
+	spoolBytes.Set(float64(s.size))
+}
+
+func (s *spool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// replay sends spooled batches oldest first and stops at the first failure,
+// so batches are not reordered while backend is still unreachable.
+func (s *spool) replay(send func(endpoint, contentType string, payload []byte) error) (replayed int, err error) {
+	for {
+		s.mu.Lock()
+		for len(s.files) > 0 && s.maxAge > 0 && time.Since(s.files[0].created) > s.maxAge {
+			s.dropOldest()
+		}
+		if len(s.files) == 0 {
+			s.mu.Unlock()
+			return replayed, nil
+		}
+		f := s.files[0]
+		s.mu.Unlock()
+
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			s.mu.Lock()
+			if len(s.files) > 0 && s.files[0].path == f.path {
+				s.dropOldest()
+			}
+			s.mu.Unlock()
+			continue
+		}
+		header, payload, _ := bytes.Cut(data, []byte{'\n'})
+		endpoint, contentType, _ := strings.Cut(string(header), " ")
+
+		if err := send(endpoint, contentType, payload); err != nil {
+			return replayed, err
+		}
+
+		s.mu.Lock()
+		// push may have dropped it meanwhile
+		if len(s.files) > 0 && s.files[0].path == f.path {
+			os.Remove(f.path)
+			s.files = s.files[1:]
+			s.size -= f.size
+			spoolBytes.Set(float64(s.size))
+		}
+		s.mu.Unlock()
+		spoolBatches.WithLabelValues("replayed").Inc()
+		replayed++
+	}
+}
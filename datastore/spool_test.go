@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.push(reqEndpoint, contentTypeJson, []byte(fmt.Sprintf(`{"batch":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// backend fails on the second batch, it must stay for the next replay
+	var sent []string
+	fail := true
+	send := func(endpoint, contentType string, payload []byte) error {
+		if endpoint != reqEndpoint || contentType != contentTypeJson {
+			t.Fatalf("unexpected endpoint %s and content type %s", endpoint, contentType)
+		}
+		if len(sent) == 1 && fail {
+			fail = false
+			return errors.New("backend down")
+		}
+		sent = append(sent, string(payload))
+		return nil
+	}
+	if n, err := s.replay(send); n != 1 || err == nil {
+		t.Fatalf("expected 1 replayed and an error, got %d %v", n, err)
+	}
+
+	// batches survive a restart
+	s, err = newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.len() != 2 {
+		t.Fatalf("expected 2 spooled batches after restart, got %d", s.len())
+	}
+	s.push(reqEndpoint, contentTypeJson, []byte(`{"batch":3}`))
+	if n, err := s.replay(send); n != 3 || err != nil {
+		t.Fatalf("expected 3 replayed, got %d %v", n, err)
+	}
+
+	want := fmt.Sprint([]string{`{"batch":0}`, `{"batch":1}`, `{"batch":2}`, `{"batch":3}`})
+	if fmt.Sprint(sent) != want {
+		t.Fatalf("expected %s, got %v", want, sent)
+	}
+	if s.len() != 0 || s.size != 0 {
+		t.Fatalf("expected empty spool, got %d files %d bytes", s.len(), s.size)
+	}
+}
+
+func TestSpoolCaps(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 120, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 30)
+	for i := 0; i < 5; i++ {
+		s.push(reqEndpoint, contentTypeJson, payload)
+	}
+	// each file is endpoint, content type and 30 bytes, only two fit in 120 bytes
+	if s.len() != 2 || s.size > 120 {
+		t.Fatalf("expected 2 batches within 120 bytes, got %d batches %d bytes", s.len(), s.size)
+	}
+	if err := s.push(reqEndpoint, contentTypeJson, make([]byte, 200)); err == nil {
+		t.Fatal("expected batch bigger than spool to be rejected")
+	}
+
+	s.maxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	n, err := s.replay(func(string, string, []byte) error { t.Fatal("expired batch replayed"); return nil })
+	if n != 0 || err != nil || s.len() != 0 {
+		t.Fatalf("expected expired batches to be dropped, got %d %v %d", n, err, s.len())
+	}
+}
+
+func TestIsRetryableBackendError(t *testing.T) {
+	for err, want := range map[error]bool{
+		errors.New("connection refused"):                                true,
+		&backendStatusError{statusCode: 503}:                            true,
+		&backendStatusError{statusCode: 429}:                            true,
+		&backendStatusError{statusCode: 400}:                            false,
+		fmt.Errorf("wrapped: %w", &backendStatusError{statusCode: 500}): true,
+	} {
+		if got := isRetryableBackendError(err); got != want {
+			t.Fatalf("%v: expected %v, got %v", err, want, got)
+		}
+	}
+}
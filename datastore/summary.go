@@ -0,0 +1,274 @@
+package datastore
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/ebpf/l7_req"
+)
+
+const (
+	// quantiles read from a sketch are within 1% of the real value
+	sketchRelativeAccuracy  = 0.01
+	defaultSummaryExemplars = 5
+	defaultSummaryMaxEdges  = 10000
+
+	// path of the edge that counts requests of edges beyond the max
+	overflowPath = "{overflow}"
+)
+
+// latencySketch is a DDSketch, values are counted in logarithmic bins
+// so that any quantile is known within sketchRelativeAccuracy.
+type latencySketch struct {
+	gamma     float64
+	logGamma  float64
+	bins      map[int32]float64
+	zeroCount float64
+	count     float64
+	min, max  float64
+	sum       float64
+}
+
+func newLatencySketch() *latencySketch {
+	gamma := (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	return &latencySketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		bins:     make(map[int32]float64),
+		min:      math.Inf(1),
+	}
+}
+
+func (s *latencySketch) add(v float64, weight float64) {
+	if v <= 0 {
+		s.zeroCount += weight
+		v = 0
+	} else {
+		s.bins[int32(math.Ceil(math.Log(v)/s.logGamma))] += weight
+	}
+	s.count += weight
+	s.sum += v * weight
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+func (s *latencySketch) binValue(i int32) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+func (s *latencySketch) sortedBins() []int32 {
+	idx := make([]int32, 0, len(s.bins))
+	for i := range s.bins {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(a, b int) bool { return idx[a] < idx[b] })
+	return idx
+}
+
+func (s *latencySketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := q * s.count
+	seen := s.zeroCount
+	if rank < seen {
+		return 0
+	}
+	for _, i := range s.sortedBins() {
+		seen += s.bins[i]
+		if rank < seen {
+			return s.binValue(i)
+		}
+	}
+	return s.max
+}
+
+func (s *latencySketch) info() LatencySketch {
+	idx := s.sortedBins()
+	counts := make([]float64, 0, len(idx))
+	for _, i := range idx {
+		counts = append(counts, s.bins[i])
+	}
+	return LatencySketch{
+		RelativeAccuracy: sketchRelativeAccuracy,
+		ZeroCount:        s.zeroCount,
+		Indexes:          idx,
+		Counts:           counts,
+		Min:              s.min,
+		Max:              s.max,
+		Sum:              s.sum,
+	}
+}
+
+type summaryKey struct {
+	fromType string
+	fromUID  string
+	toType   string
+	toUID    string
+	toPort   uint16
+	protocol string
+	method   string
+	path     string
+	tls      bool
+	locality string
+}
+
+// slowest keeps the n slowest requests of an edge, fastest on top
+type slowest []*Request
+
+func (h slowest) Len() int           { return len(h) }
+func (h slowest) Less(i, j int) bool { return h[i].Latency < h[j].Latency }
+func (h slowest) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *slowest) Push(x any)        { *h = append(*h, x.(*Request)) }
+func (h *slowest) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+type edgeSummary struct {
+	count     float64
+	errors    float64
+	bytes     float64 // request bytes
+	respBytes float64
+	latency   *latencySketch
+	slowest   slowest
+}
+
+// requestSummarizer pre-aggregates requests per edge and interval,
+// only the slowest few of each edge are kept as they are.
+// Paths are templated so that ids in them do not make an edge per request.
+type requestSummarizer struct {
+	interval  time.Duration
+	exemplars int
+	maxEdges  int
+
+	mu    sync.Mutex
+	start time.Time
+	edges map[summaryKey]*edgeSummary
+}
+
+func newRequestSummarizer(interval time.Duration, exemplars, maxEdges int, now time.Time) *requestSummarizer {
+	if exemplars == 0 {
+		exemplars = defaultSummaryExemplars
+	} else if exemplars < 0 {
+		exemplars = 0
+	}
+	if maxEdges <= 0 {
+		maxEdges = defaultSummaryMaxEdges
+	}
+	return &requestSummarizer{
+		interval:  interval,
+		exemplars: exemplars,
+		maxEdges:  maxEdges,
+		start:     now,
+		edges:     make(map[summaryKey]*edgeSummary),
+	}
+}
+
+func (s *requestSummarizer) add(r *Request) {
+	key := summaryKey{
+		fromType: r.FromType,
+		fromUID:  r.FromUID,
+		toType:   r.ToType,
+		toUID:    r.ToUID,
+		toPort:   r.ToPort,
+		protocol: r.Protocol,
+		method:   r.Method,
+		path:     summaryPath(r),
+		tls:      r.Tls,
+		locality: r.Locality,
+	}
+	weight := r.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.edges[key]
+	if !ok {
+		if len(s.edges) >= s.maxEdges {
+			key = summaryKey{path: overflowPath}
+			e, ok = s.edges[key]
+		}
+		if !ok {
+			e = &edgeSummary{latency: newLatencySketch()}
+			s.edges[key] = e
+		}
+	}
+	e.count += weight
+	e.bytes += float64(r.RequestSize) * weight
+	e.respBytes += float64(r.ResponseSize) * weight
+	if r.Failed() {
+		e.errors += weight
+	}
+	e.latency.add(float64(r.Latency), weight)
+
+	// tail sampled requests are sent anyway
+	if s.exemplars == 0 || r.Sampled {
+		return
+	}
+	if len(e.slowest) < s.exemplars {
+		c := *r
+		heap.Push(&e.slowest, &c)
+	} else if r.Latency > e.slowest[0].Latency {
+		c := *r
+		e.slowest[0] = &c
+		heap.Fix(&e.slowest, 0)
+	}
+}
+
+// summaryPath templates http paths, queries of databases are kept as they are
+func summaryPath(r *Request) string {
+	switch r.Protocol {
+	case l7_req.L7_PROTOCOL_HTTP, "HTTPS", l7_req.L7_PROTOCOL_HTTP2, "gRPC":
+		return TemplatePath(r.Path)
+	}
+	return r.Path
+}
+
+// flush returns summaries of the interval that ended and its exemplars.
+// Exemplars are sent with weight 0, they are already counted in summaries.
+func (s *requestSummarizer) flush(now time.Time) ([]*RequestSummaryInfo, []*ReqInfo) {
+	s.mu.Lock()
+	edges, start := s.edges, s.start
+	s.edges = make(map[summaryKey]*edgeSummary, len(edges))
+	s.start = now
+	s.mu.Unlock()
+
+	summaries := make([]*RequestSummaryInfo, 0, len(edges))
+	var exemplars []*ReqInfo
+	for k, e := range edges {
+		summaries = append(summaries, &RequestSummaryInfo{
+			start.UnixMilli(),
+			now.Sub(start).Milliseconds(),
+			k.fromType,
+			k.fromUID,
+			k.toType,
+			k.toUID,
+			k.toPort,
+			k.protocol,
+			k.method,
+			k.path,
+			k.tls,
+			e.count,
+			e.errors,
+			e.latency.info(),
+			k.locality,
+			e.bytes,
+			e.respBytes,
+		})
+		for _, r := range e.slowest {
+			r.Weight = 0
+			reqInfo := &ReqInfo{}
+			fillReqInfo(reqInfo, r)
+			exemplars = append(exemplars, reqInfo)
+		}
+	}
+	return summaries, exemplars
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+func TestLatencySketchQuantiles(t *testing.T) {
+	s := newLatencySketch()
+	for i := 1; i <= 10000; i++ {
+		s.add(float64(i*1000), 1)
+	}
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		expected := q * 10000 * 1000
+		got := s.quantile(q)
+		if math.Abs(got-expected)/expected > sketchRelativeAccuracy+0.001 {
+			t.Errorf("p%v: expected ~%v, got %v", q*100, expected, got)
+		}
+	}
+	if s.min != 1000 || s.max != 10000*1000 {
+		t.Errorf("unexpected min %v max %v", s.min, s.max)
+	}
+}
+
+func TestRequestSummarizer(t *testing.T) {
+	start := time.Now()
+	s := newRequestSummarizer(time.Minute, 2, 0, start)
+
+	for i := 1; i <= 100; i++ {
+		status := uint32(200)
+		if i%10 == 0 {
+			status = 503
+		}
+		s.add(&Request{FromUID: "a", ToUID: "b", Protocol: "HTTP", Method: "GET", Path: "/", StatusCode: status, Latency: uint64(i), Weight: 1})
+	}
+	s.add(&Request{FromUID: "a", ToUID: "c", Protocol: "HTTP", Method: "GET", Path: "/", StatusCode: 200, Latency: 5, Weight: 4,
+		Locality: "cross_zone", RequestSize: 100, ResponseSize: 2000})
+
+	summaries, exemplars := s.flush(start.Add(time.Minute))
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 edges, got %d", len(summaries))
+	}
+	for _, sum := range summaries {
+		switch sum[5] {
+		case "b":
+			if sum[11] != 100.0 || sum[12] != 10.0 {
+				t.Errorf("expected 100 requests and 10 errors, got %v and %v", sum[11], sum[12])
+			}
+			if sum[1] != int64(60000) {
+				t.Errorf("expected interval of 60000ms, got %v", sum[1])
+			}
+		case "c":
+			if sum[11] != 4.0 {
+				t.Errorf("expected weighted count of 4, got %v", sum[11])
+			}
+			if sum[14] != "cross_zone" || sum[15] != 400.0 || sum[16] != 8000.0 {
+				t.Errorf("expected cross zone edge with 400 and 8000 weighted bytes, got %v, %v and %v", sum[14], sum[15], sum[16])
+			}
+		}
+	}
+
+	// 2 slowest of the first edge, 1 of the second
+	if len(exemplars) != 3 {
+		t.Fatalf("expected 3 exemplars, got %d", len(exemplars))
+	}
+	latencies := map[uint64]bool{}
+	for _, e := range exemplars {
+		latencies[e[1].(uint64)] = true
+		if e[19] != 0.0 {
+			t.Errorf("expected exemplar weight 0, got %v", e[19])
+		}
+	}
+	if !latencies[100] || !latencies[99] || !latencies[5] {
+		t.Errorf("unexpected exemplar latencies %v", latencies)
+	}
+
+	if summaries, _ := s.flush(start.Add(2 * time.Minute)); len(summaries) != 0 {
+		t.Errorf("expected flush to start a new interval, got %d summaries", len(summaries))
+	}
+}
+
+func TestRequestSummarizerBoundsEdges(t *testing.T) {
+	start := time.Now()
+	s := newRequestSummarizer(time.Minute, 1, 2, start)
+
+	// ids in paths end up on one edge
+	for i := 0; i < 10; i++ {
+		s.add(&Request{FromUID: "a", ToUID: "b", Protocol: "HTTP", Path: fmt.Sprintf("/users/%d?page=2", i)})
+	}
+	s.add(&Request{FromUID: "a", ToUID: "b", Protocol: "POSTGRES", Path: "SELECT 1"})
+	for i := 0; i < 5; i++ {
+		s.add(&Request{FromUID: "a", ToUID: fmt.Sprintf("c%d", i), Protocol: "HTTP", Path: "/"})
+	}
+	// kept by tail sampling, sent on its own instead of as an exemplar
+	s.add(&Request{FromUID: "a", ToUID: "b", Protocol: "HTTP", Path: "/users/1", Latency: 1000, Sampled: true})
+
+	summaries, exemplars := s.flush(start.Add(time.Minute))
+	counts := map[string]float64{}
+	for _, sum := range summaries {
+		counts[sum[9].(string)] += sum[11].(float64)
+	}
+	if len(summaries) != 3 || counts["/users/{id}"] != 11 || counts["SELECT 1"] != 1 || counts[overflowPath] != 5 {
+		t.Fatalf("expected templated, query and overflow edges, got %v", counts)
+	}
+	for _, e := range exemplars {
+		if e[1] == uint64(1000) {
+			t.Errorf("expected sampled request not to be an exemplar")
+		}
+	}
+}
+
+func TestBackendSendsSummariesOnShutdown(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var p struct {
+			Requests  []json.RawMessage `json:"requests"`
+			Summaries []json.RawMessage `json:"summaries"`
+		}
+		json.Unmarshal(body, &p)
+		mu.Lock()
+		received[r.URL.Path] += len(p.Requests) + len(p.Summaries)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewBackendDS(ctx, config.BackendDSConfig{Host: srv.URL, ReqBufferSize: 1000, ConnBufferSize: 10,
+		AggregationInterval: 60, AggregationExemplars: 1})
+	b.Start()
+
+	for i := 0; i < 500; i++ {
+		b.PersistRequest(&Request{FromUID: "a", ToUID: "b", Protocol: "HTTP", Latency: uint64(i)})
+	}
+	b.PersistRequest(&Request{FromUID: "a", ToUID: "b", Protocol: "HTTP", Latency: 1, Weight: 10, Sampled: true})
+	cancel()
+
+	select {
+	case <-b.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("backend datastore not done")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received[reqSummaryEndpoint] != 1 || received[reqEndpoint] != 2 {
+		t.Fatalf("expected 1 summary, 1 exemplar and 1 sampled request, got %v", received)
+	}
+}
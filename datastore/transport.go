@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+// newBackendTransport returns the transport of the backend client.
+// Proxy is taken from HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+// A custom CA bundle is trusted in addition to the system roots, and a client
+// certificate is presented if configured. Requests to backend host carry a bearer token if one is set.
+func newBackendTransport(conf config.BackendDSConfig) (http.RoundTripper, error) {
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading backend ca bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in backend ca bundle %s", conf.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	if conf.ClientCertFile != "" || conf.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCertFile, conf.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading backend client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConf,
+		ForceAttemptHTTP2: true, // a custom TLSClientConfig disables http2 otherwise
+		DisableKeepAlives: false,
+		MaxConnsPerHost:   500, // 500 connection per host
+	}
+
+	if conf.AuthToken == "" && conf.AuthTokenFile == "" {
+		return rt, nil
+	}
+	u, err := url.Parse(conf.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing backend host: %w", err)
+	}
+	tokens := &tokenSource{token: conf.AuthToken, file: conf.AuthTokenFile}
+	if _, err := tokens.get(); err != nil {
+		return nil, err
+	}
+	return &bearerTransport{base: rt, host: u.Host, tokens: tokens}, nil
+}
+
+// bearerTransport sets the Authorization header on requests to backend host only
+type bearerTransport struct {
+	base   http.RoundTripper
+	host   string
+	tokens *tokenSource
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+	token, err := t.tokens.get()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// tokenSource returns the static token, or the content of the token file.
+// The file is read again when it changes, so a rotated secret is picked up without a restart.
+type tokenSource struct {
+	token string
+	file  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cached  string
+}
+
+func (s *tokenSource) get() (string, error) {
+	if s.file == "" {
+		return s.token, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		if s.cached != "" {
+			// secret volumes swap files on rotation, keep the last token meanwhile
+			return s.cached, nil
+		}
+		return "", fmt.Errorf("error reading backend token file: %w", err)
+	}
+	if s.cached != "" && info.ModTime().Equal(s.modTime) {
+		return s.cached, nil
+	}
+
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		if s.cached != "" {
+			return s.cached, nil
+		}
+		return "", fmt.Errorf("error reading backend token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		if s.cached != "" {
+			return s.cached, nil
+		}
+		return "", fmt.Errorf("backend token file %s is empty", s.file)
+	}
+	s.cached = token
+	s.modTime = info.ModTime()
+	return s.cached, nil
+}
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+)
+
+func TestBackendTransportTLSAndToken(t *testing.T) {
+	var gotAuth string
+	var gotClientCert bool
+	var gotProto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotClientCert = len(r.TLS.PeerCertificates) > 0
+		gotProto = r.Proto
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// server certificate doubles as ca bundle and client certificate
+	dir := t.TempDir()
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	os.WriteFile(tokenFile, []byte("first\n"), 0o600)
+
+	rt, err := newBackendTransport(config.BackendDSConfig{
+		Host:           srv.URL,
+		AuthTokenFile:  tokenFile,
+		CAFile:         certFile,
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: rt}
+
+	get := func() {
+		t.Helper()
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	if gotAuth != "Bearer first" || !gotClientCert {
+		t.Fatalf("unexpected auth %q, client cert %v", gotAuth, gotClientCert)
+	}
+	if gotProto != "HTTP/2.0" {
+		t.Fatalf("expected http2 with custom tls config, got %s", gotProto)
+	}
+
+	// rotated secret is picked up
+	os.WriteFile(tokenFile, []byte("second"), 0o600)
+	os.Chtimes(tokenFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	get()
+	if gotAuth != "Bearer second" {
+		t.Fatalf("expected rotated token, got %q", gotAuth)
+	}
+
+	// last token is kept while the secret is being swapped
+	os.Remove(tokenFile)
+	get()
+	if gotAuth != "Bearer second" {
+		t.Fatalf("expected last token, got %q", gotAuth)
+	}
+}
+
+func TestBackendTransportTokenOnlyToBackend(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	rt, err := newBackendTransport(config.BackendDSConfig{Host: "https://backend.example.com", AuthToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotAuth != "" {
+		t.Fatalf("token must not leak to other hosts, got %q", gotAuth)
+	}
+}
+
+func TestBackendTransportConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, nil, 0o600)
+
+	for name, conf := range map[string]config.BackendDSConfig{
+		"missing ca":         {CAFile: filepath.Join(dir, "nope")},
+		"ca without certs":   {CAFile: empty},
+		"missing key":        {ClientCertFile: empty},
+		"empty token file":   {Host: "https://backend", AuthTokenFile: empty},
+		"missing token file": {Host: "https://backend", AuthTokenFile: filepath.Join(dir, "nope")},
+	} {
+		if _, err := newBackendTransport(conf); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
@@ -58,7 +58,10 @@ type bpfL7Event struct {
 	_                   [2]byte
 	Daddr               uint32
 	Dport               uint16
-	_                   [6]byte
+	_                   [2]byte
+	WriteSize           uint32
+	ReadSize            uint32
+	_                   [4]byte
 }
 
 type bpfL7Request struct {
@@ -81,7 +84,8 @@ type bpfL7Request struct {
 	_                   [2]byte
 	Daddr               uint32
 	Dport               uint16
-	_                   [6]byte
+	_                   [2]byte
+	WriteSize           uint32
 }
 
 type bpfLogMessage struct {
@@ -194,6 +198,7 @@ type bpfMapSpecs struct {
 	GoActiveL7Requests *ebpf.MapSpec `ebpf:"go_active_l7_requests"`
 	GoActiveReads      *ebpf.MapSpec `ebpf:"go_active_reads"`
 	GoL7RequestHeap    *ebpf.MapSpec `ebpf:"go_l7_request_heap"`
+	HeldL7Events       *ebpf.MapSpec `ebpf:"held_l7_events"`
 	IngressEgressCalls *ebpf.MapSpec `ebpf:"ingress_egress_calls"`
 	IngressEgressHeap  *ebpf.MapSpec `ebpf:"ingress_egress_heap"`
 	L7EventHeap        *ebpf.MapSpec `ebpf:"l7_event_heap"`
@@ -236,6 +241,7 @@ type bpfMaps struct {
 	GoActiveL7Requests *ebpf.Map `ebpf:"go_active_l7_requests"`
 	GoActiveReads      *ebpf.Map `ebpf:"go_active_reads"`
 	GoL7RequestHeap    *ebpf.Map `ebpf:"go_l7_request_heap"`
+	HeldL7Events       *ebpf.Map `ebpf:"held_l7_events"`
 	IngressEgressCalls *ebpf.Map `ebpf:"ingress_egress_calls"`
 	IngressEgressHeap  *ebpf.Map `ebpf:"ingress_egress_heap"`
 	L7EventHeap        *ebpf.Map `ebpf:"l7_event_heap"`
@@ -261,6 +267,7 @@ func (m *bpfMaps) Close() error {
 		m.GoActiveL7Requests,
 		m.GoActiveReads,
 		m.GoL7RequestHeap,
+		m.HeldL7Events,
 		m.IngressEgressCalls,
 		m.IngressEgressHeap,
 		m.L7EventHeap,
@@ -41,6 +41,10 @@ struct l7_event {
     __u16 sport;
     __u32 daddr;
     __u16 dport;
+
+    // bytes of all writes of the request and all reads of the response, payload is capped at MAX_PAYLOAD_SIZE
+    __u32 write_size;
+    __u32 read_size;
 };
 
 struct l7_request {
@@ -61,6 +65,8 @@ struct l7_request {
     __u16 sport;
     __u32 daddr;
     __u16 dport;
+
+    __u32 write_size;
 };
 
 struct socket_key {
@@ -157,6 +163,54 @@ struct {
 } l7_events SEC(".maps");
 
 
+// events of responses are held from their first read until the response completes,
+// so that the bytes of all of its reads are counted.
+// A response completes when the next request is written to the socket or the peer closes it,
+// otherwise userspace sends the event once no more bytes are read.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(map_flags, BPF_F_NO_PREALLOC); // values of deleted events stay valid until the program returns
+    __uint(max_entries, 10240);
+    __type(key, struct socket_key);
+    __type(value, struct l7_event);
+} held_l7_events SEC(".maps");
+
+// sends the held event of the socket, if userspace has not sent it already
+static __always_inline
+long send_held_l7_event(void *ctx, struct socket_key *k) {
+    struct l7_event *held = bpf_map_lookup_elem(&held_l7_events, k);
+    if (!held) {
+        return 0;
+    }
+    if (bpf_map_delete_elem(&held_l7_events, k) != 0) {
+        return 0;
+    }
+    return bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, held, sizeof(*held));
+}
+
+// holds the event until its response completes, it is sent right away if the map is full
+static __always_inline
+long hold_l7_event(void *ctx, struct socket_key *k, struct l7_event *e) {
+    send_held_l7_event(ctx, k);
+    if (bpf_map_update_elem(&held_l7_events, k, e, BPF_ANY) < 0) {
+        return bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+    }
+    return 0;
+}
+
+// counts a read after the first one of a response, a read of 0 bytes means the peer closed the socket
+static __always_inline
+void add_held_l7_read(void *ctx, struct socket_key *k, __s64 ret) {
+    if (ret == 0) {
+        send_held_l7_event(ctx, k);
+        return;
+    }
+    struct l7_event *held = bpf_map_lookup_elem(&held_l7_events, k);
+    if (held) {
+        held->read_size += ret;
+    }
+}
+
 // used for cases in which we don't have a read event
 // we are only tracking write events.
 // so we need to know when a write event is complete
@@ -226,6 +280,8 @@ int process_enter_of_syscalls_write_sendto(void* ctx, __u64 fd, __u8 is_tls, cha
     k.fd = fd;
     k.is_tls = is_tls;
 
+    // a write after a response is read completes it
+    send_held_l7_event(ctx, &k);
 
     if(buf){
         // We are tracking tcp connections (sockets) on tcp_state bpf program, sending them to userspace
@@ -315,6 +371,8 @@ int process_enter_of_syscalls_write_sendto(void* ctx, __u64 fd, __u8 is_tls, cha
                     e->daddr = bpf_htonl(daddr);
                     e->dport = bpf_htons(dport);
                 }           
+                e->write_size = count;
+                e->read_size = 0;
                 long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
                 if (r < 0) {
                     unsigned char log_msg[] = "failed write to l7_events -- res|fd|psize";
@@ -362,6 +420,8 @@ int process_enter_of_syscalls_write_sendto(void* ctx, __u64 fd, __u8 is_tls, cha
                 e->dport = bpf_htons(dport);
             }            
 
+            e->write_size = count;
+            e->read_size = 0;
             long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
             if (r < 0) {
                 unsigned char log_msg[] = "failed write to l7_events -- res|fd|psize";
@@ -369,6 +429,11 @@ int process_enter_of_syscalls_write_sendto(void* ctx, __u64 fd, __u8 is_tls, cha
             }
             return 0;
         }else{
+            // rest of a request written in parts
+            struct l7_request *active_req = bpf_map_lookup_elem(&active_l7_requests, &k);
+            if (active_req) {
+                active_req->write_size += count;
+            }
             req->protocol = PROTOCOL_UNKNOWN;
             req->method = METHOD_UNKNOWN;
             return 0; // do not continue processing for now (udp requests are flowing and overlaps with http requests)
@@ -388,6 +453,7 @@ int process_enter_of_syscalls_write_sendto(void* ctx, __u64 fd, __u8 is_tls, cha
         req->payload_size = count;
         req->payload_read_complete = 1;
     }
+    req->write_size = count;
 
     __u32 tid = id & 0xFFFFFFFF;
     __u32 seq = process_for_dist_trace_write(ctx,fd);
@@ -550,6 +616,8 @@ int process_exit_of_syscalls_write_sendto(void* ctx, __s64 ret){
         e->daddr = active_req->daddr;
         e->dport = active_req->dport;
 
+        e->write_size = active_req->write_size;
+        e->read_size = 0;
         bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
     }else{
         // write failed
@@ -666,6 +734,8 @@ int process_exit_of_syscalls_read_recvfrom(void* ctx, __u64 id, __u32 pid, __s64
             e->dport = bpf_htons(dport);
         } 
 
+        e->write_size = 0;
+        e->read_size = ret;
         bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
         return 0;
     }
@@ -707,6 +777,8 @@ int process_exit_of_syscalls_read_recvfrom(void* ctx, __u64 id, __u32 pid, __s64
                 e->dport = bpf_htons(dport);
             } 
 
+            e->write_size = 0;
+            e->read_size = ret;
             long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
             if (r < 0) {
                 unsigned char log_msg[] = "failed write to l7_events h2 -- res|fd|psize";
@@ -756,10 +828,14 @@ int process_exit_of_syscalls_read_recvfrom(void* ctx, __u64 id, __u32 pid, __s64
             }             
             bpf_map_delete_elem(&active_reads, &id);
 
+            e->write_size = 0;
+            e->read_size = ret;
             bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
             return 0;
         }
 
+        // rest of a response
+        add_held_l7_read(ctx, &k, ret);
         bpf_map_delete_elem(&active_reads, &id);
         return 0;
     }
@@ -869,9 +945,11 @@ int process_exit_of_syscalls_read_recvfrom(void* ctx, __u64 id, __u32 pid, __s64
         return 0;
     }
        
+    e->write_size = active_req->write_size;
+    e->read_size = ret;
     bpf_map_delete_elem(&active_reads, &id);
     bpf_map_delete_elem(&active_l7_requests, &k);
-    long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+    long r = hold_l7_event(ctx, &k, e);
     if (r < 0) {
         unsigned char log_msg[] = "failed write to l7_events -- res|fd|psize";
         log_to_userspace(ctx, WARN, func_name, log_msg, r, e->fd, e->payload_size);        
@@ -1245,6 +1323,13 @@ int process_enter_of_go_conn_write(void *ctx, __u32 pid, __u32 fd, char *buf_ptr
     k.pid = pid;
     k.fd = fd;
 
+    // a write after a response is read completes it
+    struct socket_key held_k = {};
+    held_k.pid = pid;
+    held_k.fd = fd;
+    held_k.is_tls = 1;
+    send_held_l7_event(ctx, &held_k);
+
     int zero = 0;
     struct l7_request *req = bpf_map_lookup_elem(&go_l7_request_heap, &zero);
     if (!req) {
@@ -1308,6 +1393,8 @@ int process_enter_of_go_conn_write(void *ctx, __u32 pid, __u32 fd, char *buf_ptr
                 e->dport = bpf_htons(dport);
             }
 
+            e->write_size = count;
+            e->read_size = 0;
             long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
             if (r < 0) {
                 unsigned char log_msg[] = "failed write to l7_events -- res|fd|psize";
@@ -1318,6 +1405,11 @@ int process_enter_of_go_conn_write(void *ctx, __u32 pid, __u32 fd, char *buf_ptr
             process_for_dist_trace_write(ctx,fd);
             return 0;
         }else{
+            // rest of a request written in parts
+            struct l7_request *active_req = bpf_map_lookup_elem(&go_active_l7_requests, &k);
+            if (active_req) {
+                active_req->write_size += count;
+            }
             req->protocol = PROTOCOL_UNKNOWN;
             req->method = METHOD_UNKNOWN;
             return 0; 
@@ -1334,6 +1426,7 @@ int process_enter_of_go_conn_write(void *ctx, __u32 pid, __u32 fd, char *buf_ptr
         req->payload_size = count;
         req->payload_read_complete = 1;
     }
+    req->write_size = count;
 
    
     req->seq = process_for_dist_trace_write(ctx,fd);
@@ -1523,6 +1616,8 @@ int BPF_UPROBE(go_tls_conn_read_exit) {
             e->dport = bpf_htons(dport);
         }
 
+        e->write_size = 0;
+        e->read_size = ret;
         long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
         if (r < 0) {
             unsigned char log_msg[] = "failed write to l7_events -- res|fd|psize";
@@ -1539,8 +1634,15 @@ int BPF_UPROBE(go_tls_conn_read_exit) {
     req_k.pid = k.pid;
     req_k.fd = read_args->fd;
 
+    struct socket_key held_k = {};
+    held_k.pid = k.pid;
+    held_k.fd = read_args->fd;
+    held_k.is_tls = 1;
+
     struct l7_request *req = bpf_map_lookup_elem(&go_active_l7_requests, &req_k);
     if (!req) {
+        // rest of a response
+        add_held_l7_read(ctx, &held_k, ret);
         return 0;
     }
 
@@ -1618,10 +1720,12 @@ int BPF_UPROBE(go_tls_conn_read_exit) {
         return 0;
     }
 
+    e->write_size = req->write_size;
+    e->read_size = ret;
     bpf_map_delete_elem(&go_active_reads, &k);
     bpf_map_delete_elem(&go_active_l7_requests, &req_k);
 
-    long r = bpf_perf_event_output(ctx, &l7_events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+    long r = hold_l7_event(ctx, &held_k, e);
     if (r < 0) {
         unsigned char log_msg[] = "write failed to l7_events -- r|fd|method";
         log_to_userspace(ctx, WARN, func_name, log_msg, r, e->fd, e->method);
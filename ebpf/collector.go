@@ -61,6 +61,9 @@ type EbpfCollector struct {
 	mu        sync.Mutex
 
 	ct *cri.CRITool
+
+	// container pids map is repopulated right away instead of on the next tick
+	refreshPids chan struct{}
 }
 
 func NewEbpfCollector(parentCtx context.Context, ct *cri.CRITool) *EbpfCollector {
@@ -89,6 +92,16 @@ func NewEbpfCollector(parentCtx context.Context, ct *cri.CRITool) *EbpfCollector
 		tlsAttachQueue:      make(chan uint32, 10),
 		bpfPrograms:         bpfPrograms,
 		ct:                  ct,
+		refreshPids:         make(chan struct{}, 1),
+	}
+}
+
+// RefreshContainerPids repopulates the container pids map, e.g. after namespace filters changed.
+// Pids going out of scope are removed from the map, uprobes already attached are kept.
+func (e *EbpfCollector) RefreshContainerPids() {
+	select {
+	case e.refreshPids <- struct{}{}:
+	default: // a refresh is already pending
 	}
 }
 
@@ -204,6 +217,8 @@ func (e *EbpfCollector) Init() {
 				return
 			case <-t.C:
 				populate()
+			case <-e.refreshPids:
+				populate()
 			}
 		}
 	}()
@@ -223,21 +238,11 @@ func (e *EbpfCollector) ListenEvents() {
 	go e.AttachUprobesForEncrypted()
 }
 
+// close detaches all probes, so no new events are produced.
+// Event channels are left open, aggregator drains what is already in them
+// and late sends of the consumers do not panic.
 func (e *EbpfCollector) close() {
-	log.Logger.Info().Msg("closing ebpf links")
-
-	for _, p := range e.bpfPrograms {
-		p.Close()
-	}
-	c.BpfObjs.Close()
-
-	close(e.ebpfEvents)
-	close(e.ebpfProcEvents)
-	close(e.ebpfTcpEvents)
-
 	e.probesMu.Lock()
-	defer e.probesMu.Unlock()
-
 	log.Logger.Info().Msg("closing ebpf uprobes")
 
 	for pid := range e.sslWriteUprobes {
@@ -260,6 +265,14 @@ func (e *EbpfCollector) close() {
 			l.Close()
 		}
 	}
+	e.probesMu.Unlock()
+
+	log.Logger.Info().Msg("closing ebpf links")
+	for _, p := range e.bpfPrograms {
+		p.Close()
+	}
+	c.BpfObjs.Close()
+
 	log.Logger.Info().Msg("ebpf collector closed")
 }
 
@@ -10,6 +10,7 @@ import (
 
 	"github.com/ddosify/alaz/ebpf/c"
 	"github.com/ddosify/alaz/log"
+	"github.com/ddosify/alaz/metrics"
 
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/perf"
@@ -363,7 +364,10 @@ type bpfL7Event struct {
 	_                   [2]byte
 	Daddr               uint32
 	Dport               uint16
-	_                   [6]byte
+	_                   [2]byte
+	WriteSize           uint32 // bytes written for the request
+	ReadSize            uint32 // bytes read for the response
+	_                   [4]byte
 }
 
 type bpfTraceEvent struct {
@@ -401,6 +405,8 @@ type L7Event struct {
 	Payload             [1024]uint8
 	PayloadSize         uint32 // How much of the payload was copied
 	PayloadReadComplete bool   // Whether the payload was copied completely
+	RequestSize         uint32 // Bytes of all writes of the request, not capped like the payload
+	ResponseSize        uint32 // Bytes of all reads of the response
 	Failed              bool   // Request failed
 	WriteTimeNs         uint64 // start time of write syscall
 	Tid                 uint32
@@ -572,6 +578,7 @@ func (l7p *L7Prog) Consume(ctx context.Context, ch chan interface{}) {
 			}
 
 			if record.LostSamples != 0 {
+				metrics.LostSamples.WithLabelValues("bpf-logs").Add(float64(record.LostSamples))
 				log.Logger.Warn().Msgf("lost #%d bpf logs", record.LostSamples)
 			}
 
@@ -670,15 +677,45 @@ func (l7p *L7Prog) Consume(ctx context.Context, ch chan interface{}) {
 	}()
 
 	readKernelTime := &sync.Once{}
+	droppedCount := 0
 	go func() {
-		var record perf.Record
-		droppedCount := 0
-		go func() {
-			t := time.NewTicker(1 * time.Minute)
-			for range t.C {
-				log.Logger.Debug().Int("count", droppedCount).Msg("dropped l7 events")
+		t := time.NewTicker(1 * time.Minute)
+		for range t.C {
+			log.Logger.Debug().Int("count", droppedCount).Msg("dropped l7 events")
+		}
+	}()
+	send := func(l7Event *bpfL7Event) {
+		// runs once
+		readKernelTime.Do(func() {
+			FirstUserspaceTime = uint64(time.Now().UnixNano())
+			FirstKernelTime = l7Event.WriteTimeNs
+		})
+
+		go func(l7Event *L7Event) {
+			select {
+			case ch <- l7Event:
+			default:
+				droppedCount++
 			}
-		}()
+		}(toL7Event(l7Event))
+	}
+
+	go func() {
+		t := time.NewTicker(heldEventSweepInterval)
+		defer t.Stop()
+		seen := map[string]heldEvent{}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				seen = sweepHeldEvents(seen, send)
+			}
+		}
+	}()
+
+	go func() {
+		var record perf.Record
 		read := func() {
 			err := l7p.l7Events.ReadInto(&record)
 			if err != nil {
@@ -686,6 +723,7 @@ func (l7p *L7Prog) Consume(ctx context.Context, ch chan interface{}) {
 			}
 
 			if record.LostSamples != 0 {
+				metrics.LostSamples.WithLabelValues("l7-event").Add(float64(record.LostSamples))
 				log.Logger.Warn().Msgf("lost samples l7-event %d", record.LostSamples)
 			}
 
@@ -695,70 +733,7 @@ func (l7p *L7Prog) Consume(ctx context.Context, ch chan interface{}) {
 				return
 			}
 
-			l7Event := (*bpfL7Event)(unsafe.Pointer(&record.RawSample[0]))
-
-			// runs once
-			readKernelTime.Do(func() {
-				FirstUserspaceTime = uint64(time.Now().UnixNano())
-				FirstKernelTime = l7Event.WriteTimeNs
-			})
-
-			protocol := L7ProtocolConversion(l7Event.Protocol).String()
-			var method string
-			switch protocol {
-			case L7_PROTOCOL_HTTP:
-				method = HTTPMethodConversion(l7Event.Method).String()
-			case L7_PROTOCOL_AMQP:
-				method = RabbitMQMethodConversion(l7Event.Method).String()
-			case L7_PROTOCOL_POSTGRES:
-				method = PostgresMethodConversion(l7Event.Method).String()
-			case L7_PROTOCOL_HTTP2:
-				method = Http2MethodConversion(l7Event.Method).String()
-			case L7_PROTOCOL_REDIS:
-				method = RedisMethodConversion(l7Event.Method).String()
-			case L7_PROTOCOL_KAFKA:
-				method = KafkaMethodConversion(l7Event.Method).String()
-			case L7_PROTOCOL_MYSQL:
-				method = MySQLMethodConversion(l7Event.Method).String()
-			// no method set for kafka on kernel side
-			default:
-				method = "Unknown"
-			}
-
-			// copy payload slice
-			payload := [1024]uint8{}
-			copy(payload[:], l7Event.Payload[:])
-
-			userspacel7Event := &L7Event{
-				Fd:                  l7Event.Fd,
-				Pid:                 l7Event.Pid,
-				Status:              l7Event.Status,
-				Duration:            l7Event.Duration,
-				Protocol:            protocol,
-				Tls:                 uint8ToBool(l7Event.IsTls),
-				Method:              method,
-				Payload:             payload,
-				PayloadSize:         l7Event.PayloadSize,
-				PayloadReadComplete: uint8ToBool(l7Event.PayloadReadComplete),
-				Failed:              uint8ToBool(l7Event.Failed),
-				WriteTimeNs:         l7Event.WriteTimeNs,
-				Tid:                 l7Event.Tid,
-				Seq:                 l7Event.Seq,
-				KafkaApiVersion:     l7Event.KafkaApiVersion,
-				MySqlPrepStmtId:     l7Event.PrepStatementId,
-				Saddr:               l7Event.Saddr,
-				Sport:               l7Event.Sport,
-				Daddr:               l7Event.Daddr,
-				Dport:               l7Event.Dport,
-			}
-
-			go func(l7Event *L7Event) {
-				select {
-				case ch <- l7Event:
-				default:
-					droppedCount++
-				}
-			}(userspacel7Event)
+			send((*bpfL7Event)(unsafe.Pointer(&record.RawSample[0])))
 		}
 		for {
 			select {
@@ -788,6 +763,7 @@ func (l7p *L7Prog) Consume(ctx context.Context, ch chan interface{}) {
 			}
 
 			if record.LostSamples != 0 {
+				metrics.LostSamples.WithLabelValues("dist-trace").Add(float64(record.LostSamples))
 				log.Logger.Warn().Msgf("lost samples dist-trace %d", record.LostSamples)
 			}
 
@@ -830,6 +806,105 @@ func (l7p *L7Prog) Consume(ctx context.Context, ch chan interface{}) {
 	// defers will clean up
 }
 
+func toL7Event(l7Event *bpfL7Event) *L7Event {
+	protocol := L7ProtocolConversion(l7Event.Protocol).String()
+	var method string
+	switch protocol {
+	case L7_PROTOCOL_HTTP:
+		method = HTTPMethodConversion(l7Event.Method).String()
+	case L7_PROTOCOL_AMQP:
+		method = RabbitMQMethodConversion(l7Event.Method).String()
+	case L7_PROTOCOL_POSTGRES:
+		method = PostgresMethodConversion(l7Event.Method).String()
+	case L7_PROTOCOL_HTTP2:
+		method = Http2MethodConversion(l7Event.Method).String()
+	case L7_PROTOCOL_REDIS:
+		method = RedisMethodConversion(l7Event.Method).String()
+	case L7_PROTOCOL_KAFKA:
+		method = KafkaMethodConversion(l7Event.Method).String()
+	case L7_PROTOCOL_MYSQL:
+		method = MySQLMethodConversion(l7Event.Method).String()
+	// no method set for kafka on kernel side
+	default:
+		method = "Unknown"
+	}
+
+	// copy payload slice
+	payload := [1024]uint8{}
+	copy(payload[:], l7Event.Payload[:])
+
+	return &L7Event{
+		Fd:                  l7Event.Fd,
+		Pid:                 l7Event.Pid,
+		Status:              l7Event.Status,
+		Duration:            l7Event.Duration,
+		Protocol:            protocol,
+		Tls:                 uint8ToBool(l7Event.IsTls),
+		Method:              method,
+		Payload:             payload,
+		PayloadSize:         l7Event.PayloadSize,
+		PayloadReadComplete: uint8ToBool(l7Event.PayloadReadComplete),
+		RequestSize:         l7Event.WriteSize,
+		ResponseSize:        l7Event.ReadSize,
+		Failed:              uint8ToBool(l7Event.Failed),
+		WriteTimeNs:         l7Event.WriteTimeNs,
+		Tid:                 l7Event.Tid,
+		Seq:                 l7Event.Seq,
+		KafkaApiVersion:     l7Event.KafkaApiVersion,
+		MySqlPrepStmtId:     l7Event.PrepStatementId,
+		Saddr:               l7Event.Saddr,
+		Sport:               l7Event.Sport,
+		Daddr:               l7Event.Daddr,
+		Dport:               l7Event.Dport,
+	}
+}
+
+// the kernel holds the event of a response from its first read until the next request on the socket,
+// so that all reads of the response are counted. Events of idle sockets are sent from here.
+const heldEventSweepInterval = 1 * time.Second
+
+type heldEvent struct {
+	writeTimeNs uint64
+	readSize    uint32
+}
+
+// sweepHeldEvents sends held events whose response was not read further since the previous sweep,
+// returns the events that are still being read
+func sweepHeldEvents(seen map[string]heldEvent, send func(*bpfL7Event)) map[string]heldEvent {
+	m := c.BpfObjs.HeldL7Events
+	reading := make(map[string]heldEvent, len(seen))
+	idle := []string{}
+
+	var key []byte
+	var event bpfL7Event
+	iter := m.Iterate()
+	for iter.Next(&key, unsafe.Pointer(&event)) {
+		k := string(key)
+		h := heldEvent{writeTimeNs: event.WriteTimeNs, readSize: event.ReadSize}
+		if prev, ok := seen[k]; ok && prev == h {
+			idle = append(idle, k)
+			continue
+		}
+		reading[k] = h
+	}
+	if err := iter.Err(); err != nil {
+		log.Logger.Warn().Err(err).Msg("error iterating held l7 events")
+	}
+
+	for _, k := range idle {
+		if err := m.Lookup([]byte(k), unsafe.Pointer(&event)); err != nil {
+			continue
+		}
+		// the kernel sends it if the socket is written to meanwhile, whoever deletes it sends it
+		if err := m.Delete([]byte(k)); err != nil {
+			continue
+		}
+		e := event
+		send(&e)
+	}
+	return reading
+}
+
 // 0 is false, 1 is true
 func uint8ToBool(num uint8) bool {
 	return num != 0
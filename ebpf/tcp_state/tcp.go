@@ -9,6 +9,7 @@ import (
 
 	"github.com/ddosify/alaz/ebpf/c"
 	"github.com/ddosify/alaz/log"
+	"github.com/ddosify/alaz/metrics"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
@@ -216,6 +217,7 @@ func (tsp *TcpStateProg) Consume(ctx context.Context, ch chan interface{}) {
 			}
 
 			if record.LostSamples != 0 {
+				metrics.LostSamples.WithLabelValues("tcp-connect").Add(float64(record.LostSamples))
 				log.Logger.Warn().Msgf("lost samples tcp-connect %d", record.LostSamples)
 			}
 
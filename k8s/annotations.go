@@ -0,0 +1,245 @@
+package k8s
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Pod annotations override namespace annotations, which override global settings
+const (
+	AnnotationTracing        = "alaz.io/tracing"         // "false" to stop tracing the pod
+	AnnotationLogs           = "alaz.io/logs"            // "false" to stop streaming logs of the pod
+	AnnotationCapturePayload = "alaz.io/capture-payload" // "true" to send request payloads of the pod, without query string and credential headers
+	AnnotationProtocols      = "alaz.io/protocols"       // comma separated list, e.g. "http,postgres"
+)
+
+type PodPolicy struct {
+	Tracing        bool
+	Logs           bool
+	CapturePayload bool
+	Protocols      map[string]struct{} // lowercase protocol names, nil means all protocols
+}
+
+var defaultPodPolicy = PodPolicy{
+	Tracing:        true,
+	Logs:           true,
+	CapturePayload: false,
+}
+
+func (p PodPolicy) ProtocolEnabled(protocol string) bool {
+	if p.Protocols == nil {
+		return true
+	}
+	_, ok := p.Protocols[strings.ToLower(protocol)]
+	return ok
+}
+
+type podMeta struct {
+	namespace   string
+	annotations map[string]string
+	labels      map[string]string
+}
+
+type namespaceMeta struct {
+	annotations map[string]string
+	labels      map[string]string
+}
+
+// PolicyStore keeps alaz annotations and labels of pods and namespaces, fed by the k8s informers
+type PolicyStore struct {
+	mu         sync.RWMutex
+	pods       map[string]podMeta       // pod uid -> meta
+	namespaces map[string]namespaceMeta // namespace -> meta
+
+	scope atomic.Pointer[Scope]
+}
+
+func NewPolicyStore(scope *Scope) *PolicyStore {
+	s := &PolicyStore{
+		pods:       map[string]podMeta{},
+		namespaces: map[string]namespaceMeta{},
+	}
+	s.scope.Store(scope)
+	return s
+}
+
+// SetScope replaces the scope, e.g. on config reload
+func (s *PolicyStore) SetScope(scope *Scope) {
+	s.scope.Store(scope)
+}
+
+func (s *PolicyStore) Scope() *Scope {
+	return s.scope.Load()
+}
+
+func (s *PolicyStore) SetPod(pod *corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pods[string(pod.UID)] = podMeta{
+		namespace:   pod.Namespace,
+		annotations: alazAnnotations(pod.Annotations),
+		labels:      pod.Labels,
+	}
+}
+
+func (s *PolicyStore) DeletePod(pod *corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pods, string(pod.UID))
+}
+
+func (s *PolicyStore) SetNamespace(ns *corev1.Namespace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namespaces[ns.Name] = namespaceMeta{
+		annotations: alazAnnotations(ns.Annotations),
+		labels:      ns.Labels,
+	}
+}
+
+func (s *PolicyStore) DeleteNamespace(ns *corev1.Namespace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.namespaces, ns.Name)
+}
+
+// ForPod resolves the policy of a pod, namespace is used if the pod is not known yet.
+// Safe to call on a nil store, defaults are returned.
+func (s *PolicyStore) ForPod(podUid string, namespace string) PodPolicy {
+	policy := defaultPodPolicy
+	if s == nil {
+		return policy
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pod, ok := s.pods[podUid]
+	if ok {
+		namespace = pod.namespace
+	}
+	if ns, ok := s.namespaces[namespace]; ok {
+		applyAnnotations(&policy, ns.annotations)
+	}
+	if ok {
+		applyAnnotations(&policy, pod.annotations)
+	}
+	return policy
+}
+
+// RequestTraced returns false if the source or destination pod opted out of tracing the protocol,
+// the destination is only checked if it is a pod
+func (s *PolicyStore) RequestTraced(fromUid string, toUid string, toPod bool, protocol string) bool {
+	from := s.ForPod(fromUid, "")
+	if !from.Tracing || !from.ProtocolEnabled(protocol) {
+		return false
+	}
+	if toPod {
+		to := s.ForPod(toUid, "")
+		return to.Tracing && to.ProtocolEnabled(protocol)
+	}
+	return true
+}
+
+// RequestPayloadCaptured returns true if either side of the request opted in for payload capture
+func (s *PolicyStore) RequestPayloadCaptured(fromUid string, toUid string, toPod bool) bool {
+	if s.ForPod(fromUid, "").CapturePayload {
+		return true
+	}
+	return toPod && s.ForPod(toUid, "").CapturePayload
+}
+
+func (s *PolicyStore) TracingEnabled(podUid string, namespace string) bool {
+	return s.ForPod(podUid, namespace).Tracing
+}
+
+func (s *PolicyStore) LogsEnabled(podUid string, namespace string) bool {
+	return s.ForPod(podUid, namespace).Logs
+}
+
+// InScope checks namespace and pod label selectors.
+// Pods and namespaces whose labels are not known yet are out of scope if a selector is set.
+func (s *PolicyStore) InScope(podUid string, namespace string) bool {
+	if s == nil {
+		return true
+	}
+	scope := s.scope.Load()
+	if !scope.HasSelectors() {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pod, podKnown := s.pods[podUid]
+	if podKnown {
+		namespace = pod.namespace
+	}
+	ns, nsKnown := s.namespaces[namespace]
+
+	if scope.namespaceSelector != nil && (!nsKnown || !scope.NamespaceLabelsAllowed(ns.labels)) {
+		return false
+	}
+	if scope.podSelector != nil && (!podKnown || !scope.PodLabelsAllowed(pod.labels)) {
+		return false
+	}
+	return true
+}
+
+// NamespaceInScope checks namespace name lists and namespace label selector
+func (s *PolicyStore) NamespaceInScope(namespace string) bool {
+	if s == nil {
+		return true
+	}
+	scope := s.scope.Load()
+	if !scope.NamespaceNameAllowed(namespace) {
+		return false
+	}
+	if scope.namespaceSelector == nil {
+		return true
+	}
+
+	s.mu.RLock()
+	ns, ok := s.namespaces[namespace]
+	s.mu.RUnlock()
+	return ok && scope.NamespaceLabelsAllowed(ns.labels)
+}
+
+// only keep annotations we are interested in, objects have lots of them
+func alazAnnotations(annotations map[string]string) map[string]string {
+	m := map[string]string{}
+	for _, k := range []string{AnnotationTracing, AnnotationLogs, AnnotationCapturePayload, AnnotationProtocols} {
+		if v, ok := annotations[k]; ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func applyAnnotations(p *PodPolicy, annotations map[string]string) {
+	if v, ok := annotations[AnnotationTracing]; ok {
+		p.Tracing = !strings.EqualFold(v, "false")
+	}
+	if v, ok := annotations[AnnotationLogs]; ok {
+		p.Logs = !strings.EqualFold(v, "false")
+	}
+	if v, ok := annotations[AnnotationCapturePayload]; ok {
+		p.CapturePayload = strings.EqualFold(v, "true")
+	}
+	if v, ok := annotations[AnnotationProtocols]; ok {
+		p.Protocols = nil
+		for _, proto := range strings.Split(v, ",") {
+			proto = strings.ToLower(strings.TrimSpace(proto))
+			if proto == "" {
+				continue
+			}
+			if p.Protocols == nil {
+				p.Protocols = map[string]struct{}{}
+			}
+			p.Protocols[proto] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/ddosify/alaz/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testPod(uid string, namespace string, annotations map[string]string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		UID:         types.UID(uid),
+		Name:        uid,
+		Namespace:   namespace,
+		Annotations: annotations,
+		Labels:      labels,
+	}}
+}
+
+func testNamespace(name string, annotations map[string]string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations, Labels: labels}}
+}
+
+func TestApplyAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        PodPolicy
+	}{
+		{
+			name: "defaults",
+			want: defaultPodPolicy,
+		},
+		{
+			name:        "tracing and logs off",
+			annotations: map[string]string{AnnotationTracing: "FALSE", AnnotationLogs: "false"},
+			want:        PodPolicy{Tracing: false, Logs: false},
+		},
+		{
+			name:        "anything but false keeps tracing",
+			annotations: map[string]string{AnnotationTracing: "no"},
+			want:        PodPolicy{Tracing: true, Logs: true},
+		},
+		{
+			name:        "capture payload",
+			annotations: map[string]string{AnnotationCapturePayload: "True"},
+			want:        PodPolicy{Tracing: true, Logs: true, CapturePayload: true},
+		},
+		{
+			name:        "protocols",
+			annotations: map[string]string{AnnotationProtocols: " HTTP, postgres,,"},
+			want: PodPolicy{Tracing: true, Logs: true, Protocols: map[string]struct{}{
+				"http": {}, "postgres": {},
+			}},
+		},
+		{
+			name:        "empty protocols mean all",
+			annotations: map[string]string{AnnotationProtocols: " , "},
+			want:        PodPolicy{Tracing: true, Logs: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := defaultPodPolicy
+			applyAnnotations(&got, alazAnnotations(tt.annotations))
+			if got.Tracing != tt.want.Tracing || got.Logs != tt.want.Logs || got.CapturePayload != tt.want.CapturePayload {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if len(got.Protocols) != len(tt.want.Protocols) || (got.Protocols == nil) != (tt.want.Protocols == nil) {
+				t.Fatalf("got protocols %v, want %v", got.Protocols, tt.want.Protocols)
+			}
+			for p := range tt.want.Protocols {
+				if !got.ProtocolEnabled(p) {
+					t.Errorf("protocol %s not enabled", p)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyStorePrecedence(t *testing.T) {
+	s := NewPolicyStore(nil)
+	s.SetNamespace(testNamespace("payments", map[string]string{
+		AnnotationTracing:   "false",
+		AnnotationProtocols: "http",
+	}, nil))
+	s.SetPod(testPod("api", "payments", map[string]string{AnnotationTracing: "true"}, nil))
+	s.SetPod(testPod("worker", "payments", nil, nil))
+
+	if p := s.ForPod("api", ""); !p.Tracing || !p.ProtocolEnabled("HTTP") || p.ProtocolEnabled("postgres") {
+		t.Errorf("pod annotation should override namespace tracing and keep its protocols, got %+v", p)
+	}
+	if s.TracingEnabled("worker", "") {
+		t.Error("pod without annotations should inherit namespace tracing")
+	}
+	if s.TracingEnabled("unknown", "payments") {
+		t.Error("unknown pod should use the given namespace")
+	}
+	if !s.TracingEnabled("unknown", "orders") || !s.LogsEnabled("unknown", "orders") {
+		t.Error("unknown pod in a namespace without annotations should use defaults")
+	}
+
+	s.DeletePod(testPod("api", "payments", nil, nil))
+	if !s.TracingEnabled("api", "") {
+		t.Error("deleted pod should fall back to defaults")
+	}
+
+	s.DeleteNamespace(testNamespace("payments", nil, nil))
+	if !s.TracingEnabled("worker", "") {
+		t.Error("deleted namespace annotations should not apply")
+	}
+
+	var nilStore *PolicyStore
+	if p := nilStore.ForPod("api", "payments"); !p.Tracing || !p.Logs || p.CapturePayload || p.Protocols != nil {
+		t.Errorf("nil store should return defaults, got %+v", p)
+	}
+}
+
+func TestPolicyStoreRequests(t *testing.T) {
+	s := NewPolicyStore(nil)
+	s.SetPod(testPod("web", "default", map[string]string{AnnotationCapturePayload: "true"}, nil))
+	s.SetPod(testPod("db", "default", map[string]string{AnnotationProtocols: "postgres"}, nil))
+	s.SetPod(testPod("batch", "default", map[string]string{AnnotationTracing: "false"}, nil))
+
+	tests := []struct {
+		name     string
+		from, to string
+		toPod    bool
+		protocol string
+		traced   bool
+		captured bool
+	}{
+		{name: "to pod", from: "web", to: "db", toPod: true, protocol: "POSTGRES", traced: true, captured: true},
+		{name: "protocol disabled on destination", from: "web", to: "db", toPod: true, protocol: "HTTP", captured: true},
+		{name: "protocol disabled on source", from: "db", to: "web", toPod: true, protocol: "HTTP", captured: true},
+		{name: "destination opted out", from: "web", to: "batch", toPod: true, protocol: "HTTP", captured: true},
+		{name: "source opted out", from: "batch", to: "web", toPod: true, protocol: "HTTP", captured: true},
+		{name: "destination not a pod", from: "web", to: "batch", protocol: "HTTP", traced: true, captured: true},
+		{name: "capture on destination pod only", from: "db", to: "web", toPod: true, protocol: "POSTGRES", traced: true, captured: true},
+		{name: "capture ignored for services", from: "db", to: "web", protocol: "POSTGRES", traced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.RequestTraced(tt.from, tt.to, tt.toPod, tt.protocol); got != tt.traced {
+				t.Errorf("RequestTraced = %v, want %v", got, tt.traced)
+			}
+			if got := s.RequestPayloadCaptured(tt.from, tt.to, tt.toPod); got != tt.captured {
+				t.Errorf("RequestPayloadCaptured = %v, want %v", got, tt.captured)
+			}
+		})
+	}
+
+	var nilStore *PolicyStore
+	if !nilStore.RequestTraced("web", "db", true, "HTTP") || nilStore.RequestPayloadCaptured("web", "db", true) {
+		t.Error("nil store should trace and not capture payloads")
+	}
+}
+
+func TestPolicyStoreInScope(t *testing.T) {
+	scope, err := NewScope(config.PolicyConfig{
+		ExcludeNamespaceList: []string{"kube-system"},
+		NamespaceSelector:    "team=payments",
+		PodSelector:          "app",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewPolicyStore(scope)
+	s.SetNamespace(testNamespace("payments", nil, map[string]string{"team": "payments"}))
+	s.SetNamespace(testNamespace("orders", nil, map[string]string{"team": "orders"}))
+	s.SetNamespace(testNamespace("kube-system", nil, map[string]string{"team": "payments"}))
+	s.SetPod(testPod("api", "payments", nil, map[string]string{"app": "api"}))
+	s.SetPod(testPod("job", "payments", nil, nil))
+	s.SetPod(testPod("orders-api", "orders", nil, map[string]string{"app": "api"}))
+
+	tests := []struct {
+		name      string
+		uid       string
+		namespace string
+		want      bool
+	}{
+		{name: "matching pod and namespace", uid: "api", want: true},
+		{name: "pod without label", uid: "job", want: false},
+		{name: "namespace not selected", uid: "orders-api", want: false},
+		{name: "unknown pod", uid: "new", namespace: "payments", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.InScope(tt.uid, tt.namespace); got != tt.want {
+				t.Errorf("InScope(%q, %q) = %v, want %v", tt.uid, tt.namespace, got, tt.want)
+			}
+		})
+	}
+
+	for ns, want := range map[string]bool{"payments": true, "orders": false, "kube-system": false, "unknown": false} {
+		if got := s.NamespaceInScope(ns); got != want {
+			t.Errorf("NamespaceInScope(%q) = %v, want %v", ns, got, want)
+		}
+	}
+
+	// without selectors only the name lists apply
+	scope, _ = NewScope(config.PolicyConfig{ExcludeNamespaceList: []string{"kube-system"}})
+	s.SetScope(scope)
+	if !s.InScope("new", "orders") || !s.NamespaceInScope("unknown") || s.NamespaceInScope("kube-system") {
+		t.Error("name lists only scope is not applied")
+	}
+
+	var nilStore *PolicyStore
+	if !nilStore.InScope("api", "payments") || !nilStore.NamespaceInScope("kube-system") {
+		t.Error("nil store should have everything in scope")
+	}
+}
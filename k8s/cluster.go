@@ -0,0 +1,46 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ddosify/alaz/config"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	RegionLabel = "topology.kubernetes.io/region"
+	ZoneLabel   = "topology.kubernetes.io/zone"
+)
+
+// DiscoverCluster fills settings of conf that are not set from the cluster,
+// whatever could be discovered is returned along with the errors
+func (k *K8sCollector) DiscoverCluster(ctx context.Context, conf config.ClusterConfig, nodeName string) (config.ClusterConfig, error) {
+	var errs []error
+	if conf.ID == "" {
+		// kube-system is there as long as the cluster is, its uid is unique per cluster
+		ns, err := k.clientset.CoreV1().Namespaces().Get(ctx, "kube-system", metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get cluster id: %w", err))
+		} else {
+			conf.ID = string(ns.UID)
+		}
+	}
+
+	if conf.Region == "" || conf.Zone == "" {
+		node, err := k.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get topology labels of node %s: %w", nodeName, err))
+		} else {
+			if conf.Region == "" {
+				conf.Region = node.Labels[RegionLabel]
+			}
+			if conf.Zone == "" {
+				conf.Zone = node.Labels[ZoneLabel]
+			}
+		}
+	}
+	return conf, errors.Join(errs...)
+}
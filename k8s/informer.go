@@ -7,11 +7,13 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ddosify/alaz/log"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 	appsv1 "k8s.io/client-go/informers/apps/v1"
@@ -35,6 +37,8 @@ const (
 	CONTAINER   = "Container"
 	DAEMONSET   = "DaemonSet"
 	STATEFULSET = "StatefulSet"
+	NAMESPACE   = "Namespace"
+	NODE        = "Node"
 )
 
 const (
@@ -46,8 +50,13 @@ const (
 var k8sVersion string
 var resyncPeriod time.Duration = 120 * time.Second
 
+// the kubeconfig flag can only be defined once, a restarted collector reuses it
+var kubeconfigOnce sync.Once
+var kubeconfig *string
+
 type K8sCollector struct {
 	ctx              context.Context
+	clientset        kubernetes.Interface
 	informersFactory informers.SharedInformerFactory
 	watchers         map[K8SResourceType]cache.SharedIndexInformer
 	stopper          chan struct{} // stop signal for the informers
@@ -60,13 +69,26 @@ type K8sCollector struct {
 	endpointsInformer   v1.EndpointsInformer
 	daemonsetInformer   appsv1.DaemonSetInformer
 	statefulSetInformer appsv1.StatefulSetInformer
+	namespaceInformer   v1.NamespaceInformer
+	nodeInformer        v1.NodeInformer
+
+	// alaz.io annotations and labels of pods and namespaces
+	policies *PolicyStore
+
+	// set once handlers are added, cached resources are sent through them again on Resync
+	handlers map[K8SResourceType]cache.ResourceEventHandlerFuncs
+	started  atomic.Bool
+	resyncMu sync.Mutex // held by Resync, events are not closed under it
 
 	Events chan interface{}
 }
 
 func (k *K8sCollector) Init(events chan interface{}) error {
 	log.Logger.Info().Msg("k8sCollector initializing...")
-	k.Events = events
+
+	// handlers write to k.Events, resources out of scope are dropped or marked before they are forwarded to events
+	k.Events = make(chan interface{}, cap(events))
+	go k.forwardScoped(k.Events, events)
 
 	// Pod
 	k.podInformer = k.informersFactory.Core().V1().Pods()
@@ -96,62 +118,97 @@ func (k *K8sCollector) Init(events chan interface{}) error {
 	k.statefulSetInformer = k.informersFactory.Apps().V1().StatefulSets()
 	k.watchers[STATEFULSET] = k.statefulSetInformer.Informer()
 
+	// Namespace
+	k.namespaceInformer = k.informersFactory.Core().V1().Namespaces()
+	k.watchers[NAMESPACE] = k.namespaceInformer.Informer()
+
+	// Node
+	k.nodeInformer = k.informersFactory.Core().V1().Nodes()
+	k.watchers[NODE] = k.nodeInformer.Informer()
+
 	defer runtime.HandleCrash()
 
 	// Add event handlers
-	k.watchers[POD].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddPodFunc(k.Events),
-		UpdateFunc: getOnUpdatePodFunc(k.Events),
-		DeleteFunc: getOnDeletePodFunc(k.Events),
-	})
-
-	k.watchers[SERVICE].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddServiceFunc(k.Events),
-		UpdateFunc: getOnUpdateServiceFunc(k.Events),
-		DeleteFunc: getOnDeleteServiceFunc(k.Events),
-	})
-
-	k.watchers[REPLICASET].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddReplicaSetFunc(k.Events),
-		UpdateFunc: getOnUpdateReplicaSetFunc(k.Events),
-		DeleteFunc: getOnDeleteReplicaSetFunc(k.Events),
-	})
-
-	k.watchers[DEPLOYMENT].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddDeploymentSetFunc(k.Events),
-		UpdateFunc: getOnUpdateDeploymentSetFunc(k.Events),
-		DeleteFunc: getOnDeleteDeploymentSetFunc(k.Events),
-	})
-
-	k.watchers[ENDPOINTS].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddEndpointsSetFunc(k.Events),
-		UpdateFunc: getOnUpdateEndpointsSetFunc(k.Events),
-		DeleteFunc: getOnDeleteEndpointsSetFunc(k.Events),
-	})
-
-	k.watchers[DAEMONSET].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddDaemonSetFunc(k.Events),
-		UpdateFunc: getOnUpdateDaemonSetFunc(k.Events),
-		DeleteFunc: getOnDeleteDaemonSetFunc(k.Events),
-	})
-
-	k.watchers[STATEFULSET].AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    getOnAddStatefulSetFunc(k.Events),
-		UpdateFunc: getOnUpdateStatefulSetFunc(k.Events),
-		DeleteFunc: getOnDeleteStatefulSetFunc(k.Events),
-	})
+	k.handlers = map[K8SResourceType]cache.ResourceEventHandlerFuncs{
+		POD: {
+			AddFunc:    getOnAddPodFunc(k.Events, k.policies),
+			UpdateFunc: getOnUpdatePodFunc(k.Events, k.policies),
+			DeleteFunc: getOnDeletePodFunc(k.Events, k.policies),
+		},
+		SERVICE: {
+			AddFunc:    getOnAddServiceFunc(k.Events),
+			UpdateFunc: getOnUpdateServiceFunc(k.Events),
+			DeleteFunc: getOnDeleteServiceFunc(k.Events),
+		},
+		REPLICASET: {
+			AddFunc:    getOnAddReplicaSetFunc(k.Events),
+			UpdateFunc: getOnUpdateReplicaSetFunc(k.Events),
+			DeleteFunc: getOnDeleteReplicaSetFunc(k.Events),
+		},
+		DEPLOYMENT: {
+			AddFunc:    getOnAddDeploymentSetFunc(k.Events),
+			UpdateFunc: getOnUpdateDeploymentSetFunc(k.Events),
+			DeleteFunc: getOnDeleteDeploymentSetFunc(k.Events),
+		},
+		ENDPOINTS: {
+			AddFunc:    getOnAddEndpointsSetFunc(k.Events),
+			UpdateFunc: getOnUpdateEndpointsSetFunc(k.Events),
+			DeleteFunc: getOnDeleteEndpointsSetFunc(k.Events),
+		},
+		DAEMONSET: {
+			AddFunc:    getOnAddDaemonSetFunc(k.Events),
+			UpdateFunc: getOnUpdateDaemonSetFunc(k.Events),
+			DeleteFunc: getOnDeleteDaemonSetFunc(k.Events),
+		},
+		STATEFULSET: {
+			AddFunc:    getOnAddStatefulSetFunc(k.Events),
+			UpdateFunc: getOnUpdateStatefulSetFunc(k.Events),
+			DeleteFunc: getOnDeleteStatefulSetFunc(k.Events),
+		},
+		NAMESPACE: {
+			AddFunc:    getOnAddNamespaceFunc(k.policies),
+			UpdateFunc: getOnUpdateNamespaceFunc(k.policies),
+			DeleteFunc: getOnDeleteNamespaceFunc(k.policies),
+		},
+		NODE: {
+			AddFunc:    getOnAddNodeFunc(k.Events),
+			UpdateFunc: getOnUpdateNodeFunc(k.Events),
+			DeleteFunc: getOnDeleteNodeFunc(k.Events),
+		},
+	}
+	for resourceType, h := range k.handlers {
+		k.watchers[resourceType].AddEventHandler(h)
+	}
+	k.started.Store(true)
 
 	wg := sync.WaitGroup{}
 	wg.Add(len(k.watchers))
-	for _, watcher := range k.watchers {
+
+	// namespace labels must be known before other resources are checked against namespace selector
+	go func() {
+		k.watchers[NAMESPACE].Run(k.stopper)
+		wg.Done()
+	}()
+	if !cache.WaitForCacheSync(k.stopper, k.watchers[NAMESPACE].HasSynced) {
+		log.Logger.Warn().Msg("namespace informer could not sync")
+	}
+
+	for resourceType, watcher := range k.watchers {
+		if resourceType == NAMESPACE {
+			continue
+		}
 		go func(watcher cache.SharedIndexInformer) {
 			watcher.Run(k.stopper) // it will return when stopper is closed
 			wg.Done()
 		}(watcher)
 	}
 	wg.Wait()
+	// handlers are done, a running Resync returns as ctx is cancelled
+	k.resyncMu.Lock()
+	close(k.Events)
+	k.resyncMu.Unlock()
 	log.Logger.Info().Msg("k8sCollector informers stopped")
-	k.doneChan <- struct{}{}
+	close(k.doneChan)
 
 	return nil
 }
@@ -160,21 +217,24 @@ func (k *K8sCollector) Done() <-chan struct{} {
 	return k.doneChan
 }
 
-func NewK8sCollector(parentCtx context.Context) (*K8sCollector, error) {
+// NewK8sCollector creates a collector forwarding resources in scope of policies.
+// Policies outlive the collector, so a restarted one keeps them for their other users.
+func NewK8sCollector(parentCtx context.Context, policies *PolicyStore) (*K8sCollector, error) {
 	ctx, _ := context.WithCancel(parentCtx)
 	// get incluster kubeconfig
-	var kubeconfig *string
 	var kubeConfig *rest.Config
 
 	if os.Getenv("IN_CLUSTER") == "false" {
 		var err error
-		if home := homedir.HomeDir(); home != "" {
-			kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-		} else {
-			kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-		}
+		kubeconfigOnce.Do(func() {
+			if home := homedir.HomeDir(); home != "" {
+				kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+			} else {
+				kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+			}
 
-		flag.Parse()
+			flag.Parse()
+		})
 
 		kubeConfig, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
 		if err != nil {
@@ -205,10 +265,12 @@ func NewK8sCollector(parentCtx context.Context) (*K8sCollector, error) {
 
 	collector := &K8sCollector{
 		ctx:              ctx,
+		clientset:        clientset,
 		stopper:          make(chan struct{}),
 		doneChan:         make(chan struct{}),
 		informersFactory: factory,
 		watchers:         map[K8SResourceType]cache.SharedIndexInformer{},
+		policies:         policies,
 	}
 
 	go func(c *K8sCollector) {
@@ -223,6 +285,92 @@ func (k *K8sCollector) GetK8sVersion() string {
 	return k8sVersion
 }
 
+// Policies returns pod policies resolved from alaz.io annotations
+func (k *K8sCollector) Policies() *PolicyStore {
+	return k.policies
+}
+
+// SetScope replaces the scope resources are forwarded in
+func (k *K8sCollector) SetScope(scope *Scope) {
+	k.policies.SetScope(scope)
+}
+
+// Resync sends cached resources through their handlers again, so that
+// those that came into scope with a new scope are forwarded
+func (k *K8sCollector) Resync() {
+	if !k.started.Load() {
+		return
+	}
+	k.resyncMu.Lock()
+	defer k.resyncMu.Unlock()
+	for resourceType, h := range k.handlers {
+		// namespaces only update policies, nodes are not scoped
+		if resourceType == NAMESPACE || resourceType == NODE {
+			continue
+		}
+		for _, obj := range k.watchers[resourceType].GetStore().List() {
+			if k.ctx.Err() != nil {
+				return
+			}
+			h.OnUpdate(obj, obj)
+		}
+	}
+}
+
+// resources the aggregator resolves addresses and localities of requests with,
+// those out of scope are forwarded too since in scope pods talk to them
+var resolvedOutOfScope = map[string]bool{POD: true, SERVICE: true, ENDPOINTS: true}
+
+// forwardScoped runs until in is closed. Once informers are stopping, messages are dropped
+// instead of blocking on out, which is shared with a restarted collector.
+func (k *K8sCollector) forwardScoped(in <-chan interface{}, out chan<- interface{}) {
+	for msg := range in {
+		m := msg.(K8sResourceMessage)
+		if !k.inScope(m) {
+			if !resolvedOutOfScope[m.ResourceType] {
+				continue
+			}
+			m.OutOfScope = true
+			msg = m
+		}
+		select {
+		case out <- msg:
+		case <-k.stopper:
+		}
+	}
+}
+
+// inScope checks namespaced resources against namespace lists and selector, and pods against pod selector.
+// Deletes are always forwarded, the resource may have been forwarded before it went out of scope.
+func (k *K8sCollector) inScope(msg K8sResourceMessage) bool {
+	if msg.EventType == DELETE {
+		return true
+	}
+
+	var namespace string
+	if c, ok := msg.Object.(*Container); ok {
+		if !k.policies.InScope(c.PodUID, c.Namespace) {
+			return false
+		}
+		namespace = c.Namespace
+	} else {
+		obj, err := meta.Accessor(msg.Object)
+		if err != nil {
+			return true
+		}
+		namespace = obj.GetNamespace()
+		if pod, ok := msg.Object.(*corev1.Pod); ok && !k.policies.Scope().PodLabelsAllowed(pod.Labels) {
+			return false
+		}
+	}
+
+	// cluster scoped resources
+	if namespace == "" {
+		return true
+	}
+	return k.policies.NamespaceInScope(namespace)
+}
+
 func (k *K8sCollector) close() {
 	log.Logger.Info().Msg("k8sCollector closing...")
 	close(k.stopper) // stop informers
@@ -237,4 +385,6 @@ type K8sResourceMessage struct {
 	ResourceType string      `json:"type"`
 	EventType    string      `json:"eventType"`
 	Object       interface{} `json:"object"`
+	// only used to resolve requests, not persisted
+	OutOfScope bool `json:"-"`
 }
@@ -0,0 +1,31 @@
+package k8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaces are only watched for their alaz annotations, they are not sent to the aggregator
+
+func getOnAddNamespaceFunc(policies *PolicyStore) func(interface{}) {
+	return func(obj interface{}) {
+		policies.SetNamespace(obj.(*corev1.Namespace))
+	}
+}
+
+func getOnUpdateNamespaceFunc(policies *PolicyStore) func(interface{}, interface{}) {
+	return func(oldObj, newObj interface{}) {
+		policies.SetNamespace(newObj.(*corev1.Namespace))
+	}
+}
+
+func getOnDeleteNamespaceFunc(policies *PolicyStore) func(interface{}) {
+	return func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if ns, ok := obj.(*corev1.Namespace); ok {
+			policies.DeleteNamespace(ns)
+		}
+	}
+}
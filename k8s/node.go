@@ -0,0 +1,48 @@
+package k8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nodes are only sent for their topology labels, status updates are left out
+
+func getOnAddNodeFunc(ch chan interface{}) func(interface{}) {
+	return func(obj interface{}) {
+		ch <- K8sResourceMessage{
+			ResourceType: NODE,
+			EventType:    ADD,
+			Object:       obj,
+		}
+	}
+}
+
+func getOnUpdateNodeFunc(ch chan interface{}) func(interface{}, interface{}) {
+	return func(oldObj, newObj interface{}) {
+		oldNode, newNode := oldObj.(*corev1.Node), newObj.(*corev1.Node)
+		if oldNode.Labels[ZoneLabel] == newNode.Labels[ZoneLabel] && oldNode.Labels[RegionLabel] == newNode.Labels[RegionLabel] {
+			return
+		}
+		ch <- K8sResourceMessage{
+			ResourceType: NODE,
+			EventType:    UPDATE,
+			Object:       newObj,
+		}
+	}
+}
+
+func getOnDeleteNodeFunc(ch chan interface{}) func(interface{}) {
+	return func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if _, ok := obj.(*corev1.Node); !ok {
+			return
+		}
+		ch <- K8sResourceMessage{
+			ResourceType: NODE,
+			EventType:    DELETE,
+			Object:       obj,
+		}
+	}
+}
@@ -2,6 +2,7 @@ package k8s
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 type Container struct {
@@ -45,9 +46,10 @@ func getContainers(pod *corev1.Pod) []*Container {
 	return containers
 }
 
-func getOnAddPodFunc(ch chan interface{}) func(interface{}) {
+func getOnAddPodFunc(ch chan interface{}, policies *PolicyStore) func(interface{}) {
 	return func(obj interface{}) {
 		pod := obj.(*corev1.Pod)
+		policies.SetPod(pod)
 		containers := getContainers(pod)
 
 		ch <- K8sResourceMessage{
@@ -66,9 +68,10 @@ func getOnAddPodFunc(ch chan interface{}) func(interface{}) {
 	}
 }
 
-func getOnUpdatePodFunc(ch chan interface{}) func(interface{}, interface{}) {
+func getOnUpdatePodFunc(ch chan interface{}, policies *PolicyStore) func(interface{}, interface{}) {
 	return func(oldObj, newObj interface{}) {
 		pod := newObj.(*corev1.Pod)
+		policies.SetPod(pod)
 
 		containers := getContainers(pod)
 		ch <- K8sResourceMessage{
@@ -86,8 +89,16 @@ func getOnUpdatePodFunc(ch chan interface{}) func(interface{}, interface{}) {
 	}
 }
 
-func getOnDeletePodFunc(ch chan interface{}) func(interface{}) {
+func getOnDeletePodFunc(ch chan interface{}, policies *PolicyStore) func(interface{}) {
 	return func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return
+		}
+		policies.DeletePod(pod)
 		ch <- K8sResourceMessage{
 			ResourceType: POD,
 			EventType:    DELETE,
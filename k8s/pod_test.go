@@ -0,0 +1,30 @@
+package k8s
+
+import (
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestOnDeletePodUnwrapsTombstone(t *testing.T) {
+	s := NewPolicyStore(nil)
+	pod := testPod("api", "payments", map[string]string{AnnotationTracing: "false"}, nil)
+	s.SetPod(pod)
+
+	ch := make(chan interface{}, 1)
+	onDelete := getOnDeletePodFunc(ch, s)
+	onDelete(cache.DeletedFinalStateUnknown{Key: "payments/api", Obj: pod})
+
+	msg := (<-ch).(K8sResourceMessage)
+	if msg.EventType != DELETE || msg.Object != pod {
+		t.Errorf("got %+v, want delete of the pod in the tombstone", msg)
+	}
+	if !s.TracingEnabled("api", "") {
+		t.Error("pod policy should be deleted")
+	}
+
+	onDelete(cache.DeletedFinalStateUnknown{Key: "payments/unknown", Obj: nil})
+	if len(ch) != 0 {
+		t.Error("tombstone without a pod should be ignored")
+	}
+}
@@ -0,0 +1,93 @@
+package k8s
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ddosify/alaz/config"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Scope limits alaz to a subset of the cluster's workloads, see config.PolicyConfig.
+// It is immutable, a new scope is built when the policy is reloaded.
+type Scope struct {
+	includeNamespaces map[string]struct{} // empty means all namespaces
+	excludeNamespaces map[string]struct{}
+	excludeRx         *regexp.Regexp
+
+	namespaceSelector labels.Selector // nil means all namespaces
+	podSelector       labels.Selector // nil means all pods
+}
+
+func NewScope(conf config.PolicyConfig) (*Scope, error) {
+	s := &Scope{
+		includeNamespaces: namespaceSet(conf.IncludeNamespaces),
+		excludeNamespaces: namespaceSet(conf.ExcludeNamespaceList),
+	}
+
+	var err error
+	if conf.ExcludeNamespaces != "" {
+		if s.excludeRx, err = regexp.Compile(conf.ExcludeNamespaces); err != nil {
+			return nil, fmt.Errorf("invalid exclude namespaces regex: %w", err)
+		}
+	}
+	if conf.NamespaceSelector != "" {
+		if s.namespaceSelector, err = labels.Parse(conf.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+	}
+	if conf.PodSelector != "" {
+		if s.podSelector, err = labels.Parse(conf.PodSelector); err != nil {
+			return nil, fmt.Errorf("invalid pod selector: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func namespaceSet(list []string) map[string]struct{} {
+	m := map[string]struct{}{}
+	for _, ns := range list {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			m[ns] = struct{}{}
+		}
+	}
+	return m
+}
+
+// NamespaceNameAllowed checks include/exclude lists and exclude regex
+func (s *Scope) NamespaceNameAllowed(ns string) bool {
+	if s == nil {
+		return true
+	}
+	if len(s.includeNamespaces) > 0 {
+		if _, ok := s.includeNamespaces[ns]; !ok {
+			return false
+		}
+	}
+	if _, ok := s.excludeNamespaces[ns]; ok {
+		return false
+	}
+	if s.excludeRx != nil && s.excludeRx.MatchString(ns) {
+		return false
+	}
+	return true
+}
+
+func (s *Scope) NamespaceLabelsAllowed(l map[string]string) bool {
+	if s == nil || s.namespaceSelector == nil {
+		return true
+	}
+	return s.namespaceSelector.Matches(labels.Set(l))
+}
+
+func (s *Scope) PodLabelsAllowed(l map[string]string) bool {
+	if s == nil || s.podSelector == nil {
+		return true
+	}
+	return s.podSelector.Matches(labels.Set(l))
+}
+
+func (s *Scope) HasSelectors() bool {
+	return s != nil && (s.namespaceSelector != nil || s.podSelector != nil)
+}
@@ -0,0 +1,195 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/ddosify/alaz/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestScopeNamespaceNameAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.PolicyConfig
+		allowed map[string]bool
+	}{
+		{
+			name:    "no policy",
+			conf:    config.PolicyConfig{},
+			allowed: map[string]bool{"default": true, "kube-system": true},
+		},
+		{
+			name:    "include list",
+			conf:    config.PolicyConfig{IncludeNamespaces: []string{"payments", " orders "}},
+			allowed: map[string]bool{"payments": true, "orders": true, "default": false},
+		},
+		{
+			name:    "exclude list",
+			conf:    config.PolicyConfig{ExcludeNamespaceList: []string{"kube-system", ""}},
+			allowed: map[string]bool{"kube-system": false, "default": true, "": true},
+		},
+		{
+			name:    "exclude regex",
+			conf:    config.PolicyConfig{ExcludeNamespaces: "^(kube-|alaz)"},
+			allowed: map[string]bool{"kube-system": false, "kube-public": false, "alaz": false, "my-kube": true},
+		},
+		{
+			name: "exclude wins over include",
+			conf: config.PolicyConfig{
+				IncludeNamespaces:    []string{"payments", "orders", "payments-canary"},
+				ExcludeNamespaceList: []string{"orders"},
+				ExcludeNamespaces:    "-canary$",
+			},
+			allowed: map[string]bool{"payments": true, "orders": false, "payments-canary": false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScope(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ns, want := range tt.allowed {
+				if got := s.NamespaceNameAllowed(ns); got != want {
+					t.Errorf("NamespaceNameAllowed(%q) = %v, want %v", ns, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestScopeSelectors(t *testing.T) {
+	tests := []struct {
+		name         string
+		conf         config.PolicyConfig
+		labels       map[string]string
+		namespace    bool
+		pod          bool
+		hasSelectors bool
+	}{
+		{
+			name:      "no selectors",
+			labels:    map[string]string{"team": "payments"},
+			namespace: true,
+			pod:       true,
+		},
+		{
+			name:         "namespace selector matches",
+			conf:         config.PolicyConfig{NamespaceSelector: "team=payments"},
+			labels:       map[string]string{"team": "payments"},
+			namespace:    true,
+			pod:          true,
+			hasSelectors: true,
+		},
+		{
+			name:         "namespace selector does not match",
+			conf:         config.PolicyConfig{NamespaceSelector: "team=payments"},
+			labels:       map[string]string{"team": "orders"},
+			namespace:    false,
+			pod:          true,
+			hasSelectors: true,
+		},
+		{
+			name:         "pod set selector",
+			conf:         config.PolicyConfig{PodSelector: "app in (api,web),!canary"},
+			labels:       map[string]string{"app": "web"},
+			namespace:    true,
+			pod:          true,
+			hasSelectors: true,
+		},
+		{
+			name:         "pod selector excludes label",
+			conf:         config.PolicyConfig{PodSelector: "app in (api,web),!canary"},
+			labels:       map[string]string{"app": "web", "canary": "true"},
+			namespace:    true,
+			pod:          false,
+			hasSelectors: true,
+		},
+		{
+			name:         "pod selector without labels",
+			conf:         config.PolicyConfig{PodSelector: "app"},
+			namespace:    true,
+			pod:          false,
+			hasSelectors: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScope(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.NamespaceLabelsAllowed(tt.labels); got != tt.namespace {
+				t.Errorf("NamespaceLabelsAllowed = %v, want %v", got, tt.namespace)
+			}
+			if got := s.PodLabelsAllowed(tt.labels); got != tt.pod {
+				t.Errorf("PodLabelsAllowed = %v, want %v", got, tt.pod)
+			}
+			if got := s.HasSelectors(); got != tt.hasSelectors {
+				t.Errorf("HasSelectors = %v, want %v", got, tt.hasSelectors)
+			}
+		})
+	}
+}
+
+func TestNewScopeErrors(t *testing.T) {
+	for _, conf := range []config.PolicyConfig{
+		{ExcludeNamespaces: "kube-("},
+		{NamespaceSelector: "team in (payments"},
+		{PodSelector: "app in"},
+	} {
+		if _, err := NewScope(conf); err == nil {
+			t.Errorf("NewScope(%+v) succeeded, want error", conf)
+		}
+	}
+}
+
+func TestNilScopeAllowsAll(t *testing.T) {
+	var s *Scope
+	if !s.NamespaceNameAllowed("default") || !s.NamespaceLabelsAllowed(nil) || !s.PodLabelsAllowed(nil) {
+		t.Error("nil scope should allow all")
+	}
+	if s.HasSelectors() {
+		t.Error("nil scope has no selectors")
+	}
+}
+
+func TestForwardScopedMarksResolvedResources(t *testing.T) {
+	s, err := NewScope(config.PolicyConfig{IncludeNamespaces: []string{"payments"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &K8sCollector{policies: NewPolicyStore(s), stopper: make(chan struct{})}
+
+	in := make(chan interface{}, 10)
+	out := make(chan interface{}, 10)
+	meta := func(ns string) metav1.ObjectMeta { return metav1.ObjectMeta{Name: "x", Namespace: ns} }
+	in <- K8sResourceMessage{ResourceType: POD, EventType: ADD, Object: &corev1.Pod{ObjectMeta: meta("payments")}}
+	in <- K8sResourceMessage{ResourceType: POD, EventType: ADD, Object: &corev1.Pod{ObjectMeta: meta("orders")}}
+	in <- K8sResourceMessage{ResourceType: SERVICE, EventType: UPDATE, Object: &corev1.Service{ObjectMeta: meta("orders")}}
+	in <- K8sResourceMessage{ResourceType: ENDPOINTS, EventType: ADD, Object: &corev1.Endpoints{ObjectMeta: meta("orders")}}
+	in <- K8sResourceMessage{ResourceType: DEPLOYMENT, EventType: ADD, Object: &appsv1.Deployment{ObjectMeta: meta("orders")}}
+	close(in)
+	k.forwardScoped(in, out)
+	close(out)
+
+	var got []K8sResourceMessage
+	for msg := range out {
+		got = append(got, msg.(K8sResourceMessage))
+	}
+	if len(got) != 4 {
+		t.Fatalf("forwarded %d messages, want 4", len(got))
+	}
+	if got[0].OutOfScope {
+		t.Error("pod in scope marked out of scope")
+	}
+	for _, m := range got[1:] {
+		if !m.OutOfScope {
+			t.Errorf("%s out of scope not marked", m.ResourceType)
+		}
+	}
+}
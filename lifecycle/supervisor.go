@@ -0,0 +1,439 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ddosify/alaz/log"
+)
+
+type State string
+
+const (
+	StateNew        State = "new"
+	StateStarting   State = "starting"
+	StateRunning    State = "running"
+	StateRestarting State = "restarting" // waiting for the next start attempt
+	StateFailed     State = "failed"
+	StateStopping   State = "stopping"
+	StateStopped    State = "stopped"
+	StatePaused     State = "paused"    // stopped on request until resumed
+	StateUnhealthy  State = "unhealthy" // running but its check fails, only reported
+)
+
+var (
+	minRestartBackoff = 5 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+	// a run shorter than this keeps the backoff growing, so crash loops slow down
+	stableRunDuration = time.Minute
+)
+
+// Component is a part of alaz run by the Supervisor
+type Component struct {
+	Name string
+	// Start brings the component up, it is stopped by cancelling ctx.
+	// The returned channel is closed once the component has stopped.
+	Start func(ctx context.Context) (<-chan struct{}, error)
+	// Stop, if set, runs before ctx is cancelled, e.g. to drain buffered events
+	Stop func(ctx context.Context) error
+	// Restart with backoff when the component fails to start or stops on its own
+	Restart bool
+	// Optional components do not affect health and readiness
+	Optional bool
+	// Check, if set, tells whether a running component still works, e.g. that its event loop
+	// makes progress. A failing check makes the component unhealthy and alaz not ready.
+	Check func() error
+}
+
+type Status struct {
+	Name     string    `json:"name"`
+	State    State     `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Restarts int       `json:"restarts"`
+	Since    time.Time `json:"since"`
+}
+
+type component struct {
+	Component
+
+	mu       sync.Mutex
+	state    State
+	err      error
+	since    time.Time
+	restarts int
+	backoff  time.Duration
+	cancel   context.CancelFunc
+	stopped  chan struct{} // closed once the current run has stopped
+	paused   bool
+	attempt  int // pending restarts of an earlier attempt give up when it changes
+}
+
+func (c *component) setState(state State, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	c.err = err
+	c.since = time.Now()
+}
+
+func (c *component) status() Status {
+	c.mu.Lock()
+	s := Status{Name: c.Name, State: c.state, Restarts: c.restarts, Since: c.since}
+	if c.err != nil {
+		s.Error = c.err.Error()
+	}
+	c.mu.Unlock()
+
+	// checked without the lock, a check may take a while
+	if s.State == StateRunning && c.Check != nil {
+		if err := c.Check(); err != nil {
+			s.State, s.Error = StateUnhealthy, err.Error()
+		}
+	}
+	return s
+}
+
+// Supervisor starts components in the order they are added, stops them
+// in reverse order and restarts the ones that fail.
+// Its state backs the /healthz and /readyz endpoints.
+type Supervisor struct {
+	ctx    context.Context // cancelled on shutdown, stops pending restarts
+	cancel context.CancelFunc
+
+	mu         sync.RWMutex
+	components []*component
+}
+
+func NewSupervisor() *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Supervisor{ctx: ctx, cancel: cancel}
+}
+
+func (s *Supervisor) Add(c Component) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.components = append(s.components, &component{Component: c, state: StateNew, since: time.Now()})
+}
+
+func (s *Supervisor) get(name string) *component {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.components {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) list() []*component {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*component(nil), s.components...)
+}
+
+// Start starts all components in order. It returns an error if a required
+// component that is not restarted fails to start, later ones are not started then.
+func (s *Supervisor) Start() error {
+	for _, c := range s.list() {
+		err := s.start(c)
+		if err == nil {
+			continue
+		}
+		if c.Restart {
+			go s.retry(c, err)
+			continue
+		}
+		c.setState(StateFailed, err)
+		if !c.Optional {
+			return fmt.Errorf("failed to start %s: %w", c.Name, err)
+		}
+		log.Logger.Error().Err(err).Msgf("failed to start %s", c.Name)
+	}
+	return nil
+}
+
+func (s *Supervisor) start(c *component) error {
+	c.setState(StateStarting, nil)
+	log.Logger.Info().Msgf("starting %s", c.Name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done, err := c.Start(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	stopped := make(chan struct{})
+	c.mu.Lock()
+	c.cancel = cancel
+	c.stopped = stopped
+	c.state = StateRunning
+	c.err = nil
+	c.since = time.Now()
+	paused := c.paused
+	c.mu.Unlock()
+
+	// shutdown began or the component was paused while starting, nobody else will stop it
+	if s.ctx.Err() != nil || paused {
+		c.setState(StateStopping, nil)
+		cancel()
+	}
+
+	go s.watch(c, done, stopped)
+	return nil
+}
+
+// watch waits for a run of the component to end, restarting it if it ended on its own
+func (s *Supervisor) watch(c *component, done <-chan struct{}, stopped chan struct{}) {
+	<-done
+
+	// state is settled before stop returns, a restart may follow right away
+	c.mu.Lock()
+	expected := c.state == StateStopping
+	if expected {
+		c.state = StateStopped
+		if c.paused {
+			c.state = StatePaused
+		}
+		c.since = time.Now()
+	} else if time.Since(c.since) >= stableRunDuration {
+		c.backoff = 0
+	}
+	c.mu.Unlock()
+	close(stopped)
+	if expected {
+		return
+	}
+
+	err := errors.New("stopped unexpectedly")
+	log.Logger.Error().Err(err).Msgf("%s stopped", c.Name)
+	if !c.Restart || s.ctx.Err() != nil {
+		c.setState(StateFailed, err)
+		return
+	}
+	s.retry(c, err)
+}
+
+func (s *Supervisor) retry(c *component, err error) {
+	c.mu.Lock()
+	attempt := c.attempt
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		if c.backoff == 0 {
+			c.backoff = minRestartBackoff
+		} else {
+			c.backoff = min(c.backoff*2, maxRestartBackoff)
+		}
+		backoff := c.backoff
+		c.mu.Unlock()
+
+		c.setState(StateRestarting, err)
+		log.Logger.Warn().Err(err).Msgf("restarting %s in %s", c.Name, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return
+		}
+
+		c.mu.Lock()
+		superseded := c.attempt != attempt
+		c.mu.Unlock()
+		if superseded {
+			return
+		}
+
+		if err = s.start(c); err == nil {
+			c.mu.Lock()
+			c.restarts++
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *Supervisor) stop(ctx context.Context, c *component) error {
+	c.mu.Lock()
+	if c.state != StateRunning {
+		if c.state != StateStopping {
+			c.state = StateStopped
+			c.since = time.Now()
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	c.state = StateStopping
+	c.since = time.Now()
+	cancel, stopped := c.cancel, c.stopped
+	c.mu.Unlock()
+
+	log.Logger.Info().Msgf("stopping %s", c.Name)
+	if c.Stop != nil {
+		if err := c.Stop(ctx); err != nil {
+			log.Logger.Warn().Err(err).Msgf("failed to stop %s gracefully", c.Name)
+		}
+	}
+	cancel()
+
+	select {
+	case <-stopped:
+		log.Logger.Info().Msgf("%s done", c.Name)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s not done: %w", c.Name, ctx.Err())
+	}
+}
+
+// Restart stops and starts a single component, only the ones marked Restart,
+// others are held on to by the components started after them
+func (s *Supervisor) Restart(ctx context.Context, name string) error {
+	c := s.get(name)
+	if c == nil {
+		return fmt.Errorf("unknown component %s", name)
+	}
+	if !c.Restart {
+		return fmt.Errorf("%s cannot be restarted", name)
+	}
+	if s.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+	if state := c.status().State; state == StateStarting || state == StateRestarting || state == StatePaused {
+		return fmt.Errorf("%s is %s", name, state)
+	}
+	if err := s.stop(ctx, c); err != nil {
+		return err
+	}
+
+	if err := s.start(c); err != nil {
+		go s.retry(c, err)
+		return err
+	}
+	c.mu.Lock()
+	c.restarts++
+	c.mu.Unlock()
+	return nil
+}
+
+// Pause stops a component that can be restarted until Resume is called,
+// a pending restart is cancelled
+func (s *Supervisor) Pause(ctx context.Context, name string) error {
+	c := s.get(name)
+	if c == nil {
+		return fmt.Errorf("unknown component %s", name)
+	}
+	if !c.Restart {
+		return fmt.Errorf("%s cannot be paused", name)
+	}
+
+	c.mu.Lock()
+	if c.paused {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.state == StateStarting {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is %s", name, StateStarting)
+	}
+	c.paused = true
+	c.attempt++
+	c.mu.Unlock()
+
+	if err := s.stop(ctx, c); err != nil {
+		return err
+	}
+	c.setState(StatePaused, nil)
+	log.Logger.Info().Msgf("%s paused", c.Name)
+	return nil
+}
+
+// Resume starts a paused component again, restarting it with backoff if it fails to start
+func (s *Supervisor) Resume(name string) error {
+	c := s.get(name)
+	if c == nil {
+		return fmt.Errorf("unknown component %s", name)
+	}
+	if s.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+
+	c.mu.Lock()
+	if !c.paused {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is not paused", name)
+	}
+	c.paused = false
+	c.backoff = 0
+	c.mu.Unlock()
+
+	if err := s.start(c); err != nil {
+		go s.retry(c, err)
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops components in reverse start order, each one waited for until ctx is done
+func (s *Supervisor) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	var errs []error
+	components := s.list()
+	for i := len(components) - 1; i >= 0; i-- {
+		if err := s.stop(ctx, components[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Supervisor) Status() []Status {
+	components := s.list()
+	statuses := make([]Status, 0, len(components))
+	for _, c := range components {
+		statuses = append(statuses, c.status())
+	}
+	return statuses
+}
+
+// Live reports false once a required component has failed for good
+func (s *Supervisor) Live() bool {
+	for _, c := range s.list() {
+		if !c.Optional && c.status().State == StateFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready reports whether all required components are running, paused ones were stopped on purpose
+func (s *Supervisor) Ready() bool {
+	for _, c := range s.list() {
+		if state := c.status().State; !c.Optional && state != StateRunning && state != StatePaused {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterHandlers serves /healthz and /readyz, both respond with component states
+func (s *Supervisor) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.handler(s.Live))
+	mux.HandleFunc("/readyz", s.handler(s.Ready))
+}
+
+func (s *Supervisor) handler(ok func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !ok() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(s.Status())
+	}
+}
@@ -0,0 +1,276 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder keeps the order components are started and stopped in
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(e string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) component(name string) Component {
+	return Component{
+		Name: name,
+		Start: func(ctx context.Context) (<-chan struct{}, error) {
+			r.add("start " + name)
+			done := make(chan struct{})
+			context.AfterFunc(ctx, func() {
+				r.add("stop " + name)
+				close(done)
+			})
+			return done, nil
+		},
+	}
+}
+
+func waitState(t *testing.T, s *Supervisor, name string, state State) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if s.get(name).status().State == state {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s is %s, expected %s", name, s.get(name).status().State, state)
+}
+
+func TestSupervisorStopsInReverseOrder(t *testing.T) {
+	r := &recorder{}
+	s := NewSupervisor()
+	s.Add(r.component("datastore"))
+	s.Add(r.component("aggregator"))
+	s.Add(r.component("collector"))
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Ready() {
+		t.Fatalf("expected ready, got %+v", s.Status())
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"start datastore", "start aggregator", "start collector",
+		"stop collector", "stop aggregator", "stop datastore"}
+	if len(r.events) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, r.events)
+	}
+	for i := range expected {
+		if r.events[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, r.events)
+		}
+	}
+	for _, st := range s.Status() {
+		if st.State != StateStopped {
+			t.Errorf("%s is %s after shutdown", st.Name, st.State)
+		}
+	}
+}
+
+func TestSupervisorRestartsFailedComponent(t *testing.T) {
+	defer func(b time.Duration) { minRestartBackoff = b }(minRestartBackoff)
+	minRestartBackoff = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	attempts := 0
+	crash := make(chan struct{}, 1)
+	s := NewSupervisor()
+	s.Add(Component{
+		Name:    "logstreamer",
+		Restart: true,
+		Start: func(ctx context.Context) (<-chan struct{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts == 1 {
+				return nil, errors.New("backend unreachable")
+			}
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+				case <-crash:
+				}
+				close(done)
+			}()
+			return done, nil
+		},
+	})
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Ready() || !s.Live() {
+		t.Fatalf("expected live but not ready while restarting, got %+v", s.Status())
+	}
+	waitState(t, s, "logstreamer", StateRunning)
+
+	crash <- struct{}{}
+	waitState(t, s, "logstreamer", StateRestarting)
+	waitState(t, s, "logstreamer", StateRunning)
+	if st := s.Status()[0]; st.Restarts != 2 {
+		t.Errorf("expected 2 restarts, got %d", st.Restarts)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorPausesAndResumes(t *testing.T) {
+	defer func(b time.Duration) { minRestartBackoff = b }(minRestartBackoff)
+	minRestartBackoff = 50 * time.Millisecond
+
+	r := &recorder{}
+	failing := true
+	s := NewSupervisor()
+	c := r.component("logstreamer")
+	start := c.Start
+	c.Start = func(ctx context.Context) (<-chan struct{}, error) {
+		if failing {
+			return nil, errors.New("backend unreachable")
+		}
+		return start(ctx)
+	}
+	c.Restart = true
+	s.Add(c)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, "logstreamer", StateRestarting)
+
+	// pending restart is cancelled
+	if err := s.Pause(context.Background(), "logstreamer"); err != nil {
+		t.Fatal(err)
+	}
+	failing = false
+	time.Sleep(4 * minRestartBackoff)
+	r.mu.Lock()
+	started := len(r.events)
+	r.mu.Unlock()
+	if st := s.Status()[0]; st.State != StatePaused || started != 0 {
+		t.Fatalf("expected paused, got %+v after %d events", st, started)
+	}
+	if !s.Ready() {
+		t.Error("expected paused component not to affect readiness")
+	}
+	if err := s.Restart(context.Background(), "logstreamer"); err == nil {
+		t.Error("expected paused component not to be restarted")
+	}
+
+	if err := s.Resume("logstreamer"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, "logstreamer", StateRunning)
+	if err := s.Pause(context.Background(), "logstreamer"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, "logstreamer", StatePaused)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) != 2 || r.events[0] != "start logstreamer" || r.events[1] != "stop logstreamer" {
+		t.Errorf("unexpected events %v", r.events)
+	}
+}
+
+func TestSupervisorHealthEndpoints(t *testing.T) {
+	r := &recorder{}
+	s := NewSupervisor()
+	s.Add(r.component("aggregator"))
+	s.Add(Component{
+		Name: "ebpf-collector",
+		Start: func(ctx context.Context) (<-chan struct{}, error) {
+			return nil, errors.New("failed to attach probes")
+		},
+	})
+	s.Add(Component{
+		Name:     "cri",
+		Optional: true,
+		Start: func(ctx context.Context) (<-chan struct{}, error) {
+			return nil, errors.New("no runtime")
+		},
+	})
+
+	mux := http.NewServeMux()
+	s.RegisterHandlers(mux)
+	code := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code("/readyz") != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before start")
+	}
+	if code("/healthz") != http.StatusOK {
+		t.Errorf("expected healthy before start")
+	}
+
+	if err := s.Start(); err == nil {
+		t.Fatal("expected start to fail")
+	}
+	if code("/healthz") != http.StatusServiceUnavailable || code("/readyz") != http.StatusServiceUnavailable {
+		t.Errorf("expected unhealthy and not ready, got %+v", s.Status())
+	}
+	s.Shutdown(context.Background())
+}
+
+func TestSupervisorChecksRunningComponents(t *testing.T) {
+	r := &recorder{}
+	var mu sync.Mutex
+	var checkErr error
+	c := r.component("aggregator")
+	c.Check = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return checkErr
+	}
+	s := NewSupervisor()
+	s.Add(c)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	if !s.Ready() {
+		t.Fatalf("expected ready, got %+v", s.Status())
+	}
+
+	mu.Lock()
+	checkErr = errors.New("120 events queued, none processed for 45s")
+	mu.Unlock()
+	if s.Ready() {
+		t.Fatal("expected a failing check to make alaz not ready")
+	}
+	if !s.Live() {
+		t.Fatal("expected a failing check to keep alaz live")
+	}
+	if st := s.Status()[0]; st.State != StateUnhealthy || st.Error != checkErr.Error() {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	mu.Lock()
+	checkErr = nil
+	mu.Unlock()
+	if !s.Ready() {
+		t.Fatalf("expected ready once the check passes, got %+v", s.Status())
+	}
+}
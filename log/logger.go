@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/ddosify/alaz/config"
 	"github.com/rs/zerolog"
 )
 
@@ -35,30 +36,44 @@ func init() {
 		defaultLevel = zerolog.Level(level)
 	}
 
-	// Set the global log level for Zerolog
-	zerolog.SetGlobalLevel(defaultLevel)
-
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	if os.Getenv("DISABLE_LOGS") == "true" {
+	Configure(config.LogConfig{
+		Level:      int(defaultLevel),
+		Disabled:   os.Getenv("DISABLE_LOGS") == "true",
+		ContextKey: os.Getenv("LOG_CONTEXT_KEY"),
+	})
+}
+
+// Configure replaces the global logger once the config is loaded,
+// until then it is set up from env variables
+func Configure(conf config.LogConfig) {
+	SetLevel(conf.Level)
+
+	if conf.Disabled {
 		Logger = zerolog.New(NoopLogger{})
 	} else {
 		hook := &ContextFilterHook{
 			ContextKey:   LOG_CONTEXT,
-			ContextValue: os.Getenv("LOG_CONTEXT_KEY"),
+			ContextValue: conf.ContextKey,
 		}
 
 		Logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Hook(hook)
 	}
 }
 
+// SetLevel changes the global log level, safe to call while logging
+func SetLevel(level int) {
+	zerolog.SetGlobalLevel(zerolog.Level(level))
+}
+
 type ContextFilterHook struct {
 	ContextKey   string
 	ContextValue string
 }
 
 func (cfh *ContextFilterHook) Run(e *zerolog.Event, level zerolog.Level, message string) {
-	if os.Getenv("LOG_CONTEXT_KEY") == "" {
+	if cfh.ContextValue == "" {
 		// if not specified, no filtering
 		return
 	}
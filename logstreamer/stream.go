@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,11 +18,17 @@ import (
 	"time"
 
 	"github.com/ddosify/alaz/log"
+	"github.com/ddosify/alaz/metrics"
 
+	"github.com/ddosify/alaz/config"
 	"github.com/ddosify/alaz/cri"
+	"github.com/ddosify/alaz/datastore"
 	"github.com/fsnotify/fsnotify"
 )
 
+// logs left in watched files are sent on shutdown within this time
+const logFlushTimeout = 10 * time.Second
+
 type LogStreamer struct {
 	critool *cri.CRITool
 
@@ -48,16 +55,11 @@ type fileReader struct {
 	*bufio.Reader
 }
 
-func createTLSConfig() (*tls.Config, error) {
+func createTLSConfig(serverName string) (*tls.Config, error) {
 	caCertPool := x509.NewCertPool()
 	caCert := []byte(CaCert)
 	caCertPool.AppendCertsFromPEM(caCert)
 
-	serverName := os.Getenv("LOG_BACKEND_SERVER_NAME")
-	if serverName == "" {
-		serverName = "log-alaz.getanteon.com"
-	}
-
 	return &tls.Config{
 		RootCAs:    caCertPool,
 		ServerName: serverName,
@@ -69,34 +71,24 @@ func createFsNotifyWatcher() (*fsnotify.Watcher, error) {
 	return fsnotify.NewBufferedWatcher(sz)
 }
 
-func NewLogStreamer(ctx context.Context, critool *cri.CRITool) (*LogStreamer, error) {
+func NewLogStreamer(ctx context.Context, critool *cri.CRITool, conf config.LogBackendConfig) (*LogStreamer, error) {
 	ls := &LogStreamer{
 		critool: critool,
 	}
 
-	logBackend := os.Getenv("LOG_BACKEND")
-	if logBackend == "" {
-		logBackend = "log-alaz.getanteon.com:443"
-	}
+	logBackend := conf.Host
 
 	dialer := &net.Dialer{
 		Timeout: 60 * time.Second,
 	}
 
-	tlsConfig, err := createTLSConfig()
+	tlsConfig, err := createTLSConfig(conf.ServerName)
 	if err != nil {
 		log.Logger.Error().Err(err).Msg("failed to create TLS config")
 		return nil, err
 	}
 
-	max_connection := 30
-	max_connection_str := os.Getenv("LOG_BACKEND_MAX_CONNECTION")
-	if max_connection_str != "" {
-		m, err := strconv.Atoi(max_connection_str)
-		if err == nil {
-			max_connection = m
-		}
-	}
+	max_connection := conf.MaxConnection
 
 	tlsFunc := func() (net.Conn, error) {
 		log.Logger.Debug().Msgf("dialing to log backend: %s", logBackend)
@@ -110,12 +102,7 @@ func NewLogStreamer(ctx context.Context, critool *cri.CRITool) (*LogStreamer, er
 
 	var factory Factory
 
-	var logTls = true
-
-	logTlsEnv, err := strconv.ParseBool(os.Getenv("LOG_BACKEND_TLS"))
-	if err == nil && logTlsEnv == false {
-		logTls = false
-	}
+	logTls := conf.TLS
 
 	if logTls {
 		factory = tlsFunc
@@ -143,6 +130,7 @@ func NewLogStreamer(ctx context.Context, critool *cri.CRITool) (*LogStreamer, er
 	go func() {
 		<-ctx.Done()
 		ls.watcher.Close()
+		ls.flush(time.Now().Add(logFlushTimeout))
 		ls.connPool.Close()
 		close(ls.done)
 	}()
@@ -159,6 +147,27 @@ func (ls *LogStreamer) Done() chan struct{} {
 	return ls.done
 }
 
+// flush sends what is left in every watched log file, until the deadline
+func (ls *LogStreamer) flush(deadline time.Time) {
+	ls.readerMapMu.RLock()
+	logPaths := make([]string, 0, len(ls.logPathToFile))
+	for logPath := range ls.logPathToFile {
+		logPaths = append(logPaths, logPath)
+	}
+	ls.readerMapMu.RUnlock()
+
+	for i, logPath := range logPaths {
+		if time.Now().After(deadline) {
+			log.Logger.Warn().Int("files", len(logPaths)-i).Msg("log flush deadline exceeded, remaining logs are not sent")
+			return
+		}
+		if err := ls.sendLogs(logPath); err != nil {
+			log.Logger.Error().Err(err).Msgf("Failed to flush logs for %s", logPath)
+		}
+	}
+	log.Logger.Info().Int("files", len(logPaths)).Msg("logs flushed")
+}
+
 func (ls *LogStreamer) watchContainer(id string, name string, new bool) error {
 	resp, err := ls.critool.ContainerStatus(id)
 	if err != nil {
@@ -166,7 +175,7 @@ func (ls *LogStreamer) watchContainer(id string, name string, new bool) error {
 		return err
 	}
 
-	if ls.critool.FilterNamespace(resp.PodNs) {
+	if ls.critool.FilterLogs(resp) {
 		log.Logger.Debug().Msgf("Skipping logs for container [%s] with id [%s]", name, id)
 		return nil
 	}
@@ -218,12 +227,19 @@ func (ls *LogStreamer) sendLogs(logPath string) error {
 	t := 1
 	for {
 		poolConn, err = ls.connPool.Get()
+		if err != nil && ls.ctx.Err() != nil {
+			// shutting down, do not wait for the log backend
+			return err
+		}
 		if err != nil {
 			log.Logger.Error().Err(err).Msgf("connect failed, retryconn..")
 			time.Sleep(time.Duration(t) * time.Second)
 			t *= 2
 			continue
 		}
+		if poolConn == nil && ls.ctx.Err() != nil {
+			return fmt.Errorf("no connection to log backend")
+		}
 		if poolConn == nil {
 			log.Logger.Info().Msgf("poolConn is nil, retryconn..")
 			time.Sleep(time.Duration(t) * time.Second)
@@ -271,7 +287,8 @@ func (ls *LogStreamer) sendLogs(logPath string) error {
 
 	poolConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 	defer poolConn.SetWriteDeadline(time.Time{})
-	_, err = io.Copy(poolConn, reader)
+	n, err := io.Copy(poolConn, reader)
+	metrics.LogBytesSent.Add(float64(n))
 	if err != nil {
 		log.Logger.Error().Err(err).Msgf("logs could not be sent to backend: %v", err)
 		reader.mu.Unlock()
@@ -642,6 +659,14 @@ func (ls *LogStreamer) StreamLogs() error {
 // podUid
 // containerName
 // which version of container, 0,1,2...
+// cluster identity follows as a query string, cluster names may contain underscores
 func getContainerMetadataLine(podNs, podName, podUid, containerName string, num int) string {
-	return fmt.Sprintf("\n**AlazLogs_%s_%s_%s_%s_%d**\n", podNs, podName, podUid, containerName, num)
+	c := datastore.Cluster()
+	cluster := url.Values{
+		"cluster_id":   {c.ID},
+		"cluster_name": {c.Name},
+		"region":       {c.Region},
+		"zone":         {c.Zone},
+	}
+	return fmt.Sprintf("\n**AlazLogs_%s_%s_%s_%s_%d**%s**\n", podNs, podName, podUid, containerName, num, cluster.Encode())
 }
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"os/signal"
-	"regexp"
 	"runtime/debug"
-	"strconv"
 	"syscall"
 	"time"
 
@@ -15,6 +14,7 @@ import (
 	"github.com/ddosify/alaz/datastore"
 	"github.com/ddosify/alaz/ebpf"
 	"github.com/ddosify/alaz/k8s"
+	"github.com/ddosify/alaz/lifecycle"
 	"github.com/ddosify/alaz/logstreamer"
 
 	"context"
@@ -23,6 +23,9 @@ import (
 
 	"net/http"
 	_ "net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -37,144 +40,221 @@ func main() {
 		cancel()
 	}()
 
-	var nsFilterRx *regexp.Regexp
-	if os.Getenv("EXCLUDE_NAMESPACES") != "" {
-		nsFilterRx = regexp.MustCompile(os.Getenv("EXCLUDE_NAMESPACES"))
+	// CONFIG_FILE is optional, env variables override it
+	configFile := os.Getenv("CONFIG_FILE")
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		log.Logger.Fatal().Err(err).Msg("invalid config")
 	}
+	log.Configure(cfg.Log)
+	datastore.MonitoringID = cfg.MonitoringID
+	datastore.NodeID = cfg.NodeName
+	datastore.SetCluster(cfg.Cluster)
 
-	stopAndWait := false
-	var nsFilterStr string
-	if nsFilterRx != nil {
-		nsFilterStr = nsFilterRx.String()
+	// all components share the scope, it is replaced on reload
+	scope, err := k8s.NewScope(cfg.Policy)
+	if err != nil {
+		log.Logger.Fatal().Err(err).Msg("invalid config")
 	}
-
-	var k8sCollector *k8s.K8sCollector
-	kubeEvents := make(chan interface{}, 1000)
-	var k8sVersion string
-
-	var k8sCollectorEnabled bool = true
-	k8sEnabled, err := strconv.ParseBool(os.Getenv("K8S_COLLECTOR_ENABLED"))
-	if err == nil && !k8sEnabled {
-		k8sCollectorEnabled = false
+	policy, err := aggregator.NewPolicy(cfg.Policy)
+	if err != nil {
+		log.Logger.Fatal().Err(err).Msg("invalid config")
 	}
 
-	if k8sCollectorEnabled {
-		// k8s collector
-		var err error
-		k8sCollector, err = k8s.NewK8sCollector(ctx)
-		if err != nil {
-			panic(err)
+	// policy and log level are reloaded on SIGHUP and when the config file changes
+	rl := newReloader(configFile, cfg, scope, policy)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rl.reload()
+		}
+	}()
+	if configFile != "" {
+		if err := config.Watch(ctx, configFile, rl.reload); err != nil {
+			log.Logger.Warn().Err(err).Msg("config file not watched, send SIGHUP to reload")
 		}
-		k8sVersion = k8sCollector.GetK8sVersion()
-		go k8sCollector.Init(kubeEvents)
 	}
 
-	tracingEnabled, err := strconv.ParseBool(os.Getenv("TRACING_ENABLED"))
-	if err != nil {
-		// for backwards compatibility
-		ebpfEnabled, _ := strconv.ParseBool(os.Getenv("SERVICE_MAP_ENABLED"))
-		distTracingEnabled, _ := strconv.ParseBool(os.Getenv("DIST_TRACING_ENABLED"))
-		tracingEnabled = ebpfEnabled || distTracingEnabled
-	}
+	stopAndWait := false
+
+	// components start in the order they are added and stop in reverse,
+	// so probes are detached and the aggregator drained before datastores flush
+	sup := lifecycle.NewSupervisor()
+	sup.RegisterHandlers(http.DefaultServeMux)
+	// OpenMetrics carries exemplars of RED histograms
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	// effective config, secrets redacted
+	http.Handle("/config", rl)
+	go http.ListenAndServe(":8181", nil)
 
-	metricsEnabled, _ := strconv.ParseBool(os.Getenv("METRICS_ENABLED"))
-	logsEnabled, _ := strconv.ParseBool(os.Getenv("LOGS_ENABLED"))
-
-	// datastore backend
-	dsBackend := datastore.NewBackendDS(ctx, config.BackendDSConfig{
-		Host:                  os.Getenv("BACKEND_HOST"),
-		MetricsExport:         metricsEnabled,
-		GpuMetricsExport:      metricsEnabled,
-		MetricsExportInterval: 10,
-		ReqBufferSize:         40000, // TODO: get from a conf file
-		ConnBufferSize:        1000,  // TODO: get from a conf file
-		KafkaEventBufferSize:  2000,
+	// datastore, alaz backend by default
+	// several datastores, e.g. DATASTORE_TYPE=backend,otlp,file, are fanned out to.
+	// It is not restarted, the aggregator holds on to it and buffered events would be lost,
+	// backend datastore retries and spools failed batches by itself.
+	var ds datastore.DataStore
+	var dsBackend *datastore.BackendDS
+	sup.Add(lifecycle.Component{
+		Name: "datastore",
+		Start: func(ctx context.Context) (<-chan struct{}, error) {
+			var done <-chan struct{}
+			ds, dsBackend, done = startDataStores(ctx, cfg)
+			return done, nil
+		},
 	})
 
-	var ct *cri.CRITool
-	ct, err = cri.NewCRITool(ctx)
-	if err != nil {
-		log.Logger.Error().Err(err).Msg("failed to create cri tool")
+	// alaz.io annotations and labels of pods and namespaces, kept by the k8s collector.
+	// They outlive a restarted collector, cri tool and aggregator hold on to them.
+	var policies *k8s.PolicyStore
+	kubeEvents := make(chan interface{}, 1000)
+	var k8sVersion string
+	if cfg.K8sCollectorEnabled {
+		policies = k8s.NewPolicyStore(scope)
+		// a restarted collector lists every resource again, the aggregator takes them as updates
+		sup.Add(lifecycle.Component{
+			Name:    "k8s-collector",
+			Restart: true,
+			Start: func(ctx context.Context) (<-chan struct{}, error) {
+				collector, err := k8s.NewK8sCollector(ctx, policies)
+				if err != nil {
+					return nil, err
+				}
+				rl.setK8sCollector(collector)
+				// before any resource is sent, so every payload carries the cluster identity
+				cluster, err := collector.DiscoverCluster(ctx, cfg.Cluster, cfg.NodeName)
+				if err != nil {
+					log.Logger.Warn().Err(err).Msg("cluster identity could not be discovered, set CLUSTER_ID, CLUSTER_REGION and CLUSTER_ZONE")
+				}
+				datastore.SetCluster(cluster)
+				log.Logger.Info().Msgf("cluster id: %s, name: %s, region: %s, zone: %s", cluster.ID, cluster.Name, cluster.Region, cluster.Zone)
+				k8sVersion = collector.GetK8sVersion()
+				go collector.Init(kubeEvents)
+				// informers do not block on kubeEvents once stopping, the aggregator may be stopped already
+				return collector.Done(), nil
+			},
+		})
 	}
 
-	// deploy ebpf programs
-	var ec *ebpf.EbpfCollector
-	if tracingEnabled {
-		ec = ebpf.NewEbpfCollector(ctx, ct)
-
-		a := aggregator.NewAggregator(ctx, ct, kubeEvents, ec.EbpfEvents(), ec.EbpfProcEvents(), ec.EbpfTcpEvents(), ec.TlsAttachQueue(), dsBackend)
-		a.Run()
+	// cri tool is a grpc client reconnecting by itself, it is not restarted since
+	// the aggregator, ebpf collector and logstreamer hold on to it. Its check pings the runtime.
+	var ct *cri.CRITool
+	sup.Add(lifecycle.Component{
+		Name:     "cri",
+		Optional: true,
+		Start: func(ctx context.Context) (<-chan struct{}, error) {
+			var err error
+			ct, err = cri.NewCRITool(ctx, scope)
+			if err != nil {
+				return nil, err
+			}
+			if policies != nil {
+				ct.SetPodPolicies(policies)
+			}
+			rl.setCRITool(ct)
+			return ctx.Done(), nil
+		},
+		Check: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return ct.Ping(ctx)
+		},
+	})
 
-		a.AdvertiseDebugData()
+	// deploy ebpf programs
+	if cfg.TracingEnabled {
+		// the collector is created along with the aggregator reading its channels,
+		// but started and stopped on its own, probes are detached before the aggregator drains.
+		// Neither is restarted: the aggregator keeps sockets and processes learned from ebpf events
+		// that are not sent again, and probes are loaded once per process. A stalled aggregator,
+		// events queued but none taken, is reported unhealthy so alaz is not ready.
+		ebpfCtx, ebpfCancel := context.WithCancel(context.Background())
+		var ec *ebpf.EbpfCollector
+		var a *aggregator.Aggregator
+		sup.Add(lifecycle.Component{
+			Name: "aggregator",
+			Start: func(ctx context.Context) (<-chan struct{}, error) {
+				ec = ebpf.NewEbpfCollector(ebpfCtx, ct)
+				a = aggregator.NewAggregator(ctx, ct, kubeEvents, ec.EbpfEvents(), ec.EbpfProcEvents(), ec.EbpfTcpEvents(), ec.TlsAttachQueue(), ds)
+				if policies != nil {
+					a.SetPodPolicies(policies)
+				}
+				a.SetREDMetrics(cfg.RedMetrics)
+				a.SetZoneTrafficMetrics(cfg.ZoneTrafficMetrics)
+				rl.setAggregator(a, ec)
+				a.Run()
 
-		ec.Init()
-		go ec.ListenEvents()
+				a.AdvertiseDebugData()
+				return ctx.Done(), nil
+			},
+			Stop: func(ctx context.Context) error {
+				return a.Drain(ctx)
+			},
+			Check: func() error {
+				return a.Healthy()
+			},
+		})
+		sup.Add(lifecycle.Component{
+			Name: "ebpf-collector",
+			Start: func(ctx context.Context) (<-chan struct{}, error) {
+				context.AfterFunc(ctx, ebpfCancel)
+				ec.Init()
+				go ec.ListenEvents()
+				return ec.Done(), nil
+			},
+		})
 	}
 
-	var ls *logstreamer.LogStreamer
-	if logsEnabled {
-		if ct != nil {
-			go func() {
-				backoff := 5 * time.Second
-				for {
-					// retry creating LogStreamer with backoff
-					// it will throw an error if connection to backend is not established
-					log.Logger.Info().Msg("creating logstreamer")
-					ls, err = logstreamer.NewLogStreamer(ctx, ct)
-					if err != nil {
-						log.Logger.Error().Err(err).Msg("failed to create logstreamer")
-						select {
-						case <-time.After(backoff):
-						case <-ctx.Done():
-							return
-						}
-						backoff *= 2
-					} else {
-						log.Logger.Info().Msg("logstreamer successfully created")
-						break
-					}
+	if cfg.LogsEnabled {
+		sup.Add(lifecycle.Component{
+			Name:    "logstreamer",
+			Restart: true,
+			Start: func(ctx context.Context) (<-chan struct{}, error) {
+				if ct == nil {
+					return nil, errors.New("logs enabled but cri tool not available")
 				}
-
-				err := ls.StreamLogs()
+				// it will throw an error if connection to backend is not established
+				lsCtx, lsCancel := context.WithCancel(ctx)
+				ls, err := logstreamer.NewLogStreamer(lsCtx, ct, cfg.LogBackend)
 				if err != nil {
-					log.Logger.Error().Err(err).Msg("failed to stream logs")
+					lsCancel()
+					return nil, err
 				}
-			}()
-
-		} else {
-			log.Logger.Error().Msg("logs enabled but cri tool not available")
-		}
+				go func() {
+					if err := ls.StreamLogs(); err != nil {
+						log.Logger.Error().Err(err).Msg("failed to stream logs")
+						lsCancel()
+					}
+				}()
+				return ls.Done(), nil
+			},
+		})
 	}
 
-	dsBackend.Start()
-
-	healthCh := dsBackend.SendHealthCheck(tracingEnabled, metricsEnabled, logsEnabled, nsFilterStr, k8sVersion)
-	go func() {
-		for msg := range healthCh {
-			if msg == datastore.HealthCheckActionStop {
-				stopAndWait = true
-				cancel()
-				break
-			}
-		}
-	}()
-
-	go http.ListenAndServe(":8181", nil)
-
-	if k8sCollectorEnabled {
-		<-k8sCollector.Done()
-		log.Logger.Info().Msg("k8sCollector done")
+	if err := sup.Start(); err != nil {
+		log.Logger.Fatal().Err(err).Msg("failed to start alaz")
 	}
 
-	if tracingEnabled {
-		<-ec.Done()
-		log.Logger.Info().Msg("ebpfCollector done")
+	var healthCh chan datastore.HealthCheckAction
+	if dsBackend != nil {
+		healthCh = dsBackend.SendHealthCheck(cfg.TracingEnabled, cfg.MetricsEnabled, cfg.LogsEnabled, cfg.Policy.ExcludeNamespaces, k8sVersion, remoteCommands(rl, sup))
+		go func() {
+			for msg := range healthCh {
+				if msg == datastore.HealthCheckActionStop {
+					stopAndWait = true
+					cancel()
+					break
+				}
+			}
+		}()
 	}
 
-	if logsEnabled && ls != nil {
-		<-ls.Done()
-		log.Logger.Info().Msg("cri done")
+	<-ctx.Done()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	if err := sup.Shutdown(shutdownCtx); err != nil {
+		log.Logger.Warn().Err(err).Msg("shutdown deadline exceeded")
 	}
+	shutdownCancel()
 
 	if stopAndWait {
 		log.Logger.Warn().Msg("Payment required. Alaz will restart itself after payment's been made.")
@@ -188,3 +268,92 @@ func main() {
 		log.Logger.Info().Msg("alaz exiting...")
 	}
 }
+
+// startDataStores creates the sinks and the fanout in front of them.
+// Sinks outlive ctx until the fanout has handed them its buffered calls,
+// the returned channel is closed once all of them are flushed.
+func startDataStores(ctx context.Context, cfg *config.Config) (datastore.DataStore, *datastore.BackendDS, <-chan struct{}) {
+	sinkCtx, sinkCancel := context.WithCancel(context.Background())
+
+	var ds datastore.DataStore
+	var dsBackend *datastore.BackendDS
+	sinks := make([]datastore.FanoutSink, 0, len(cfg.Datastores))
+	for _, dsType := range cfg.Datastores {
+		sinkDS := newDataStore(sinkCtx, dsType, cfg)
+		if b, ok := sinkDS.(*datastore.BackendDS); ok {
+			dsBackend = b
+			dsBackend.Start()
+		}
+		sinks = append(sinks, datastore.FanoutSink{DS: sinkDS, Conf: cfg.Sink(dsType)})
+	}
+
+	var fanoutDS *datastore.FanoutDS
+	if len(sinks) == 1 {
+		ds = sinks[0].DS
+	} else {
+		var err error
+		fanoutDS, err = datastore.NewFanoutDS(ctx, sinks)
+		if err != nil {
+			panic(err)
+		}
+		fanoutDS.Start()
+		ds = fanoutDS
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		if fanoutDS != nil {
+			<-fanoutDS.Done()
+		}
+		sinkCancel()
+		for _, s := range sinks {
+			if f, ok := s.DS.(datastore.Flusher); ok {
+				<-f.Done()
+				log.Logger.Info().Msgf("%s datastore flushed", s.Conf.Name)
+			}
+		}
+		close(done)
+	}()
+	return ds, dsBackend, done
+}
+
+func newDataStore(ctx context.Context, dsType string, cfg *config.Config) datastore.DataStore {
+	switch dsType {
+	case "otlp":
+		otlpDS, err := datastore.NewOtlpDS(ctx, cfg.Otlp)
+		if err != nil {
+			panic(err)
+		}
+		otlpDS.Start()
+		return otlpDS
+	case "postgres":
+		pgDS, err := datastore.NewPostgresDS(ctx, cfg.Postgres)
+		if err != nil {
+			panic(err)
+		}
+		pgDS.Start()
+		return pgDS
+	case "file":
+		fileDS, err := datastore.NewFileDS(ctx, cfg.File)
+		if err != nil {
+			panic(err)
+		}
+		fileDS.Start()
+		return fileDS
+	case "kafka":
+		kafkaDS, err := datastore.NewKafkaDS(ctx, cfg.Kafka)
+		if err != nil {
+			panic(err)
+		}
+		kafkaDS.Start()
+		return kafkaDS
+	case "backend":
+		conf := cfg.Backend
+		conf.MetricsExport = cfg.MetricsEnabled
+		conf.GpuMetricsExport = cfg.MetricsEnabled
+		return datastore.NewBackendDS(ctx, conf)
+	default:
+		panic("unknown datastore type " + dsType)
+	}
+}
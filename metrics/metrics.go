@@ -0,0 +1,84 @@
+// Package metrics holds Prometheus metrics about alaz itself,
+// they are served on /metrics along with the rest of the default registry.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const channelDepthInterval = 5 * time.Second
+
+var (
+	ChannelDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "alaz",
+		Name:      "channel_depth",
+		Help:      "Events waiting in an internal channel, sampled every 5 seconds.",
+	}, []string{"channel"})
+	LostSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "ebpf",
+		Name:      "lost_samples_total",
+		Help:      "Samples dropped by the kernel because a perf reader fell behind.",
+	}, []string{"reader"})
+	ParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "aggregator",
+		Name:      "parse_failures_total",
+		Help:      "L7 events discarded because their payload could not be parsed.",
+	}, []string{"protocol"})
+	UnresolvedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "aggregator",
+		Name:      "unresolved_events_total",
+		Help:      "Events discarded because their source address did not match a known pod.",
+	}, []string{"protocol"})
+	RateLimitedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "aggregator",
+		Name:      "rate_limited_events_total",
+		Help:      "Events dropped by per process rate limiters.",
+	}, []string{"event"})
+	BackendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "alaz",
+		Subsystem: "backend",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of requests to backend, retries included.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"endpoint"})
+	BackendRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "backend",
+		Name:      "request_errors_total",
+		Help:      "Failed requests to backend, by status code or error for transport failures.",
+	}, []string{"endpoint", "code"})
+	LogBytesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "alaz",
+		Subsystem: "logs",
+		Name:      "sent_bytes_total",
+		Help:      "Container log bytes shipped to the log backend.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(ChannelDepth, LostSamples, ParseFailures, UnresolvedEvents,
+		RateLimitedEvents, BackendRequestDuration, BackendRequestErrors, LogBytesSent)
+}
+
+// SampleChannelDepths sets ChannelDepth for every named channel until ctx is done
+func SampleChannelDepths(ctx context.Context, channels map[string]func() int) {
+	t := time.NewTicker(channelDepthInterval)
+	defer t.Stop()
+	for {
+		for name, length := range channels {
+			ChannelDepth.WithLabelValues(name).Set(float64(length()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
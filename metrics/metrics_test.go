@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSampleChannelDepths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan int, 10)
+	ch <- 1
+	ch <- 2
+	go SampleChannelDepths(ctx, map[string]func() int{
+		"test": func() int { return len(ch) },
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(ChannelDepth.WithLabelValues("test")) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected depth 2, got %v", testutil.ToFloat64(ChannelDepth.WithLabelValues("test")))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/ddosify/alaz/aggregator"
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/cri"
+	"github.com/ddosify/alaz/ebpf"
+	"github.com/ddosify/alaz/k8s"
+	"github.com/ddosify/alaz/log"
+)
+
+// reloader applies the policy and log level of a changed config to running components,
+// everything else needs a restart. Components are registered as they start.
+type reloader struct {
+	path string
+
+	mu     sync.Mutex
+	cfg    *config.Config // effective config
+	scope  *k8s.Scope
+	policy *aggregator.Policy
+
+	collector *k8s.K8sCollector
+	ct        *cri.CRITool
+	a         *aggregator.Aggregator
+	ec        *ebpf.EbpfCollector
+}
+
+func newReloader(path string, cfg *config.Config, scope *k8s.Scope, policy *aggregator.Policy) *reloader {
+	return &reloader{path: path, cfg: cfg, scope: scope, policy: policy}
+}
+
+// components get the current policy when they register, a reload may have happened while they started
+
+func (r *reloader) setK8sCollector(c *k8s.K8sCollector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collector = c
+	c.SetScope(r.scope)
+}
+
+func (r *reloader) setCRITool(ct *cri.CRITool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ct = ct
+	ct.SetScope(r.scope)
+}
+
+func (r *reloader) setAggregator(a *aggregator.Aggregator, ec *ebpf.EbpfCollector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.a, r.ec = a, ec
+	a.SetPolicy(r.policy)
+}
+
+// reload validates the whole config before anything is applied,
+// an invalid config leaves the running policy as it is
+func (r *reloader) reload() {
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("config not reloaded")
+		return
+	}
+	scope, err := k8s.NewScope(cfg.Policy)
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("config not reloaded")
+		return
+	}
+	policy, err := aggregator.NewPolicy(cfg.Policy)
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("config not reloaded")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cfg.RequiresRestart(r.cfg) {
+		log.Logger.Warn().Msg("only policy and log level are applied on reload, restart alaz for other changes")
+	}
+	r.apply(cfg, scope, policy)
+	log.Logger.Info().Msg("config reloaded")
+}
+
+// update changes the policy or log level of the effective config, e.g. on remote commands.
+// Changes hold until the config is reloaded.
+func (r *reloader) update(f func(cfg *config.Config) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg := *r.cfg
+	cfg.Policy = r.cfg.Policy.Clone()
+	if err := f(&cfg); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	scope, err := k8s.NewScope(cfg.Policy)
+	if err != nil {
+		return err
+	}
+	policy, err := aggregator.NewPolicy(cfg.Policy)
+	if err != nil {
+		return err
+	}
+	r.apply(&cfg, scope, policy)
+	return nil
+}
+
+// apply is called with r.mu held
+func (r *reloader) apply(cfg *config.Config, scope *k8s.Scope, policy *aggregator.Policy) {
+	log.SetLevel(cfg.Log.Level)
+	if r.collector != nil {
+		r.collector.SetScope(scope)
+		if scopeChanged(r.cfg.Policy, cfg.Policy) {
+			// resources filtered out before are sent if they are in the new scope
+			go r.collector.Resync()
+		}
+	}
+	if r.ct != nil {
+		r.ct.SetScope(scope)
+	}
+	if r.a != nil {
+		r.a.SetPolicy(policy)
+	}
+	if r.ec != nil {
+		// pids of namespaces going out of scope stop being traced in kernel
+		r.ec.RefreshContainerPids()
+	}
+
+	r.scope, r.policy = scope, policy
+	applied := *r.cfg
+	applied.Policy = cfg.Policy
+	applied.Log.Level = cfg.Log.Level
+	r.cfg = &applied
+}
+
+func scopeChanged(old, new config.PolicyConfig) bool {
+	return !slices.Equal(old.IncludeNamespaces, new.IncludeNamespaces) ||
+		!slices.Equal(old.ExcludeNamespaceList, new.ExcludeNamespaceList) ||
+		old.ExcludeNamespaces != new.ExcludeNamespaces ||
+		old.NamespaceSelector != new.NamespaceSelector ||
+		old.PodSelector != new.PodSelector
+}
+
+func (r *reloader) config() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// ServeHTTP dumps the effective config, secrets redacted
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	out, err := r.config().Dump()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
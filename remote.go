@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ddosify/alaz/config"
+	"github.com/ddosify/alaz/datastore"
+	"github.com/ddosify/alaz/lifecycle"
+	"gopkg.in/yaml.v3"
+)
+
+// remoteCommands runs commands sent in healthcheck responses
+func remoteCommands(rl *reloader, sup *lifecycle.Supervisor) datastore.CommandHandler {
+	return func(cmd datastore.Command) (interface{}, error) {
+		switch cmd.Type {
+		case datastore.CommandSetLogLevel:
+			var args struct {
+				Level *int `json:"level"`
+			}
+			if err := json.Unmarshal(cmd.Args, &args); err != nil {
+				return nil, err
+			}
+			if args.Level == nil {
+				return nil, errors.New("level is not set")
+			}
+			return nil, rl.update(func(cfg *config.Config) error {
+				cfg.Log.Level = *args.Level
+				return nil
+			})
+
+		case datastore.CommandSetPolicy:
+			// fields are named as in the config file, those not sent are kept.
+			// Policy has no file paths, filter rules are sent inline.
+			return nil, rl.update(func(cfg *config.Config) error {
+				dec := yaml.NewDecoder(bytes.NewReader(cmd.Args))
+				dec.KnownFields(true)
+				if err := dec.Decode(&cfg.Policy); err != nil {
+					if err == io.EOF {
+						return errors.New("no policy fields sent")
+					}
+					return err
+				}
+				return nil
+			})
+
+		case datastore.CommandToggleProtocols:
+			var args map[string]bool // protocol -> enabled
+			if err := json.Unmarshal(cmd.Args, &args); err != nil {
+				return nil, err
+			}
+			return nil, rl.update(func(cfg *config.Config) error {
+				disabled := map[string]bool{}
+				for _, p := range cfg.Policy.DisabledProtocols {
+					disabled[strings.ToLower(p)] = true
+				}
+				for p, enabled := range args {
+					disabled[strings.ToLower(p)] = !enabled
+				}
+				cfg.Policy.DisabledProtocols = nil
+				for p, d := range disabled {
+					if d {
+						cfg.Policy.DisabledProtocols = append(cfg.Policy.DisabledProtocols, p)
+					}
+				}
+				return nil
+			})
+
+		case datastore.CommandDiagnosticDump:
+			return diagnosticDump(rl, sup)
+
+		case datastore.CommandPauseLogs, datastore.CommandResumeLogs:
+			// the logstreamer is not registered if logs are disabled
+			if cmd.Type == datastore.CommandPauseLogs {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				return nil, sup.Pause(ctx, "logstreamer")
+			}
+			return nil, sup.Resume("logstreamer")
+
+		default:
+			return nil, fmt.Errorf("%w: %s", datastore.ErrUnsupportedCommand, cmd.Type)
+		}
+	}
+}
+
+func diagnosticDump(rl *reloader, sup *lifecycle.Supervisor) (interface{}, error) {
+	conf, err := rl.config().Dump()
+	if err != nil {
+		return nil, err
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return map[string]interface{}{
+		"components": sup.Status(),
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]uint64{
+			"heap_alloc":  m.HeapAlloc,
+			"heap_inuse":  m.HeapInuse,
+			"sys":         m.Sys,
+			"num_gc":      uint64(m.NumGC),
+			"pause_total": m.PauseTotalNs,
+		},
+		"config": string(conf),
+	}, nil
+}